@@ -1,6 +1,7 @@
 package fastip
 
 import (
+	"context"
 	"net/netip"
 	"testing"
 
@@ -100,6 +101,12 @@ func (u *errUpstream) Exchange(_ *dns.Msg) (*dns.Msg, error) {
 	return nil, u.err
 }
 
+// ExchangeContext implements the [upstream.Upstream] interface for
+// *errUpstream.
+func (u *errUpstream) ExchangeContext(_ context.Context, _ *dns.Msg) (*dns.Msg, error) {
+	return nil, u.err
+}
+
 // Close implements the [upstream.Upstream] interface for *errUpstream.
 func (u *errUpstream) Close() error {
 	return u.closeErr
@@ -125,6 +132,15 @@ func (u *testAUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, nil
 }
 
+// ExchangeContext implements the [upstream.Upstream] interface for
+// *testAUpstream.
+func (u *testAUpstream) ExchangeContext(
+	_ context.Context,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	return u.Exchange(m)
+}
+
 // Address implements the [upstream.Upstream] interface for *testAUpstream.
 func (u *testAUpstream) Address() (addr string) {
 	return ""
@@ -0,0 +1,176 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Binding is the local endpoint the outgoing connections are bound to.
+type Binding struct {
+	// Addr is the local address to bind to.  If it's invalid, the address of
+	// Interface is used.
+	Addr netip.Addr
+
+	// Interface is the name of the network interface to bind to.  The first
+	// address of the interface from the same family as the dialed address is
+	// used.  It's ignored if Addr is valid.
+	Interface string
+
+	// DSCP is the Differentiated Services Code Point the outgoing packets are
+	// marked with, see RFC 2474.  It must be less than 64.  If zero, the
+	// packets aren't marked.
+	DSCP uint8
+}
+
+// localAddr returns the local address to bind the connection to address over
+// network to.  laddr is nil if b doesn't restrict the local address.
+func (b *Binding) localAddr(network Network, address string) (laddr net.Addr, err error) {
+	ip := b.Addr
+	if !ip.IsValid() && b.Interface == "" {
+		return nil, nil
+	} else if !ip.IsValid() {
+		ip, err = interfaceAddr(b.Interface, address)
+		if err != nil {
+			return nil, fmt.Errorf("binding to interface %q: %w", b.Interface, err)
+		}
+	}
+
+	ap := netip.AddrPortFrom(ip, 0)
+	if strings.HasPrefix(network, NetworkUDP) {
+		return net.UDPAddrFromAddrPort(ap), nil
+	}
+
+	return net.TCPAddrFromAddrPort(ap), nil
+}
+
+// interfaceAddr returns the first address of the interface with name suitable
+// to dial address.  The link-local addresses are skipped, since those require
+// the zone.
+func interfaceAddr(name, address string) (ip netip.Addr, err error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return ip, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ip, fmt.Errorf("getting addresses: %w", err)
+	}
+
+	// address may also be a hostname, e.g. the one of the proxy, in which case
+	// any family fits.
+	remote, _ := netip.ParseAddrPort(address)
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip, ok = netip.AddrFromSlice(ipNet.IP)
+		if !ok || ip.Unmap().IsLinkLocalUnicast() {
+			continue
+		}
+
+		ip = ip.Unmap()
+		if !remote.IsValid() || ip.Is4() == remote.Addr().Unmap().Is4() {
+			return ip, nil
+		}
+	}
+
+	return netip.Addr{}, fmt.Errorf("no suitable address to dial %s", address)
+}
+
+// dialer dials the connections with and without context.
+type dialer interface {
+	proxy.Dialer
+	proxy.ContextDialer
+}
+
+// boundDialer is a dialer binding the connections to the local endpoint.
+type boundDialer struct {
+	// binding is the local endpoint to bind to.  It must not be nil.
+	binding *Binding
+
+	// timeout is the timeout of a single connection attempt.
+	timeout time.Duration
+}
+
+// newDialer returns a dialer with the specified timeout binding the
+// connections to b.  If b is nil, the connections aren't bound.
+func newDialer(timeout time.Duration, b *Binding) (d dialer) {
+	if b == nil {
+		return &net.Dialer{Timeout: timeout}
+	}
+
+	return &boundDialer{
+		binding: b,
+		timeout: timeout,
+	}
+}
+
+// type check
+var _ dialer = (*boundDialer)(nil)
+
+// DialContext implements the [proxy.ContextDialer] interface for *boundDialer.
+func (d *boundDialer) DialContext(
+	ctx context.Context,
+	network Network,
+	address string,
+) (conn net.Conn, err error) {
+	laddr, err := d.binding.localAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	nd := &net.Dialer{
+		Timeout:   d.timeout,
+		LocalAddr: laddr,
+	}
+
+	if d.binding.DSCP != 0 {
+		nd.Control = d.binding.control
+	}
+
+	return nd.DialContext(ctx, network, address)
+}
+
+// Dial implements the [proxy.Dialer] interface for *boundDialer.
+func (d *boundDialer) Dial(network Network, address string) (conn net.Conn, err error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// ListenPacket returns the unconnected UDP socket to send the packets to
+// address from, which must be an IP address with port.  The socket is bound to
+// the local endpoint of b and marks the packets with its DSCP.
+func (b *Binding) ListenPacket(ctx context.Context, address string) (conn net.PacketConn, err error) {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("parsing address: %w", err)
+	}
+
+	network := NetworkUDP + "4"
+	if ap.Addr().Unmap().Is6() {
+		network = NetworkUDP + "6"
+	}
+
+	lc := &net.ListenConfig{}
+	if b.DSCP != 0 {
+		lc.Control = b.control
+	}
+
+	laddr := ""
+	localAddr, err := b.localAddr(network, address)
+	if err != nil {
+		return nil, err
+	} else if localAddr != nil {
+		laddr = localAddr.String()
+	}
+
+	return lc.ListenPacket(ctx, network, laddr)
+}
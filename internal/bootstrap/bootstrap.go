@@ -14,6 +14,7 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
+	"golang.org/x/net/proxy"
 )
 
 // Network is a network type for use in [Resolver]'s methods.
@@ -50,17 +51,41 @@ func ResolveDialContext(
 	r Resolver,
 	preferV6 bool,
 ) (h DialHandler, err error) {
+	addrs, _, err := ResolveAddrs(u, timeout, r, preferV6)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+
+	return NewDialContext(timeout, nil, strs...), nil
+}
+
+// ResolveAddrs resolves the hostname of u using resolver and returns the
+// resolved addresses with the port of u in the order they should be dialed.
+// The invalid addresses are skipped.  ttl is the minimum TTL of the addresses
+// if r is a [TTLResolver], and zero otherwise.  u must not be nil.
+func ResolveAddrs(
+	u *url.URL,
+	timeout time.Duration,
+	r Resolver,
+	preferV6 bool,
+) (addrs []netip.AddrPort, ttl time.Duration, err error) {
 	defer func() { err = errors.Annotate(err, "dialing %q: %w", u.Host) }()
 
 	host, port, err := netutil.SplitHostPort(u.Host)
 	if err != nil {
 		// Don't wrap the error since it's informative enough as is and there is
 		// already deferred annotation here.
-		return nil, err
+		return nil, 0, err
 	}
 
 	if r == nil {
-		return nil, fmt.Errorf("resolver is nil: %w", ErrNoResolvers)
+		return nil, 0, fmt.Errorf("resolver is nil: %w", ErrNoResolvers)
 	}
 
 	ctx := context.Background()
@@ -71,9 +96,9 @@ func ResolveDialContext(
 	}
 
 	// TODO(e.burkov):  Use network properly, perhaps, pass it through options.
-	ips, err := r.LookupNetIP(ctx, NetworkIP, host)
+	ips, ttl, err := lookupTTL(ctx, r, NetworkIP, host)
 	if err != nil {
-		return nil, fmt.Errorf("resolving hostname: %w", err)
+		return nil, 0, fmt.Errorf("resolving hostname: %w", err)
 	}
 
 	if preferV6 {
@@ -82,17 +107,20 @@ func ResolveDialContext(
 		slices.SortStableFunc(ips, netutil.PreferIPv4)
 	}
 
-	addrs := make([]string, 0, len(ips))
+	addrs = make([]netip.AddrPort, 0, len(ips))
 	for _, ip := range ips {
-		addrs = append(addrs, netip.AddrPortFrom(ip, port).String())
+		if ip.IsValid() {
+			addrs = append(addrs, netip.AddrPortFrom(ip, port))
+		}
 	}
 
-	return NewDialContext(timeout, addrs...), nil
+	return addrs, ttl, nil
 }
 
 // NewDialContext returns a DialHandler that dials addrs and returns the first
-// successful connection.  At least a single addr should be specified.
-func NewDialContext(timeout time.Duration, addrs ...string) (h DialHandler) {
+// successful connection.  At least a single addr should be specified.  The
+// connections are bound to b, if it's not nil.
+func NewDialContext(timeout time.Duration, b *Binding, addrs ...string) (h DialHandler) {
 	l := len(addrs)
 	if l == 0 {
 		log.Debug("bootstrap: no addresses to dial")
@@ -102,33 +130,274 @@ func NewDialContext(timeout time.Duration, addrs ...string) (h DialHandler) {
 		}
 	}
 
-	dialer := &net.Dialer{
-		Timeout: timeout,
+	return newDialContext(newDialer(timeout, b), addrs, nil)
+}
+
+// OrderFunc returns addrs in the order they should be dialed.  It must not
+// modify addrs and must be safe for concurrent use.
+type OrderFunc func(addrs []string) (ordered []string)
+
+// NewOrderedDialContext is like [NewDialContext], but dials addrs in the order
+// returned by order for each new connection.  If order is nil, addrs are dialed
+// in the order given.
+func NewOrderedDialContext(
+	timeout time.Duration,
+	b *Binding,
+	order OrderFunc,
+	addrs ...string,
+) (h DialHandler) {
+	if len(addrs) == 0 {
+		return NewDialContext(timeout, b)
 	}
 
+	return newDialContext(newDialer(timeout, b), addrs, order)
+}
+
+// NewProxyDialContext returns a DialHandler that dials addrs through the SOCKS5
+// proxy at proxyURL and returns the first successful connection.  The scheme
+// of proxyURL must be either "socks5" or "socks5h".  addrs may contain
+// hostnames, those are resolved by the proxy.  The handler returns
+// [ErrProxyUDP] for [NetworkUDP].  At least a single addr should be specified.
+// The connections to the proxy are bound to b, if it's not nil.
+func NewProxyDialContext(
+	timeout time.Duration,
+	b *Binding,
+	proxyURL *url.URL,
+	addrs ...string,
+) (h DialHandler, err error) {
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		// Go on.
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", proxyURL.Scheme)
+	}
+
+	var auth *proxy.Auth
+	if u := proxyURL.User; u != nil {
+		auth = &proxy.Auth{User: u.Username()}
+		auth.Password, _ = u.Password()
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+
+	d, err := proxy.SOCKS5(NetworkTCP, proxyAddr, auth, newDialer(timeout, b))
+	if err != nil {
+		return nil, fmt.Errorf("creating proxy dialer: %w", err)
+	}
+
+	// The SOCKS5 dialer always implements [proxy.ContextDialer].
+	dial := newDialContext(d.(proxy.ContextDialer), addrs, nil)
+
+	return func(ctx context.Context, network Network, addr string) (conn net.Conn, err error) {
+		if network == NetworkUDP {
+			return nil, ErrProxyUDP
+		}
+
+		if timeout > 0 {
+			var cancel func()
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		return dial(ctx, network, addr)
+	}, nil
+}
+
+// ConnectionAttemptDelay is the delay between starting the connection attempts
+// to the subsequent addresses when dialing over TCP, as recommended by RFC 8305.
+const ConnectionAttemptDelay = 250 * time.Millisecond
+
+// newDialContext returns a DialHandler that dials addrs using d in the order
+// returned by order and returns the first successful connection.  addrs must
+// not be empty.  order may be nil.
+//
+// TCP connections are established using the Happy Eyeballs algorithm described
+// in RFC 8305: the addresses of different families are interleaved, keeping the
+// family of the first address first, and each subsequent attempt starts after
+// [ConnectionAttemptDelay] or right after the previous one fails.
+func newDialContext(d proxy.ContextDialer, addrs []string, order OrderFunc) (h DialHandler) {
 	return func(ctx context.Context, network Network, _ string) (conn net.Conn, err error) {
-		var errs []error
+		ordered := addrs
+		if order != nil {
+			ordered = order(addrs)
+		}
+
+		// Note that we're using addrs instead of what's passed to the
+		// function.
+		if network == NetworkTCP && len(ordered) > 1 {
+			return dialHappyEyeballs(ctx, d, network, interleaveFamilies(ordered))
+		}
+
+		return dialSequential(ctx, d, network, ordered)
+	}
+}
 
-		// Return first succeeded connection.  Note that we're using addrs
-		// instead of what's passed to the function.
-		for i, addr := range addrs {
-			log.Debug("bootstrap: dialing %s (%d/%d)", addr, i+1, l)
+// dialSequential dials addrs one by one and returns the first successful
+// connection.
+func dialSequential(
+	ctx context.Context,
+	d proxy.ContextDialer,
+	network Network,
+	addrs []string,
+) (conn net.Conn, err error) {
+	var errs []error
 
-			start := time.Now()
-			conn, err = dialer.DialContext(ctx, network, addr)
-			elapsed := time.Since(start)
-			if err != nil {
-				log.Debug("bootstrap: connection to %s failed in %s: %s", addr, elapsed, err)
-				errs = append(errs, err)
+	// Return first succeeded connection.
+	for i, addr := range addrs {
+		conn, err = dialLogged(ctx, d, network, addr, i, len(addrs))
+		if err != nil {
+			errs = append(errs, err)
 
-				continue
+			continue
+		}
+
+		return conn, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// dialResult is the result of a single connection attempt.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs dials addrs concurrently with staggered starts and returns
+// the first successful connection.  The rest of the attempts are cancelled and
+// their connections, if any, are closed.
+func dialHappyEyeballs(
+	ctx context.Context,
+	d proxy.ContextDialer,
+	network Network,
+	addrs []string,
+) (conn net.Conn, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Make the channel large enough for the losing attempts to never block.
+	results := make(chan dialResult, len(addrs))
+
+	var started, pending int
+	var delay <-chan time.Time
+	startNext := func() {
+		i := started
+		started++
+		pending++
+
+		go func() {
+			c, dialErr := dialLogged(ctx, d, network, addrs[i], i, len(addrs))
+			results <- dialResult{conn: c, err: dialErr}
+		}()
+
+		delay = nil
+		if started < len(addrs) {
+			delay = time.After(ConnectionAttemptDelay)
+		}
+	}
+
+	startNext()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go closeLosers(results, pending)
+
+				return res.conn, nil
 			}
 
-			log.Debug("bootstrap: connection to %s succeeded in %s", addr, elapsed)
+			errs = append(errs, res.err)
+			if started < len(addrs) {
+				startNext()
+			}
+		case <-delay:
+			startNext()
+		}
+	}
 
-			return conn, nil
+	return nil, errors.Join(errs...)
+}
+
+// closeLosers receives n results from results and closes the successfully
+// established connections.
+func closeLosers(results <-chan dialResult, n int) {
+	for range n {
+		res := <-results
+		if res.conn != nil {
+			log.OnCloserError(res.conn, log.DEBUG)
 		}
+	}
+}
+
+// dialLogged dials addr using d and logs the result.  i is the index of addr
+// among l addresses.
+func dialLogged(
+	ctx context.Context,
+	d proxy.ContextDialer,
+	network Network,
+	addr string,
+	i int,
+	l int,
+) (conn net.Conn, err error) {
+	log.Debug("bootstrap: dialing %s (%d/%d)", addr, i+1, l)
+
+	start := time.Now()
+	conn, err = d.DialContext(ctx, network, addr)
+	elapsed := time.Since(start)
+	if err != nil {
+		log.Debug("bootstrap: connection to %s failed in %s: %s", addr, elapsed, err)
+
+		return nil, err
+	}
+
+	log.Debug("bootstrap: connection to %s succeeded in %s", addr, elapsed)
+
+	return conn, nil
+}
+
+// interleaveFamilies returns addrs reordered so that IPv4 and IPv6 addresses
+// alternate, starting with the family of the first address, and keeping the
+// order within each family.  The addresses that aren't IP addresses with ports
+// are kept at the end.
+func interleaveFamilies(addrs []string) (res []string) {
+	var first, second, other []string
+	var firstIs4 bool
+	for _, addr := range addrs {
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			other = append(other, addr)
 
-		return nil, errors.Join(errs...)
+			continue
+		}
+
+		is4 := ap.Addr().Unmap().Is4()
+		if first == nil && second == nil {
+			firstIs4 = is4
+		}
+
+		if is4 == firstIs4 {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
 	}
+
+	res = make([]string, 0, len(addrs))
+	for i := range max(len(first), len(second)) {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+
+	return append(res, other...)
 }
@@ -0,0 +1,193 @@
+package bootstrap
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is a common timeout used in tests of this package.
+const testTimeout = 1 * time.Second
+
+// fakeDialer is a [proxy.ContextDialer] for tests.
+type fakeDialer struct {
+	onDialContext func(ctx context.Context, network, addr string) (conn net.Conn, err error)
+}
+
+// DialContext implements the [proxy.ContextDialer] interface for *fakeDialer.
+func (d *fakeDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (conn net.Conn, err error) {
+	return d.onDialContext(ctx, network, addr)
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	const (
+		slowAddr = "[2001:db8::1]:53"
+		fastAddr = "192.0.2.1:53"
+	)
+
+	t.Run("slow_first", func(t *testing.T) {
+		cancelled := make(chan struct{}, 1)
+		client, server := net.Pipe()
+		testutil.CleanupAndRequireSuccess(t, server.Close)
+
+		d := &fakeDialer{
+			onDialContext: func(ctx context.Context, _, addr string) (conn net.Conn, err error) {
+				if addr == fastAddr {
+					return client, nil
+				}
+
+				<-ctx.Done()
+				cancelled <- struct{}{}
+
+				return nil, ctx.Err()
+			},
+		}
+
+		start := time.Now()
+		conn, err := dialHappyEyeballs(
+			context.Background(),
+			d,
+			NetworkTCP,
+			[]string{slowAddr, fastAddr},
+		)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		assert.Same(t, client, conn)
+		assert.GreaterOrEqual(t, time.Since(start), ConnectionAttemptDelay)
+
+		_, ok := testutil.RequireReceive(t, cancelled, testTimeout)
+		assert.True(t, ok)
+	})
+
+	t.Run("failed_first", func(t *testing.T) {
+		client, server := net.Pipe()
+		testutil.CleanupAndRequireSuccess(t, server.Close)
+
+		d := &fakeDialer{
+			onDialContext: func(_ context.Context, _, addr string) (conn net.Conn, err error) {
+				if addr == fastAddr {
+					return client, nil
+				}
+
+				return nil, errors.Error("refused")
+			},
+		}
+
+		start := time.Now()
+		conn, err := dialHappyEyeballs(
+			context.Background(),
+			d,
+			NetworkTCP,
+			[]string{slowAddr, fastAddr},
+		)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		assert.Same(t, client, conn)
+		assert.Less(t, time.Since(start), ConnectionAttemptDelay)
+	})
+
+	t.Run("late_winner_closed", func(t *testing.T) {
+		lateClient, lateServer := net.Pipe()
+		testutil.CleanupAndRequireSuccess(t, lateServer.Close)
+
+		fastClient, fastServer := net.Pipe()
+		testutil.CleanupAndRequireSuccess(t, fastServer.Close)
+
+		release := make(chan struct{})
+		d := &fakeDialer{
+			onDialContext: func(_ context.Context, _, addr string) (conn net.Conn, err error) {
+				if addr == fastAddr {
+					return fastClient, nil
+				}
+
+				// Ignore the cancellation to emulate a connection
+				// established right after it.
+				<-release
+
+				return lateClient, nil
+			},
+		}
+
+		conn, err := dialHappyEyeballs(
+			context.Background(),
+			d,
+			NetworkTCP,
+			[]string{slowAddr, fastAddr},
+		)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		assert.Same(t, fastClient, conn)
+
+		close(release)
+
+		// Reading from the closed end of the pipe returns io.ErrClosedPipe
+		// while reading from the other end returns io.EOF.
+		require.Eventually(t, func() (ok bool) {
+			_, readErr := lateServer.Read(make([]byte, 1))
+
+			return readErr != nil
+		}, testTimeout, testTimeout/10)
+	})
+
+	t.Run("all_failed", func(t *testing.T) {
+		const testErr errors.Error = "test error"
+
+		d := &fakeDialer{
+			onDialContext: func(_ context.Context, _, _ string) (conn net.Conn, err error) {
+				return nil, testErr
+			},
+		}
+
+		conn, err := dialHappyEyeballs(
+			context.Background(),
+			d,
+			NetworkTCP,
+			[]string{slowAddr, fastAddr},
+		)
+		assert.ErrorIs(t, err, testErr)
+		assert.Nil(t, conn)
+	})
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	testCases := []struct {
+		name  string
+		addrs []string
+		want  []string
+	}{{
+		name:  "v4_first",
+		addrs: []string{"1.1.1.1:53", "1.0.0.1:53", "[::1]:53", "[::2]:53"},
+		want:  []string{"1.1.1.1:53", "[::1]:53", "1.0.0.1:53", "[::2]:53"},
+	}, {
+		name:  "v6_first",
+		addrs: []string{"[::1]:53", "[::2]:53", "[::3]:53", "1.1.1.1:53"},
+		want:  []string{"[::1]:53", "1.1.1.1:53", "[::2]:53", "[::3]:53"},
+	}, {
+		name:  "single_family",
+		addrs: []string{"1.1.1.1:53", "1.0.0.1:53"},
+		want:  []string{"1.1.1.1:53", "1.0.0.1:53"},
+	}, {
+		name:  "hostname",
+		addrs: []string{"host.example:53", "[::1]:53", "1.1.1.1:53"},
+		want:  []string{"[::1]:53", "1.1.1.1:53", "host.example:53"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, interleaveFamilies(tc.addrs))
+		})
+	}
+}
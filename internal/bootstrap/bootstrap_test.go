@@ -165,3 +165,84 @@ func TestResolveDialContext(t *testing.T) {
 		assert.Nil(t, dialContext)
 	})
 }
+
+// loopbackInterface returns the name of the loopback interface having an IPv4
+// address.
+func loopbackInterface(t *testing.T) (name string) {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+
+		addrs, addrsErr := iface.Addrs()
+		require.NoError(t, addrsErr)
+
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return iface.Name
+			}
+		}
+	}
+
+	t.Skip("no loopback interface with ipv4 address")
+
+	return ""
+}
+
+func TestNewDialContext_binding(t *testing.T) {
+	sig := make(chan net.Addr, 1)
+	ipp := newListener(t, "tcp", sig)
+
+	testCases := []struct {
+		binding    *bootstrap.Binding
+		name       string
+		wantErrMsg string
+	}{{
+		binding:    nil,
+		name:       "none",
+		wantErrMsg: "",
+	}, {
+		binding:    &bootstrap.Binding{Addr: netutil.IPv4Localhost()},
+		name:       "addr",
+		wantErrMsg: "",
+	}, {
+		binding:    &bootstrap.Binding{Interface: loopbackInterface(t)},
+		name:       "interface",
+		wantErrMsg: "",
+	}, {
+		binding:    &bootstrap.Binding{DSCP: 46},
+		name:       "dscp",
+		wantErrMsg: "",
+	}, {
+		binding: &bootstrap.Binding{Interface: "no-such-iface"},
+		name:    "bad_interface",
+		wantErrMsg: `binding to interface "no-such-iface": ` +
+			`route ip+net: no such network interface`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dial := bootstrap.NewDialContext(testTimeout, tc.binding, ipp.String())
+
+			conn, err := dial(context.Background(), bootstrap.NetworkTCP, "")
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if tc.wantErrMsg != "" {
+				return
+			}
+
+			testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+			_, _ = testutil.RequireReceive(t, sig, testTimeout)
+
+			local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+			require.NoError(t, err)
+
+			assert.Equal(t, netutil.IPv4Localhost(), local.Addr())
+		})
+	}
+}
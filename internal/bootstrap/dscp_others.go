@@ -0,0 +1,13 @@
+//go:build !unix
+
+package bootstrap
+
+import "syscall"
+
+// control is used as a [net.Dialer.Control] and [net.ListenConfig.Control]
+// function to mark the packets sent over the socket with b.DSCP.  It does
+// nothing on this platform, since the marking is controlled by the system QoS
+// policies, e.g. on Windows.
+func (b *Binding) control(_, _ string, _ syscall.RawConn) (err error) {
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package bootstrap
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/sys/unix"
+)
+
+// control is used as a [net.Dialer.Control] and [net.ListenConfig.Control]
+// function to mark the packets sent over the socket with b.DSCP.  Failures are
+// only logged, since the marking is merely a hint for the network equipment,
+// and some systems require privileges to set certain values.
+func (b *Binding) control(network, address string, c syscall.RawConn) (err error) {
+	tos := int(b.DSCP) << 2
+
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+		} else {
+			opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+		}
+	})
+
+	if opErr != nil {
+		log.Debug("bootstrap: setting dscp %d for %s over %s: %s", b.DSCP, address, network, opErr)
+	}
+
+	return errors.Annotate(err, "setting dscp: %w")
+}
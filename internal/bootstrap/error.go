@@ -4,3 +4,7 @@ import "github.com/AdguardTeam/golibs/errors"
 
 // ErrNoResolvers is returned when zero resolvers specified.
 const ErrNoResolvers errors.Error = "no resolvers specified"
+
+// ErrProxyUDP is returned when a UDP connection is dialed through a proxy,
+// which only supports TCP.
+const ErrProxyUDP errors.Error = "udp connections can't be dialed through proxy"
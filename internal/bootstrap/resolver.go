@@ -23,12 +23,36 @@ type Resolver interface {
 // type check
 var _ Resolver = &net.Resolver{}
 
+// TTLResolver is a [Resolver] also reporting for how long the resolved
+// addresses may be used.
+type TTLResolver interface {
+	Resolver
+
+	// LookupNetIPTTL is like [Resolver.LookupNetIP], but also returns the
+	// minimum TTL of addrs.  ttl is zero if it's unknown.
+	LookupNetIPTTL(
+		ctx context.Context,
+		network Network,
+		host string,
+	) (addrs []netip.Addr, ttl time.Duration, err error)
+}
+
+// lookupResult is the result of a successful lookup.
+type lookupResult struct {
+	// addrs are the resolved addresses.
+	addrs []netip.Addr
+
+	// ttl is the minimum TTL of addrs, or zero if it's unknown.
+	ttl time.Duration
+}
+
 // ParallelResolver is a slice of resolvers that are queried concurrently.  The
-// first successful response is returned.
+// first successful non-empty response is returned.  If all the responses are
+// empty, the empty response is returned.
 type ParallelResolver []Resolver
 
 // type check
-var _ Resolver = ParallelResolver(nil)
+var _ TTLResolver = ParallelResolver(nil)
 
 // LookupNetIP implements the [Resolver] interface for ParallelResolver.
 func (r ParallelResolver) LookupNetIP(
@@ -36,10 +60,22 @@ func (r ParallelResolver) LookupNetIP(
 	network Network,
 	host string,
 ) (addrs []netip.Addr, err error) {
+	addrs, _, err = r.LookupNetIPTTL(ctx, network, host)
+
+	return addrs, err
+}
+
+// LookupNetIPTTL implements the [TTLResolver] interface for ParallelResolver.
+// The TTL is only known if the resolver that responded is a [TTLResolver].
+func (r ParallelResolver) LookupNetIPTTL(
+	ctx context.Context,
+	network Network,
+	host string,
+) (addrs []netip.Addr, ttl time.Duration, err error) {
 	resolversNum := len(r)
 	switch resolversNum {
 	case 0:
-		return nil, ErrNoResolvers
+		return nil, 0, ErrNoResolvers
 	case 1:
 		return lookup(ctx, r[0], network, host)
 	default:
@@ -58,12 +94,14 @@ func (r ParallelResolver) LookupNetIP(
 		switch result := <-ch; result := result.(type) {
 		case error:
 			errs = append(errs, result)
-		case []netip.Addr:
-			return result, nil
+		case *lookupResult:
+			if len(result.addrs) > 0 {
+				return result.addrs, result.ttl, nil
+			}
 		}
 	}
 
-	return nil, errors.Join(errs...)
+	return nil, 0, errors.Join(errs...)
 }
 
 // lookupAsync performs a lookup for ip of host with r and sends the result into
@@ -71,11 +109,11 @@ func (r ParallelResolver) LookupNetIP(
 func lookupAsync(ctx context.Context, r Resolver, network, host string, resCh chan<- any) {
 	defer log.OnPanic("parallel lookup")
 
-	addrs, err := lookup(ctx, r, network, host)
+	addrs, ttl, err := lookup(ctx, r, network, host)
 	if err != nil {
 		resCh <- err
 	} else {
-		resCh <- addrs
+		resCh <- &lookupResult{addrs: addrs, ttl: ttl}
 	}
 }
 
@@ -83,27 +121,51 @@ func lookupAsync(ctx context.Context, r Resolver, network, host string, resCh ch
 //
 // TODO(e.burkov):  Get rid of this function?  It only wraps the actual lookup
 // with dubious logging.
-func lookup(ctx context.Context, r Resolver, network, host string) (addrs []netip.Addr, err error) {
+func lookup(
+	ctx context.Context,
+	r Resolver,
+	network Network,
+	host string,
+) (addrs []netip.Addr, ttl time.Duration, err error) {
 	start := time.Now()
-	addrs, err = r.LookupNetIP(ctx, network, host)
+	addrs, ttl, err = lookupTTL(ctx, r, network, host)
 	elapsed := time.Since(start)
 
 	if err != nil {
-		log.Debug("parallel lookup: lookup for %s failed in %s: %s", host, elapsed, err)
+		log.Debug("bootstrap: lookup for %s failed in %s: %s", host, elapsed, err)
 	} else {
-		log.Debug("parallel lookup: lookup for %s succeeded in %s: %s", host, elapsed, addrs)
+		log.Debug("bootstrap: lookup for %s succeeded in %s: %s", host, elapsed, addrs)
 	}
 
-	return addrs, err
+	return addrs, ttl, err
+}
+
+// lookupTTL looks up the IP addresses of host using r and also returns their
+// TTL, if r is a [TTLResolver].  Otherwise, ttl is zero.
+func lookupTTL(
+	ctx context.Context,
+	r Resolver,
+	network Network,
+	host string,
+) (addrs []netip.Addr, ttl time.Duration, err error) {
+	if tr, ok := r.(TTLResolver); ok {
+		return tr.LookupNetIPTTL(ctx, network, host)
+	}
+
+	addrs, err = r.LookupNetIP(ctx, network, host)
+
+	return addrs, 0, err
 }
 
 // ConsequentResolver is a slice of resolvers that are queried in order until
-// the first successful non-empty response, as opposed to just successful
-// response requirement in [ParallelResolver].
+// the first successful non-empty response.  If the context has a deadline,
+// each resolver is only given an equal share of the time left, so that the
+// resolver not responding in time doesn't prevent the next ones from being
+// queried.
 type ConsequentResolver []Resolver
 
 // type check
-var _ Resolver = ConsequentResolver(nil)
+var _ TTLResolver = ConsequentResolver(nil)
 
 // LookupNetIP implements the [Resolver] interface for ConsequentResolver.
 func (resolvers ConsequentResolver) LookupNetIP(
@@ -111,21 +173,56 @@ func (resolvers ConsequentResolver) LookupNetIP(
 	network Network,
 	host string,
 ) (addrs []netip.Addr, err error) {
+	addrs, _, err = resolvers.LookupNetIPTTL(ctx, network, host)
+
+	return addrs, err
+}
+
+// LookupNetIPTTL implements the [TTLResolver] interface for
+// ConsequentResolver.  The TTL is only known if the resolver that responded is
+// a [TTLResolver].
+func (resolvers ConsequentResolver) LookupNetIPTTL(
+	ctx context.Context,
+	network Network,
+	host string,
+) (addrs []netip.Addr, ttl time.Duration, err error) {
 	if len(resolvers) == 0 {
-		return nil, ErrNoResolvers
+		return nil, 0, ErrNoResolvers
 	}
 
 	var errs []error
-	for _, r := range resolvers {
-		addrs, err = r.LookupNetIP(ctx, network, host)
+	for i, r := range resolvers {
+		addrs, ttl, err = lookupShare(ctx, r, network, host, len(resolvers)-i)
 		if err == nil && len(addrs) > 0 {
-			return addrs, nil
+			return addrs, ttl, nil
 		}
 
 		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, 0, errors.Join(errs...)
+}
+
+// lookupShare looks up the IP addresses of host using r within the n-th part of
+// the time left until the deadline of ctx, if any.
+func lookupShare(
+	ctx context.Context,
+	r Resolver,
+	network Network,
+	host string,
+	n int,
+) (addrs []netip.Addr, ttl time.Duration, err error) {
+	if deadline, ok := ctx.Deadline(); ok && n > 1 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(n))
+		defer cancel()
 	}
 
-	return nil, errors.Join(errs...)
+	return lookup(ctx, r, network, host)
 }
 
 // StaticResolver is a resolver which always responds with an underlying slice
@@ -5,6 +5,7 @@ import (
 	"net/netip"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -83,6 +84,23 @@ func TestLookupParallel(t *testing.T) {
 		assert.Equal(t, hostAddrs, addrs)
 	})
 
+	t.Run("empty_response", func(t *testing.T) {
+		empty := &testResolver{
+			onLookupNetIP: func(_ context.Context, _, _ string) ([]netip.Addr, error) {
+				return nil, nil
+			},
+		}
+
+		addrs, err := bootstrap.ParallelResolver{empty, immediate}.LookupNetIP(
+			context.Background(),
+			"ip",
+			hostname,
+		)
+		require.NoError(t, err)
+
+		assert.Equal(t, hostAddrs, addrs)
+	})
+
 	t.Run("all_errors", func(t *testing.T) {
 		err := assert.AnError
 		errStr := err.Error()
@@ -103,3 +121,150 @@ func TestLookupParallel(t *testing.T) {
 		assert.Nil(t, addrs)
 	})
 }
+
+func TestConsequentResolver(t *testing.T) {
+	const hostname = "host.name"
+
+	hostAddrs := []netip.Addr{netutil.IPv4Localhost()}
+
+	succeeding := &testResolver{
+		onLookupNetIP: func(_ context.Context, _, _ string) ([]netip.Addr, error) {
+			return hostAddrs, nil
+		},
+	}
+	failing := &testResolver{
+		onLookupNetIP: func(_ context.Context, _, _ string) ([]netip.Addr, error) {
+			return nil, assert.AnError
+		},
+	}
+	empty := &testResolver{
+		onLookupNetIP: func(_ context.Context, _, _ string) ([]netip.Addr, error) {
+			return nil, nil
+		},
+	}
+	hanging := &testResolver{
+		onLookupNetIP: func(ctx context.Context, _, _ string) ([]netip.Addr, error) {
+			<-ctx.Done()
+
+			return nil, ctx.Err()
+		},
+	}
+
+	t.Run("no_resolvers", func(t *testing.T) {
+		addrs, err := bootstrap.ConsequentResolver(nil).LookupNetIP(context.Background(), "ip", "")
+		assert.ErrorIs(t, err, bootstrap.ErrNoResolvers)
+		assert.Nil(t, addrs)
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		addrs, err := bootstrap.ConsequentResolver{failing, empty, succeeding}.LookupNetIP(
+			context.Background(),
+			"ip",
+			hostname,
+		)
+		require.NoError(t, err)
+
+		assert.Equal(t, hostAddrs, addrs)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		addrs, err := bootstrap.ConsequentResolver{hanging, succeeding}.LookupNetIP(
+			ctx,
+			"ip",
+			hostname,
+		)
+		require.NoError(t, err)
+
+		assert.Equal(t, hostAddrs, addrs)
+	})
+
+	t.Run("all_failed", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		addrs, err := bootstrap.ConsequentResolver{failing, hanging, failing}.LookupNetIP(
+			ctx,
+			"ip",
+			hostname,
+		)
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Nil(t, addrs)
+	})
+}
+
+// testTTLResolver is the [bootstrap.TTLResolver] interface implementation for
+// testing purposes.
+type testTTLResolver struct {
+	*testResolver
+
+	ttl time.Duration
+}
+
+// LookupNetIPTTL implements the [bootstrap.TTLResolver] interface for
+// *testTTLResolver.
+func (r *testTTLResolver) LookupNetIPTTL(
+	ctx context.Context,
+	network string,
+	host string,
+) (addrs []netip.Addr, ttl time.Duration, err error) {
+	addrs, err = r.onLookupNetIP(ctx, network, host)
+
+	return addrs, r.ttl, err
+}
+
+func TestTTLResolver(t *testing.T) {
+	const (
+		hostname = "host.name"
+		ttl      = 42 * time.Second
+	)
+
+	hostAddrs := []netip.Addr{netutil.IPv4Localhost()}
+
+	plain := &testResolver{
+		onLookupNetIP: func(_ context.Context, _, _ string) ([]netip.Addr, error) {
+			return hostAddrs, nil
+		},
+	}
+	withTTL := &testTTLResolver{testResolver: plain, ttl: ttl}
+	failing := &testResolver{
+		onLookupNetIP: func(_ context.Context, _, _ string) ([]netip.Addr, error) {
+			return nil, assert.AnError
+		},
+	}
+
+	testCases := []struct {
+		r       bootstrap.TTLResolver
+		name    string
+		wantTTL time.Duration
+	}{{
+		r:       bootstrap.ConsequentResolver{failing, withTTL},
+		name:    "consequent",
+		wantTTL: ttl,
+	}, {
+		r:       bootstrap.ConsequentResolver{failing, plain, withTTL},
+		name:    "consequent_unknown",
+		wantTTL: 0,
+	}, {
+		r:       bootstrap.ParallelResolver{failing, withTTL},
+		name:    "parallel",
+		wantTTL: ttl,
+	}, {
+		r:       bootstrap.ParallelResolver{plain},
+		name:    "parallel_unknown",
+		wantTTL: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addrs, gotTTL, err := tc.r.LookupNetIPTTL(context.Background(), "ip", hostname)
+			require.NoError(t, err)
+
+			assert.Equal(t, hostAddrs, addrs)
+			assert.Equal(t, tc.wantTTL, gotTTL)
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package dnsproxytest
 
 import (
+	"context"
+
 	"github.com/miekg/dns"
 )
 
@@ -23,6 +25,15 @@ func (u *FakeUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	return u.OnExchange(req)
 }
 
+// ExchangeContext implements the [Upstream] interface for *FakeUpstream.  It
+// ignores ctx.
+func (u *FakeUpstream) ExchangeContext(
+	_ context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	return u.OnExchange(req)
+}
+
 // Close implements the [Upstream] interface for *FakeUpstream.
 func (u *FakeUpstream) Close() (err error) {
 	return u.OnClose()
@@ -87,6 +87,14 @@ type Options struct {
 	// BootstrapDNS is the list of bootstrap DNS upstream servers.
 	BootstrapDNS []string `yaml:"bootstrap" short:"b" long:"bootstrap" description:"Bootstrap DNS for DoH and DoT, can be specified multiple times (default: use system-provided)"`
 
+	// BootstrapParallel makes the bootstrap DNS servers queried concurrently
+	// instead of in order.
+	BootstrapParallel bool `yaml:"bootstrap-parallel" long:"bootstrap-parallel" description:"If specified, the bootstrap DNS servers are queried concurrently instead of in order" optional:"yes" optional-value:"true"`
+
+	// BootstrapTimeout is the timeout for resolving the upstreams' hostnames
+	// in a human-readable form.  If not set, Timeout is used.
+	BootstrapTimeout timeutil.Duration `yaml:"bootstrap-timeout" long:"bootstrap-timeout" description:"Timeout for resolving the upstreams' hostnames with the bootstrap DNS servers in a human-readable form (default: same as --timeout)"`
+
 	// Fallbacks is the list of fallback DNS upstream servers.
 	Fallbacks []string `yaml:"fallback" short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times. You can also specify path to a file with the list of servers"`
 
@@ -410,12 +418,14 @@ func initUpstreams(config *proxy.Config, options *Options) {
 	}
 
 	timeout := options.Timeout.Duration
+	bootTimeout := options.BootstrapTimeout.Duration
 	bootOpts := &upstream.Options{
 		HTTPVersions:       httpVersions,
 		InsecureSkipVerify: options.Insecure,
 		Timeout:            timeout,
+		BootstrapTimeout:   bootTimeout,
 	}
-	boot, err := initBootstrap(options.BootstrapDNS, bootOpts)
+	boot, err := initBootstrap(options.BootstrapDNS, options.BootstrapParallel, bootOpts)
 	if err != nil {
 		log.Fatalf("error while initializing bootstrap: %s", err)
 	}
@@ -425,6 +435,7 @@ func initUpstreams(config *proxy.Config, options *Options) {
 		InsecureSkipVerify: options.Insecure,
 		Bootstrap:          boot,
 		Timeout:            timeout,
+		BootstrapTimeout:   bootTimeout,
 	}
 	upstreams := loadServersList(options.Upstreams)
 
@@ -434,9 +445,10 @@ func initUpstreams(config *proxy.Config, options *Options) {
 	}
 
 	privUpsOpts := &upstream.Options{
-		HTTPVersions: httpVersions,
-		Bootstrap:    boot,
-		Timeout:      min(defaultLocalTimeout, timeout),
+		HTTPVersions:     httpVersions,
+		Bootstrap:        boot,
+		Timeout:          min(defaultLocalTimeout, timeout),
+		BootstrapTimeout: bootTimeout,
 	}
 	privUpstreams := loadServersList(options.PrivateRDNSUpstreams)
 
@@ -469,11 +481,23 @@ func initUpstreams(config *proxy.Config, options *Options) {
 
 // initBootstrap initializes the [upstream.Resolver] for bootstrapping upstream
 // servers.  It returns the default resolver if no bootstraps were specified.
-// The returned resolver will also use system hosts files first.
-func initBootstrap(bootstraps []string, opts *upstream.Options) (r upstream.Resolver, err error) {
+// The returned resolver will also use system hosts files first.  The empty
+// bootstraps stand for the system-provided resolver.  Multiple bootstraps are
+// queried in order, unless parallel is true.
+func initBootstrap(
+	bootstraps []string,
+	parallel bool,
+	opts *upstream.Options,
+) (r upstream.Resolver, err error) {
 	var resolvers []upstream.Resolver
 
 	for i, b := range bootstraps {
+		if b == "" {
+			resolvers = append(resolvers, net.DefaultResolver)
+
+			continue
+		}
+
 		var ur *upstream.UpstreamResolver
 		ur, err = upstream.NewUpstreamResolver(b, opts)
 		if err != nil {
@@ -496,7 +520,11 @@ func initBootstrap(bootstraps []string, opts *upstream.Options) (r upstream.Reso
 	case 1:
 		return resolvers[0], nil
 	default:
-		return upstream.ParallelResolver(resolvers), nil
+		if parallel {
+			return upstream.ParallelResolver(resolvers), nil
+		}
+
+		return upstream.ConsequentResolver(resolvers), nil
 	}
 }
 
@@ -679,7 +707,7 @@ type ipv6Configuration struct {
 
 // handleDNSRequest checks IPv6 configuration for current session before resolve
 func (c *ipv6Configuration) handleDNSRequest(p *proxy.Proxy, ctx *proxy.DNSContext) error {
-	if proxy.CheckDisabledAAAARequest(ctx, c.ipv6Disabled) {
+	if p.CheckDisabledAAAARequest(ctx, c.ipv6Disabled) {
 		return nil
 	}
 
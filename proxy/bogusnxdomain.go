@@ -1,23 +1,134 @@
 package proxy
 
 import (
+	"fmt"
+	"net/netip"
+	"strings"
+
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 )
 
 // isBogusNXDomain returns true if m contains at least a single IP address in
-// the Answer section contained in BogusNXDomain subnets of p.
+// the Answer section contained in BogusNXDomain subnets of p.  The addresses
+// are taken from the A and AAAA records, including the ones following the
+// CNAME records.  For PTR responses, the addresses of the PTR targets are
+// taken from the Answer and Additional sections.  It also returns true if any
+// CNAME record in the Answer section targets one of BogusNXDomainHosts of p.
 func (p *Proxy) isBogusNXDomain(m *dns.Msg) (ok bool) {
-	if m == nil || len(p.BogusNXDomain) == 0 || len(m.Question) == 0 {
+	if m == nil || len(m.Question) == 0 {
 		return false
-	} else if qt := m.Question[0].Qtype; qt != dns.TypeA && qt != dns.TypeAAAA {
+	}
+
+	if containsBogusCNAME(p.BogusNXDomainHosts, m.Answer) {
+		return true
+	}
+
+	if len(p.BogusNXDomain) == 0 {
 		return false
 	}
 
 	set := netutil.SliceSubnetSet(p.BogusNXDomain)
-	for _, rr := range m.Answer {
-		ip := proxyutil.IPFromRR(rr)
+
+	switch m.Question[0].Qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME:
+		return containsBogusIP(set, m.Answer, nil)
+	case dns.TypePTR:
+		targets := ptrTargets(m)
+		if len(targets) == 0 {
+			return false
+		}
+
+		return containsBogusIP(set, m.Answer, targets) || containsBogusIP(set, m.Extra, targets)
+	default:
+		return false
+	}
+}
+
+// validateBogusNXDomainRcode returns an error if rcode isn't supported as the
+// [Config.BogusNXDomainRcode].
+func validateBogusNXDomainRcode(rcode *int) (err error) {
+	if rcode == nil {
+		return nil
+	}
+
+	switch *rcode {
+	case dns.RcodeNameError, dns.RcodeSuccess:
+		return nil
+	default:
+		return fmt.Errorf("unsupported rcode %d", *rcode)
+	}
+}
+
+// newBogusNXDomainResp returns the response replacing the one to req matching
+// BogusNXDomain of p.  It's either NXDOMAIN or NODATA, depending on the
+// BogusNXDomainRcode of p.
+func (p *Proxy) newBogusNXDomainResp(req *dns.Msg) (resp *dns.Msg) {
+	if p.BogusNXDomainRcode == nil || *p.BogusNXDomainRcode == dns.RcodeNameError {
+		return p.messages.NewMsgNXDOMAIN(req)
+	}
+
+	return p.newMsgNODATA(req)
+}
+
+// containsBogusCNAME returns true if any of CNAME records in rrs targets one of
+// hosts or their subdomains.  hosts must be normalized with
+// [normalizeBogusHosts].
+func containsBogusCNAME(hosts []string, rrs []dns.RR) (ok bool) {
+	if len(hosts) == 0 {
+		return false
+	}
+
+	for _, rr := range rrs {
+		cname, isCNAME := rr.(*dns.CNAME)
+		if !isCNAME {
+			continue
+		}
+
+		target := strings.TrimSuffix(strings.ToLower(cname.Target), ".")
+		for _, host := range hosts {
+			if target == host || netutil.IsSubdomain(target, host) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// normalizeBogusHosts returns a copy of hosts lowercased and with the trailing
+// dots removed.  The empty names are skipped.
+func normalizeBogusHosts(hosts []string) (normalized []string) {
+	if hosts == nil {
+		return nil
+	}
+
+	normalized = make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		h = strings.TrimSuffix(strings.ToLower(h), ".")
+		if h != "" {
+			normalized = append(normalized, h)
+		}
+	}
+
+	return normalized
+}
+
+// containsBogusIP returns true if any of A and AAAA records in rrs contains an
+// IP address from set.  If names isn't nil, only the records with the owner
+// names from it are checked.
+func containsBogusIP(set netutil.SubnetSet, rrs []dns.RR, names map[string]struct{}) (ok bool) {
+	for _, rr := range rrs {
+		if names != nil {
+			if _, ok = names[strings.ToLower(rr.Header().Name)]; !ok {
+				continue
+			}
+		}
+
+		// Unmap the IPv4-mapped IPv6 addresses, since those aren't contained in
+		// IPv4 subnets.
+		ip := proxyutil.IPFromRR(rr).Unmap()
 		if set.Contains(ip) {
 			return true
 		}
@@ -25,3 +136,55 @@ func (p *Proxy) isBogusNXDomain(m *dns.Msg) (ok bool) {
 
 	return false
 }
+
+// unmapPrefixes returns a copy of prefs with the IPv4-mapped IPv6 subnets
+// converted into IPv4 ones, so that those match the unmapped addresses.
+func unmapPrefixes(prefs []netip.Prefix) (unmapped []netip.Prefix) {
+	if prefs == nil {
+		return nil
+	}
+
+	unmapped = make([]netip.Prefix, 0, len(prefs))
+	for _, pref := range prefs {
+		if addr := pref.Addr(); addr.Is4In6() && pref.Bits() >= 96 {
+			pref = netip.PrefixFrom(addr.Unmap(), pref.Bits()-96)
+		}
+
+		unmapped = append(unmapped, pref)
+	}
+
+	return unmapped
+}
+
+// ptrTargets returns the lowercased targets of the PTR records in the Answer
+// section of m along with the names they are aliased to by the CNAME records
+// in the Answer and Additional sections.
+func ptrTargets(m *dns.Msg) (targets map[string]struct{}) {
+	aliases := map[string]string{}
+	for _, rrs := range [][]dns.RR{m.Answer, m.Extra} {
+		for _, rr := range rrs {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				aliases[strings.ToLower(cname.Hdr.Name)] = strings.ToLower(cname.Target)
+			}
+		}
+	}
+
+	targets = map[string]struct{}{}
+	for _, rr := range m.Answer {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok {
+			continue
+		}
+
+		// Follow the CNAME chain, preventing loops.
+		for name := strings.ToLower(ptr.Ptr); name != ""; name = aliases[name] {
+			if _, ok = targets[name]; ok {
+				break
+			}
+
+			targets[name] = struct{}{}
+		}
+	}
+
+	return targets
+}
@@ -86,13 +86,15 @@ func TestProxy_IsBogusNXDomain(t *testing.T) {
 	require.NoError(t, err)
 	testutil.CleanupAndRequireSuccess(t, func() (err error) { return prx.Shutdown(ctx) })
 
-	d := &DNSContext{
-		Req: newHostTestMessage("host"),
-	}
-
 	for _, tc := range testCases {
 		u.ans = tc.ans
 
+		// Use a separate question for each case, since the synthesized
+		// NXDOMAIN responses contain SOA and therefore are cached.
+		d := &DNSContext{
+			Req: newHostTestMessage(tc.name),
+		}
+
 		t.Run(tc.name, func(t *testing.T) {
 			err = prx.Resolve(d)
 			require.NoError(t, err)
@@ -102,3 +104,282 @@ func TestProxy_IsBogusNXDomain(t *testing.T) {
 		})
 	}
 }
+
+func TestProxy_IsBogusNXDomain_chains(t *testing.T) {
+	p := &Proxy{
+		Config: Config{
+			BogusNXDomain: []netip.Prefix{netip.MustParsePrefix("4.3.2.1/24")},
+		},
+	}
+
+	const (
+		host   = "host.example."
+		alias  = "alias.example."
+		target = "target.example."
+		arpa   = "1.2.3.4.in-addr.arpa."
+	)
+
+	newA := func(name, ip string) (rr dns.RR) {
+		return &dns.A{
+			Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: name, Ttl: 10},
+			A:   net.ParseIP(ip),
+		}
+	}
+
+	newCNAME := func(name, target string) (rr dns.RR) {
+		return &dns.CNAME{
+			Hdr:    dns.RR_Header{Rrtype: dns.TypeCNAME, Name: name, Ttl: 10},
+			Target: target,
+		}
+	}
+
+	ptr := &dns.PTR{
+		Hdr: dns.RR_Header{Rrtype: dns.TypePTR, Name: arpa, Ttl: 10},
+		Ptr: target,
+	}
+
+	testCases := []struct {
+		name  string
+		qname string
+		ans   []dns.RR
+		extra []dns.RR
+		qtype uint16
+		want  assert.BoolAssertionFunc
+	}{{
+		name:  "cname_bogus",
+		qname: host,
+		ans:   []dns.RR{newCNAME(host, alias), newA(alias, "4.3.2.1")},
+		extra: nil,
+		qtype: dns.TypeA,
+		want:  assert.True,
+	}, {
+		name:  "cname_mixed",
+		qname: host,
+		ans: []dns.RR{
+			newCNAME(host, alias),
+			newA(alias, "10.0.0.1"),
+			newA(alias, "4.3.2.2"),
+		},
+		extra: nil,
+		qtype: dns.TypeA,
+		want:  assert.True,
+	}, {
+		name:  "cname_not_bogus",
+		qname: host,
+		ans:   []dns.RR{newCNAME(host, alias), newA(alias, "10.0.0.1")},
+		extra: nil,
+		qtype: dns.TypeA,
+		want:  assert.False,
+	}, {
+		name:  "ptr_bogus",
+		qname: arpa,
+		ans:   []dns.RR{ptr},
+		extra: []dns.RR{newA(target, "4.3.2.1")},
+		qtype: dns.TypePTR,
+		want:  assert.True,
+	}, {
+		name:  "ptr_cname_bogus",
+		qname: arpa,
+		ans:   []dns.RR{ptr},
+		extra: []dns.RR{newCNAME(target, alias), newA(alias, "4.3.2.1")},
+		qtype: dns.TypePTR,
+		want:  assert.True,
+	}, {
+		name:  "ptr_unrelated",
+		qname: arpa,
+		ans:   []dns.RR{ptr},
+		extra: []dns.RR{newA(host, "4.3.2.1")},
+		qtype: dns.TypePTR,
+		want:  assert.False,
+	}, {
+		name:  "ptr_not_bogus",
+		qname: arpa,
+		ans:   []dns.RR{ptr},
+		extra: []dns.RR{newA(target, "10.0.0.1")},
+		qtype: dns.TypePTR,
+		want:  assert.False,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype)
+			m.Answer = tc.ans
+			m.Extra = tc.extra
+
+			tc.want(t, p.isBogusNXDomain(m))
+		})
+	}
+}
+
+func TestProxy_IsBogusNXDomain_mapped(t *testing.T) {
+	p := &Proxy{
+		Config: Config{
+			BogusNXDomain: unmapPrefixes([]netip.Prefix{
+				netip.MustParsePrefix("1.2.3.0/24"),
+				netip.MustParsePrefix("::ffff:5.6.7.0/120"),
+				netip.MustParsePrefix("2001:db8::/32"),
+			}),
+		},
+	}
+
+	testCases := []struct {
+		want  assert.BoolAssertionFunc
+		name  string
+		ip    net.IP
+		qtype uint16
+	}{{
+		want:  assert.True,
+		name:  "mapped_in_v4_subnet",
+		ip:    net.ParseIP("::ffff:1.2.3.4"),
+		qtype: dns.TypeAAAA,
+	}, {
+		want:  assert.True,
+		name:  "v4_in_mapped_subnet",
+		ip:    net.ParseIP("5.6.7.8").To4(),
+		qtype: dns.TypeA,
+	}, {
+		want:  assert.True,
+		name:  "v6_in_v6_subnet",
+		ip:    net.ParseIP("2001:db8::1"),
+		qtype: dns.TypeAAAA,
+	}, {
+		want:  assert.False,
+		name:  "mapped_not_bogus",
+		ip:    net.ParseIP("::ffff:1.2.4.4"),
+		qtype: dns.TypeAAAA,
+	}, {
+		want:  assert.False,
+		name:  "v6_not_bogus",
+		ip:    net.ParseIP("2001:db9::1"),
+		qtype: dns.TypeAAAA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := (&dns.Msg{}).SetQuestion("host.example.", tc.qtype)
+
+			hdr := dns.RR_Header{Rrtype: tc.qtype, Name: "host.example.", Ttl: 10}
+			if tc.qtype == dns.TypeA {
+				m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: tc.ip}}
+			} else {
+				m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: tc.ip}}
+			}
+
+			tc.want(t, p.isBogusNXDomain(m))
+		})
+	}
+}
+
+func TestProxy_IsBogusNXDomain_hosts(t *testing.T) {
+	p := &Proxy{
+		Config: Config{
+			BogusNXDomainHosts: normalizeBogusHosts([]string{"Parking.Example.", "ads.test"}),
+		},
+	}
+
+	const host = "host.example."
+
+	testCases := []struct {
+		want   assert.BoolAssertionFunc
+		name   string
+		target string
+	}{{
+		want:   assert.True,
+		name:   "exact",
+		target: "parking.example.",
+	}, {
+		want:   assert.True,
+		name:   "subdomain",
+		target: "lander.parking.example.",
+	}, {
+		want:   assert.True,
+		name:   "case_insensitive",
+		target: "LANDER.ADS.TEST.",
+	}, {
+		want:   assert.False,
+		name:   "not_subdomain",
+		target: "notparking.example.",
+	}, {
+		want:   assert.False,
+		name:   "other",
+		target: "cdn.example.",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+			m.Answer = []dns.RR{&dns.CNAME{
+				Hdr:    dns.RR_Header{Rrtype: dns.TypeCNAME, Name: host, Ttl: 10},
+				Target: tc.target,
+			}, &dns.A{
+				Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: tc.target, Ttl: 10},
+				A:   net.ParseIP("1.2.3.4"),
+			}}
+
+			tc.want(t, p.isBogusNXDomain(m))
+		})
+	}
+}
+
+func TestProxy_BogusNXDomainRcode(t *testing.T) {
+	nodata, nxdomain, refused := dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeRefused
+
+	newConf := func(rcode *int) (conf *Config) {
+		return &Config{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{&testUpstream{
+					ans: []dns.RR{&dns.A{
+						Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: "host.", Ttl: 10},
+						A:   net.ParseIP("4.3.2.1"),
+					}},
+				}},
+			},
+			TrustedProxies:     defaultTrustedProxies,
+			BogusNXDomain:      []netip.Prefix{netip.MustParsePrefix("4.3.2.0/24")},
+			BogusNXDomainRcode: rcode,
+		}
+	}
+
+	testCases := []struct {
+		rcode     *int
+		name      string
+		wantRcode int
+	}{{
+		rcode:     nil,
+		name:      "default",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		rcode:     &nxdomain,
+		name:      "nxdomain",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		rcode:     &nodata,
+		name:      "nodata",
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			prx := mustNew(t, newConf(tc.rcode))
+
+			req := newHostTestMessage("host")
+			d := &DNSContext{Req: req}
+
+			err := prx.Resolve(d)
+			require.NoError(t, err)
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+			assert.Equal(t, req.Question, d.Res.Question)
+			assert.Empty(t, d.Res.Answer)
+
+			require.Len(t, d.Res.Ns, 1)
+			assert.IsType(t, &dns.SOA{}, d.Res.Ns[0])
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(newConf(&refused))
+		testutil.AssertErrorMsg(t, "validating bogus-nxdomain rcode: unsupported rcode 5", err)
+	})
+}
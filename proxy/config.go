@@ -10,9 +10,11 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/hostsfile"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
 )
 
 // UpstreamModeType - upstream mode
@@ -45,6 +47,13 @@ type RequestHandler func(p *Proxy, dctx *DNSContext) (err error)
 // [BeforeRequestHandler].
 type ResponseHandler func(dctx *DNSContext, err error)
 
+// ResponseFilter is an optional custom handler called for each response
+// received from the upstreams, after the bogus-nxdomain responses are replaced.
+// It may modify resp in place or return another message to reply with, e.g. to
+// strip records or to rewrite TTLs.  If err is not nil, the client receives
+// SERVFAIL and err is passed to [ResponseHandler].
+type ResponseFilter func(req, resp *dns.Msg) (filtered *dns.Msg, err error)
+
 // Config contains all the fields necessary for proxy configuration
 //
 // TODO(a.garipov): Consider extracting conf blocks for better fieldalignment.
@@ -63,6 +72,13 @@ type Config struct {
 	// constructor will be used.
 	MessageConstructor MessageConstructor
 
+	// SyntheticSOA describes the SOA record added to the negative responses
+	// synthesized by the default [MessageConstructor].  If nil,
+	// [DefaultSyntheticSOA] is used.  If MessageConstructor is set, it's only
+	// used for the NODATA responses and only if MessageConstructor doesn't
+	// implement [NODATAConstructor].
+	SyntheticSOA *SyntheticSOA
+
 	// BeforeRequestHandler is an optional custom handler called before each DNS
 	// request is started processing, see [BeforeRequestHandler].  The default
 	// no-op implementation is used, if it's nil.
@@ -76,6 +92,18 @@ type Config struct {
 	// been processed.  See [ResponseHandler].
 	ResponseHandler ResponseHandler
 
+	// ResponseFilter is an optional custom handler called for each response
+	// received from the upstreams.  See [ResponseFilter].
+	ResponseFilter ResponseFilter
+
+	// LocalRecords are the addresses and hostnames the A, AAAA, and PTR
+	// queries are answered with without contacting the upstreams, e.g. the
+	// ones parsed from a hosts file with [hostsfile.NewDefaultStorage].  The
+	// names are looked up without the trailing dot.  The A and AAAA queries
+	// for the names having only the addresses of the other family are answered
+	// with NODATA.  If nil, all the queries are resolved with the upstreams.
+	LocalRecords hostsfile.Storage
+
 	// UpstreamConfig is a general set of DNS servers to forward requests to.
 	UpstreamConfig *UpstreamConfig
 
@@ -143,6 +171,19 @@ type Config struct {
 	// networks.  It's similar to dnsmasq's "bogus-nxdomain".
 	BogusNXDomain []netip.Prefix
 
+	// BogusNXDomainHosts is the set of domain names used to transform responses
+	// into NXDOMAIN ones if they contain at least a single CNAME record
+	// targeting any of these domains or their subdomains.  The names are
+	// matched case-insensitively, the trailing dots are ignored.
+	BogusNXDomainHosts []string
+
+	// BogusNXDomainRcode is the response code of the responses replacing the
+	// ones matching BogusNXDomain.  It must be either [dns.RcodeNameError] or
+	// [dns.RcodeSuccess], the latter means the NODATA response.  Both contain
+	// the SOA record described by SyntheticSOA.  If nil, [dns.RcodeNameError]
+	// is used.
+	BogusNXDomainRcode *int
+
 	// DNS64Prefs is the set of NAT64 prefixes used for DNS64 handling.  nil
 	// value disables the feature.  An empty value will be interpreted as the
 	// default Well-Known Prefix.
@@ -177,6 +218,21 @@ type Config struct {
 	// CacheMaxTTL is the maximum TTL for cached DNS responses in seconds.
 	CacheMaxTTL uint32
 
+	// MinTTL is the minimum TTL in seconds of the resource records within the
+	// responses sent to the clients, the lower TTLs are raised to it.  Unlike
+	// CacheMinTTL, it applies to all sections of the responses, including the
+	// cached ones.  OPT records aren't affected.  Zero disables the clamping.
+	MinTTL uint32
+
+	// MaxTTL is the maximum TTL in seconds of the resource records within the
+	// responses sent to the clients, the higher TTLs are lowered to it.  See
+	// MinTTL.  Zero disables the clamping.
+	MaxTTL uint32
+
+	// LocalRecordsTTL is the TTL in seconds of the records constructed from
+	// LocalRecords.  If zero, [DefaultLocalRecordsTTL] is used.
+	LocalRecordsTTL uint32
+
 	// MaxGoroutines is the maximum number of goroutines processing DNS
 	// requests.  Important for mobile users.
 	//
@@ -199,6 +255,13 @@ type Config struct {
 	// RefuseAny makes proxy refuse the requests of type ANY.
 	RefuseAny bool
 
+	// ShuffleAnswers makes proxy randomly permute the A and AAAA records
+	// within the answer section of each response, emulating the round-robin
+	// load balancing, which is otherwise lost when the responses are cached.
+	// The records of each type only swap positions with each other, so that
+	// CNAME and other records stay in place.
+	ShuffleAnswers bool
+
 	// HTTP3 enables HTTP/3 support for HTTPS server.
 	HTTP3 bool
 
@@ -275,6 +338,15 @@ func (p *Proxy) validateConfig() (err error) {
 		return fmt.Errorf("validating ratelimit: %w", err)
 	}
 
+	err = validateBogusNXDomainRcode(p.BogusNXDomainRcode)
+	if err != nil {
+		return fmt.Errorf("validating bogus-nxdomain rcode: %w", err)
+	}
+
+	if p.MaxTTL != 0 && p.MinTTL > p.MaxTTL {
+		return fmt.Errorf("min ttl %d is greater than max ttl %d", p.MinTTL, p.MaxTTL)
+	}
+
 	p.logConfigInfo()
 
 	return nil
@@ -332,6 +404,10 @@ func (p *Proxy) logConfigInfo() {
 		log.Info("dnsproxy: server will refuse requests of type ANY")
 	}
 
+	if p.ShuffleAnswers {
+		log.Info("dnsproxy: server will shuffle address records in answers")
+	}
+
 	if len(p.BogusNXDomain) > 0 {
 		log.Info("%d bogus-nxdomain IP specified", len(p.BogusNXDomain))
 	}
@@ -17,16 +17,125 @@ type MessageConstructor interface {
 	NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.Msg)
 }
 
+// NODATAConstructor is a [MessageConstructor] able to create the NODATA
+// responses, i.e. the ones with the NOERROR code and no answers.  The proxy
+// uses it, if implemented, for the names that exist but have no records of the
+// requested type, e.g. within [Config.LocalRecords].
+type NODATAConstructor interface {
+	MessageConstructor
+
+	// NewMsgNODATA creates a new response message replying to req with the
+	// NOERROR code and no answers.
+	NewMsgNODATA(req *dns.Msg) (resp *dns.Msg)
+}
+
+// SyntheticSOA describes the SOA record added into the authority section of
+// the negative responses synthesized by the proxy, so that the clients are able
+// to cache them.  See RFC 2308.
+type SyntheticSOA struct {
+	// MName is the domain name of the primary name server.  If empty,
+	// [DefaultSyntheticSOA]'s one is used.
+	MName string
+
+	// RName is the mailbox of the person responsible for the zone.  If empty,
+	// it's "hostmaster." followed by the requested name.
+	RName string
+
+	// TTL is the TTL of the SOA record itself.
+	TTL uint32
+
+	// MinTTL is the value of the MINIMUM field of the SOA record.  The
+	// negative response is cached for the lesser of TTL and MinTTL.
+	MinTTL uint32
+}
+
+// DefaultSyntheticSOA is the default SOA record configuration for the
+// synthesized negative responses.
+var DefaultSyntheticSOA = &SyntheticSOA{
+	MName:  "fake-for-negative-caching.adguard.com.",
+	TTL:    10,
+	MinTTL: 10,
+}
+
+// newRR returns a new SOA record for the negative response to req.
+func (s *SyntheticSOA) newRR(req *dns.Msg) (rr *dns.SOA) {
+	zone := ""
+	if len(req.Question) > 0 {
+		zone = req.Question[0].Name
+	}
+
+	rr = &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    s.TTL,
+		},
+		Ns:     dns.Fqdn(s.MName),
+		Mbox:   s.RName,
+		Serial: 100500,
+		// Values copied from the Verisign's nonexistent .com domain.  Their
+		// exact values aren't important, since they're only used for the zone
+		// transfers between the primary and the secondary servers.
+		Refresh: 1800,
+		Retry:   retryNoError,
+		Expire:  604800,
+		Minttl:  s.MinTTL,
+	}
+
+	if rr.Ns == "." {
+		rr.Ns = DefaultSyntheticSOA.MName
+	}
+
+	if rr.Mbox == "" {
+		rr.Mbox = "hostmaster."
+		if len(zone) > 0 && zone[0] != '.' {
+			rr.Mbox += zone
+		}
+	} else {
+		rr.Mbox = dns.Fqdn(rr.Mbox)
+	}
+
+	return rr
+}
+
 // defaultMessageConstructor is a default implementation of MessageConstructor.
-type defaultMessageConstructor struct{}
+type defaultMessageConstructor struct {
+	// soa is the SOA record configuration for the negative responses.  It
+	// must not be nil.
+	soa *SyntheticSOA
+}
 
 // type check
-var _ MessageConstructor = defaultMessageConstructor{}
+var _ NODATAConstructor = defaultMessageConstructor{}
+
+// newDefaultMessageConstructor returns a new default message constructor
+// adding the SOA record described by soa to the negative responses.  If soa is
+// nil, [DefaultSyntheticSOA] is used.
+func newDefaultMessageConstructor(soa *SyntheticSOA) (c defaultMessageConstructor) {
+	if soa == nil {
+		soa = DefaultSyntheticSOA
+	}
+
+	return defaultMessageConstructor{soa: soa}
+}
 
 // NewMsgNXDOMAIN implements the [MessageConstructor] interface for
 // defaultMessageConstructor.
-func (defaultMessageConstructor) NewMsgNXDOMAIN(req *dns.Msg) (resp *dns.Msg) {
-	return reply(req, dns.RcodeNameError)
+func (c defaultMessageConstructor) NewMsgNXDOMAIN(req *dns.Msg) (resp *dns.Msg) {
+	resp = reply(req, dns.RcodeNameError)
+	resp.Ns = []dns.RR{c.soa.newRR(req)}
+
+	return resp
+}
+
+// NewMsgNODATA implements the [NODATAConstructor] interface for
+// defaultMessageConstructor.
+func (c defaultMessageConstructor) NewMsgNODATA(req *dns.Msg) (resp *dns.Msg) {
+	resp = reply(req, dns.RcodeSuccess)
+	resp.Ns = []dns.RR{c.soa.newRR(req)}
+
+	return resp
 }
 
 // NewMsgSERVFAIL implements the [MessageConstructor] interface for
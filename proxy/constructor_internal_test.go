@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultMessageConstructor_NewMsgNXDOMAIN(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("nonexistent.example.", dns.TypeA)
+
+	testCases := []struct {
+		soa        *SyntheticSOA
+		name       string
+		wantNs     string
+		wantMbox   string
+		wantTTL    uint32
+		wantMinTTL uint32
+	}{{
+		soa:        nil,
+		name:       "default",
+		wantNs:     DefaultSyntheticSOA.MName,
+		wantMbox:   "hostmaster.nonexistent.example.",
+		wantTTL:    DefaultSyntheticSOA.TTL,
+		wantMinTTL: DefaultSyntheticSOA.MinTTL,
+	}, {
+		soa: &SyntheticSOA{
+			MName:  "ns.example",
+			RName:  "admin.example",
+			TTL:    300,
+			MinTTL: 60,
+		},
+		name:       "custom",
+		wantNs:     "ns.example.",
+		wantMbox:   "admin.example.",
+		wantTTL:    300,
+		wantMinTTL: 60,
+	}, {
+		soa: &SyntheticSOA{
+			TTL:    30,
+			MinTTL: 5,
+		},
+		name:       "empty_names",
+		wantNs:     DefaultSyntheticSOA.MName,
+		wantMbox:   "hostmaster.nonexistent.example.",
+		wantTTL:    30,
+		wantMinTTL: 5,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := newDefaultMessageConstructor(tc.soa).NewMsgNXDOMAIN(req)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+			require.Len(t, resp.Ns, 1)
+
+			soa, ok := resp.Ns[0].(*dns.SOA)
+			require.True(t, ok)
+
+			assert.Equal(t, req.Question[0].Name, soa.Hdr.Name)
+			assert.Equal(t, tc.wantNs, soa.Ns)
+			assert.Equal(t, tc.wantMbox, soa.Mbox)
+			assert.Equal(t, tc.wantTTL, soa.Hdr.Ttl)
+			assert.Equal(t, tc.wantMinTTL, soa.Minttl)
+		})
+	}
+}
+
+// testNODATAConstructor is a [NODATAConstructor] for tests.
+type testNODATAConstructor struct {
+	*testMessageConstructor
+
+	onNewMsgNODATA func(req *dns.Msg) (resp *dns.Msg)
+}
+
+// type check
+var _ NODATAConstructor = testNODATAConstructor{}
+
+// NewMsgNODATA implements the [NODATAConstructor] interface for
+// testNODATAConstructor.
+func (c testNODATAConstructor) NewMsgNODATA(req *dns.Msg) (resp *dns.Msg) {
+	return c.onNewMsgNODATA(req)
+}
+
+func TestProxy_CheckDisabledAAAARequest(t *testing.T) {
+	const customMinTTL = 42
+
+	ups := &fakeUpstream{
+		onExchange: func(_ *dns.Msg) (_ *dns.Msg, _ error) { panic("not implemented") },
+		onAddress:  func() (addr string) { return "" },
+		onClose:    func() (err error) { return nil },
+	}
+
+	nodata := &dns.Msg{}
+	notImplemented := &testMessageConstructor{
+		onNewMsgNXDOMAIN:       func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
+		onNewMsgSERVFAIL:       func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
+		onNewMsgNOTIMPLEMENTED: func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
+	}
+
+	testCases := []struct {
+		messages   MessageConstructor
+		soa        *SyntheticSOA
+		want       *dns.Msg
+		name       string
+		wantMinTTL uint32
+	}{{
+		messages:   nil,
+		soa:        nil,
+		want:       nil,
+		name:       "default",
+		wantMinTTL: DefaultSyntheticSOA.MinTTL,
+	}, {
+		messages:   nil,
+		soa:        &SyntheticSOA{MinTTL: customMinTTL},
+		want:       nil,
+		name:       "synthetic_soa",
+		wantMinTTL: customMinTTL,
+	}, {
+		messages:   notImplemented,
+		soa:        &SyntheticSOA{MinTTL: customMinTTL},
+		want:       nil,
+		name:       "no_nodata_constructor",
+		wantMinTTL: customMinTTL,
+	}, {
+		messages: testNODATAConstructor{
+			testMessageConstructor: notImplemented,
+			onNewMsgNODATA:         func(_ *dns.Msg) (resp *dns.Msg) { return nodata },
+		},
+		soa:        nil,
+		want:       nodata,
+		name:       "nodata_constructor",
+		wantMinTTL: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := mustNew(t, &Config{
+				UpstreamConfig:     &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+				TrustedProxies:     defaultTrustedProxies,
+				MessageConstructor: tc.messages,
+				SyntheticSOA:       tc.soa,
+			})
+
+			d := &DNSContext{Req: (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)}
+			require.False(t, p.CheckDisabledAAAARequest(d, true))
+
+			d.Req.Question[0].Qtype = dns.TypeAAAA
+			require.False(t, p.CheckDisabledAAAARequest(d, false))
+			require.True(t, p.CheckDisabledAAAARequest(d, true))
+
+			if tc.want != nil {
+				assert.Same(t, tc.want, d.Res)
+
+				return
+			}
+
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+			assert.Empty(t, d.Res.Answer)
+			require.Len(t, d.Res.Ns, 1)
+
+			soa, ok := d.Res.Ns[0].(*dns.SOA)
+			require.True(t, ok)
+
+			assert.Equal(t, tc.wantMinTTL, soa.Minttl)
+		})
+	}
+}
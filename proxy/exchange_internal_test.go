@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"net"
 	"net/netip"
 	"sync"
@@ -65,6 +66,17 @@ func (u measuredUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	return u.Upstream.Exchange(req)
 }
 
+// ExchangeContext implements the [upstream.Upstream] interface for
+// measuredUpstream.
+func (u measuredUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	u.stats[u.Address()]++
+
+	return u.Upstream.ExchangeContext(ctx, req)
+}
+
 func TestProxy_Exchange_loadBalance(t *testing.T) {
 	// Make the test deterministic.
 	randSrc := rand.NewSource(42)
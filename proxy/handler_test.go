@@ -3,10 +3,13 @@ package proxy
 import (
 	"context"
 	"net"
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -71,3 +74,71 @@ func TestFilteringHandler(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, dns.RcodeNotImplemented, r.Rcode)
 }
+
+func TestProxy_ResponseFilter(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	newConf := func(ip string, f ResponseFilter) (conf *Config) {
+		return &Config{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{&testUpstream{
+					ans: []dns.RR{&dns.A{
+						Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: "host.", Ttl: 10},
+						A:   net.ParseIP(ip),
+					}},
+				}},
+			},
+			TrustedProxies: defaultTrustedProxies,
+			BogusNXDomain:  []netip.Prefix{netip.MustParsePrefix("4.3.2.0/24")},
+			ResponseFilter: f,
+		}
+	}
+
+	t.Run("rewrite", func(t *testing.T) {
+		prx := mustNew(t, newConf("1.2.3.4", func(_, resp *dns.Msg) (f *dns.Msg, err error) {
+			for _, rr := range resp.Answer {
+				rr.Header().Ttl = 100
+			}
+
+			return resp, nil
+		}))
+
+		d := &DNSContext{Req: newHostTestMessage("host")}
+		require.NoError(t, prx.Resolve(d))
+		require.NotNil(t, d.Res)
+
+		require.Len(t, d.Res.Answer, 1)
+		assert.Equal(t, uint32(100), d.Res.Answer[0].Header().Ttl)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var gotErr error
+		conf := newConf("1.2.3.4", func(_, _ *dns.Msg) (f *dns.Msg, err error) {
+			return nil, testErr
+		})
+		conf.ResponseHandler = func(_ *DNSContext, err error) { gotErr = err }
+		prx := mustNew(t, conf)
+
+		d := &DNSContext{Req: newHostTestMessage("host")}
+		err := prx.Resolve(d)
+		require.ErrorIs(t, err, testErr)
+		require.NotNil(t, d.Res)
+
+		assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+		assert.ErrorIs(t, gotErr, testErr)
+	})
+
+	t.Run("after_bogus_nxdomain", func(t *testing.T) {
+		var gotRcode int
+		prx := mustNew(t, newConf("4.3.2.1", func(_, resp *dns.Msg) (f *dns.Msg, err error) {
+			gotRcode = resp.Rcode
+
+			return resp, nil
+		}))
+
+		d := &DNSContext{Req: newHostTestMessage("host")}
+		require.NoError(t, prx.Resolve(d))
+
+		assert.Equal(t, dns.RcodeNameError, gotRcode)
+	})
+}
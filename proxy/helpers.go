@@ -11,6 +11,9 @@ import (
 const retryNoError = 60 // Retry time for NoError SOA
 
 // CheckDisabledAAAARequest checks if AAAA requests should be disabled or not and sets NoError empty response to given DNSContext if needed
+//
+// Deprecated: Use [Proxy.CheckDisabledAAAARequest], which respects
+// [Config.SyntheticSOA] and [Config.MessageConstructor].
 func CheckDisabledAAAARequest(ctx *DNSContext, ipv6Disabled bool) bool {
 	if ipv6Disabled && ctx.Req.Question[0].Qtype == dns.TypeAAAA {
 		log.Debug("IPv6 is disabled. Reply with NoError to %s AAAA request", ctx.Req.Question[0].Name)
@@ -21,7 +24,35 @@ func CheckDisabledAAAARequest(ctx *DNSContext, ipv6Disabled bool) bool {
 	return false
 }
 
+// CheckDisabledAAAARequest sets the NODATA response to d and returns true if
+// ipv6Disabled is true and d is an AAAA request.
+func (p *Proxy) CheckDisabledAAAARequest(d *DNSContext, ipv6Disabled bool) (ok bool) {
+	if !ipv6Disabled || d.Req.Question[0].Qtype != dns.TypeAAAA {
+		return false
+	}
+
+	log.Debug("dnsproxy: ipv6 is disabled; replying with nodata to %q", d.Req.Question[0].Name)
+
+	d.Res = p.newMsgNODATA(d.Req)
+
+	return true
+}
+
+// newMsgNODATA returns the NODATA response to req constructed by the message
+// constructor of p, if it implements [NODATAConstructor], or by the default
+// one otherwise.
+func (p *Proxy) newMsgNODATA(req *dns.Msg) (resp *dns.Msg) {
+	if c, ok := p.messages.(NODATAConstructor); ok {
+		return c.NewMsgNODATA(req)
+	}
+
+	return newDefaultMessageConstructor(p.SyntheticSOA).NewMsgNODATA(req)
+}
+
 // GenEmptyMessage generates empty message with given response code and retry time
+//
+// Deprecated: It doesn't respect [Config.SyntheticSOA], use the
+// [MessageConstructor] of the proxy instead.
 func GenEmptyMessage(request *dns.Msg, rCode int, retry uint32) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetRcode(request, rCode)
@@ -35,36 +66,21 @@ func genEmptyNoError(request *dns.Msg) *dns.Msg {
 	return GenEmptyMessage(request, dns.RcodeSuccess, retryNoError)
 }
 
+// emptyMessageSOA is the SOA record configuration for the messages generated by
+// the deprecated [GenEmptyMessage].  Its MinTTL is kept for backward
+// compatibility.
+var emptyMessageSOA = &SyntheticSOA{
+	MName:  DefaultSyntheticSOA.MName,
+	TTL:    10,
+	MinTTL: 86400,
+}
+
 // genSOA returns SOA for an authority section
 func genSOA(request *dns.Msg, retry uint32) []dns.RR {
-	zone := ""
-	if len(request.Question) > 0 {
-		zone = request.Question[0].Name
-	}
+	soa := emptyMessageSOA.newRR(request)
+	soa.Retry = retry
 
-	soa := dns.SOA{
-		// values copied from verisign's nonexistent .com domain
-		// their exact values are not important in our use case because they are used for domain transfers between primary/secondary DNS servers
-		Refresh: 1800,
-		Retry:   retry,
-		Expire:  604800,
-		Minttl:  86400,
-		// copied from AdGuard DNS
-		Ns:     "fake-for-negative-caching.adguard.com.",
-		Serial: 100500,
-		// rest is request-specific
-		Hdr: dns.RR_Header{
-			Name:   zone,
-			Rrtype: dns.TypeSOA,
-			Ttl:    10,
-			Class:  dns.ClassINET,
-		},
-	}
-	soa.Mbox = "hostmaster."
-	if len(zone) > 0 && zone[0] != '.' {
-		soa.Mbox += zone
-	}
-	return []dns.RR{&soa}
+	return []dns.RR{soa}
 }
 
 // ecsFromMsg returns the subnet from EDNS Client Subnet option of m if any.
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"cmp"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// DefaultLocalRecordsTTL is the default TTL in seconds of the records from
+// [Config.LocalRecords].
+const DefaultLocalRecordsTTL uint32 = 10
+
+// replyFromLocal sets the response to d constructed from the local records of
+// p, if there are any for the question of d.  ok is false if d should be
+// resolved with the upstreams.
+func (p *Proxy) replyFromLocal(d *DNSContext) (ok bool) {
+	if p.LocalRecords == nil || len(d.Req.Question) != 1 {
+		return false
+	}
+
+	q := d.Req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return false
+	}
+
+	var answer []dns.RR
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		addrs := p.LocalRecords.ByName(strings.TrimSuffix(q.Name, "."))
+		if len(addrs) == 0 {
+			return false
+		}
+
+		answer = p.localAddrRRs(q, addrs)
+	case dns.TypePTR:
+		ip, err := netutil.IPFromReversedAddr(q.Name)
+		if err != nil {
+			return false
+		}
+
+		names := p.LocalRecords.ByAddr(ip)
+		if len(names) == 0 {
+			return false
+		}
+
+		answer = p.localPTRRRs(q, names)
+	default:
+		return false
+	}
+
+	log.Debug("dnsproxy: answering %q with %d local records", q.Name, len(answer))
+
+	if len(answer) == 0 {
+		// The name is known, but has no addresses of the requested family.
+		d.Res = p.newMsgNODATA(d.Req)
+
+		return true
+	}
+
+	d.Res = reply(d.Req, dns.RcodeSuccess)
+	d.Res.Answer = answer
+
+	return true
+}
+
+// localHdr returns the header of the local record of type rrType answering q.
+func (p *Proxy) localHdr(q dns.Question, rrType uint16) (hdr dns.RR_Header) {
+	return dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: rrType,
+		Class:  dns.ClassINET,
+		Ttl:    cmp.Or(p.LocalRecordsTTL, DefaultLocalRecordsTTL),
+	}
+}
+
+// localAddrRRs returns the A or AAAA records, depending on the type of q, for
+// those of addrs that have the corresponding family.
+func (p *Proxy) localAddrRRs(q dns.Question, addrs []netip.Addr) (rrs []dns.RR) {
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		switch {
+		case q.Qtype == dns.TypeA && addr.Is4():
+			rrs = append(rrs, &dns.A{
+				Hdr: p.localHdr(q, dns.TypeA),
+				A:   addr.AsSlice(),
+			})
+		case q.Qtype == dns.TypeAAAA && addr.Is6():
+			rrs = append(rrs, &dns.AAAA{
+				Hdr:  p.localHdr(q, dns.TypeAAAA),
+				AAAA: addr.AsSlice(),
+			})
+		default:
+			// Go on.
+		}
+	}
+
+	return rrs
+}
+
+// localPTRRRs returns the PTR records answering q with names.
+func (p *Proxy) localPTRRRs(q dns.Question, names []string) (rrs []dns.RR) {
+	rrs = make([]dns.RR, 0, len(names))
+	for _, name := range names {
+		rrs = append(rrs, &dns.PTR{
+			Hdr: p.localHdr(q, dns.TypePTR),
+			Ptr: dns.Fqdn(name),
+		})
+	}
+
+	return rrs
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/hostsfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_localRecords(t *testing.T) {
+	const ttl = 42
+
+	hosts, err := hostsfile.NewDefaultStorage(strings.NewReader(
+		"1.2.3.4 local.example local-alias.example\n" +
+			"::1 local.example\n" +
+			"5.6.7.8 v4only.example\n",
+	))
+	require.NoError(t, err)
+
+	var upsNum int
+	u := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			upsNum++
+
+			return (&dns.Msg{}).SetRcode(m, dns.RcodeNameError), nil
+		},
+		onAddress: func() (addr string) { return "stub" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	prx := mustNew(t, &Config{
+		UpstreamConfig:  &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:  defaultTrustedProxies,
+		LocalRecords:    hosts,
+		LocalRecordsTTL: ttl,
+	})
+
+	hdr := func(name string, rrType uint16) (h dns.RR_Header) {
+		return dns.RR_Header{Name: name, Rrtype: rrType, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	testCases := []struct {
+		want      []dns.RR
+		name      string
+		host      string
+		qtype     uint16
+		wantRcode int
+		wantUps   bool
+	}{{
+		want: []dns.RR{&dns.A{
+			Hdr: hdr("LOCAL.example.", dns.TypeA),
+			A:   net.IP{1, 2, 3, 4},
+		}},
+		name:      "a",
+		host:      "LOCAL.example.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantUps:   false,
+	}, {
+		want: []dns.RR{&dns.AAAA{
+			Hdr:  hdr("local.example.", dns.TypeAAAA),
+			AAAA: net.IPv6loopback,
+		}},
+		name:      "aaaa",
+		host:      "local.example.",
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantUps:   false,
+	}, {
+		want: []dns.RR{&dns.PTR{
+			Hdr: hdr("4.3.2.1.in-addr.arpa.", dns.TypePTR),
+			Ptr: "local.example.",
+		}, &dns.PTR{
+			Hdr: hdr("4.3.2.1.in-addr.arpa.", dns.TypePTR),
+			Ptr: "local-alias.example.",
+		}},
+		name:      "ptr",
+		host:      "4.3.2.1.in-addr.arpa.",
+		qtype:     dns.TypePTR,
+		wantRcode: dns.RcodeSuccess,
+		wantUps:   false,
+	}, {
+		want:      nil,
+		name:      "nodata",
+		host:      "v4only.example.",
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantUps:   false,
+	}, {
+		want:      nil,
+		name:      "other_type",
+		host:      "local.example.",
+		qtype:     dns.TypeMX,
+		wantRcode: dns.RcodeNameError,
+		wantUps:   true,
+	}, {
+		want:      nil,
+		name:      "unknown",
+		host:      "unknown.example.",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+		wantUps:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upsNum = 0
+
+			req := (&dns.Msg{}).SetQuestion(tc.host, tc.qtype)
+			d := &DNSContext{Req: req}
+			require.NoError(t, prx.Resolve(d))
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+			assert.Equal(t, tc.wantUps, upsNum > 0)
+
+			if tc.wantUps {
+				return
+			}
+
+			if tc.want == nil {
+				assert.Empty(t, d.Res.Answer)
+				require.Len(t, d.Res.Ns, 1)
+				assert.IsType(t, &dns.SOA{}, d.Res.Ns[0])
+
+				return
+			}
+
+			require.Len(t, d.Res.Answer, len(tc.want))
+			for i, rr := range tc.want {
+				assert.Equal(t, rr.String(), d.Res.Answer[i].String())
+			}
+		})
+	}
+}
@@ -225,7 +225,7 @@ func New(c *Config) (p *Proxy, err error) {
 		time:       realClock{},
 		messages: cmp.Or[MessageConstructor](
 			c.MessageConstructor,
-			defaultMessageConstructor{},
+			newDefaultMessageConstructor(c.SyntheticSOA),
 		),
 		recDetector: newRecursionDetector(recursionTTL, cachedRecurrentReqNum),
 	}
@@ -270,6 +270,9 @@ func New(c *Config) (p *Proxy, err error) {
 	p.RatelimitWhitelist = slices.Clone(p.RatelimitWhitelist)
 	slices.SortFunc(p.RatelimitWhitelist, netip.Addr.Compare)
 
+	p.BogusNXDomain = unmapPrefixes(p.BogusNXDomain)
+	p.BogusNXDomainHosts = normalizeBogusHosts(p.BogusNXDomainHosts)
+
 	return p, nil
 }
 
@@ -320,6 +323,9 @@ func (p *Proxy) Init() (err error) {
 	p.RatelimitWhitelist = slices.Clone(p.RatelimitWhitelist)
 	slices.SortFunc(p.RatelimitWhitelist, netip.Addr.Compare)
 
+	p.BogusNXDomain = unmapPrefixes(p.BogusNXDomain)
+	p.BogusNXDomainHosts = normalizeBogusHosts(p.BogusNXDomainHosts)
+
 	p.time = realClock{}
 
 	return nil
@@ -614,7 +620,7 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 		u = dns64Ups
 	} else if p.isBogusNXDomain(resp) {
 		log.Debug("dnsproxy: replying from upstream: response contains bogus-nxdomain ip")
-		resp = p.messages.NewMsgNXDOMAIN(req)
+		resp = p.newBogusNXDomainResp(req)
 	}
 
 	if err != nil && !isPrivate && p.Fallbacks != nil {
@@ -631,6 +637,10 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 		resp, u, err = upstream.ExchangeParallel(upstreams, req)
 	}
 
+	if resp != nil && p.ResponseFilter != nil {
+		resp, err = p.filterResponse(req, resp)
+	}
+
 	if err != nil {
 		log.Debug("dnsproxy: replying from %s: %s", src, err)
 	}
@@ -645,6 +655,19 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 	return resp != nil, err
 }
 
+// filterResponse applies the [ResponseFilter] of p to resp.  filtered is nil
+// if the filter fails, so that SERVFAIL is sent.
+func (p *Proxy) filterResponse(req, resp *dns.Msg) (filtered *dns.Msg, err error) {
+	filtered, err = p.ResponseFilter(req, resp)
+	if err != nil {
+		return nil, fmt.Errorf("filtering response: %w", err)
+	} else if filtered == nil {
+		return nil, errors.Error("filtering response: no response")
+	}
+
+	return filtered, nil
+}
+
 // handleExchangeResult handles the result after the upstream exchange.  It sets
 // the response to d and sets the upstream that have resolved the request.  If
 // the response is nil, it generates a server failure response.
@@ -695,6 +718,14 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 
 	dctx.calcFlagsAndSize()
 
+	if p.replyFromLocal(dctx) {
+		p.clampTTL(dctx.Res)
+		p.shuffleAnswers(dctx.Res)
+		dctx.scrub()
+
+		return nil
+	}
+
 	// Also don't lookup the cache for responses with DNSSEC checking disabled
 	// since only validated responses are cached and those may be not the
 	// desired result for user specifying CD flag.
@@ -702,6 +733,8 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 	if cacheWorks {
 		if p.replyFromCache(dctx) {
 			// Complete the response from cache.
+			p.clampTTL(dctx.Res)
+			p.shuffleAnswers(dctx.Res)
 			dctx.scrub()
 
 			return nil
@@ -729,6 +762,8 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 	// chosen.
 	if dctx.Res != nil {
 		filterMsg(dctx.Res, dctx.Res, dctx.adBit, dctx.doBit, 0)
+		p.clampTTL(dctx.Res)
+		p.shuffleAnswers(dctx.Res)
 	}
 
 	// Complete the response.
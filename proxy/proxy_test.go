@@ -14,6 +14,7 @@ import (
 	"net/netip"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -207,6 +208,14 @@ func (u *testUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, nil
 }
 
+// ExchangeContext implements the upstream.Upstream interface for *testUpstream.
+func (u *testUpstream) ExchangeContext(
+	_ context.Context,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	return u.Exchange(m)
+}
+
 // Address implements the upstream.Upstream interface for *testUpstream.
 func (u *testUpstream) Address() (addr string) {
 	return ""
@@ -548,6 +557,210 @@ func TestProxy_Resolve_dnssecCache(t *testing.T) {
 	}
 }
 
+func TestProxy_Resolve_dnssecStrip(t *testing.T) {
+	const host = "signed.example."
+
+	hdr := func(rrType uint16) (h dns.RR_Header) {
+		return dns.RR_Header{Name: host, Rrtype: rrType, Class: dns.ClassINET, Ttl: 60}
+	}
+
+	u := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = []dns.RR{
+				&dns.A{Hdr: hdr(dns.TypeA), A: net.IP{1, 2, 3, 4}},
+				&dns.RRSIG{Hdr: hdr(dns.TypeRRSIG), TypeCovered: dns.TypeA},
+			}
+			resp.Ns = []dns.RR{
+				&dns.NS{Hdr: hdr(dns.TypeNS), Ns: "ns." + host},
+				&dns.NSEC{Hdr: hdr(dns.TypeNSEC), NextDomain: "a." + host},
+				&dns.NSEC3{Hdr: hdr(dns.TypeNSEC3), Hash: 1},
+			}
+			resp.Extra = []dns.RR{
+				&dns.DNSKEY{Hdr: hdr(dns.TypeDNSKEY), Protocol: 3, Algorithm: 8},
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies: defaultTrustedProxies,
+	})
+
+	types := func(rrs []dns.RR) (rrTypes []uint16) {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rrTypes = append(rrTypes, rr.Header().Rrtype)
+			}
+		}
+
+		return rrTypes
+	}
+
+	testCases := []struct {
+		name      string
+		wantAns   []uint16
+		wantNs    []uint16
+		wantExtra []uint16
+		edns      bool
+		do        bool
+	}{{
+		name:      "no_edns",
+		wantAns:   []uint16{dns.TypeA},
+		wantNs:    []uint16{dns.TypeNS},
+		wantExtra: nil,
+		edns:      false,
+		do:        false,
+	}, {
+		name:      "no_do",
+		wantAns:   []uint16{dns.TypeA},
+		wantNs:    []uint16{dns.TypeNS},
+		wantExtra: nil,
+		edns:      true,
+		do:        false,
+	}, {
+		name:      "do",
+		wantAns:   []uint16{dns.TypeA, dns.TypeRRSIG},
+		wantNs:    []uint16{dns.TypeNS, dns.TypeNSEC, dns.TypeNSEC3},
+		wantExtra: []uint16{dns.TypeDNSKEY},
+		edns:      true,
+		do:        true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+			if tc.edns {
+				req.SetEdns0(dns.DefaultMsgSize, tc.do)
+			}
+
+			d := &DNSContext{Req: req, Proto: ProtoTCP}
+			require.NoError(t, p.Resolve(d))
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantAns, types(d.Res.Answer))
+			assert.Equal(t, tc.wantNs, types(d.Res.Ns))
+			assert.Equal(t, tc.wantExtra, types(d.Res.Extra))
+		})
+	}
+}
+
+func TestProxy_Resolve_shuffleAnswers(t *testing.T) {
+	const (
+		host  = "alias.example."
+		n     = 8
+		tries = 20
+	)
+
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: host, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "www.example.",
+	}
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{"txt"},
+	}
+
+	// The A records of other are in the same section but a different RRset.
+	addrs := make([]dns.RR, 0, n)
+	others := make([]dns.RR, 0, n)
+	for i := range n {
+		addrs = append(addrs, &dns.A{
+			Hdr: dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{192, 0, 2, byte(i)},
+		})
+		others = append(others, &dns.A{
+			Hdr: dns.RR_Header{Name: "other.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{198, 51, 100, byte(i)},
+		})
+	}
+
+	u := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = append(append([]dns.RR{dns.Copy(cname)}, copyRRs(addrs)...), dns.Copy(txt))
+			resp.Answer = append(resp.Answer, copyRRs(others)...)
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	resolve := func(t *testing.T, p *Proxy) (ans []dns.RR) {
+		t.Helper()
+
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(host, dns.TypeA), Proto: ProtoTCP}
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+		require.Len(t, d.Res.Answer, 2*n+2)
+
+		return d.Res.Answer
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		p := mustNew(t, &Config{
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			TrustedProxies: defaultTrustedProxies,
+		})
+
+		for range tries {
+			ans := resolve(t, p)
+			for i, rr := range addrs {
+				assert.Equal(t, rr.String(), ans[i+1].String())
+			}
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		p := mustNew(t, &Config{
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			TrustedProxies: defaultTrustedProxies,
+			ShuffleAnswers: true,
+		})
+
+		strs := func(rrs []dns.RR) (ss []string) {
+			ss = make([]string, 0, len(rrs))
+			for _, rr := range rrs {
+				ss = append(ss, rr.String())
+			}
+
+			return ss
+		}
+
+		want, wantOthers := strs(addrs), strs(others)
+
+		orders := map[string]struct{}{}
+		for range tries {
+			ans := resolve(t, p)
+			assert.Equal(t, cname.String(), ans[0].String())
+			assert.Equal(t, txt.String(), ans[n+1].String())
+
+			got := strs(ans[1 : n+1])
+			assert.ElementsMatch(t, want, got)
+			assert.ElementsMatch(t, wantOthers, strs(ans[n+2:]))
+
+			orders[strings.Join(got, ";")] = struct{}{}
+		}
+
+		assert.Greater(t, len(orders), 1)
+	})
+}
+
+// copyRRs returns the deep copy of rrs.
+func copyRRs(rrs []dns.RR) (copied []dns.RR) {
+	copied = make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		copied = append(copied, dns.Copy(rr))
+	}
+
+	return copied
+}
+
 func TestExchangeWithReservedDomains(t *testing.T) {
 	dnsProxy := mustNew(t, &Config{
 		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
@@ -964,6 +1177,14 @@ var _ upstream.Upstream = (*fakeUpstream)(nil)
 // Exchange implements upstream.Upstream interface for *funcUpstream.
 func (u *fakeUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) { return u.onExchange(m) }
 
+// ExchangeContext implements upstream.Upstream interface for *funcUpstream.
+func (u *fakeUpstream) ExchangeContext(
+	_ context.Context,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	return u.onExchange(m)
+}
+
 // Address implements upstream.Upstream interface for *funcUpstream.
 func (u *fakeUpstream) Address() (addr string) { return u.onAddress() }
 
@@ -1348,6 +1569,89 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 	assert.True(t, ci.m.Answer[0].Header().Ttl == prx.CacheMaxTTL)
 }
 
+func TestProxy_Resolve_minMaxTTL(t *testing.T) {
+	const minTTL, maxTTL = 20, 40
+
+	u := &fakeUpstream{
+		onExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+			name := m.Question[0].Name
+			resp = (&dns.Msg{}).SetReply(m)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A:   net.IP{1, 2, 3, 4},
+			}, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+				A:   net.IP{1, 2, 3, 5},
+			}}
+			resp.Ns = []dns.RR{&dns.NS{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "ns." + name,
+			}}
+			resp.SetEdns0(dns.DefaultMsgSize, false)
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "stub" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	prx := mustNew(t, &Config{
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		MinTTL:         minTTL,
+		MaxTTL:         maxTTL,
+	})
+
+	resolve := func(t *testing.T) (res *dns.Msg) {
+		t.Helper()
+
+		req := newHostTestMessage("host")
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		d := &DNSContext{Req: req}
+		require.NoError(t, prx.Resolve(d))
+		require.NotNil(t, d.Res)
+
+		opt := d.Res.IsEdns0()
+		require.NotNil(t, opt)
+		assert.Zero(t, opt.Hdr.Ttl)
+
+		return d.Res
+	}
+
+	t.Run("upstream", func(t *testing.T) {
+		res := resolve(t)
+
+		require.Len(t, res.Answer, 2)
+		assert.Equal(t, uint32(minTTL), res.Answer[0].Header().Ttl)
+		assert.Equal(t, uint32(30), res.Answer[1].Header().Ttl)
+
+		require.Len(t, res.Ns, 1)
+		assert.Equal(t, uint32(maxTTL), res.Ns[0].Header().Ttl)
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		res := resolve(t)
+
+		// The cache decrements the TTLs, so only check the range.
+		for _, rr := range append(res.Answer, res.Ns...) {
+			assert.GreaterOrEqual(t, rr.Header().Ttl, uint32(minTTL))
+			assert.LessOrEqual(t, rr.Header().Ttl, uint32(maxTTL))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(&Config{
+			UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			TrustedProxies: defaultTrustedProxies,
+			MinTTL:         maxTTL,
+			MaxTTL:         minTTL,
+		})
+		testutil.AssertErrorMsg(t, "min ttl 40 is greater than max ttl 20", err)
+	})
+}
+
 func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 	const (
 		host             = "some.domain.name."
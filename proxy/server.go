@@ -3,7 +3,9 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"math/rand/v2"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
@@ -230,6 +232,64 @@ func (p *Proxy) setMinMaxTTL(r *dns.Msg) {
 	}
 }
 
+// clampTTL sets the TTLs of the resource records in all sections of r within
+// the range of MinTTL and MaxTTL of p.  OPT records are skipped, since their
+// TTL field holds the extended flags.
+func (p *Proxy) clampTTL(r *dns.Msg) {
+	if p.MinTTL == 0 && p.MaxTTL == 0 {
+		return
+	}
+
+	for _, rrs := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = respectTTLOverrides(hdr.Ttl, p.MinTTL, p.MaxTTL)
+			}
+		}
+	}
+}
+
+// rrsetKey identifies an RRset within a section of a DNS message.
+type rrsetKey struct {
+	// name is the lowercased owner name.
+	name string
+
+	// rrType is the type of the records.
+	rrType uint16
+}
+
+// shuffleAnswers randomly permutes the A and AAAA records within the answer
+// section of r if p.ShuffleAnswers is true.  The records of each RRset, i.e.
+// having the same owner name and type, only take the positions of each other,
+// so that e.g. the CNAME chains keep their order.
+func (p *Proxy) shuffleAnswers(r *dns.Msg) {
+	if !p.ShuffleAnswers {
+		return
+	}
+
+	rrsets := map[rrsetKey][]int{}
+	for i, rr := range r.Answer {
+		hdr := rr.Header()
+		if hdr.Rrtype != dns.TypeA && hdr.Rrtype != dns.TypeAAAA {
+			continue
+		}
+
+		k := rrsetKey{
+			name:   strings.ToLower(hdr.Name),
+			rrType: hdr.Rrtype,
+		}
+		rrsets[k] = append(rrsets[k], i)
+	}
+
+	for _, idx := range rrsets {
+		rand.Shuffle(len(idx), func(i, j int) {
+			a, b := idx[i], idx[j]
+			r.Answer[a], r.Answer[b] = r.Answer[b], r.Answer[a]
+		})
+	}
+}
+
 func (p *Proxy) logDNSMessage(m *dns.Msg) {
 	if m == nil {
 		return
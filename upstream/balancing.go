@@ -0,0 +1,76 @@
+package upstream
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+)
+
+// BalancingStrategy defines the order in which the addresses resolved from the
+// upstream's hostname are dialed for each new connection.
+type BalancingStrategy uint8
+
+// BalancingStrategy values.
+const (
+	// BalancingStrategyFirstAvailable dials the addresses in the order they
+	// are resolved, so that the first reachable one is always used.  It's the
+	// default.
+	BalancingStrategyFirstAvailable BalancingStrategy = iota
+
+	// BalancingStrategyRoundRobin starts dialing from the address following
+	// the one the previous connection has started from.
+	BalancingStrategyRoundRobin
+
+	// BalancingStrategyShuffle dials the addresses in random order.
+	BalancingStrategyShuffle
+)
+
+// addrsBalancer orders the addresses to dial according to a balancing
+// strategy.  It's safe for concurrent use.
+type addrsBalancer struct {
+	// next is the number of the address to start the next round-robin
+	// rotation from.
+	next *atomic.Uint32
+
+	// strategy is the balancing strategy.
+	strategy BalancingStrategy
+}
+
+// newAddrsBalancer returns a new balancer using strategy.
+func newAddrsBalancer(strategy BalancingStrategy) (b *addrsBalancer, err error) {
+	switch strategy {
+	case
+		BalancingStrategyFirstAvailable,
+		BalancingStrategyRoundRobin,
+		BalancingStrategyShuffle:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("unsupported balancing strategy %d", strategy)
+	}
+
+	return &addrsBalancer{
+		next:     &atomic.Uint32{},
+		strategy: strategy,
+	}, nil
+}
+
+// order returns addrs in the order they should be dialed.  addrs aren't
+// modified.
+func (b *addrsBalancer) order(addrs []string) (ordered []string) {
+	switch b.strategy {
+	case BalancingStrategyRoundRobin:
+		n := int((b.next.Add(1) - 1) % uint32(len(addrs)))
+
+		return slices.Concat(addrs[n:], addrs[:n])
+	case BalancingStrategyShuffle:
+		ordered = slices.Clone(addrs)
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+
+		return ordered
+	default:
+		return addrs
+	}
+}
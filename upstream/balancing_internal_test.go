@@ -0,0 +1,50 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrsBalancer_order(t *testing.T) {
+	addrs := []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}
+
+	t.Run("first_available", func(t *testing.T) {
+		b, err := newAddrsBalancer(BalancingStrategyFirstAvailable)
+		require.NoError(t, err)
+
+		for range len(addrs) + 1 {
+			assert.Equal(t, addrs, b.order(addrs))
+		}
+	})
+
+	t.Run("round_robin", func(t *testing.T) {
+		b, err := newAddrsBalancer(BalancingStrategyRoundRobin)
+		require.NoError(t, err)
+
+		assert.Equal(t, addrs, b.order(addrs))
+		assert.Equal(t, []string{addrs[1], addrs[2], addrs[0]}, b.order(addrs))
+		assert.Equal(t, []string{addrs[2], addrs[0], addrs[1]}, b.order(addrs))
+		assert.Equal(t, addrs, b.order(addrs))
+
+		// The original slice must not be modified.
+		assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}, addrs)
+	})
+
+	t.Run("shuffle", func(t *testing.T) {
+		b, err := newAddrsBalancer(BalancingStrategyShuffle)
+		require.NoError(t, err)
+
+		for range 10 {
+			assert.ElementsMatch(t, addrs, b.order(addrs))
+		}
+
+		assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}, addrs)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := newAddrsBalancer(BalancingStrategyShuffle + 1)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,354 @@
+package upstream
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+)
+
+// DefaultCacheEntries is the default maximum number of responses cached by the
+// upstream returned from [NewCachingUpstream].
+const DefaultCacheEntries = 1000
+
+// DefaultCacheMaxStale is the default maximum time the expired responses are
+// served from cache by the upstream returned from [NewCachingUpstream], within
+// the range recommended by RFC 8767.
+const DefaultCacheMaxStale = 24 * time.Hour
+
+// staleTTL is the TTL of the expired responses served from cache, as
+// recommended by RFC 8767.
+const staleTTL = 30
+
+// CacheOptions are the options for [NewCachingUpstream].
+type CacheOptions struct {
+	// MaxEntries is the maximum number of cached responses, the least recently
+	// used ones are evicted first.  If zero, [DefaultCacheEntries] is used.
+	MaxEntries int
+
+	// NegativeCaching enables caching the NXDOMAIN and NODATA responses for the
+	// minimum TTL of the SOA record in the authority section, as described by
+	// RFC 2308.
+	NegativeCaching bool
+
+	// ServeStale makes the upstream return the expired responses from cache
+	// while refreshing them in the background.
+	ServeStale bool
+
+	// MaxStale is the maximum time after the expiration the responses are
+	// served from cache for, if ServeStale is true.  The responses expired
+	// longer ago are evicted.  If zero, [DefaultCacheMaxStale] is used.
+	MaxStale time.Duration
+}
+
+// cacheKey is the key of a cached response.
+type cacheKey struct {
+	// name is the lowercased question name.
+	name string
+
+	// qtype is the question type.
+	qtype uint16
+
+	// subnet is the subnet from the EDNS Client Subnet option of the query, if
+	// any, since the responses may differ for the different subnets.
+	subnet netip.Prefix
+
+	// qclass is the question class.
+	qclass uint16
+
+	// do is the DO bit of the query, since the responses to the queries
+	// without it contain no DNSSEC records.
+	do bool
+
+	// cd is the CD bit of the query, since the responses to the queries with
+	// it may contain the data failed the DNSSEC validation.
+	cd bool
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	// resp is the cached response, it must not be modified.
+	resp *dns.Msg
+
+	// stored is the time the response has been cached.
+	stored time.Time
+
+	// expire is the time the response expires.
+	expire time.Time
+}
+
+// cachingUpstream is an [Upstream] caching the responses of the wrapped one.
+type cachingUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// cache stores the *cacheEntry values by cacheKey.
+	cache gcache.Cache
+
+	// now returns the current time.  It's replaced in tests.
+	now func() (now time.Time)
+
+	// refreshingMu protects refreshing.
+	refreshingMu *sync.Mutex
+
+	// refreshing contains the keys of the responses being refreshed in the
+	// background.
+	refreshing map[cacheKey]struct{}
+
+	// maxStale is the maximum time after the expiration the responses are
+	// served for, if serveStale is true.
+	maxStale time.Duration
+
+	// negative is true if the negative responses should be cached.
+	negative bool
+
+	// serveStale is true if the expired responses should be served.
+	serveStale bool
+}
+
+// NewCachingUpstream returns u wrapped to cache its responses according to
+// opts.  The responses are cached for the minimum TTL of their answer records.
+// The responses prefetched by u, if it's a [PrefetchingUpstream] or wraps one,
+// are cached as well.
+func NewCachingUpstream(u Upstream, opts CacheOptions) (c Upstream) {
+	size := opts.MaxEntries
+	if size <= 0 {
+		size = DefaultCacheEntries
+	}
+
+	maxStale := opts.MaxStale
+	if maxStale <= 0 {
+		maxStale = DefaultCacheMaxStale
+	}
+
+	cu := &cachingUpstream{
+		wrapped:      wrapped{ups: u},
+		cache:        gcache.New(size).LRU().Build(),
+		now:          time.Now,
+		refreshingMu: &sync.Mutex{},
+		refreshing:   map[cacheKey]struct{}{},
+		maxStale:     maxStale,
+		negative:     opts.NegativeCaching,
+		serveStale:   opts.ServeStale,
+	}
+
+	setPrefetchHandler(u, cu.prefetched)
+
+	return cu
+}
+
+// type check
+var _ Upstream = (*cachingUpstream)(nil)
+
+// Address implements the [Upstream] interface for *cachingUpstream.
+func (u *cachingUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *cachingUpstream.
+func (u *cachingUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *cachingUpstream.
+// The refreshes of the stale entries aren't bound to ctx.
+func (u *cachingUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if len(req.Question) != 1 {
+		return u.ups.ExchangeContext(ctx, req)
+	}
+
+	key := newCacheKey(req)
+
+	now := u.now()
+	if e := u.get(key); e != nil {
+		switch {
+		case now.Before(e.expire):
+			return fromCache(req, e, now, false), nil
+		case u.serveStale && now.Before(e.expire.Add(u.maxStale)):
+			go u.refresh(key, req.Copy())
+
+			return fromCache(req, e, now, true), nil
+		default:
+			// Don't keep the entry if the exchange fails, since it's too
+			// stale to be served anyway.
+			u.cache.Remove(key)
+		}
+	}
+
+	resp, err = u.ups.ExchangeContext(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	u.set(key, resp, now)
+
+	return resp, nil
+}
+
+// newCacheKey returns the cache key for req, which must have a single
+// question.
+func newCacheKey(req *dns.Msg) (key cacheKey) {
+	q := req.Question[0]
+	opt := req.IsEdns0()
+
+	return cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		subnet: requestSubnet(req),
+		qclass: q.Qclass,
+		do:     opt != nil && opt.Do(),
+		cd:     req.CheckingDisabled,
+	}
+}
+
+// prefetched caches the response to the speculative query req.  It's a
+// [PrefetchHandler].
+func (u *cachingUpstream) prefetched(req, resp *dns.Msg) {
+	if len(req.Question) == 1 {
+		u.set(newCacheKey(req), resp, u.now())
+	}
+}
+
+// get returns the cached entry for key or nil if there is none.
+func (u *cachingUpstream) get(key cacheKey) (e *cacheEntry) {
+	v, err := u.cache.Get(key)
+	if err != nil {
+		// The only possible error is [gcache.KeyNotFoundError].
+		return nil
+	}
+
+	return v.(*cacheEntry)
+}
+
+// set caches resp for key, if it's cacheable.
+func (u *cachingUpstream) set(key cacheKey, resp *dns.Msg, now time.Time) {
+	ttl := u.cacheTTL(resp)
+	if ttl == 0 {
+		return
+	}
+
+	_ = u.cache.Set(key, &cacheEntry{
+		resp:   resp.Copy(),
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	})
+}
+
+// refresh exchanges req with the wrapped upstream and caches the response for
+// key.  It does nothing if the response for key is already being refreshed.
+// It's intended to be used as a goroutine.
+func (u *cachingUpstream) refresh(key cacheKey, req *dns.Msg) {
+	defer log.OnPanic("caching upstream: refreshing")
+
+	u.refreshingMu.Lock()
+	_, ok := u.refreshing[key]
+	if !ok {
+		u.refreshing[key] = struct{}{}
+	}
+	u.refreshingMu.Unlock()
+
+	if ok {
+		return
+	}
+
+	defer func() {
+		u.refreshingMu.Lock()
+		defer u.refreshingMu.Unlock()
+
+		delete(u.refreshing, key)
+	}()
+
+	resp, err := u.ups.Exchange(req)
+	if err != nil {
+		log.Debug("caching upstream %s: refreshing %s: %s", u.Address(), key.name, err)
+
+		return
+	}
+
+	u.set(key, resp, u.now())
+}
+
+// cacheTTL returns the TTL in seconds resp should be cached for.  It returns
+// zero if resp shouldn't be cached.
+func (u *cachingUpstream) cacheTTL(resp *dns.Msg) (ttl uint32) {
+	if resp.Truncated {
+		return 0
+	}
+
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		return minAnswerTTL(resp.Answer)
+	case resp.Rcode == dns.RcodeSuccess, resp.Rcode == dns.RcodeNameError:
+		if u.negative {
+			return negativeTTL(resp)
+		}
+	}
+
+	return 0
+}
+
+// minAnswerTTL returns the minimum TTL of rrs, which must not be empty.
+func minAnswerTTL(rrs []dns.RR) (ttl uint32) {
+	ttl = rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+
+	return ttl
+}
+
+// negativeTTL returns the TTL of the negative response resp as defined by
+// RFC 2308, Section 5.  It returns zero if resp has no SOA record.
+func negativeTTL(resp *dns.Msg) (ttl uint32) {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	return 0
+}
+
+// fromCache returns the response to req from the cached entry e with the TTLs
+// decreased by the time elapsed since it has been cached.  If stale is true,
+// the TTLs are set to [staleTTL] instead.
+func fromCache(req *dns.Msg, e *cacheEntry, now time.Time, stale bool) (resp *dns.Msg) {
+	resp = e.resp.Copy()
+	resp.Id = req.Id
+	resp.Question = slices.Clone(req.Question)
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			switch {
+			case stale:
+				hdr.Ttl = staleTTL
+			case hdr.Ttl > elapsed:
+				hdr.Ttl -= elapsed
+			default:
+				hdr.Ttl = 0
+			}
+		}
+	}
+
+	return resp
+}
+
+// Close implements the [Upstream] interface for *cachingUpstream.
+func (u *cachingUpstream) Close() (err error) {
+	u.cache.Purge()
+
+	return u.ups.Close()
+}
@@ -0,0 +1,222 @@
+package upstream
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCountingUpstream returns a fake upstream responding with the result of
+// respond and counting the exchanges.
+func newCountingUpstream(
+	respond func(req *dns.Msg) (resp *dns.Msg),
+) (u *dnsproxytest.FakeUpstream, exchanges *atomic.Int32) {
+	exchanges = &atomic.Int32{}
+
+	return &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "fake" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			return respond(req), nil
+		},
+		OnClose: func() (err error) { return nil },
+	}, exchanges
+}
+
+func TestCachingUpstream(t *testing.T) {
+	fake, exchanges := newCountingUpstream(respondToTestMessage)
+
+	u := testutil.RequireTypeAssert[*cachingUpstream](t, NewCachingUpstream(fake, CacheOptions{}))
+
+	now := time.Now()
+	u.now = func() (n time.Time) { return now }
+
+	req := createTestMessage()
+	for range 3 {
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+		requireResponse(t, req, resp)
+	}
+
+	assert.Equal(t, int32(1), exchanges.Load())
+
+	now = now.Add(time.Hour)
+
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	assert.Equal(t, int32(2), exchanges.Load())
+}
+
+func TestCachingUpstream_key(t *testing.T) {
+	fake, exchanges := newCountingUpstream(respondToTestMessage)
+	u := NewCachingUpstream(fake, CacheOptions{})
+
+	withDO := createTestMessage()
+	withDO.SetEdns0(dns.DefaultMsgSize, true)
+
+	withCD := createTestMessage()
+	withCD.CheckingDisabled = true
+
+	withECS := createTestMessage()
+	withECS.SetEdns0(dns.DefaultMsgSize, false)
+	opt := withECS.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IP{192, 0, 2, 0},
+	})
+
+	reqs := []*dns.Msg{createTestMessage(), withDO, withCD, withECS}
+	for range 2 {
+		for _, req := range reqs {
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+		}
+	}
+
+	assert.Equal(t, int32(len(reqs)), exchanges.Load())
+}
+
+func TestCachingUpstream_negative(t *testing.T) {
+	const minTTL = 60
+
+	respond := func(req *dns.Msg) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+		resp.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   "example.",
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    3600,
+			},
+			Ns:     "ns.example.",
+			Mbox:   "hostmaster.example.",
+			Minttl: minTTL,
+		}}
+
+		return resp
+	}
+
+	testCases := []struct {
+		name          string
+		wantExchanges int32
+		negative      bool
+	}{{
+		name:          "disabled",
+		wantExchanges: 2,
+		negative:      false,
+	}, {
+		name:          "enabled",
+		wantExchanges: 1,
+		negative:      true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, exchanges := newCountingUpstream(respond)
+
+			u := NewCachingUpstream(fake, CacheOptions{NegativeCaching: tc.negative})
+			cu := testutil.RequireTypeAssert[*cachingUpstream](t, u)
+
+			now := time.Now()
+			cu.now = func() (n time.Time) { return now }
+
+			req := createTestMessage()
+			for range 2 {
+				_, err := u.Exchange(req)
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, tc.wantExchanges, exchanges.Load())
+
+			now = now.Add(minTTL * time.Second)
+
+			_, err := u.Exchange(req)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantExchanges+1, exchanges.Load())
+		})
+	}
+}
+
+func TestCachingUpstream_serveStale(t *testing.T) {
+	fake, exchanges := newCountingUpstream(respondToTestMessage)
+
+	u := NewCachingUpstream(fake, CacheOptions{ServeStale: true})
+	cu := testutil.RequireTypeAssert[*cachingUpstream](t, u)
+
+	now := time.Now()
+	cu.now = func() (n time.Time) { return now }
+
+	req := createTestMessage()
+	_, err := u.Exchange(req)
+	require.NoError(t, err)
+
+	now = now.Add(time.Hour)
+
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	require.NotEmpty(t, resp.Answer)
+	assert.Equal(t, uint32(staleTTL), resp.Answer[0].Header().Ttl)
+
+	require.Eventually(t, func() (ok bool) {
+		return exchanges.Load() == 2
+	}, timeout, 10*time.Millisecond)
+}
+
+func TestCachingUpstream_maxStale(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	exchanges := &atomic.Int32{}
+	fake := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "fake" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if exchanges.Add(1) > 1 {
+				return nil, testErr
+			}
+
+			return respondToTestMessage(req), nil
+		},
+		OnClose: func() (err error) { return nil },
+	}
+
+	u := NewCachingUpstream(fake, CacheOptions{
+		ServeStale: true,
+		MaxStale:   time.Hour,
+	})
+	cu := testutil.RequireTypeAssert[*cachingUpstream](t, u)
+
+	now := time.Now()
+	cu.now = func() (n time.Time) { return now }
+
+	req := createTestMessage()
+	_, err := u.Exchange(req)
+	require.NoError(t, err)
+
+	key := newCacheKey(req)
+	require.NotNil(t, cu.get(key))
+
+	now = now.Add(2 * time.Hour)
+
+	resp, err := u.Exchange(req)
+	assert.ErrorIs(t, err, testErr)
+	assert.Nil(t, resp)
+
+	assert.Equal(t, int32(2), exchanges.Load())
+	assert.Nil(t, cu.get(key))
+}
@@ -0,0 +1,159 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// FailureFunc returns true if the exchange resulted in resp and err should be
+// considered failed.  resp may be nil.
+type FailureFunc func(resp *dns.Msg, err error) (failed bool)
+
+// IsFailure is the default [FailureFunc] of [ChainUpstream].  It considers
+// failed the exchanges resulted in an error, no response, or a SERVFAIL or
+// REFUSED response.
+func IsFailure(resp *dns.Msg, err error) (failed bool) {
+	if err != nil || resp == nil {
+		return true
+	}
+
+	return resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused
+}
+
+// ChainUpstream is an [Upstream] exchanging with the primary upstream and then
+// with each of the fallback ones in order until the exchange succeeds.
+type ChainUpstream struct {
+	// isFailure decides if the exchange with a member has failed.
+	isFailure FailureFunc
+
+	// ups are the primary upstream followed by the fallback ones.
+	ups []Upstream
+}
+
+// NewChainUpstream returns a new chain of upstreams using [IsFailure] to decide
+// if the exchange has failed.  primary must not be nil.
+func NewChainUpstream(primary Upstream, fallbacks ...Upstream) (u *ChainUpstream) {
+	return NewChainUpstreamFunc(IsFailure, primary, fallbacks...)
+}
+
+// NewChainUpstreamFunc returns a new chain of upstreams using isFailure to
+// decide if the exchange has failed.  If isFailure is nil, [IsFailure] is used.
+// primary must not be nil.
+func NewChainUpstreamFunc(
+	isFailure FailureFunc,
+	primary Upstream,
+	fallbacks ...Upstream,
+) (u *ChainUpstream) {
+	if isFailure == nil {
+		isFailure = IsFailure
+	}
+
+	return &ChainUpstream{
+		isFailure: isFailure,
+		ups:       append([]Upstream{primary}, fallbacks...),
+	}
+}
+
+// type check
+var _ Upstream = (*ChainUpstream)(nil)
+
+// Address implements the [Upstream] interface for *ChainUpstream.  It lists
+// the addresses of the members in order, e.g. "chain(tls://dns.example,
+// 1.1.1.1:53)".
+func (u *ChainUpstream) Address() (addr string) {
+	addrs := make([]string, 0, len(u.ups))
+	for _, ups := range u.ups {
+		addrs = append(addrs, ups.Address())
+	}
+
+	return fmt.Sprintf("chain(%s)", strings.Join(addrs, ", "))
+}
+
+// Exchange implements the [Upstream] interface for *ChainUpstream.
+func (u *ChainUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *ChainUpstream.  It
+// returns the first successful response.  If all the members fail, it returns
+// the last response along with the errors of all the members, if any.  It
+// doesn't fall back once ctx is done.
+func (u *ChainUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	var errs []error
+	for i, ups := range u.ups {
+		resp, err = ups.ExchangeContext(ctx, req)
+		if !u.isFailure(resp, err) {
+			return resp, err
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("exchanging with %s: %w", ups.Address(), err))
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		if i < len(u.ups)-1 {
+			log.Debug(
+				"dnsproxy: chain: %s failed, falling back: %s",
+				ups.Address(),
+				retryReason(resp, err),
+			)
+		}
+	}
+
+	return resp, errors.Join(errs...)
+}
+
+// Close implements the [Upstream] interface for *ChainUpstream.  It closes all
+// the members.
+func (u *ChainUpstream) Close() (err error) {
+	var errs []error
+	for _, ups := range u.ups {
+		closeErr := ups.Close()
+		if closeErr != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", ups.Address(), closeErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ ProbableUpstream = (*ChainUpstream)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *ChainUpstream.  It
+// succeeds if any of the members responds properly.
+func (u *ChainUpstream) Probe(ctx context.Context) (err error) {
+	var errs []error
+	for _, ups := range u.ups {
+		err = probeWrapped(ctx, ups)
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ BootstrapSetter = (*ChainUpstream)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for *ChainUpstream.
+// It sets the resolvers for each member implementing [BootstrapSetter].
+func (u *ChainUpstream) SetBootstrap(resolvers []Resolver) {
+	for _, ups := range u.ups {
+		setBootstrap(ups, resolvers)
+	}
+}
@@ -0,0 +1,109 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newChainMember returns a fake upstream named addr responding with rcode, or
+// with err if it's not nil.  It also returns the pointer to the number of its
+// exchanges and closings.
+func newChainMember(addr string, rcode int, err error) (u Upstream, exchanges, closes *int) {
+	exchanges, closes = new(int), new(int)
+
+	return &dnsproxytest.FakeUpstream{
+		OnAddress: func() (a string) { return addr },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, exErr error) {
+			*exchanges++
+			if err != nil {
+				return nil, err
+			}
+
+			resp = respondToTestMessage(req)
+			resp.Rcode = rcode
+
+			return resp, nil
+		},
+		OnClose: func() (closeErr error) {
+			*closes++
+
+			return nil
+		},
+	}, exchanges, closes
+}
+
+func TestChainUpstream(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	t.Run("primary", func(t *testing.T) {
+		primary, primaryN, _ := newChainMember("primary", dns.RcodeSuccess, nil)
+		fallback, fallbackN, _ := newChainMember("fallback", dns.RcodeSuccess, nil)
+
+		u := NewChainUpstream(primary, fallback)
+		assert.Equal(t, "chain(primary, fallback)", u.Address())
+
+		req := createTestMessage()
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+		requireResponse(t, req, resp)
+
+		assert.Equal(t, 1, *primaryN)
+		assert.Equal(t, 0, *fallbackN)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		primary, _, primaryCloses := newChainMember("primary", 0, testErr)
+		refused, refusedN, refusedCloses := newChainMember("refused", dns.RcodeRefused, nil)
+		fallback, fallbackN, fallbackCloses := newChainMember("fallback", dns.RcodeSuccess, nil)
+
+		u := NewChainUpstream(primary, refused, fallback)
+
+		req := createTestMessage()
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+		requireResponse(t, req, resp)
+
+		assert.Equal(t, 1, *refusedN)
+		assert.Equal(t, 1, *fallbackN)
+
+		require.NoError(t, u.Close())
+
+		assert.Equal(t, 1, *primaryCloses)
+		assert.Equal(t, 1, *refusedCloses)
+		assert.Equal(t, 1, *fallbackCloses)
+	})
+
+	t.Run("all_failed", func(t *testing.T) {
+		primary, _, _ := newChainMember("primary", 0, testErr)
+		fallback, _, _ := newChainMember("fallback", dns.RcodeServerFailure, nil)
+
+		u := NewChainUpstream(primary, fallback)
+
+		resp, err := u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, testErr)
+
+		require.NotNil(t, resp)
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	})
+
+	t.Run("custom_failure", func(t *testing.T) {
+		primary, _, _ := newChainMember("primary", dns.RcodeNameError, nil)
+		fallback, fallbackN, _ := newChainMember("fallback", dns.RcodeSuccess, nil)
+
+		u := NewChainUpstreamFunc(func(resp *dns.Msg, err error) (failed bool) {
+			return IsFailure(resp, err) || resp.Rcode == dns.RcodeNameError
+		}, primary, fallback)
+
+		resp, err := u.Exchange(createTestMessage())
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Equal(t, 1, *fallbackN)
+	})
+}
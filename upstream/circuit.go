@@ -0,0 +1,196 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// ErrCircuitOpen is returned by the upstreams created with
+// [NewCircuitBreakerUpstream] when the exchange isn't attempted since the
+// wrapped upstream has been failing.
+const ErrCircuitOpen errors.Error = "circuit is open"
+
+const (
+	// DefaultCircuitThreshold is the default number of consecutive failures
+	// opening the circuit of the upstream returned from
+	// [NewCircuitBreakerUpstream].
+	DefaultCircuitThreshold = 5
+
+	// DefaultCircuitCooldown is the default time the circuit of the upstream
+	// returned from [NewCircuitBreakerUpstream] stays open.
+	DefaultCircuitCooldown = 30 * time.Second
+)
+
+// CircuitOptions are the options for [NewCircuitBreakerUpstream].
+type CircuitOptions struct {
+	// IsFailure decides if the exchange with the wrapped upstream has failed.
+	// If nil, [IsFailure] is used.
+	IsFailure FailureFunc
+
+	// Cooldown is the time the circuit stays open before a single exchange is
+	// allowed to probe the wrapped upstream.  If zero, [DefaultCircuitCooldown]
+	// is used.
+	Cooldown time.Duration
+
+	// Threshold is the number of consecutive failures opening the circuit.  If
+	// zero, [DefaultCircuitThreshold] is used.
+	Threshold int
+}
+
+// circuitBreakerUpstream is an [Upstream] stopping the exchanges with the
+// wrapped one after a number of consecutive failures for a while.
+type circuitBreakerUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// isFailure decides if the exchange with ups has failed.
+	isFailure FailureFunc
+
+	// now returns the current time.  It's replaced in tests.
+	now func() (now time.Time)
+
+	// mu protects openedAt, failures, and probing.
+	mu *sync.Mutex
+
+	// openedAt is the time the circuit has been opened last time.
+	openedAt time.Time
+
+	// cooldown is the time the circuit stays open.
+	cooldown time.Duration
+
+	// failures is the number of consecutive failures.  The circuit is open
+	// while it's not less than threshold.
+	failures int
+
+	// threshold is the number of consecutive failures opening the circuit.
+	threshold int
+
+	// probing is true while the exchange probing ups after the cooldown is in
+	// flight, i.e. the circuit is half-open.
+	probing bool
+}
+
+// NewCircuitBreakerUpstream returns u wrapped to fail the exchanges with
+// [ErrCircuitOpen] right away once the exchanges with u have failed the
+// configured number of times in a row.  After the cooldown a single exchange is
+// passed to u, and the circuit is closed if it succeeds or opened again
+// otherwise.  The cancelled exchanges aren't counted.
+func NewCircuitBreakerUpstream(u Upstream, opts CircuitOptions) (c Upstream) {
+	isFailure := opts.IsFailure
+	if isFailure == nil {
+		isFailure = IsFailure
+	}
+
+	cooldown := opts.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitCooldown
+	}
+
+	threshold := opts.Threshold
+	if threshold <= 0 {
+		threshold = DefaultCircuitThreshold
+	}
+
+	return &circuitBreakerUpstream{
+		wrapped:   wrapped{ups: u},
+		isFailure: isFailure,
+		now:       time.Now,
+		mu:        &sync.Mutex{},
+		cooldown:  cooldown,
+		threshold: threshold,
+	}
+}
+
+// type check
+var _ Upstream = (*circuitBreakerUpstream)(nil)
+
+// Address implements the [Upstream] interface for *circuitBreakerUpstream.
+func (u *circuitBreakerUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *circuitBreakerUpstream.
+func (u *circuitBreakerUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for
+// *circuitBreakerUpstream.
+func (u *circuitBreakerUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	allowed, probe := u.allow()
+	if !allowed {
+		return nil, fmt.Errorf("%s: %w", u.ups.Address(), ErrCircuitOpen)
+	}
+
+	resp, err = u.ups.ExchangeContext(ctx, req)
+
+	failed := u.isFailure(resp, err)
+	u.report(probe, failed, failed && ctx.Err() != nil)
+
+	return resp, err
+}
+
+// allow returns true if the exchange should be passed to the wrapped upstream.
+// probe is true if the exchange is the one probing it after the cooldown.
+func (u *circuitBreakerUpstream) allow() (allowed, probe bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.failures < u.threshold {
+		return true, false
+	}
+
+	if u.probing || u.now().Sub(u.openedAt) < u.cooldown {
+		return false, false
+	}
+
+	u.probing = true
+
+	return true, true
+}
+
+// report accounts for the result of the exchange allowed by allow.  cancelled
+// is true if the exchange has failed since its context is done.
+func (u *circuitBreakerUpstream) report(probe, failed, cancelled bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if probe {
+		u.probing = false
+	}
+
+	if cancelled {
+		return
+	}
+
+	if !failed {
+		if u.failures >= u.threshold {
+			log.Debug("dnsproxy: %s: circuit closed", u.ups.Address())
+		}
+
+		u.failures = 0
+
+		return
+	}
+
+	u.failures++
+	if probe || u.failures == u.threshold {
+		u.openedAt = u.now()
+		log.Debug(
+			"dnsproxy: %s: circuit opened for %s after %d failures",
+			u.ups.Address(),
+			u.cooldown,
+			u.failures,
+		)
+	}
+}
+
+// Close implements the [Upstream] interface for *circuitBreakerUpstream.
+func (u *circuitBreakerUpstream) Close() (err error) { return u.ups.Close() }
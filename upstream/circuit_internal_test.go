@@ -0,0 +1,134 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerUpstream(t *testing.T) {
+	const (
+		testErr errors.Error = "test error"
+
+		threshold = 3
+		cooldown  = time.Minute
+	)
+
+	var exchanges int
+	var failErr error
+	ups := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (a string) { return "flaky" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges++
+			if failErr != nil {
+				return nil, failErr
+			}
+
+			return respondToTestMessage(req), nil
+		},
+		OnClose: func() (err error) { return nil },
+	}
+
+	u := NewCircuitBreakerUpstream(ups, CircuitOptions{
+		Cooldown:  cooldown,
+		Threshold: threshold,
+	})
+	assert.Equal(t, "flaky", u.Address())
+
+	cu := testutil.RequireTypeAssert[*circuitBreakerUpstream](t, u)
+	now := time.Now()
+	cu.now = func() (n time.Time) { return now }
+
+	// Open the circuit.
+	failErr = testErr
+	for range threshold {
+		_, err := u.Exchange(createTestMessage())
+		require.ErrorIs(t, err, testErr)
+	}
+
+	_, err := u.Exchange(createTestMessage())
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, threshold, exchanges)
+
+	// The failed probe opens the circuit again.
+	now = now.Add(cooldown)
+	_, err = u.Exchange(createTestMessage())
+	require.ErrorIs(t, err, testErr)
+
+	_, err = u.Exchange(createTestMessage())
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, threshold+1, exchanges)
+
+	// The successful probe closes the circuit.
+	now = now.Add(cooldown)
+	failErr = nil
+	for range 2 {
+		req := createTestMessage()
+		resp, exErr := u.Exchange(req)
+		require.NoError(t, exErr)
+		requireResponse(t, req, resp)
+	}
+
+	assert.Equal(t, threshold+3, exchanges)
+
+	// A success resets the consecutive failures.
+	for _, e := range []error{testErr, testErr, nil, testErr, testErr} {
+		failErr = e
+		_, err = u.Exchange(createTestMessage())
+		require.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+}
+
+func TestCircuitBreakerUpstream_options(t *testing.T) {
+	t.Run("failure_func", func(t *testing.T) {
+		ups, exchanges, _ := newChainMember("servfail", dns.RcodeServerFailure, nil)
+		u := NewCircuitBreakerUpstream(ups, CircuitOptions{
+			IsFailure: func(resp *dns.Msg, err error) (failed bool) { return err != nil },
+			Threshold: 1,
+		})
+
+		for range 3 {
+			resp, err := u.Exchange(createTestMessage())
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+		}
+
+		assert.Equal(t, 3, *exchanges)
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		ups, exchanges, _ := newChainMember("servfail", dns.RcodeServerFailure, nil)
+		u := NewCircuitBreakerUpstream(ups, CircuitOptions{})
+
+		for range DefaultCircuitThreshold + 1 {
+			_, _ = u.Exchange(createTestMessage())
+		}
+
+		assert.Equal(t, DefaultCircuitThreshold, *exchanges)
+
+		cu := testutil.RequireTypeAssert[*circuitBreakerUpstream](t, u)
+		assert.Equal(t, DefaultCircuitCooldown, cu.cooldown)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ups, exchanges, _ := newChainMember("failing", 0, context.Canceled)
+		u := NewCircuitBreakerUpstream(ups, CircuitOptions{Threshold: 1})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		for range 2 {
+			_, err := u.ExchangeContext(ctx, createTestMessage())
+			require.ErrorIs(t, err, context.Canceled)
+		}
+
+		assert.Equal(t, 2, *exchanges)
+	})
+}
@@ -0,0 +1,95 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// ErrClosed is returned from the exchanges with the upstreams created with
+// [AddressToUpstream] after those are closed.
+const ErrClosed errors.Error = "upstream is closed"
+
+// DefaultCloseGracePeriod is the default time Close waits for the exchanges in
+// flight, see [Options.CloseGracePeriod].
+const DefaultCloseGracePeriod = 5 * time.Second
+
+// inflight tracks the exchanges in flight of an upstream, so that closing it
+// waits for them.
+type inflight struct {
+	// mu protects closed and makes the starting exchanges not race with the
+	// waiting for them.
+	mu *sync.RWMutex
+
+	// wg tracks the exchanges in flight.
+	wg *sync.WaitGroup
+
+	// grace is the maximum time to wait for the exchanges in flight.  If it's
+	// negative, those aren't waited for.
+	grace time.Duration
+
+	// closed is true if no more exchanges are allowed.
+	closed bool
+}
+
+// newInflight returns a new tracker of the exchanges in flight with the grace
+// period from opts.
+func newInflight(opts *Options) (f *inflight) {
+	grace := opts.CloseGracePeriod
+	if grace == 0 {
+		grace = DefaultCloseGracePeriod
+	}
+
+	return &inflight{
+		mu:    &sync.RWMutex{},
+		wg:    &sync.WaitGroup{},
+		grace: grace,
+	}
+}
+
+// begin registers a new exchange.  It returns [ErrClosed] if the upstream is
+// closed, otherwise end must be called when the exchange is finished.
+func (f *inflight) begin() (err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+
+	f.wg.Add(1)
+
+	return nil
+}
+
+// end unregisters the exchange registered with begin.
+func (f *inflight) end() {
+	f.wg.Done()
+}
+
+// shutdown forbids the new exchanges and waits for the ones in flight for up to
+// the grace period.  It's safe to call it several times.
+func (f *inflight) shutdown() {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+
+	if f.grace < 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(f.grace)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,88 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstream_Close_graceful(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		received <- struct{}{}
+		<-release
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+
+	t.Run("wait", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{Timeout: timeout})
+		require.NoError(t, err)
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, exchErr := u.Exchange(createTestMessage())
+			errCh <- exchErr
+		}()
+
+		testutil.RequireReceive(t, received, timeout)
+
+		closed := make(chan struct{})
+		go func() {
+			require.NoError(testutil.PanicT{}, u.Close())
+			close(closed)
+		}()
+
+		// Make sure Close is called before the response is sent.
+		active := testutil.RequireTypeAssert[*plainDNS](t, u).active
+		require.Eventually(t, func() (ok bool) {
+			if active.begin() != nil {
+				return true
+			}
+
+			active.end()
+
+			return false
+		}, timeout, time.Millisecond)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, ErrClosed)
+
+		release <- struct{}{}
+
+		err, _ = testutil.RequireReceive(t, errCh, timeout)
+		require.NoError(t, err)
+
+		testutil.RequireReceive(t, closed, timeout)
+	})
+
+	t.Run("grace_period", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{
+			Timeout:          timeout,
+			CloseGracePeriod: 10 * time.Millisecond,
+		})
+		require.NoError(t, err)
+
+		go func() {
+			_, _ = u.Exchange(createTestMessage())
+		}()
+
+		testutil.RequireReceive(t, received, timeout)
+
+		start := time.Now()
+		require.NoError(t, u.Close())
+		assert.Less(t, time.Since(start), timeout)
+
+		close(release)
+	})
+}
@@ -0,0 +1,77 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// ErrTooManyQueries is returned by the upstreams configured with
+// [Options.MaxConcurrentQueries] when the exchange can't be started within the
+// timeout.
+const ErrTooManyQueries errors.Error = "too many concurrent queries"
+
+// concurrencyLimitedUpstream is an [Upstream] limiting the number of the
+// exchanges in flight, see [Options.MaxConcurrentQueries].
+type concurrencyLimitedUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// slots is the semaphore containing a value for each exchange in flight.
+	slots chan struct{}
+
+	// timeout is the maximum time to wait for the exchange to start.  Zero
+	// means waiting until the context is done.
+	timeout time.Duration
+}
+
+// newConcurrencyLimitedUpstream returns ups wrapped to limit the number of the
+// exchanges in flight according to opts.
+func newConcurrencyLimitedUpstream(ups Upstream, opts *Options) (u *concurrencyLimitedUpstream) {
+	return &concurrencyLimitedUpstream{
+		wrapped: wrapped{ups: ups},
+		slots:   make(chan struct{}, opts.MaxConcurrentQueries),
+		timeout: opts.Timeout,
+	}
+}
+
+// type check
+var _ Upstream = (*concurrencyLimitedUpstream)(nil)
+
+// Address implements the [Upstream] interface for *concurrencyLimitedUpstream.
+func (u *concurrencyLimitedUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *concurrencyLimitedUpstream.
+func (u *concurrencyLimitedUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for
+// *concurrencyLimitedUpstream.  It waits for one of the exchanges in flight to
+// finish first, if there are too many of them.
+func (u *concurrencyLimitedUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	waitCtx := ctx
+	if u.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, u.timeout)
+		defer cancel()
+	}
+
+	select {
+	case u.slots <- struct{}{}:
+		defer func() { <-u.slots }()
+	case <-waitCtx.Done():
+		return nil, fmt.Errorf("%s: %w: %w", u.ups.Address(), ErrTooManyQueries, waitCtx.Err())
+	}
+
+	return u.ups.ExchangeContext(ctx, req)
+}
+
+// Close implements the [Upstream] interface for *concurrencyLimitedUpstream.
+func (u *concurrencyLimitedUpstream) Close() (err error) { return u.ups.Close() }
@@ -0,0 +1,79 @@
+package upstream
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimitedUpstream(t *testing.T) {
+	const limit = 2
+
+	var inFlight, maxInFlight atomic.Int32
+	started := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	ups := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (a string) { return "limited" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+
+			for cur := maxInFlight.Load(); n > cur; cur = maxInFlight.Load() {
+				if maxInFlight.CompareAndSwap(cur, n) {
+					break
+				}
+			}
+
+			started <- struct{}{}
+			<-unblock
+
+			return respondToTestMessage(req), nil
+		},
+		OnClose: func() (err error) { return nil },
+	}
+
+	u := wrapUpstream(ups, &Options{
+		MaxConcurrentQueries: limit,
+		Timeout:              100 * time.Millisecond,
+	})
+
+	wg := &sync.WaitGroup{}
+	for range limit {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := createTestMessage()
+			resp, err := u.ExchangeContext(context.Background(), req)
+			assert.NoError(t, err)
+			assert.NotNil(t, resp)
+		}()
+	}
+
+	for range limit {
+		<-started
+	}
+
+	// All the slots are taken, so the next exchange times out.
+	_, err := u.Exchange(createTestMessage())
+	assert.ErrorIs(t, err, ErrTooManyQueries)
+
+	close(unblock)
+	wg.Wait()
+
+	// The slots are freed.
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	assert.Len(t, started, 1)
+	assert.Equal(t, int32(limit), maxInFlight.Load())
+}
@@ -0,0 +1,176 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// connUpstream implements the [Upstream] interface for the plain DNS protocol
+// over an already established connection.
+type connUpstream struct {
+	// mu protects conn and serializes the exchanges, since a single connection
+	// can't be used for several exchanges at once.
+	mu *sync.Mutex
+
+	// conn is the connection used for all exchanges.
+	conn *dns.Conn
+
+	// rttStats measures the round-trip time of the exchanges.
+	*rttStats
+
+	// addr is the string representation of the remote address of conn.
+	addr string
+
+	// net is the network of conn used for logging.
+	net network
+
+	// timeout is the timeout for a single exchange.
+	timeout time.Duration
+
+	// probeTimeout is the timeout of the health-check probes.
+	probeTimeout time.Duration
+
+	// forceRD is true if the RD bit should be set in the outgoing queries.
+	forceRD bool
+
+	// tcPolicy defines how the responses with the TC bit set are handled.
+	tcPolicy TruncatedPolicy
+}
+
+// NewUpstreamFromConn returns a plain DNS upstream that exchanges messages over
+// conn without dialing.  If conn implements [net.PacketConn], messages are
+// sent as datagrams, otherwise they are prefixed with their length as in DNS
+// over TCP.  opts may be nil, only the timeout is used.
+//
+// The returned upstream owns conn: closing the upstream closes conn, and conn
+// must not be used by the caller after that.  Exchanges are serialized.
+func NewUpstreamFromConn(conn net.Conn, opts *Options) (u Upstream) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	n := networkTCP
+	if _, ok := conn.(net.PacketConn); ok {
+		n = networkUDP
+	}
+
+	addr := "conn"
+	if ra := conn.RemoteAddr(); ra != nil {
+		addr = ra.String()
+	}
+
+	return &connUpstream{
+		mu: &sync.Mutex{},
+		conn: &dns.Conn{
+			Conn:    conn,
+			UDPSize: dns.MaxMsgSize,
+		},
+		rttStats:     newRTTStats(opts),
+		addr:         addr,
+		net:          n,
+		timeout:      opts.Timeout,
+		forceRD:      !opts.PreserveRecursionDesired,
+		probeTimeout: opts.ProbeTimeout,
+		tcPolicy:     opts.TruncatedPolicy,
+	}
+}
+
+// type check
+var _ UpstreamWithStats = (*connUpstream)(nil)
+
+// Address implements the [Upstream] interface for *connUpstream.
+func (u *connUpstream) Address() (addr string) { return u.addr }
+
+// Exchange implements the [Upstream] interface for *connUpstream.
+func (u *connUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *connUpstream.  Since
+// the connection can't be closed on cancellation, the exchange is aborted by
+// moving its deadline into the past.
+func (u *connUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	restoreRD := forceRecursionDesired(req, u.forceRD)
+	defer func() { restoreRD(resp) }()
+
+	logBegin(u.addr, u.net, req)
+	defer func() { logFinish(u.addr, u.net, resp, err) }()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var deadline time.Time
+	if u.timeout > 0 {
+		deadline = time.Now().Add(u.timeout)
+	}
+
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	err = u.conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	// Register the function after setting the deadline so that it's never
+	// overridden.
+	stop := context.AfterFunc(ctx, func() { _ = u.conn.SetDeadline(time.Unix(0, 1)) })
+	defer func() {
+		if !stop() && err != nil {
+			err = fmt.Errorf("exchange aborted: %w: %w", ctx.Err(), err)
+		}
+	}()
+
+	start := time.Now()
+
+	err = u.conn.WriteMsg(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request to %s: %w", u.addr, err)
+	}
+
+	resp, err = u.conn.ReadMsg()
+	if err != nil {
+		return nil, fmt.Errorf("reading response from %s: %w", u.addr, err)
+	} else if resp.Id != req.Id {
+		return resp, dns.ErrId
+	}
+
+	if u.net == networkTCP {
+		err = handleTruncated(resp, u.addr, u.tcPolicy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = validatePlainResponse(req, resp)
+	if err != nil {
+		return resp, err
+	}
+
+	u.update(time.Since(start))
+
+	return resp, nil
+}
+
+// Close implements the [Upstream] interface for *connUpstream.  It closes the
+// underlying connection.
+func (u *connUpstream) Close() (err error) {
+	return closeConn(u.conn)
+}
+
+// type check
+var _ ProbableUpstream = (*connUpstream)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *connUpstream.
+func (u *connUpstream) Probe(ctx context.Context) (err error) {
+	return probe(ctx, u, u.probeTimeout)
+}
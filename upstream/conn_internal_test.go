@@ -0,0 +1,63 @@
+package upstream
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUpstreamFromConn(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	testutil.CleanupAndRequireSuccess(t, srvConn.Close)
+
+	go func() {
+		pt := testutil.PanicT{}
+		srv := &dns.Conn{Conn: srvConn}
+
+		for {
+			req, err := srv.ReadMsg()
+			if err != nil {
+				return
+			}
+
+			require.NoError(pt, srv.WriteMsg(respondToTestMessage(req)))
+		}
+	}()
+
+	u := NewUpstreamFromConn(cliConn, &Options{Timeout: timeout})
+	assert.Equal(t, "pipe", u.Address())
+
+	for range 3 {
+		checkUpstream(t, u, u.Address())
+	}
+
+	require.NoError(t, u.Close())
+
+	_, err := cliConn.Write([]byte{0})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestNewUpstreamFromConn_timeout(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	testutil.CleanupAndRequireSuccess(t, srvConn.Close)
+
+	go func() {
+		// Read the request, but never respond.
+		_, _ = (&dns.Conn{Conn: srvConn}).ReadMsg()
+	}()
+
+	u := NewUpstreamFromConn(cliConn, &Options{Timeout: 100 * time.Millisecond})
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	resp, err := u.Exchange(createTestMessage())
+	require.Error(t, err)
+
+	assert.True(t, isTimeout(err))
+	assert.Nil(t, resp)
+}
@@ -0,0 +1,127 @@
+package upstream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// clientCookieLen is the length of the client cookie in bytes, as defined by
+// RFC 7873.
+const clientCookieLen = 8
+
+// Server cookie length limits in bytes, as defined by RFC 7873.
+const (
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+)
+
+// errCookieMismatch is returned when the response contains the client cookie
+// other than the one sent, which means that it's likely spoofed.
+const errCookieMismatch errors.Error = "client cookie mismatch"
+
+// cookieJar stores the DNS cookies, as defined by RFC 7873, used by a single
+// upstream.
+type cookieJar struct {
+	// mu protects servers.
+	mu *sync.Mutex
+
+	// servers maps the addresses of the servers to the hex-encoded server
+	// cookies received from them.
+	servers map[string]string
+
+	// client is the hex-encoded client cookie.  It's the same for all the
+	// servers.
+	client string
+}
+
+// newCookieJar returns a new cookie jar with a random client cookie.
+func newCookieJar() (j *cookieJar) {
+	cookie := make([]byte, clientCookieLen)
+	_, err := rand.Read(cookie)
+	if err != nil {
+		// Must not happen in normal circumstances.
+		panic(fmt.Errorf("dnsproxy: generating client cookie: %w", err))
+	}
+
+	return &cookieJar{
+		mu:      &sync.Mutex{},
+		servers: map[string]string{},
+		client:  hex.EncodeToString(cookie),
+	}
+}
+
+// attach returns a copy of req with the cookie option for server.  If req has
+// no OPT record or already has a cookie option, it's returned as is and ok is
+// false.
+func (j *cookieJar) attach(req *dns.Msg, server string) (creq *dns.Msg, ok bool) {
+	opt := req.IsEdns0()
+	if opt == nil || slices.ContainsFunc(opt.Option, isCookieOption) {
+		return req, false
+	}
+
+	j.mu.Lock()
+	cookie := j.client + j.servers[server]
+	j.mu.Unlock()
+
+	creq = req.Copy()
+	opt = creq.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: cookie,
+	})
+
+	return creq, true
+}
+
+// learn remembers the server cookie from resp received from server.  It
+// returns an error if resp contains a client cookie other than the one of j.
+func (j *cookieJar) learn(server string, resp *dns.Msg) (err error) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+
+		if !strings.EqualFold(c.Cookie[:min(len(c.Cookie), len(j.client))], j.client) {
+			return errCookieMismatch
+		}
+
+		serverCookie := c.Cookie[len(j.client):]
+		if l := len(serverCookie) / 2; l < minServerCookieLen || l > maxServerCookieLen {
+			return fmt.Errorf("bad server cookie length %d", l)
+		}
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		j.servers[server] = serverCookie
+
+		return nil
+	}
+
+	return nil
+}
+
+// isCookieOption returns true if o is the DNS cookie option.
+func isCookieOption(o dns.EDNS0) (ok bool) {
+	return o.Option() == dns.EDNS0COOKIE
+}
+
+// removeCookie removes the DNS cookie options from resp.
+func removeCookie(resp *dns.Msg) {
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, isCookieOption)
+	}
+}
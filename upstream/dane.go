@@ -0,0 +1,303 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// ErrDANEValidation is returned when the certificate of the server doesn't
+// match any of the DNSSEC-validated TLSA records of its hostname, or when those
+// records can't be looked up, see [Options.EnableDANE].
+const ErrDANEValidation errors.Error = "dane validation failed"
+
+// errDANEBootstrap is returned when [Options.EnableDANE] is set, but
+// [Options.Bootstrap] doesn't contain any upstream to look up the TLSA records
+// with.
+const errDANEBootstrap errors.Error = "dane requires an upstream bootstrap resolver"
+
+// errDANEIP is returned when [Options.EnableDANE] is set for the upstream
+// having an IP address instead of hostname.
+const errDANEIP errors.Error = "dane requires a hostname"
+
+// TLSA certificate usages, see RFC 6698, section 2.1.1.
+const (
+	tlsaUsagePKIXTA uint8 = 0
+	tlsaUsagePKIXEE uint8 = 1
+	tlsaUsageDANETA uint8 = 2
+	tlsaUsageDANEEE uint8 = 3
+)
+
+// daneVerifier verifies the certificates of the server against the TLSA
+// records of its hostname.
+type daneVerifier struct {
+	// ups looks up and validates the TLSA records.
+	ups *dnssecUpstream
+
+	// roots are the root certificates for the regular verification.  If nil,
+	// the system ones are used.
+	roots *x509.CertPool
+
+	// next, if not nil, is called after the successful verification.
+	next func(state tls.ConnectionState) (err error)
+
+	// name is the owner name of the TLSA records, e.g.
+	// "_853._tcp.dns.example.".
+	name string
+
+	// serverName is the name the certificates are verified against, where
+	// required.
+	serverName string
+
+	// timeout is the timeout for the TLSA lookup.
+	timeout time.Duration
+
+	// skipPKIX is true if the regular verification is disabled, see
+	// [Options.InsecureSkipVerify].
+	skipPKIX bool
+}
+
+// setDANEVerifier makes conf, created for the server at addr, verify the
+// certificates against the TLSA records looked up using the upstream of
+// opts.Bootstrap.  The regular verification, skipped by crypto/tls then, is
+// only performed when required by the records, or when they are insecure or
+// missing.
+func setDANEVerifier(addr *url.URL, opts *Options, conf *tls.Config) (err error) {
+	pins, err := newPinSet(opts.PinnedKeys)
+	if err != nil {
+		return fmt.Errorf("dane %s: %w", addr.Host, err)
+	}
+
+	next := opts.VerifyConnection
+	if len(pins) > 0 {
+		next = newPinVerifier(pins, next)
+	}
+
+	v, err := newDANEVerifier(addr, opts, conf.RootCAs, next)
+	if err != nil {
+		return err
+	}
+
+	// #nosec G402 -- The verification is performed by VerifyConnection.
+	conf.InsecureSkipVerify = true
+	conf.VerifyConnection = v.verify
+
+	return nil
+}
+
+// newDANEVerifier returns the verifier of the certificates of the server at
+// addr against the TLSA records looked up using the upstream of
+// opts.Bootstrap.  roots are used for the regular verification.  next, if not
+// nil, is called after the successful verification.
+func newDANEVerifier(
+	addr *url.URL,
+	opts *Options,
+	roots *x509.CertPool,
+	next func(state tls.ConnectionState) (err error),
+) (v *daneVerifier, err error) {
+	host := addr.Hostname()
+	if _, err = netip.ParseAddr(host); err == nil {
+		return nil, fmt.Errorf("dane %s: %w", addr.Host, errDANEIP)
+	}
+
+	bootUps := bootstrapUpstream(opts.Bootstrap)
+	if bootUps == nil {
+		return nil, fmt.Errorf("dane %s: %w", addr.Host, errDANEBootstrap)
+	}
+
+	name, err := dns.TLSAName(dns.Fqdn(host), addr.Port(), string(networkTCP))
+	if err != nil {
+		return nil, fmt.Errorf("dane %s: %w", addr.Host, err)
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = dialTimeout
+	}
+
+	return &daneVerifier{
+		ups:        newDNSSECUpstream(bootUps, opts),
+		roots:      roots,
+		next:       next,
+		name:       name,
+		serverName: serverName(addr, opts),
+		timeout:    timeout,
+		skipPKIX:   opts.InsecureSkipVerify,
+	}, nil
+}
+
+// bootstrapUpstream returns the first upstream used by r, or nil if there is
+// none.
+func bootstrapUpstream(r Resolver) (ups Upstream) {
+	switch r := r.(type) {
+	case *UpstreamResolver:
+		return r.Upstream
+	case *CachingResolver:
+		return r.resolver.Upstream
+	case ParallelResolver:
+		return firstBootstrapUpstream(r)
+	case ConsequentResolver:
+		return firstBootstrapUpstream(r)
+	default:
+		return nil
+	}
+}
+
+// firstBootstrapUpstream returns the first upstream used by any of rs, or nil
+// if there is none.
+func firstBootstrapUpstream(rs []Resolver) (ups Upstream) {
+	for _, r := range rs {
+		if ups = bootstrapUpstream(r); ups != nil {
+			return ups
+		}
+	}
+
+	return nil
+}
+
+// verify implements the [tls.Config.VerifyConnection] function for
+// *daneVerifier.  The certificates are only verified against the TLSA records if
+// those are secure, otherwise the verification falls back to the regular one.
+func (v *daneVerifier) verify(state tls.ConnectionState) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+
+	resp, secure, err := v.ups.lookup(ctx, v.name, dns.TypeTLSA)
+	if err != nil {
+		return fmt.Errorf("looking up %s: %w: %w", v.name, ErrDANEValidation, err)
+	}
+
+	var recs []*dns.TLSA
+	for _, rr := range resp.Answer {
+		if tlsa, ok := rr.(*dns.TLSA); ok {
+			recs = append(recs, tlsa)
+		}
+	}
+
+	if !secure || len(recs) == 0 {
+		log.Debug("dane %s: no secure tlsa records", v.name)
+
+		_, err = v.verifyPKIX(state.PeerCertificates)
+		if err != nil {
+			return err
+		}
+	} else if !v.matchTLSA(recs, state.PeerCertificates) {
+		return fmt.Errorf("%s: %w", v.name, ErrDANEValidation)
+	}
+
+	if v.next != nil {
+		return v.next(state)
+	}
+
+	return nil
+}
+
+// verifyPKIX performs the regular verification of certs, unless it's disabled,
+// and returns the verified chains.  If it's disabled, certs are returned as
+// the only chain.
+func (v *daneVerifier) verifyPKIX(
+	certs []*x509.Certificate,
+) (chains [][]*x509.Certificate, err error) {
+	if v.skipPKIX {
+		return [][]*x509.Certificate{certs}, nil
+	}
+
+	return verifyChain(v.serverName, v.roots, certs)
+}
+
+// matchTLSA returns true if certs, presented by the server, match any of recs,
+// as described by RFC 7671.  The regular verification is only performed for
+// the PKIX usages, the DANE-TA usage only requires the chain to the matching
+// certificate, and the DANE-EE usage only requires the leaf certificate to
+// match.
+func (v *daneVerifier) matchTLSA(recs []*dns.TLSA, certs []*x509.Certificate) (ok bool) {
+	if len(certs) == 0 {
+		return false
+	}
+
+	var pkixRecs []*dns.TLSA
+	for _, rec := range recs {
+		switch rec.Usage {
+		case tlsaUsageDANEEE:
+			if rec.Verify(certs[0]) == nil {
+				return true
+			}
+		case tlsaUsageDANETA:
+			if v.matchDANETA(rec, certs) {
+				return true
+			}
+		case tlsaUsagePKIXTA, tlsaUsagePKIXEE:
+			pkixRecs = append(pkixRecs, rec)
+		default:
+			// Skip the unknown usages, see RFC 6698, section 4.1.
+		}
+	}
+
+	if len(pkixRecs) == 0 {
+		return false
+	}
+
+	chains, err := v.verifyPKIX(certs)
+	if err != nil {
+		log.Debug("dane %s: %s", v.name, err)
+
+		return false
+	}
+
+	return slices.ContainsFunc(pkixRecs, func(rec *dns.TLSA) (matched bool) {
+		return matchPKIX(rec, chains)
+	})
+}
+
+// matchDANETA returns true if any of certs matches rec and the leaf
+// certificate chains up to it.
+func (v *daneVerifier) matchDANETA(rec *dns.TLSA, certs []*x509.Certificate) (ok bool) {
+	for _, cert := range certs {
+		if rec.Verify(cert) != nil {
+			continue
+		}
+
+		anchor := x509.NewCertPool()
+		anchor.AddCert(cert)
+
+		_, err := verifyChain(v.serverName, anchor, certs)
+		if err == nil {
+			return true
+		}
+
+		log.Debug("dane %s: trust anchor: %s", v.name, err)
+	}
+
+	return false
+}
+
+// matchPKIX returns true if rec with a PKIX usage matches the verified chains.
+// The end-entity usage only matches the leaf certificate.
+func matchPKIX(rec *dns.TLSA, chains [][]*x509.Certificate) (ok bool) {
+	for _, chain := range chains {
+		if rec.Usage == tlsaUsagePKIXEE {
+			if rec.Verify(chain[0]) == nil {
+				return true
+			}
+
+			continue
+		}
+
+		for _, cert := range chain {
+			if rec.Verify(cert) == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,190 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTLSA returns the TLSA record of usage for cert with name.
+func newTestTLSA(t *testing.T, name string, usage uint8, cert *x509.Certificate) (rr *dns.TLSA) {
+	t.Helper()
+
+	rr = &dns.TLSA{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTLSA,
+			Class:  dns.ClassINET,
+			Ttl:    300,
+		},
+	}
+
+	err := rr.Sign(int(usage), 1, 1, cert)
+	require.NoError(t, err)
+
+	return rr
+}
+
+// newTestCert returns the new self-signed certificate for name along with the
+// pool containing it.
+func newTestCert(t *testing.T, name string) (cert *x509.Certificate, pool *x509.CertPool) {
+	t.Helper()
+
+	conf, pool := createServerTLSConfig(t, name)
+	cert, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+
+	return cert, pool
+}
+
+func TestDANEVerifier(t *testing.T) {
+	// None of the certificates except trusted is trusted by the roots.
+	cert, _ := newTestCert(t, "dns.example")
+	otherCert, _ := newTestCert(t, "dns.example")
+	taCert, _ := newTestCert(t, "ta.example")
+	trusted, roots := newTestCert(t, "dns.insecure")
+	untrusted, _ := newTestCert(t, "dns.insecure")
+
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+
+	ds := example.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+
+	answers := map[dns.Question][]dns.RR{
+		{Name: ".", Qtype: dns.TypeDNSKEY}:        root.sign(t, root.key),
+		{Name: "example.", Qtype: dns.TypeDS}:     root.sign(t, ds),
+		{Name: "example.", Qtype: dns.TypeDNSKEY}: example.sign(t, example.key),
+		{Name: "_853._tcp.dns.example.", Qtype: dns.TypeTLSA}: example.sign(
+			t,
+			newTestTLSA(t, "_853._tcp.dns.example.", tlsaUsageDANEEE, cert),
+		),
+		{Name: "_853._tcp.ta.example.", Qtype: dns.TypeTLSA}: example.sign(
+			t,
+			newTestTLSA(t, "_853._tcp.ta.example.", tlsaUsageDANETA, taCert),
+		),
+		{Name: "_853._tcp.dns.insecure.", Qtype: dns.TypeTLSA}: {
+			newTestTLSA(t, "_853._tcp.dns.insecure.", tlsaUsageDANEEE, otherCert),
+		},
+	}
+
+	authorities := map[dns.Question][]dns.RR{
+		{Name: "insecure.", Qtype: dns.TypeDS}: root.sign(
+			t,
+			newTestRR(t, "insecure. 300 IN NSEC . NS RRSIG NSEC"),
+		),
+	}
+
+	boot := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "fake" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+
+			q := req.Question[0]
+			q = dns.Question{Name: strings.ToLower(q.Name), Qtype: q.Qtype}
+
+			if ans, ok := answers[q]; ok {
+				resp.Answer = ans
+			} else if ns, isNeg := authorities[q]; isNeg {
+				resp.Ns = ns
+			} else {
+				resp.Rcode = dns.RcodeServerFailure
+			}
+
+			return resp, nil
+		},
+		OnClose: func() (err error) { return nil },
+	}
+
+	opts := &Options{
+		Bootstrap:    &UpstreamResolver{Upstream: boot},
+		TrustAnchors: []*dns.DS{root.key.ToDS(dns.SHA256)},
+		Timeout:      timeout,
+	}
+
+	testCases := []struct {
+		wantErr error
+		cert    *x509.Certificate
+		name    string
+		host    string
+	}{{
+		wantErr: nil,
+		cert:    cert,
+		name:    "match",
+		host:    "dns.example",
+	}, {
+		wantErr: ErrDANEValidation,
+		cert:    otherCert,
+		name:    "mismatch",
+		host:    "dns.example",
+	}, {
+		wantErr: nil,
+		cert:    taCert,
+		name:    "dane_ta",
+		host:    "ta.example",
+	}, {
+		wantErr: ErrDANEValidation,
+		cert:    otherCert,
+		name:    "dane_ta_mismatch",
+		host:    "ta.example",
+	}, {
+		wantErr: nil,
+		cert:    trusted,
+		name:    "insecure",
+		host:    "dns.insecure",
+	}, {
+		wantErr: ErrDANEValidation,
+		cert:    cert,
+		name:    "lookup_failure",
+		host:    "dns.unknown.example",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &url.URL{Scheme: "tls", Host: tc.host + ":853"}
+
+			v, vErr := newDANEVerifier(u, opts, roots, nil)
+			require.NoError(t, vErr)
+
+			vErr = v.verify(tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{tc.cert},
+			})
+			assert.ErrorIs(t, vErr, tc.wantErr)
+		})
+	}
+
+	t.Run("insecure_untrusted", func(t *testing.T) {
+		u := &url.URL{Scheme: "tls", Host: "dns.insecure:853"}
+
+		v, vErr := newDANEVerifier(u, opts, roots, nil)
+		require.NoError(t, vErr)
+
+		vErr = v.verify(tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{untrusted},
+		})
+
+		var authErr x509.UnknownAuthorityError
+		assert.ErrorAs(t, vErr, &authErr)
+	})
+
+	t.Run("ip", func(t *testing.T) {
+		u := &url.URL{Scheme: "tls", Host: "127.0.0.1:853"}
+
+		_, vErr := newDANEVerifier(u, opts, roots, nil)
+		assert.ErrorIs(t, vErr, errDANEIP)
+	})
+
+	t.Run("no_bootstrap", func(t *testing.T) {
+		u := &url.URL{Scheme: "tls", Host: "dns.example:853"}
+
+		_, vErr := newDANEVerifier(u, &Options{}, roots, nil)
+		assert.ErrorIs(t, vErr, errDANEBootstrap)
+	})
+}
@@ -0,0 +1,183 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// dedupCall is an exchange shared by the identical queries in flight.
+type dedupCall struct {
+	// done is closed when the exchange is finished.
+	done chan struct{}
+
+	// cancel cancels the exchange.  It's called when all the waiters have
+	// left.
+	cancel context.CancelFunc
+
+	// resp is the response of the exchange, it must not be modified.  It's
+	// only accessed after done is closed.
+	resp *dns.Msg
+
+	// err is the error of the exchange.  It's only accessed after done is
+	// closed.
+	err error
+
+	// waiters is the number of the queries waiting for the exchange.  It's
+	// protected by the mutex of the dedupUpstream.
+	waiters int
+}
+
+// dedupUpstream is an [Upstream] coalescing the identical queries in flight
+// into a single exchange with the wrapped upstream.
+type dedupUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// mu protects calls and the waiters of each call.
+	mu *sync.Mutex
+
+	// calls are the exchanges in flight by the keys of their queries.
+	calls map[string]*dedupCall
+}
+
+// NewDedupUpstream returns u wrapped to coalesce the concurrent queries, which
+// are equal except for their IDs and the letter case of the question names,
+// into a single exchange.  The queries with different flags or EDNS options,
+// e.g. EDNS Client Subnet, aren't coalesced.  Each query receives its own copy
+// of the response.  The shared exchange is only cancelled once all the queries
+// waiting for it are cancelled.
+func NewDedupUpstream(u Upstream) (d Upstream) {
+	return &dedupUpstream{
+		wrapped: wrapped{ups: u},
+		mu:      &sync.Mutex{},
+		calls:   map[string]*dedupCall{},
+	}
+}
+
+// type check
+var _ Upstream = (*dedupUpstream)(nil)
+
+// Address implements the [Upstream] interface for *dedupUpstream.
+func (u *dedupUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *dedupUpstream.
+func (u *dedupUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *dedupUpstream.
+func (u *dedupUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	key, ok := dedupKey(req)
+	if !ok {
+		return u.ups.ExchangeContext(ctx, req)
+	}
+
+	c := u.join(ctx, key, req)
+
+	select {
+	case <-c.done:
+		// Go on.
+	case <-ctx.Done():
+		u.leave(key, c)
+
+		return nil, fmt.Errorf("waiting for exchange: %w", ctx.Err())
+	}
+
+	if c.resp == nil {
+		return nil, c.err
+	}
+
+	resp = c.resp.Copy()
+	resp.Id = req.Id
+	resp.Question = slices.Clone(req.Question)
+
+	return resp, c.err
+}
+
+// join returns the exchange in flight for key, starting it for req if there
+// is none.  The exchange isn't bound to the cancellation of ctx.
+func (u *dedupUpstream) join(ctx context.Context, key string, req *dns.Msg) (c *dedupCall) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c, ok := u.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &dedupCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		u.calls[key] = c
+
+		go u.do(callCtx, key, c, req.Copy())
+	}
+
+	c.waiters++
+
+	return c
+}
+
+// leave removes a waiter from c and cancels it if there are no more waiters.
+func (u *dedupUpstream) leave(key string, c *dedupCall) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c.waiters--
+	if c.waiters > 0 {
+		return
+	}
+
+	c.cancel()
+	if u.calls[key] == c {
+		delete(u.calls, key)
+	}
+}
+
+// do performs the exchange of c.  It's intended to be used as a goroutine.
+func (u *dedupUpstream) do(ctx context.Context, key string, c *dedupCall, req *dns.Msg) {
+	defer log.OnPanic("dedup upstream: exchanging")
+	defer c.cancel()
+
+	c.resp, c.err = u.ups.ExchangeContext(ctx, req)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.calls[key] == c {
+		delete(u.calls, key)
+	}
+
+	close(c.done)
+}
+
+// dedupKey returns the key of req identifying the queries, which are equal
+// except for their IDs and the letter case of the question names.  ok is false
+// if req shouldn't be coalesced with other queries.
+func dedupKey(req *dns.Msg) (key string, ok bool) {
+	if len(req.Question) != 1 {
+		return "", false
+	}
+
+	req = req.Copy()
+	req.Id = 0
+	req.Question[0].Name = strings.ToLower(req.Question[0].Name)
+
+	b, err := req.Pack()
+	if err != nil {
+		return "", false
+	}
+
+	return string(b), true
+}
+
+// Close implements the [Upstream] interface for *dedupUpstream.
+func (u *dedupUpstream) Close() (err error) { return u.ups.Close() }
@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBlockingUpstream returns a fake upstream responding to the test messages
+// once release is closed.  It also returns the pointer to the number of its
+// exchanges.
+func newBlockingUpstream(release <-chan struct{}) (u Upstream, exchanges *atomic.Int32) {
+	exchanges = &atomic.Int32{}
+
+	return &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "fake" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+			<-release
+
+			return respondToTestMessage(req), nil
+		},
+		OnClose: func() (err error) { return nil },
+	}, exchanges
+}
+
+// requireWaiters waits until there are n waiters for the exchange of req.
+func requireWaiters(t *testing.T, u *dedupUpstream, req *dns.Msg, n int) {
+	t.Helper()
+
+	key, ok := dedupKey(req)
+	require.True(t, ok)
+
+	require.Eventually(t, func() (ok bool) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		c := u.calls[key]
+
+		return c != nil && c.waiters == n
+	}, timeout, time.Millisecond)
+}
+
+func TestDedupUpstream(t *testing.T) {
+	t.Run("coalesced", func(t *testing.T) {
+		release := make(chan struct{})
+		fake, exchanges := newBlockingUpstream(release)
+		u := testutil.RequireTypeAssert[*dedupUpstream](t, NewDedupUpstream(fake))
+
+		const n = 10
+
+		reqs := make([]*dns.Msg, n)
+		resps := make([]*dns.Msg, n)
+		errs := make([]error, n)
+
+		wg := &sync.WaitGroup{}
+		for i := range n {
+			reqs[i] = createTestMessage()
+			reqs[i].Id = uint16(i + 1)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				resps[i], errs[i] = u.Exchange(reqs[i])
+			}()
+		}
+
+		requireWaiters(t, u, reqs[0], n)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), exchanges.Load())
+		for i := range n {
+			require.NoError(t, errs[i])
+			requireResponse(t, reqs[i], resps[i])
+		}
+
+		resps[0].Answer = nil
+		assert.NotEmpty(t, resps[1].Answer)
+	})
+
+	t.Run("cancelled_waiter", func(t *testing.T) {
+		release := make(chan struct{})
+		fake, exchanges := newBlockingUpstream(release)
+		u := testutil.RequireTypeAssert[*dedupUpstream](t, NewDedupUpstream(fake))
+
+		req := createTestMessage()
+		ctx, cancel := context.WithCancel(context.Background())
+
+		cancelledErrCh := make(chan error, 1)
+		go func() {
+			_, err := u.ExchangeContext(ctx, req)
+			cancelledErrCh <- err
+		}()
+
+		requireWaiters(t, u, req, 1)
+
+		type result struct {
+			resp *dns.Msg
+			err  error
+		}
+
+		resCh := make(chan result, 1)
+		go func() {
+			resp, err := u.Exchange(req)
+			resCh <- result{resp: resp, err: err}
+		}()
+
+		requireWaiters(t, u, req, 2)
+
+		cancel()
+		err, _ := testutil.RequireReceive(t, cancelledErrCh, timeout)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		close(release)
+		res, _ := testutil.RequireReceive(t, resCh, timeout)
+		require.NoError(t, res.err)
+		requireResponse(t, req, res.resp)
+
+		assert.Equal(t, int32(1), exchanges.Load())
+	})
+
+	t.Run("different_options", func(t *testing.T) {
+		release := make(chan struct{})
+		fake, exchanges := newBlockingUpstream(release)
+		u := testutil.RequireTypeAssert[*dedupUpstream](t, NewDedupUpstream(fake))
+
+		subnets := []netip.Prefix{
+			netip.MustParsePrefix("1.2.3.0/24"),
+			netip.MustParsePrefix("4.3.2.0/24"),
+		}
+
+		wg := &sync.WaitGroup{}
+		for _, subnet := range subnets {
+			req := createTestMessage()
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: uint8(subnet.Bits()),
+				Address:       subnet.Addr().AsSlice(),
+			})
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				_, err := u.Exchange(req)
+				assert.NoError(t, err)
+			}()
+
+			requireWaiters(t, u, req, 1)
+		}
+
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(2), exchanges.Load())
+	})
+}
@@ -0,0 +1,79 @@
+package upstream
+
+import (
+	cryptorand "crypto/rand"
+	"fmt"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// withRandomCase returns a copy of req with the letters of the question name
+// randomly switched to upper or lower case, as described by the 0x20 encoding
+// draft, see [Options.EnableDNS0x20].  qname is the original question name, it
+// is empty and req is returned as is if there is nothing to randomize.
+func withRandomCase(req *dns.Msg) (randReq *dns.Msg, qname string) {
+	if len(req.Question) != 1 {
+		return req, ""
+	}
+
+	qname = req.Question[0].Name
+	name := []byte(qname)
+
+	bits := make([]byte, (len(name)+7)/8)
+	_, err := cryptorand.Read(bits)
+	if err != nil {
+		// Must not happen in normal circumstances.
+		panic(fmt.Errorf("dnsproxy: randomizing name case: %w", err))
+	}
+
+	for i, c := range name {
+		if bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+
+		switch {
+		case c >= 'a' && c <= 'z':
+			name[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			name[i] = c - 'A' + 'a'
+		}
+	}
+
+	// Only the question section is changed, so don't copy the records.
+	randReq = &dns.Msg{}
+	*randReq = *req
+	randReq.Question = slices.Clone(req.Question)
+	randReq.Question[0].Name = string(name)
+
+	return randReq, qname
+}
+
+// matchCase returns an error if the question name of resp isn't exactly the
+// same as the one of req, including the case.  req and resp must have a single
+// question.
+func matchCase(req, resp *dns.Msg) (err error) {
+	if name := resp.Question[0].Name; name != req.Question[0].Name {
+		return fmt.Errorf("%w: mismatched name case %q", errQuestion, name)
+	}
+
+	return nil
+}
+
+// restoreCase replaces the randomized question name in resp and the names of
+// the records equal to it with qname.
+func restoreCase(resp *dns.Msg, randName, qname string) {
+	for i, q := range resp.Question {
+		if q.Name == randName {
+			resp.Question[i].Name = qname
+		}
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Name == randName {
+				hdr.Name = qname
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// dns64WellKnownPrefix is the default NAT64 prefix, see RFC 6052, Section 2.1.
+var dns64WellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// dns64Upstream is an [Upstream] synthesizing the AAAA records from the A ones,
+// as defined by RFC 6147.
+type dns64Upstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// prefix is the NAT64 prefix the IPv4 addresses are embedded into.
+	prefix netip.Prefix
+}
+
+// NewDNS64Upstream returns u wrapped to synthesize the AAAA records from the A
+// ones, when the successful responses to the AAAA queries contain none.  The A
+// queries are sent concurrently with the AAAA ones.  The IPv4 addresses are
+// embedded into the last 32 bits of prefix, which must be an IPv6 prefix of at
+// most 96 bits.  If prefix isn't valid, the Well-Known Prefix 64:ff9b::/96 is
+// used.  The synthesized records have the TTLs of the A records.
+func NewDNS64Upstream(u Upstream, prefix netip.Prefix) (d Upstream) {
+	if !prefix.IsValid() {
+		prefix = dns64WellKnownPrefix
+	}
+
+	return &dns64Upstream{
+		wrapped: wrapped{ups: u},
+		prefix:  prefix.Masked(),
+	}
+}
+
+// type check
+var _ Upstream = (*dns64Upstream)(nil)
+
+// Address implements the [Upstream] interface for *dns64Upstream.
+func (u *dns64Upstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *dns64Upstream.
+func (u *dns64Upstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *dns64Upstream.
+func (u *dns64Upstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if len(req.Question) != 1 {
+		return u.ups.ExchangeContext(ctx, req)
+	}
+
+	q := req.Question[0]
+	if q.Qtype != dns.TypeAAAA || q.Qclass != dns.ClassINET {
+		// DNS64 operation for classes other than IN is undefined.
+		return u.ups.ExchangeContext(ctx, req)
+	}
+
+	aCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	aRespCh := make(chan *dns.Msg, 1)
+	go u.exchangeA(aCtx, req, aRespCh)
+
+	resp, err = u.ups.ExchangeContext(ctx, req)
+	if err != nil || resp.Rcode != dns.RcodeSuccess || hasAAAA(resp) {
+		return resp, err
+	}
+
+	var aResp *dns.Msg
+	select {
+	case aResp = <-aRespCh:
+		// Go on.
+	case <-ctx.Done():
+		return resp, nil
+	}
+
+	if aResp != nil {
+		u.synthesize(resp, aResp)
+	}
+
+	return resp, nil
+}
+
+// exchangeA sends the A query for the question of req and sends the successful
+// response to respCh, or nil if there is none.  It's intended to be used as a
+// goroutine.
+func (u *dns64Upstream) exchangeA(ctx context.Context, req *dns.Msg, respCh chan<- *dns.Msg) {
+	defer log.OnPanic("dns64 upstream: exchanging")
+
+	aReq := req.Copy()
+	aReq.Id = dns.Id()
+	aReq.Question[0].Qtype = dns.TypeA
+
+	resp, err := u.ups.ExchangeContext(ctx, aReq)
+	if err != nil {
+		log.Debug("dns64 %s: exchanging a: %s", u.ups.Address(), err)
+
+		respCh <- nil
+	} else if resp.Rcode != dns.RcodeSuccess {
+		respCh <- nil
+	} else {
+		respCh <- resp
+	}
+}
+
+// synthesize replaces the answer section of resp with the AAAA records
+// synthesized from the A records of aResp, if there are any.
+func (u *dns64Upstream) synthesize(resp, aResp *dns.Msg) {
+	ans := make([]dns.RR, 0, len(aResp.Answer))
+	var synthesized bool
+	for _, rr := range aResp.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			// Keep the CNAME and DNAME records leading to the A ones.
+			ans = append(ans, rr)
+
+			continue
+		}
+
+		ip, ok := netip.AddrFromSlice(a.A)
+		if !ok || !ip.Unmap().Is4() {
+			continue
+		}
+
+		ans = append(ans, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   a.Hdr.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  a.Hdr.Class,
+				Ttl:    a.Hdr.Ttl,
+			},
+			AAAA: u.mapAddr(ip.Unmap()),
+		})
+		synthesized = true
+	}
+
+	if synthesized {
+		resp.Answer = ans
+		resp.Ns = aResp.Ns
+	}
+}
+
+// mapAddr embeds ip into the prefix of u.  ip must be a valid IPv4 address.
+func (u *dns64Upstream) mapAddr(ip netip.Addr) (mapped net.IP) {
+	prefixData := u.prefix.Addr().As16()
+	ipData := ip.As4()
+
+	mapped = make(net.IP, net.IPv6len)
+	copy(mapped, prefixData[:net.IPv6len-net.IPv4len])
+	copy(mapped[net.IPv6len-net.IPv4len:], ipData[:])
+
+	return mapped
+}
+
+// hasAAAA returns true if resp contains AAAA records in its answer section.
+func hasAAAA(resp *dns.Msg) (ok bool) {
+	for _, rr := range resp.Answer {
+		if _, ok = rr.(*dns.AAAA); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close implements the [Upstream] interface for *dns64Upstream.
+func (u *dns64Upstream) Close() (err error) { return u.ups.Close() }
@@ -0,0 +1,108 @@
+package upstream
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNS64Upstream(t *testing.T) {
+	const (
+		host = "dns64.example."
+		ttl  = 42
+	)
+
+	ip4 := net.IP{1, 2, 3, 4}
+	ip6 := netip.MustParseAddr("2001:db8::1")
+
+	// newFake returns a fake upstream responding to the A queries with ip4
+	// and to the AAAA queries with ip6, if withAAAA is true.
+	newFake := func(withAAAA bool) (u Upstream) {
+		return &dnsproxytest.FakeUpstream{
+			OnAddress: func() (addr string) { return "fake" },
+			OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				resp = (&dns.Msg{}).SetReply(req)
+				hdr := dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: req.Question[0].Qtype,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				}
+
+				switch req.Question[0].Qtype {
+				case dns.TypeA:
+					resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip4}}
+				case dns.TypeAAAA:
+					if withAAAA {
+						resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip6.AsSlice()}}
+					}
+				}
+
+				return resp, nil
+			},
+			OnClose: func() (err error) { return nil },
+		}
+	}
+
+	testCases := []struct {
+		prefix   netip.Prefix
+		name     string
+		want     netip.Addr
+		withAAAA bool
+	}{{
+		prefix:   netip.Prefix{},
+		name:     "well_known",
+		want:     netip.MustParseAddr("64:ff9b::102:304"),
+		withAAAA: false,
+	}, {
+		prefix:   netip.MustParsePrefix("2001:db8:64::/96"),
+		name:     "custom",
+		want:     netip.MustParseAddr("2001:db8:64::102:304"),
+		withAAAA: false,
+	}, {
+		prefix:   netip.Prefix{},
+		name:     "real_aaaa",
+		want:     ip6,
+		withAAAA: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := NewDNS64Upstream(newFake(tc.withAAAA), tc.prefix)
+
+			req := (&dns.Msg{}).SetQuestion(host, dns.TypeAAAA)
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, req.Id, resp.Id)
+			require.Len(t, resp.Answer, 1)
+
+			aaaa, ok := resp.Answer[0].(*dns.AAAA)
+			require.True(t, ok)
+
+			assert.Equal(t, uint32(ttl), aaaa.Hdr.Ttl)
+			assert.Equal(t, host, aaaa.Hdr.Name)
+
+			got, ok := netip.AddrFromSlice(aaaa.AAAA)
+			require.True(t, ok)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	t.Run("a_query", func(t *testing.T) {
+		u := NewDNS64Upstream(newFake(false), netip.Prefix{})
+
+		resp, err := u.Exchange((&dns.Msg{}).SetQuestion(host, dns.TypeA))
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1)
+
+		assert.IsType(t, (*dns.A)(nil), resp.Answer[0])
+	})
+}
@@ -1,13 +1,16 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net/netip"
 	"net/url"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
@@ -28,33 +31,99 @@ type dnsCrypt struct {
 	// addr is the DNSCrypt server URL.
 	addr *url.URL
 
+	// rttStats measures the round-trip time of the exchanges.
+	*rttStats
+
 	// verifyCert is a callback that verifies the resolver's certificate.
 	verifyCert func(cert *dnscrypt.Cert) (err error)
 
+	// binding is the local endpoint the exchange connections are bound to.
+	// It's nil if the connections aren't bound.
+	binding *bootstrap.Binding
+
+	// relays are the anonymized DNSCrypt relays to send the queries through.
+	// If empty, the queries are sent to the server directly.
+	relays []netip.AddrPort
+
 	// timeout is the timeout for the DNS requests.
 	timeout time.Duration
+
+	// probeTimeout is the timeout of the health-check probes.
+	probeTimeout time.Duration
+
+	// active tracks the exchanges in flight, so that Close waits for them.
+	active *inflight
+
+	// onDial, if not nil, is called after each dialing attempt.  It's set
+	// before the upstream is used and is never changed afterwards.
+	onDial func(err error)
+
+	// forceRD is true if the RD bit should be set in the outgoing queries.
+	forceRD bool
 }
 
 // newDNSCrypt returns a new DNSCrypt Upstream.
-func newDNSCrypt(addr *url.URL, opts *Options) (u *dnsCrypt) {
-	return &dnsCrypt{
-		mu:         &sync.RWMutex{},
-		addr:       addr,
-		verifyCert: opts.VerifyDNSCryptCertificate,
-		timeout:    opts.Timeout,
+func newDNSCrypt(addr *url.URL, opts *Options) (u *dnsCrypt, err error) {
+	var relays []netip.AddrPort
+	for i, r := range opts.DNSCryptRelays {
+		var relay netip.AddrPort
+		relay, err = parseDNSCryptRelay(r)
+		if err != nil {
+			return nil, fmt.Errorf("dnscrypt relay at index %d: %w", i, err)
+		}
+
+		relays = append(relays, relay)
 	}
+
+	return &dnsCrypt{
+		mu:           &sync.RWMutex{},
+		addr:         addr,
+		rttStats:     newRTTStats(opts),
+		verifyCert:   opts.VerifyDNSCryptCertificate,
+		binding:      newBinding(opts),
+		relays:       relays,
+		timeout:      opts.Timeout,
+		forceRD:      !opts.PreserveRecursionDesired,
+		probeTimeout: opts.ProbeTimeout,
+		active:       newInflight(opts),
+	}, nil
 }
 
 // type check
-var _ Upstream = (*dnsCrypt)(nil)
+var _ UpstreamWithStats = (*dnsCrypt)(nil)
 
 // Address implements the [Upstream] interface for *dnsCrypt.
 func (p *dnsCrypt) Address() string { return p.addr.String() }
 
+// type check
+var _ ProtocolUpstream = (*dnsCrypt)(nil)
+
+// Protocol implements the [ProtocolUpstream] interface for *dnsCrypt.
+func (p *dnsCrypt) Protocol() (proto Protocol) { return ProtocolDNSCrypt }
+
 // Exchange implements the [Upstream] interface for *dnsCrypt.
 func (p *dnsCrypt) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
-	resp, err = p.exchangeDNSCrypt(m)
-	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext implements the [Upstream] interface for *dnsCrypt.  Note that
+// fetching the server certificate isn't aborted when ctx is done.
+func (p *dnsCrypt) ExchangeContext(ctx context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
+	defer func() { err = classifyError(err) }()
+
+	err = p.active.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer p.active.end()
+
+	restoreRD := forceRecursionDesired(m, p.forceRD)
+	defer func() { restoreRD(resp) }()
+
+	resp, err = p.exchangeDNSCrypt(ctx, m)
+	if ctx.Err() != nil {
+		return resp, err
+	} else if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) {
 		// If request times out, it is possible that the server configuration
 		// has been changed.  It is safe to assume that the key was rotated, see
 		// https://dnscrypt.pl/2017/02/26/how-key-rotation-is-automated.
@@ -64,19 +133,35 @@ func (p *dnsCrypt) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 			return nil, err
 		}
 
-		return p.exchangeDNSCrypt(m)
+		return p.exchangeDNSCrypt(ctx, m)
 	}
 
 	return resp, err
 }
 
+// type check
+var _ timeoutUpstream = (*dnsCrypt)(nil)
+
+// exchangeTimeout implements the [timeoutUpstream] interface for *dnsCrypt.
+func (p *dnsCrypt) exchangeTimeout() (d time.Duration) { return p.timeout }
+
 // Close implements the [Upstream] interface for *dnsCrypt.
 func (p *dnsCrypt) Close() (err error) {
+	p.active.shutdown()
+
 	return nil
 }
 
+// type check
+var _ ProbableUpstream = (*dnsCrypt)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *dnsCrypt.
+func (p *dnsCrypt) Probe(ctx context.Context) (err error) {
+	return probe(ctx, p, p.probeTimeout)
+}
+
 // exchangeDNSCrypt attempts to send the DNS query and returns the response.
-func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (resp *dns.Msg, err error) {
+func (p *dnsCrypt) exchangeDNSCrypt(ctx context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
 	var client *dnscrypt.Client
 	var resolverInfo *dnscrypt.ResolverInfo
 	func() {
@@ -104,19 +189,78 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (resp *dns.Msg, err error) {
 		// Go on.
 	}
 
-	resp, err = client.Exchange(m, resolverInfo)
+	start := time.Now()
+
+	resp, err = p.exchangeContext(ctx, client, m, resolverInfo)
 	if resp != nil && resp.Truncated {
 		q := &m.Question[0]
 		log.Debug("dnscrypt %s: received truncated, falling back to tcp with %s", p.addr, q)
 
 		tcpClient := &dnscrypt.Client{Timeout: p.timeout, Net: networkTCP}
-		resp, err = tcpClient.Exchange(m, resolverInfo)
+		resp, err = p.exchangeContext(ctx, tcpClient, m, resolverInfo)
 	}
-	if err == nil && resp != nil && resp.Id != m.Id {
-		err = dns.ErrId
+	if err != nil {
+		return resp, err
+	} else if resp != nil && resp.Id != m.Id {
+		return resp, dns.ErrId
 	}
 
-	return resp, err
+	p.update(time.Since(start))
+
+	return resp, nil
+}
+
+// exchangeContext is like [dnscrypt.Client.Exchange], but it closes the
+// connection as soon as ctx is done.  It sends m through a relay if p has any.
+func (p *dnsCrypt) exchangeContext(
+	ctx context.Context,
+	client *dnscrypt.Client,
+	m *dns.Msg,
+	ri *dnscrypt.ResolverInfo,
+) (resp *dns.Msg, err error) {
+	n := networkUDP
+	if client.Net == networkTCP {
+		n = networkTCP
+	}
+
+	addr, relay := ri.ServerAddress, p.relay()
+	if relay.IsValid() {
+		addr = relay.String()
+	}
+
+	dial := bootstrap.NewDialContext(0, p.binding, addr)
+	conn, err := dial(ctx, n, "")
+	if p.onDial != nil {
+		p.onDial(err)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("dialing: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, closeConn(conn)) }()
+
+	stop := abortOnDone(ctx, conn)
+	if relay.IsValid() {
+		resp, err = p.exchangeRelayed(conn, n, m, ri)
+	} else {
+		resp, err = client.ExchangeConn(conn, m, ri)
+	}
+
+	if abortErr := stop(); abortErr != nil {
+		return nil, abortErr
+	} else if err != nil {
+		return nil, fmt.Errorf("exchanging: %w", err)
+	}
+
+	return resp, nil
+}
+
+// type check
+var _ dialReporter = (*dnsCrypt)(nil)
+
+// setOnDial implements the [dialReporter] interface for *dnsCrypt.
+func (p *dnsCrypt) setOnDial(onDial func(err error)) {
+	p.onDial = onDial
 }
 
 // resetClient renews the DNSCrypt client and server properties and also sets
@@ -133,7 +277,12 @@ func (p *dnsCrypt) resetClient() (client *dnscrypt.Client, ri *dnscrypt.Resolver
 
 	// Use UDP for DNSCrypt upstreams by default.
 	client = &dnscrypt.Client{Timeout: p.timeout, Net: networkUDP}
-	ri, err = client.Dial(addr)
+	if len(p.relays) > 0 {
+		ri, err = p.dialRelayed(addr)
+	} else {
+		ri, err = client.Dial(addr)
+	}
+
 	if err != nil {
 		// Trigger client and server info renewal on the next request.
 		client, ri = nil, nil
@@ -2,7 +2,10 @@ package upstream
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"net"
+	"net/netip"
 	"os"
 	"strings"
 	"sync/atomic"
@@ -227,3 +230,128 @@ func TestDNSCrypt_Exchange_dialFail(t *testing.T) {
 		assert.Nil(t, res)
 	})
 }
+
+// startTestDNSCryptRelay starts a test anonymized DNSCrypt relay over UDP and
+// returns its address.  relayed is incremented for each relayed packet.
+func startTestDNSCryptRelay(t testing.TB, relayed *atomic.Uint32) (addr netip.AddrPort) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: netutil.IPv4Localhost().AsSlice()})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	const hdrLen = len(dnsCryptRelayMagic) + 18
+
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, client, rErr := conn.ReadFromUDPAddrPort(buf)
+			if rErr != nil {
+				return
+			}
+
+			pkt := buf[:n]
+			require.GreaterOrEqual(testutil.PanicT{}, n, hdrLen)
+			require.Equal(testutil.PanicT{}, dnsCryptRelayMagic[:], pkt[:len(dnsCryptRelayMagic)])
+
+			ip := netip.AddrFrom16([16]byte(pkt[len(dnsCryptRelayMagic) : hdrLen-2])).Unmap()
+			port := binary.BigEndian.Uint16(pkt[hdrLen-2 : hdrLen])
+			relayed.Add(1)
+
+			srv, dErr := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port)))
+			require.NoError(testutil.PanicT{}, dErr)
+
+			_, dErr = srv.Write(pkt[hdrLen:])
+			require.NoError(testutil.PanicT{}, dErr)
+
+			resp := make([]byte, dns.MaxMsgSize)
+			l, dErr := srv.Read(resp)
+			require.NoError(testutil.PanicT{}, dErr)
+			require.NoError(testutil.PanicT{}, srv.Close())
+
+			_, _ = conn.WriteToUDPAddrPort(resp[:l], client)
+		}
+	}()
+
+	return testutil.RequireTypeAssert[*net.UDPAddr](t, conn.LocalAddr()).AddrPort()
+}
+
+func TestDNSCrypt_Exchange_relay(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	require.NoError(t, err)
+
+	h := dnsCryptHandlerFunc(func(w dnscrypt.ResponseWriter, r *dns.Msg) (err error) {
+		return w.WriteMsg(respondToTestMessage(r))
+	})
+	srvStamp := startTestDNSCryptServer(t, rc, h)
+
+	var relayed atomic.Uint32
+	relayAddr := startTestDNSCryptRelay(t, &relayed)
+
+	addrBytes := []byte(relayAddr.String())
+	relayStamp := "sdns://" + base64.RawURLEncoding.EncodeToString(
+		append([]byte{dnsCryptRelayStampProto, byte(len(addrBytes))}, addrBytes...),
+	)
+
+	for _, relay := range []string{relayStamp, relayAddr.String()} {
+		t.Run(relay, func(t *testing.T) {
+			relayed.Store(0)
+
+			u, uErr := AddressToUpstream(srvStamp.String(), &Options{
+				Timeout:        timeout,
+				DNSCryptRelays: []string{relay},
+			})
+			require.NoError(t, uErr)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, srvStamp.String())
+
+			// The certificate request and the query itself.
+			assert.Equal(t, 2, int(relayed.Load()))
+		})
+	}
+}
+
+func TestParseDNSCryptRelay(t *testing.T) {
+	testCases := []struct {
+		want       netip.AddrPort
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		want:       netip.MustParseAddrPort("1.2.3.4:443"),
+		name:       "ip",
+		in:         "1.2.3.4",
+		wantErrMsg: "",
+	}, {
+		want:       netip.MustParseAddrPort("[::1]:5353"),
+		name:       "ip_port",
+		in:         "[::1]:5353",
+		wantErrMsg: "",
+	}, {
+		// 0x81, 0x0b, "1.2.3.4:443".
+		want:       netip.MustParseAddrPort("1.2.3.4:443"),
+		name:       "stamp",
+		in:         "sdns://gQsxLjIuMy40OjQ0Mw",
+		wantErrMsg: "",
+	}, {
+		want:       netip.AddrPort{},
+		name:       "server_stamp",
+		in:         "sdns://AQcAAAAAAAAADTEyNy4wLjAuMTo0NDM",
+		wantErrMsg: "not a dnscrypt relay stamp",
+	}, {
+		want: netip.AddrPort{},
+		name: "hostname",
+		in:   "relay.example",
+		wantErrMsg: `bad relay address "relay.example": ParseAddr("relay.example"): ` +
+			`unexpected character (at "relay.example")`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, err := parseDNSCryptRelay(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.want, addr)
+		})
+	}
+}
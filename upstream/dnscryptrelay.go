@@ -0,0 +1,360 @@
+package upstream
+
+import (
+	"context"
+	"crypto/ecdh"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// dnsCryptRelayStampProto is the protocol identifier of the anonymized DNSCrypt
+// relay stamps, see https://dnscrypt.info/stamps-specifications.
+const dnsCryptRelayStampProto byte = 0x81
+
+// defaultPortDNSCryptRelay is the default port of the anonymized DNSCrypt
+// relays.
+const defaultPortDNSCryptRelay uint16 = 443
+
+// dnsCryptRelayMagic is the prefix of the anonymized DNSCrypt queries, see
+// https://github.com/DNSCrypt/dnscrypt-protocol/blob/master/ANONYMIZED-DNSCRYPT.txt.
+var dnsCryptRelayMagic = [...]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+// parseDNSCryptRelay parses the address of the anonymized DNSCrypt relay from
+// s, which is either a relay stamp or an IP address with an optional port.
+func parseDNSCryptRelay(s string) (addr netip.AddrPort, err error) {
+	host := s
+	if b64, ok := strings.CutPrefix(s, "sdns://"); ok {
+		var bin []byte
+		bin, err = base64.RawURLEncoding.DecodeString(b64)
+		if err != nil {
+			return addr, fmt.Errorf("decoding relay stamp: %w", err)
+		}
+
+		if len(bin) < 2 || bin[0] != dnsCryptRelayStampProto {
+			return addr, errors.Error("not a dnscrypt relay stamp")
+		}
+
+		l := int(bin[1])
+		if len(bin) != 2+l {
+			return addr, errors.Error("bad relay stamp address length")
+		}
+
+		host = string(bin[2:])
+	}
+
+	addr, err = netip.ParseAddrPort(host)
+	if err == nil {
+		return addr, nil
+	}
+
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	if err != nil {
+		return addr, fmt.Errorf("bad relay address %q: %w", host, err)
+	}
+
+	return netip.AddrPortFrom(ip, defaultPortDNSCryptRelay), nil
+}
+
+// appendRelayHeader appends the anonymized DNSCrypt header addressing server to
+// b.
+func appendRelayHeader(b []byte, server netip.AddrPort) (res []byte) {
+	ip := server.Addr().Unmap().As16()
+
+	res = append(b, dnsCryptRelayMagic[:]...)
+	res = append(res, ip[:]...)
+
+	return binary.BigEndian.AppendUint16(res, server.Port())
+}
+
+// relay returns a random relay of p.  It returns an invalid address if p
+// doesn't use relays.
+func (p *dnsCrypt) relay() (addr netip.AddrPort) {
+	if len(p.relays) == 0 {
+		return addr
+	}
+
+	return p.relays[rand.IntN(len(p.relays))]
+}
+
+// relayedPacket returns the packet wrapping msg with the anonymized DNSCrypt
+// header addressing server.  The packet is prefixed with its length for TCP.
+func relayedPacket(n network, server netip.AddrPort, msg []byte) (pkt []byte) {
+	pkt = make([]byte, 0, 2+len(dnsCryptRelayMagic)+18+len(msg))
+	if n == networkTCP {
+		pkt = binary.BigEndian.AppendUint16(pkt, uint16(len(dnsCryptRelayMagic)+18+len(msg)))
+	}
+
+	pkt = appendRelayHeader(pkt, server)
+
+	return append(pkt, msg...)
+}
+
+// readRelayed reads the response to the relayed query from conn of network n.
+func readRelayed(conn net.Conn, n network) (resp []byte, err error) {
+	if n == networkTCP {
+		var l uint16
+		err = binary.Read(conn, binary.BigEndian, &l)
+		if err != nil {
+			return nil, fmt.Errorf("reading length: %w", err)
+		}
+
+		resp = make([]byte, l)
+		_, err = io.ReadFull(conn, resp)
+
+		return resp, err
+	}
+
+	resp = make([]byte, dns.MaxMsgSize)
+	l, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp[:l], nil
+}
+
+// exchangeRelayed sends m encrypted with ri over conn to the relay and returns
+// the decrypted response.
+func (p *dnsCrypt) exchangeRelayed(
+	conn net.Conn,
+	n network,
+	m *dns.Msg,
+	ri *dnscrypt.ResolverInfo,
+) (resp *dns.Msg, err error) {
+	server, err := netip.ParseAddrPort(ri.ServerAddress)
+	if err != nil {
+		return nil, fmt.Errorf("parsing server address: %w", err)
+	}
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	q := &dnscrypt.EncryptedQuery{
+		EsVersion:   ri.ResolverCert.EsVersion,
+		ClientMagic: ri.ResolverCert.ClientMagic,
+		ClientPk:    ri.PublicKey,
+	}
+
+	encrypted, err := q.Encrypt(packed, ri.SharedKey)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting: %w", err)
+	}
+
+	if p.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(p.timeout))
+	}
+
+	_, err = conn.Write(relayedPacket(n, server, encrypted))
+	if err != nil {
+		return nil, fmt.Errorf("writing: %w", err)
+	}
+
+	b, err := readRelayed(conn, n)
+	if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	r := &dnscrypt.EncryptedResponse{EsVersion: ri.ResolverCert.EsVersion}
+	decrypted, err := r.Decrypt(b, ri.SharedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %w", err)
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking: %w", err)
+	}
+
+	return resp, nil
+}
+
+// dialRelayed fetches the certificate of the DNSCrypt server described by
+// stampStr through a relay and returns the server information to exchange
+// with it.
+func (p *dnsCrypt) dialRelayed(stampStr string) (ri *dnscrypt.ResolverInfo, err error) {
+	stamp, err := dnsstamps.NewServerStampFromString(stampStr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing stamp: %w", err)
+	}
+
+	server, err := netip.ParseAddrPort(stamp.ServerAddrStr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing server address: %w", err)
+	}
+
+	cert, err := p.fetchCertRelayed(stamp, server)
+	if err != nil {
+		return nil, fmt.Errorf("fetching cert: %w", err)
+	}
+
+	sk, err := ecdh.X25519().GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	ri = &dnscrypt.ResolverInfo{
+		ServerPublicKey: stamp.ServerPk,
+		ServerAddress:   stamp.ServerAddrStr,
+		ProviderName:    stamp.ProviderName,
+		ResolverCert:    cert,
+	}
+	copy(ri.SecretKey[:], sk.Bytes())
+	copy(ri.PublicKey[:], sk.PublicKey().Bytes())
+
+	switch cert.EsVersion {
+	case dnscrypt.XChacha20Poly1305:
+		ri.SharedKey, err = xsecretbox.SharedKey(ri.SecretKey, cert.ResolverPk)
+		if err != nil {
+			return nil, fmt.Errorf("computing shared key: %w", err)
+		}
+	case dnscrypt.XSalsa20Poly1305:
+		box.Precompute(&ri.SharedKey, &cert.ResolverPk, &ri.SecretKey)
+	default:
+		return nil, fmt.Errorf("unsupported es version %s", cert.EsVersion)
+	}
+
+	return ri, nil
+}
+
+// fetchCertRelayed requests the certificates of the DNSCrypt server described
+// by stamp through a relay and returns the preferred valid one.
+func (p *dnsCrypt) fetchCertRelayed(
+	stamp dnsstamps.ServerStamp,
+	server netip.AddrPort,
+) (cert *dnscrypt.Cert, err error) {
+	providerName := dns.Fqdn(stamp.ProviderName)
+	req := (&dns.Msg{}).SetQuestion(providerName, dns.TypeTXT)
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing query: %w", err)
+	}
+
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	dial := bootstrap.NewDialContext(p.timeout, p.binding, p.relay().String())
+	conn, err := dial(ctx, networkUDP, "")
+	if err != nil {
+		return nil, fmt.Errorf("dialing relay: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, closeConn(conn)) }()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	_, err = conn.Write(relayedPacket(networkUDP, server, packed))
+	if err != nil {
+		return nil, fmt.Errorf("writing query: %w", err)
+	}
+
+	b, err := readRelayed(conn, networkUDP)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	resp := &dns.Msg{}
+	err = resp.Unpack(b)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response: %w", err)
+	} else if resp.Id != req.Id {
+		return nil, dns.ErrId
+	} else if resp.Rcode != dns.RcodeSuccess {
+		return nil, dnscrypt.ErrFailedToFetchCert
+	}
+
+	return preferredCert(stamp, resp.Answer)
+}
+
+// preferredCert returns the valid certificate from the TXT records of rrs
+// preferred by the DNSCrypt specification, i.e. the one with the highest serial
+// and then the highest encryption system version.
+func preferredCert(stamp dnsstamps.ServerStamp, rrs []dns.RR) (cert *dnscrypt.Cert, err error) {
+	var errs []error
+	for _, rr := range rrs {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		c := &dnscrypt.Cert{}
+		err = c.Deserialize(unescapeTXT(strings.Join(txt.Txt, "")))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deserializing: %w", err))
+
+			continue
+		} else if !c.VerifyDate() {
+			errs = append(errs, dnscrypt.ErrInvalidDate)
+
+			continue
+		} else if !c.VerifySignature(stamp.ServerPk) {
+			errs = append(errs, dnscrypt.ErrInvalidCertSignature)
+
+			continue
+		}
+
+		if cert == nil ||
+			c.Serial > cert.Serial ||
+			(c.Serial == cert.Serial && c.EsVersion > cert.EsVersion) {
+			cert = c
+		}
+	}
+
+	if cert != nil {
+		return cert, nil
+	} else if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return nil, fmt.Errorf("no txt records for provider %q", stamp.ProviderName)
+}
+
+// unescapeTXT returns the binary data of the TXT record string s, which
+// escapes the non-printable bytes as \DDD and the special ones with
+// backslashes.
+func unescapeTXT(s string) (b []byte) {
+	b = make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+
+			continue
+		}
+
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			b = append(b, (s[i]-'0')*100+(s[i+1]-'0')*10+(s[i+2]-'0'))
+			i += 2
+		} else {
+			b = append(b, s[i])
+		}
+	}
+
+	return b
+}
+
+// isDigit returns true if c is an ASCII digit.
+func isDigit(c byte) (ok bool) { return c >= '0' && c <= '9' }
@@ -0,0 +1,790 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// ErrDNSSECValidation is returned by the upstreams configured with
+// [Options.ValidateDNSSEC] when the response fails the validation.  The
+// response itself is returned along with the error for inspection.
+const ErrDNSSECValidation errors.Error = "dnssec validation failed"
+
+// DefaultTrustAnchors returns the DS records of the IANA root zone key signing
+// keys, which are used as the trust anchors when [Options.TrustAnchors] is
+// empty.
+func DefaultTrustAnchors() (anchors []*dns.DS) {
+	return []*dns.DS{
+		newRootDS(20326, "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"),
+		newRootDS(38696, "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16"),
+	}
+}
+
+// newRootDS returns the DS record of the root zone key with the given key tag
+// and the SHA-256 digest of the RSA/SHA-256 key.
+func newRootDS(keyTag uint16, digest string) (ds *dns.DS) {
+	return &dns.DS{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeDS,
+			Class:  dns.ClassINET,
+		},
+		KeyTag:     keyTag,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     digest,
+	}
+}
+
+// delegationState is the DNSSEC state of a zone cut.
+type delegationState uint8
+
+const (
+	// delegationNone means that the name isn't a zone cut.
+	delegationNone delegationState = iota
+
+	// delegationSecure means that the zone is signed and has DS records.
+	delegationSecure
+
+	// delegationInsecure means that the zone provably has no DS records, so
+	// that its data can't be validated.
+	delegationInsecure
+)
+
+// zoneTrust is the cached DNSSEC information about a zone.
+type zoneTrust struct {
+	// expire is the time the information expires.
+	expire time.Time
+
+	// ds are the validated DS records of the zone, if state is
+	// [delegationSecure].
+	ds []*dns.DS
+
+	// keys are the validated DNSKEY records of the zone.  It's nil until the
+	// keys are requested.
+	keys []*dns.DNSKEY
+
+	// state is the state of the zone's delegation.
+	state delegationState
+}
+
+// dnssecUpstream is an [Upstream] validating the DNSSEC signatures in the
+// responses of the wrapped one.
+type dnssecUpstream struct {
+	// wrapped contains the wrapped upstream, it's also used to request the
+	// DNSKEY and DS records.
+	wrapped
+
+	// now returns the current time.  It's replaced in tests.
+	now func() (now time.Time)
+
+	// zonesMu protects zones.
+	zonesMu *sync.Mutex
+
+	// zones are the validated zones by their lowercased FQDNs.
+	zones map[string]*zoneTrust
+
+	// anchors are the DS records of the root zone trusted unconditionally.
+	anchors []*dns.DS
+}
+
+// newDNSSECUpstream returns ups wrapped to validate the responses using the
+// trust anchors from opts.
+func newDNSSECUpstream(ups Upstream, opts *Options) (u *dnssecUpstream) {
+	anchors := opts.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = DefaultTrustAnchors()
+	}
+
+	return &dnssecUpstream{
+		wrapped: wrapped{ups: ups},
+		now:     time.Now,
+		zonesMu: &sync.Mutex{},
+		zones:   map[string]*zoneTrust{},
+		anchors: anchors,
+	}
+}
+
+// type check
+var _ Upstream = (*dnssecUpstream)(nil)
+
+// Address implements the [Upstream] interface for *dnssecUpstream.
+func (u *dnssecUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *dnssecUpstream.
+func (u *dnssecUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *dnssecUpstream.  The
+// AD bit of the response is set if it's validated.  The DNSSEC records are
+// removed from the response if req has no DO bit set, and the EDNS of the
+// response is restored to match req, see [restoreDO].  req itself isn't
+// modified.  ctx is also used for the lookups made to validate the response.
+func (u *dnssecUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if len(req.Question) != 1 {
+		return u.ups.ExchangeContext(ctx, req)
+	}
+
+	resp, err = u.exchangeDO(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	secure, err := u.validate(ctx, req.Question[0], resp, "")
+	if err != nil {
+		return resp, fmt.Errorf("%w: %w", ErrDNSSECValidation, err)
+	}
+
+	if !secure {
+		log.Debug("dnssec upstream %s: %s is insecure", u.Address(), &req.Question[0])
+	}
+
+	resp.AuthenticatedData = secure
+	restoreDO(req, resp)
+
+	return resp, nil
+}
+
+// restoreDO makes resp match the EDNS of req, which is sent with the DO bit set
+// by [dnssecUpstream.exchangeDO].  That is, the OPT record is removed from resp
+// if req has none, and the DO bit of resp is set the same as the one of req.
+// The DNSSEC records are removed from resp if req has no DO bit set.
+func restoreDO(req, resp *dns.Msg) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		removeOPT(resp)
+		stripDNSSEC(resp)
+
+		return
+	}
+
+	if respOpt := resp.IsEdns0(); respOpt != nil {
+		respOpt.SetDo(reqOpt.Do())
+	}
+
+	if !reqOpt.Do() {
+		stripDNSSEC(resp)
+	}
+}
+
+// exchangeDO exchanges the copy of req with the DO bit set.
+func (u *dnssecUpstream) exchangeDO(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	req = req.Copy()
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	return u.ups.ExchangeContext(ctx, req)
+}
+
+// lookup requests the records of type qtype for name with the DO bit set and
+// validates the response.
+func (u *dnssecUpstream) lookup(
+	ctx context.Context,
+	name string,
+	qtype uint16,
+) (resp *dns.Msg, secure bool, err error) {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+
+	resp, err = u.exchangeDO(ctx, req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		// Go on.
+	default:
+		return nil, false, fmt.Errorf(
+			"requesting %s for %s: got rcode %s",
+			dns.Type(qtype),
+			name,
+			dns.RcodeToString[resp.Rcode],
+		)
+	}
+
+	// The response to DS request comes from the parent zone, so make sure it
+	// isn't validated with the zone's own data.
+	cut := ""
+	if qtype == dns.TypeDS {
+		cut = name
+	}
+
+	secure, err = u.validate(ctx, req.Question[0], resp, cut)
+
+	return resp, secure, err
+}
+
+// validate validates resp to the question q.  secure is false if the response
+// comes from an insecure zone, so that it can't be validated.  If cut isn't
+// empty, resp is only validated with the data of the zones above it.
+func (u *dnssecUpstream) validate(
+	ctx context.Context,
+	q dns.Question,
+	resp *dns.Msg,
+	cut string,
+) (secure bool, err error) {
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		// Go on.
+	default:
+		// There is nothing to validate.
+		return false, nil
+	}
+
+	secure = true
+
+	dnames := []*dns.DNAME{}
+	wildcards := []*rrset{}
+	for _, set := range splitRRsets(resp.Answer) {
+		if cname, ok := set.rrs[0].(*dns.CNAME); ok && len(set.sigs) == 0 {
+			if isSynthesized(cname, dnames) {
+				// The CNAME records synthesized from the DNAME ones aren't
+				// signed.
+				continue
+			}
+		}
+
+		var setSecure bool
+		setSecure, err = u.verifyRRset(ctx, set, cut)
+		if err != nil {
+			return false, fmt.Errorf("answer: %w", err)
+		}
+
+		secure = secure && setSecure
+		if !setSecure {
+			continue
+		}
+
+		if dname, ok := set.rrs[0].(*dns.DNAME); ok {
+			dnames = append(dnames, dname)
+		}
+
+		if _, ok := wildcardLabels(set); ok {
+			wildcards = append(wildcards, set)
+		}
+	}
+
+	target, found := chainTarget(q, resp.Answer)
+	if found && len(wildcards) == 0 {
+		return secure, nil
+	}
+
+	for _, set := range splitRRsets(resp.Ns) {
+		var setSecure bool
+		setSecure, err = u.verifyRRset(ctx, set, cut)
+		if err != nil {
+			return false, fmt.Errorf("authority: %w", err)
+		}
+
+		secure = secure && setSecure
+	}
+
+	if !secure {
+		return false, nil
+	}
+
+	err = proveWildcards(wildcards, resp.Ns)
+	if errors.Is(err, errOptOut) {
+		return false, nil
+	} else if err != nil || found {
+		return err == nil, err
+	}
+
+	if resp.Rcode == dns.RcodeNameError {
+		err = proveNXDomain(target, resp.Ns)
+	} else {
+		_, err = proveNoData(target, q.Qtype, resp.Ns)
+	}
+
+	if errors.Is(err, errOptOut) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// wildcardLabels returns the number of labels of the wildcard the records of
+// set are expanded from, if the signatures of set say so, see RFC 4035,
+// Section 5.3.4.
+func wildcardLabels(set *rrset) (labels int, ok bool) {
+	owner := set.rrs[0].Header().Name
+	n := dns.CountLabel(owner)
+	if strings.HasPrefix(owner, "*.") {
+		// The wildcard label itself isn't counted.
+		n--
+	}
+
+	for _, sig := range set.sigs {
+		if int(sig.Labels) < n {
+			return int(sig.Labels), true
+		}
+	}
+
+	return 0, false
+}
+
+// proveWildcards returns nil if the denial records in ns prove that the owner
+// names of the records in sets, expanded from the wildcards, don't exist.
+func proveWildcards(sets []*rrset, ns []dns.RR) (err error) {
+	for _, set := range sets {
+		labels, _ := wildcardLabels(set)
+		err = proveWildcardExpansion(set.rrs[0].Header().Name, labels, ns)
+		if err != nil {
+			return fmt.Errorf("wildcard expansion: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// chainTarget follows the CNAME and DNAME chain in answer starting at q.Name.
+// found is true if answer contains the records of type q.Qtype for the final
+// target.
+func chainTarget(q dns.Question, answer []dns.RR) (target string, found bool) {
+	target = q.Name
+
+	// Limit the number of iterations to avoid loops.
+	for range len(answer) + 1 {
+		next := target
+		for _, rr := range answer {
+			hdr := rr.Header()
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				if strings.EqualFold(hdr.Name, target) {
+					next = rr.Target
+				}
+			default:
+				if hdr.Rrtype == q.Qtype && strings.EqualFold(hdr.Name, target) {
+					return target, true
+				}
+			}
+		}
+
+		if next == target {
+			break
+		}
+
+		target = next
+	}
+
+	return target, false
+}
+
+// isSynthesized returns true if cname is synthesized from one of dnames as
+// described by RFC 6672.
+func isSynthesized(cname *dns.CNAME, dnames []*dns.DNAME) (ok bool) {
+	for _, dname := range dnames {
+		owner := dname.Hdr.Name
+		if !dns.IsSubDomain(owner, cname.Hdr.Name) || strings.EqualFold(owner, cname.Hdr.Name) {
+			continue
+		}
+
+		prefix := cname.Hdr.Name[:len(cname.Hdr.Name)-len(owner)]
+		if strings.EqualFold(cname.Target, prefix+dname.Target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rrset is a set of records with the same owner name, class, and type along
+// with the signatures covering it.
+type rrset struct {
+	// rrs are the records, it's never empty.
+	rrs []dns.RR
+
+	// sigs are the signatures covering rrs.
+	sigs []*dns.RRSIG
+}
+
+// splitRRsets groups rrs into the record sets, preserving the order.
+func splitRRsets(rrs []dns.RR) (sets []*rrset) {
+	type setKey struct {
+		name  string
+		class uint16
+		rtype uint16
+	}
+
+	byKey := map[setKey]*rrset{}
+	sigs := []*dns.RRSIG{}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			sigs = append(sigs, rr)
+
+			continue
+		case *dns.OPT:
+			continue
+		}
+
+		k := setKey{
+			name:  strings.ToLower(hdr.Name),
+			class: hdr.Class,
+			rtype: hdr.Rrtype,
+		}
+
+		set, ok := byKey[k]
+		if !ok {
+			set = &rrset{}
+			byKey[k] = set
+			sets = append(sets, set)
+		}
+
+		set.rrs = append(set.rrs, rr)
+	}
+
+	for _, sig := range sigs {
+		k := setKey{
+			name:  strings.ToLower(sig.Hdr.Name),
+			class: sig.Hdr.Class,
+			rtype: sig.TypeCovered,
+		}
+
+		if set, ok := byKey[k]; ok {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+
+	return sets
+}
+
+// verifyRRset verifies the signatures of set.  secure is false if set belongs
+// to an insecure zone.  If cut isn't empty, only the zones above it are used.
+func (u *dnssecUpstream) verifyRRset(
+	ctx context.Context,
+	set *rrset,
+	cut string,
+) (secure bool, err error) {
+	hdr := set.rrs[0].Header()
+	if len(set.sigs) == 0 {
+		name := hdr.Name
+		if cut != "" && dns.IsSubDomain(cut, name) {
+			name = parentDomain(cut)
+		}
+
+		var insecure bool
+		insecure, err = u.isInsecure(ctx, name)
+		if err != nil {
+			return false, err
+		} else if !insecure {
+			return false, fmt.Errorf("no signatures for %s %s", hdr.Name, dns.Type(hdr.Rrtype))
+		}
+
+		return false, nil
+	}
+
+	var errs []error
+	for _, sig := range set.sigs {
+		secure, err = u.verifySig(ctx, sig, set.rrs, cut)
+		if err == nil {
+			return secure, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return false, fmt.Errorf("verifying %s %s: %w", hdr.Name, dns.Type(hdr.Rrtype), errors.Join(errs...))
+}
+
+// verifySig verifies sig over rrs.  secure is false if the signer's zone is
+// insecure.  If cut isn't empty, the signer must be above it.
+func (u *dnssecUpstream) verifySig(
+	ctx context.Context,
+	sig *dns.RRSIG,
+	rrs []dns.RR,
+	cut string,
+) (secure bool, err error) {
+	if !dns.IsSubDomain(sig.SignerName, sig.Hdr.Name) {
+		return false, fmt.Errorf("signer %s is out of zone", sig.SignerName)
+	} else if cut != "" && dns.IsSubDomain(cut, sig.SignerName) {
+		return false, fmt.Errorf("signer %s is not above %s", sig.SignerName, cut)
+	} else if !sig.ValidityPeriod(u.now()) {
+		return false, fmt.Errorf("signature by %s is expired or not yet valid", sig.SignerName)
+	}
+
+	keys, secure, err := u.zoneKeys(ctx, sig.SignerName)
+	if err != nil || !secure {
+		return false, err
+	}
+
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+
+		if sig.Verify(key, rrs) == nil {
+			return true, nil
+		}
+	}
+
+	return false, fmt.Errorf("no valid key %d of %s", sig.KeyTag, sig.SignerName)
+}
+
+// zoneKeys returns the validated DNSKEY records of zone.  secure is false if
+// zone is insecure.
+func (u *dnssecUpstream) zoneKeys(
+	ctx context.Context,
+	zone string,
+) (keys []*dns.DNSKEY, secure bool, err error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+
+	zt, err := u.delegation(ctx, zone)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch zt.state {
+	case delegationSecure:
+		// Go on.
+	case delegationInsecure:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("%s is not a signed zone apex", zone)
+	}
+
+	u.zonesMu.Lock()
+	keys = zt.keys
+	u.zonesMu.Unlock()
+
+	if keys != nil {
+		return keys, true, nil
+	}
+
+	keys, ttl, err := u.lookupKeys(ctx, zone, zt.ds)
+	if err != nil {
+		return nil, false, err
+	}
+
+	u.zonesMu.Lock()
+	defer u.zonesMu.Unlock()
+
+	zt.keys = keys
+	zt.expire = minTime(zt.expire, u.now().Add(time.Duration(ttl)*time.Second))
+
+	return keys, true, nil
+}
+
+// lookupKeys requests the DNSKEY records of zone and validates them against
+// the DS records.
+func (u *dnssecUpstream) lookupKeys(
+	ctx context.Context,
+	zone string,
+	dsSet []*dns.DS,
+) (keys []*dns.DNSKEY, ttl uint32, err error) {
+	req := &dns.Msg{}
+	req.SetQuestion(zone, dns.TypeDNSKEY)
+
+	resp, err := u.exchangeDO(ctx, req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("requesting dnskey for %s: %w", zone, err)
+	}
+
+	var set *rrset
+	for _, s := range splitRRsets(resp.Answer) {
+		if s.rrs[0].Header().Rrtype == dns.TypeDNSKEY && strings.EqualFold(s.rrs[0].Header().Name, zone) {
+			set = s
+
+			break
+		}
+	}
+
+	if set == nil {
+		return nil, 0, fmt.Errorf("no dnskey for %s", zone)
+	}
+
+	for _, rr := range set.rrs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	now := u.now()
+	for _, sig := range set.sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && matchesDS(key, dsSet) && sig.Verify(key, set.rrs) == nil {
+				return keys, minAnswerTTL(set.rrs), nil
+			}
+		}
+	}
+
+	return nil, 0, fmt.Errorf("no dnskey for %s matches ds", zone)
+}
+
+// matchesDS returns true if key matches one of dsSet.
+func matchesDS(key *dns.DNSKEY, dsSet []*dns.DS) (ok bool) {
+	return slices.ContainsFunc(dsSet, func(ds *dns.DS) (eq bool) {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			return false
+		}
+
+		keyDS := key.ToDS(ds.DigestType)
+
+		return keyDS != nil && strings.EqualFold(keyDS.Digest, ds.Digest)
+	})
+}
+
+// delegation returns the DNSSEC state of the zone cut at zone, which must be
+// a lowercased FQDN.
+func (u *dnssecUpstream) delegation(ctx context.Context, zone string) (zt *zoneTrust, err error) {
+	now := u.now()
+
+	u.zonesMu.Lock()
+	zt, ok := u.zones[zone]
+	u.zonesMu.Unlock()
+
+	if ok && now.Before(zt.expire) {
+		return zt, nil
+	}
+
+	if zone == "." {
+		zt = &zoneTrust{
+			// The trust anchors never expire, but the keys do.
+			expire: now.Add(time.Duration(1<<31-1) * time.Second),
+			ds:     u.anchors,
+			state:  delegationSecure,
+		}
+	} else {
+		zt, err = u.lookupDelegation(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u.zonesMu.Lock()
+	defer u.zonesMu.Unlock()
+
+	u.zones[zone] = zt
+
+	return zt, nil
+}
+
+// lookupDelegation requests the DS records for zone and determines the state
+// of the zone cut.
+func (u *dnssecUpstream) lookupDelegation(
+	ctx context.Context,
+	zone string,
+) (zt *zoneTrust, err error) {
+	resp, secure, err := u.lookup(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, fmt.Errorf("validating ds for %s: %w", zone, err)
+	}
+
+	zt = &zoneTrust{
+		expire: u.now().Add(time.Duration(minResponseTTL(resp)) * time.Second),
+	}
+
+	for _, rr := range resp.Answer {
+		if ds, ok := rr.(*dns.DS); ok && strings.EqualFold(ds.Hdr.Name, zone) {
+			zt.ds = append(zt.ds, ds)
+		}
+	}
+
+	switch {
+	case !secure:
+		// The parent zone itself is insecure.
+		zt.state = delegationInsecure
+	case len(zt.ds) > 0:
+		zt.state = delegationSecure
+	default:
+		zt.state, err = denialDelegationState(zone, resp.Ns)
+	}
+
+	return zt, err
+}
+
+// isInsecure returns true if name or any of its ancestors is a provably
+// insecure zone cut.
+func (u *dnssecUpstream) isInsecure(ctx context.Context, name string) (ok bool, err error) {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		var zt *zoneTrust
+		zt, err = u.delegation(ctx, zone)
+		if err != nil {
+			return false, err
+		}
+
+		if zt.state == delegationInsecure {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// parentDomain returns the parent domain of the FQDN name, which must not be
+// the root.
+func parentDomain(name string) (parent string) {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+
+	return name[i:]
+}
+
+// minResponseTTL returns the minimum TTL of the records in resp or
+// [staleTTL] if there are none.
+func minResponseTTL(resp *dns.Msg) (ttl uint32) {
+	rrs := slices.Concat(resp.Answer, resp.Ns)
+	if len(rrs) == 0 {
+		return staleTTL
+	}
+
+	return minAnswerTTL(rrs)
+}
+
+// minTime returns the earliest of a and b.
+func minTime(a, b time.Time) (t time.Time) {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+// stripDNSSEC removes the DNSSEC records from all the sections of resp, except
+// the ones requested explicitly.
+func stripDNSSEC(resp *dns.Msg) {
+	var qtype uint16
+	if len(resp.Question) == 1 {
+		qtype = resp.Question[0].Qtype
+	}
+
+	isDNSSEC := func(rr dns.RR) (ok bool) {
+		switch rtype := rr.Header().Rrtype; rtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			return rtype != qtype
+		default:
+			return false
+		}
+	}
+
+	resp.Answer = slices.DeleteFunc(resp.Answer, isDNSSEC)
+	resp.Ns = slices.DeleteFunc(resp.Ns, isDNSSEC)
+	resp.Extra = slices.DeleteFunc(resp.Extra, isDNSSEC)
+}
+
+// Close implements the [Upstream] interface for *dnssecUpstream.
+func (u *dnssecUpstream) Close() (err error) { return u.ups.Close() }
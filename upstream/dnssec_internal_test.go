@@ -0,0 +1,295 @@
+package upstream
+
+import (
+	"crypto"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZone is a signed zone used in DNSSEC tests.
+type testZone struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// newTestZone generates the key for the zone named name.
+func newTestZone(t *testing.T, name string) (z *testZone) {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	signer, ok := priv.(crypto.Signer)
+	require.True(t, ok)
+
+	return &testZone{
+		key:    key,
+		signer: signer,
+	}
+}
+
+// sign returns rrs along with their signature made by z.
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) (signed []dns.RR) {
+	t.Helper()
+
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: rrs[0].Header().Ttl,
+		},
+		Algorithm:  z.key.Algorithm,
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+	}
+
+	require.NoError(t, sig.Sign(z.signer, rrs))
+
+	return append(rrs, sig)
+}
+
+// newTestRR parses the record from s.
+func newTestRR(t *testing.T, s string) (rr dns.RR) {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+
+	return rr
+}
+
+// newTestDNSSECUpstream returns the DNSSEC-validating upstream over the fake
+// signed hierarchy consisting of the root zone, the signed zone "example.",
+// and the insecure delegation "insecure.".
+func newTestDNSSECUpstream(t *testing.T) (u *dnssecUpstream) {
+	t.Helper()
+
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+
+	ds := example.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+
+	www := newTestRR(t, "www.example. 300 IN A 192.0.2.1")
+	signedWWW := example.sign(t, www)
+
+	// Tamper with the record after signing it.
+	bad := newTestRR(t, "bad.example. 300 IN A 192.0.2.1")
+	signedBad := example.sign(t, bad)
+	signedBad[0].(*dns.A).A = net.IP{192, 0, 2, 2}
+
+	// expand returns the record expanded for name from the signed wildcard.
+	expand := func(name string) (rrs []dns.RR) {
+		rrs = example.sign(t, newTestRR(t, "*.wild.example. 300 IN A 192.0.2.5"))
+		for _, rr := range rrs {
+			rr.Header().Name = name
+		}
+
+		return rrs
+	}
+
+	answers := map[dns.Question][]dns.RR{
+		{Name: ".", Qtype: dns.TypeDNSKEY}:            root.sign(t, root.key),
+		{Name: "example.", Qtype: dns.TypeDS}:         root.sign(t, ds),
+		{Name: "example.", Qtype: dns.TypeDNSKEY}:     example.sign(t, example.key),
+		{Name: "www.example.", Qtype: dns.TypeA}:      signedWWW,
+		{Name: "bad.example.", Qtype: dns.TypeA}:      signedBad,
+		{Name: "a.insecure.", Qtype: dns.TypeA}:       {newTestRR(t, "a.insecure. 300 IN A 192.0.2.3")},
+		{Name: "unsigned.example.", Qtype: dns.TypeA}: {newTestRR(t, "unsigned.example. 300 IN A 192.0.2.4")},
+		{Name: "alias.example.", Qtype: dns.TypeA}: append(
+			example.sign(t, newTestRR(t, "alias.example. 300 IN CNAME www.example.")),
+			signedWWW...,
+		),
+		{Name: "a.wild.example.", Qtype: dns.TypeA}: expand("a.wild.example."),
+		{Name: "b.wild.example.", Qtype: dns.TypeA}: expand("b.wild.example."),
+	}
+
+	nsecApex := example.sign(t, newTestRR(t, "example. 300 IN NSEC www.example. SOA NS RRSIG NSEC DNSKEY"))
+	nsecWWW := example.sign(t, newTestRR(t, "www.example. 300 IN NSEC example. A RRSIG NSEC"))
+	soa := example.sign(t, newTestRR(t, "example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300"))
+
+	authorities := map[dns.Question][]dns.RR{
+		{Name: "nx.example.", Qtype: dns.TypeA}:     append(append(soa, nsecApex...), nsecWWW...),
+		{Name: "www.example.", Qtype: dns.TypeAAAA}: append(soa, nsecWWW...),
+		{Name: "insecure.", Qtype: dns.TypeDS}: root.sign(
+			t,
+			newTestRR(t, "insecure. 300 IN NSEC . NS RRSIG NSEC"),
+		),
+		{Name: "a.wild.example.", Qtype: dns.TypeA}: example.sign(
+			t,
+			newTestRR(t, "*.wild.example. 300 IN NSEC b.wild.example. A RRSIG NSEC"),
+		),
+	}
+
+	fake := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "fake" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+
+			q := req.Question[0]
+			q = dns.Question{Name: strings.ToLower(q.Name), Qtype: q.Qtype}
+
+			ans, hasAns := answers[q]
+			ns, hasNs := authorities[q]
+			if hasAns || hasNs {
+				// Clone the sections, since the DNSSEC records are removed
+				// from the responses.
+				resp.Answer, resp.Ns = slices.Clone(ans), slices.Clone(ns)
+			} else {
+				resp.Rcode = dns.RcodeServerFailure
+			}
+
+			if opt := req.IsEdns0(); opt != nil {
+				resp.SetEdns0(opt.UDPSize(), opt.Do())
+			}
+
+			if q.Name == "nx.example." {
+				resp.Rcode = dns.RcodeNameError
+			}
+
+			return resp, nil
+		},
+		OnClose: func() (err error) { return nil },
+	}
+
+	return newDNSSECUpstream(fake, &Options{
+		ValidateDNSSEC: true,
+		TrustAnchors:   []*dns.DS{root.key.ToDS(dns.SHA256)},
+	})
+}
+
+func TestDNSSECUpstream(t *testing.T) {
+	u := newTestDNSSECUpstream(t)
+
+	testCases := []struct {
+		wantErr    error
+		name       string
+		host       string
+		qtype      uint16
+		wantRcode  int
+		wantSecure bool
+	}{{
+		wantErr:    nil,
+		name:       "secure",
+		host:       "www.example.",
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSecure: true,
+	}, {
+		wantErr:    nil,
+		name:       "cname",
+		host:       "alias.example.",
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSecure: true,
+	}, {
+		wantErr:    nil,
+		name:       "nxdomain",
+		host:       "nx.example.",
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeNameError,
+		wantSecure: true,
+	}, {
+		wantErr:    nil,
+		name:       "nodata",
+		host:       "www.example.",
+		qtype:      dns.TypeAAAA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSecure: true,
+	}, {
+		wantErr:    nil,
+		name:       "insecure",
+		host:       "a.insecure.",
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSecure: false,
+	}, {
+		wantErr:    nil,
+		name:       "wildcard",
+		host:       "a.wild.example.",
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSecure: true,
+	}, {
+		wantErr:    ErrDNSSECValidation,
+		name:       "wildcard_no_denial",
+		host:       "b.wild.example.",
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSecure: false,
+	}, {
+		wantErr:    ErrDNSSECValidation,
+		name:       "bogus",
+		host:       "bad.example.",
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSecure: false,
+	}, {
+		wantErr:    ErrDNSSECValidation,
+		name:       "unsigned",
+		host:       "unsigned.example.",
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSecure: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, tc.qtype)
+
+			resp, err := u.Exchange(req)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantSecure, resp.AuthenticatedData)
+			assert.Nil(t, resp.IsEdns0())
+			for _, rr := range resp.Answer {
+				assert.NotEqual(t, dns.TypeRRSIG, rr.Header().Rrtype)
+			}
+		})
+	}
+
+	t.Run("edns_no_do", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("www.example.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		opt := resp.IsEdns0()
+		require.NotNil(t, opt)
+
+		assert.False(t, opt.Do())
+		assert.True(t, resp.AuthenticatedData)
+	})
+}
@@ -0,0 +1,237 @@
+package upstream
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// errOptOut is returned when the nonexistence of a name is only proven with
+// an opt-out NSEC3 record, so that the name belongs to an insecure delegation.
+const errOptOut errors.Error = "covered by opt-out nsec3"
+
+// denialRecords returns the NSEC and NSEC3 records from rrs.
+func denialRecords(rrs []dns.RR) (nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) {
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+
+	return nsecs, nsec3s
+}
+
+// proveNoData returns nil if the denial records in ns prove that name has no
+// records of qtype.  types are the types from the bitmap of the matching
+// record.  It returns [errOptOut] if name is covered by an opt-out NSEC3.
+func proveNoData(name string, qtype uint16, ns []dns.RR) (types []uint16, err error) {
+	nsecs, nsec3s := denialRecords(ns)
+
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return nsec.TypeBitMap, checkBitmap(name, qtype, nsec.TypeBitMap)
+		}
+	}
+
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return nsec3.TypeBitMap, checkBitmap(name, qtype, nsec3.TypeBitMap)
+		}
+	}
+
+	if qtype == dns.TypeDS && len(nsec3s) > 0 {
+		// See RFC 5155, Section 8.6.
+		err = proveClosestEncloser(name, nsec3s)
+		if err == nil {
+			err = fmt.Errorf("nsec3 for %s doesn't opt out", name)
+		}
+
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("no nodata proof for %s", name)
+}
+
+// checkBitmap returns an error if bitmap proves that name has records of qtype
+// or a CNAME record.
+func checkBitmap(name string, qtype uint16, bitmap []uint16) (err error) {
+	if slices.Contains(bitmap, qtype) || slices.Contains(bitmap, dns.TypeCNAME) {
+		return fmt.Errorf("denial for %s %s lists the type", name, dns.Type(qtype))
+	}
+
+	return nil
+}
+
+// proveNXDomain returns nil if the denial records in ns prove that name
+// doesn't exist.  It returns [errOptOut] if name is covered by an opt-out
+// NSEC3.
+func proveNXDomain(name string, ns []dns.RR) (err error) {
+	nsecs, nsec3s := denialRecords(ns)
+	if len(nsecs) > 0 {
+		return proveNXDomainNSEC(name, nsecs)
+	} else if len(nsec3s) > 0 {
+		return proveClosestEncloser(name, nsec3s)
+	}
+
+	return fmt.Errorf("no nxdomain proof for %s", name)
+}
+
+// proveWildcardExpansion returns nil if the denial records in ns prove that
+// name, which the records are expanded for from the wildcard with labels
+// labels, doesn't exist itself, as described by RFC 4035, Section 5.3.4, and
+// RFC 5155, Section 8.8.  It returns [errOptOut] if the next closer name is
+// covered by an opt-out NSEC3.
+func proveWildcardExpansion(name string, labels int, ns []dns.RR) (err error) {
+	nsecs, nsec3s := denialRecords(ns)
+	if slices.ContainsFunc(nsecs, func(n *dns.NSEC) (ok bool) { return nsecCovers(n, name) }) {
+		return nil
+	}
+
+	nameLabels := dns.SplitDomainName(name)
+	nextCloser := dns.Fqdn(strings.Join(nameLabels[len(nameLabels)-labels-1:], "."))
+	i := slices.IndexFunc(nsec3s, func(n *dns.NSEC3) (ok bool) { return n.Cover(nextCloser) })
+	if i < 0 {
+		return fmt.Errorf("no denial of %s", name)
+	} else if nsec3s[i].Flags&nsec3OptOut != 0 {
+		return errOptOut
+	}
+
+	return nil
+}
+
+// proveNXDomainNSEC returns nil if nsecs prove that neither name nor the
+// wildcard at its closest encloser exists.
+func proveNXDomainNSEC(name string, nsecs []*dns.NSEC) (err error) {
+	i := slices.IndexFunc(nsecs, func(nsec *dns.NSEC) (ok bool) {
+		return nsecCovers(nsec, name)
+	})
+	if i < 0 {
+		return fmt.Errorf("no nsec covers %s", name)
+	}
+
+	// The closest encloser is the longest common ancestor of name and the
+	// names of the covering record.
+	nsec := nsecs[i]
+	ce := commonAncestor(name, nsec.Hdr.Name)
+	if next := commonAncestor(name, nsec.NextDomain); dns.CountLabel(next) > dns.CountLabel(ce) {
+		ce = next
+	}
+
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+
+	if !slices.ContainsFunc(nsecs, func(n *dns.NSEC) (ok bool) { return nsecCovers(n, wildcard) }) {
+		return fmt.Errorf("no nsec covers %s", wildcard)
+	}
+
+	return nil
+}
+
+// nsecCovers returns true if name is between the owner name and the next name
+// of nsec in the canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) (ok bool) {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(name, owner) <= 0 {
+		return false
+	}
+
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(name, next) < 0
+	}
+
+	// It's the last record in the zone, so next is the zone apex.
+	return dns.IsSubDomain(next, name)
+}
+
+// proveClosestEncloser returns nil if nsec3s prove the closest encloser of
+// name, the nonexistence of the next closer name, and the nonexistence of the
+// wildcard at the closest encloser, as described by RFC 5155, Section 8.4.  It
+// returns [errOptOut] if the next closer name is covered by an opt-out NSEC3.
+func proveClosestEncloser(name string, nsec3s []*dns.NSEC3) (err error) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		ce := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) (ok bool) { return n.Match(ce) }) {
+			continue
+		}
+
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		j := slices.IndexFunc(nsec3s, func(n *dns.NSEC3) (ok bool) { return n.Cover(nextCloser) })
+		if j < 0 {
+			return fmt.Errorf("no nsec3 covers %s", nextCloser)
+		} else if nsec3s[j].Flags&nsec3OptOut != 0 {
+			return errOptOut
+		}
+
+		wildcard := "*." + ce
+		if ce == "." {
+			wildcard = "*."
+		}
+
+		if !slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) (ok bool) { return n.Cover(wildcard) }) {
+			return fmt.Errorf("no nsec3 covers %s", wildcard)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("no closest encloser proof for %s", name)
+}
+
+// nsec3OptOut is the Opt-Out flag of NSEC3 records.
+const nsec3OptOut = 1
+
+// denialDelegationState returns the state of the zone cut at zone, which has
+// no DS records as proven by the denial records in ns.
+func denialDelegationState(zone string, ns []dns.RR) (state delegationState, err error) {
+	types, err := proveNoData(zone, dns.TypeDS, ns)
+	switch {
+	case errors.Is(err, errOptOut):
+		return delegationInsecure, nil
+	case err != nil:
+		// The name doesn't exist, so it's not a zone cut.
+		return delegationNone, nil
+	case slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA):
+		return delegationInsecure, nil
+	default:
+		return delegationNone, nil
+	}
+}
+
+// canonicalCompare compares the domain names a and b in the canonical order
+// defined by RFC 4034, Section 6.1.
+func canonicalCompare(a, b string) (res int) {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+
+	for i := 1; i <= min(len(la), len(lb)); i++ {
+		res = strings.Compare(la[len(la)-i], lb[len(lb)-i])
+		if res != 0 {
+			return res
+		}
+	}
+
+	return cmp.Compare(len(la), len(lb))
+}
+
+// commonAncestor returns the longest common ancestor of the domain names a and
+// b.
+func commonAncestor(a, b string) (anc string) {
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+
+	labels := dns.SplitDomainName(a)
+
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
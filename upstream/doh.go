@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
@@ -10,7 +11,9 @@ import (
 	"net/http"
 	"net/url"
 	"runtime"
+	"slices"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
@@ -28,10 +31,6 @@ const (
 	// idle connections in HTTP/2 transport.
 	transportDefaultReadIdleTimeout = 30 * time.Second
 
-	// transportDefaultIdleConnTimeout is the default timeout for idle
-	// connections in HTTP transport.
-	transportDefaultIdleConnTimeout = 5 * time.Minute
-
 	// dohMaxConnsPerHost controls the maximum number of connections for
 	// each host.  Note, that setting it to 1 may cause issues with Go's http
 	// implementation, see https://github.com/AdguardTeam/dnsproxy/issues/278.
@@ -42,12 +41,16 @@ const (
 	dohMaxIdleConns = 2
 )
 
+// DefaultDoHIdleConnTimeout is the default time an idle connection of a
+// DNS-over-HTTPS upstream is kept open, see [Options.DoHIdleConnTimeout].
+const DefaultDoHIdleConnTimeout = 30 * time.Second
+
 // dnsOverHTTPS is a struct that implements the Upstream interface for the
 // DNS-over-HTTPS protocol.
 type dnsOverHTTPS struct {
-	// getDialer either returns an initialized dial handler or creates a new
-	// one.
-	getDialer DialerInitializer
+	// bootstrapper resolves the upstream's hostname and creates dial
+	// handlers.
+	*bootstrapper
 
 	// addr is the DNS-over-HTTPS server URL.
 	addr *url.URL
@@ -55,6 +58,9 @@ type dnsOverHTTPS struct {
 	// tlsConf is the configuration of TLS.
 	tlsConf *tls.Config
 
+	// rttStats measures the round-trip time of the exchanges.
+	*rttStats
+
 	// The Client's Transport typically has internal state (cached TCP
 	// connections), so Clients should be reused instead of created as needed.
 	// Clients are safe for concurrent use by multiple goroutines.
@@ -70,54 +76,170 @@ type dnsOverHTTPS struct {
 	// quicConfMu protects quicConf.
 	quicConfMu *sync.Mutex
 
+	// protoMu protects proto.
+	protoMu *sync.Mutex
+
+	// proto is the HTTP protocol of the most recent response, e.g.
+	// "HTTP/2.0".
+	proto string
+
 	// addrRedacted is the redacted string representation of addr.  It is saved
 	// separately to reduce allocations during logging and error reporting.
 	addrRedacted string
 
+	// method is the HTTP method used to send the queries.
+	method DoHMethod
+
+	// maxRespSize is the maximum size of the response body.
+	maxRespSize int
+
 	// timeout is used in HTTP client and for H3 probes.
 	timeout time.Duration
+
+	// idleConnTimeout is the time an idle connection is kept open.
+	idleConnTimeout time.Duration
+
+	// maxIdleConns is the maximum number of idle connections kept open.
+	maxIdleConns int
+
+	// probeTimeout is the timeout of the health-check probes.
+	probeTimeout time.Duration
+
+	// active tracks the exchanges in flight, so that Close waits for them.
+	active *inflight
+
+	// forceRD is true if the RD bit should be set in the outgoing queries.
+	forceRD bool
+
+	// tcPolicy defines how the responses with the TC bit set are handled.
+	tcPolicy TruncatedPolicy
+
+	// prefetchMu protects onPrefetch.
+	prefetchMu *sync.Mutex
+
+	// onPrefetch handles the prefetched responses, see
+	// [PrefetchingUpstream].
+	onPrefetch PrefetchHandler
+
+	// json is true if the queries are sent using the JSON API.
+	json bool
+
+	// prefetchAAAA is true if the AAAA queries should be sent along with the
+	// A ones, see [Options.PrefetchAAAA].
+	prefetchAAAA bool
+}
+
+// NegotiatingUpstream is an [Upstream] reporting the protocol actually used for
+// its exchanges, which may differ from the configured preference.
+//
+// The DNS-over-HTTPS upstreams created with [AddressToUpstream] implement it,
+// unless they are wrapped, e.g. by configuring [Options.Retries].  Use
+// [UpstreamAs] to get it from the wrapper.
+type NegotiatingUpstream interface {
+	Upstream
+
+	// NegotiatedProtocol returns the protocol used for the most recent
+	// exchange, e.g. "HTTP/2.0" or "HTTP/3.0".  It returns an empty string if
+	// there were no exchanges yet.  It's safe for concurrent use along with
+	// Exchange.
+	NegotiatedProtocol() (proto string)
 }
 
-// newDoH returns the DNS-over-HTTPS Upstream.
+// newDoH returns the DNS-over-HTTPS Upstream.  The "h3" scheme of addr makes
+// the upstream use HTTP/3 only, in which case opts.HTTPVersions, if set, must
+// contain [HTTPVersion3].
 func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
+	p, err := newDNSOverHTTPS(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.DoHAlternateURLs) > 0 {
+		return newDoHFailover(p, opts)
+	}
+
+	return p, nil
+}
+
+// newDNSOverHTTPS is like [newDoH] but returns the concrete type.
+func newDNSOverHTTPS(addr *url.URL, opts *Options) (p *dnsOverHTTPS, err error) {
 	addPort(addr, defaultPortDoH)
 
 	var httpVersions []HTTPVersion
 	if addr.Scheme == "h3" {
+		if len(opts.HTTPVersions) > 0 && !slices.Contains(opts.HTTPVersions, HTTPVersion3) {
+			return nil, fmt.Errorf(
+				"h3 scheme conflicts with http versions %q that exclude %s",
+				opts.HTTPVersions,
+				HTTPVersion3,
+			)
+		}
+
 		addr.Scheme = "https"
 		httpVersions = []HTTPVersion{HTTPVersion3}
 	} else if httpVersions = opts.HTTPVersions; len(opts.HTTPVersions) == 0 {
 		httpVersions = DefaultHTTPVersions
 	}
 
+	method := opts.DoHMethod
+	switch method {
+	case "":
+		method = DoHMethodPost
+	case DoHMethodPost, DoHMethodGet:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("unsupported doh method %q", method)
+	}
+
+	b, err := newBootstrapper(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf, err := newTLSConfig(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	idleConnTimeout := opts.DoHIdleConnTimeout
+	if idleConnTimeout == 0 {
+		idleConnTimeout = DefaultDoHIdleConnTimeout
+	}
+
+	maxIdleConns := opts.DoHMaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = dohMaxIdleConns
+	}
+
 	ups := &dnsOverHTTPS{
-		getDialer: newDialerInitializer(addr, opts),
-		addr:      addr,
+		bootstrapper: b,
+		rttStats:     newRTTStats(opts),
+		addr:         addr,
 		quicConf: &quic.Config{
 			KeepAlivePeriod: QUICKeepAlivePeriod,
 			TokenStore:      newQUICTokenStore(),
 			Tracer:          opts.QUICTracer,
 		},
-		quicConfMu: &sync.Mutex{},
-		tlsConf: &tls.Config{
-			ServerName:   addr.Hostname(),
-			RootCAs:      opts.RootCAs,
-			CipherSuites: opts.CipherSuites,
-			// Use the default capacity for the LRU cache.  It may be useful to
-			// store several caches since the user may be routed to different
-			// servers in case there's load balancing on the server-side.
-			ClientSessionCache: tls.NewLRUClientSessionCache(0),
-			MinVersion:         tls.VersionTLS12,
-			// #nosec G402 -- TLS certificate verification could be disabled by
-			// configuration.
-			InsecureSkipVerify:    opts.InsecureSkipVerify,
-			VerifyPeerCertificate: opts.VerifyServerCertificate,
-			VerifyConnection:      opts.VerifyConnection,
-		},
+		quicConfMu:   &sync.Mutex{},
+		protoMu:      &sync.Mutex{},
+		tlsConf:      tlsConf,
 		clientMu:     &sync.Mutex{},
 		addrRedacted: addr.Redacted(),
+		method:       method,
+		maxRespSize:  maxResponseSize(opts),
 		timeout:      opts.Timeout,
+		forceRD:      !opts.PreserveRecursionDesired,
+		probeTimeout: opts.ProbeTimeout,
+		active:       newInflight(opts),
+		tcPolicy:     truncatedPolicy(opts),
+		json:         opts.DoHJSON,
+		prefetchMu:   &sync.Mutex{},
+		prefetchAAAA: opts.PrefetchAAAA,
+
+		idleConnTimeout: idleConnTimeout,
+		maxIdleConns:    maxIdleConns,
 	}
+
 	for _, v := range httpVersions {
 		ups.tlsConf.NextProtos = append(ups.tlsConf.NextProtos, string(v))
 	}
@@ -128,15 +250,43 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 }
 
 // type check
-var _ Upstream = (*dnsOverHTTPS)(nil)
+var _ UpstreamWithStats = (*dnsOverHTTPS)(nil)
+
+// type check
+var _ ResolvingUpstream = (*dnsOverHTTPS)(nil)
 
 // Address implements the [Upstream] interface for *dnsOverHTTPS.  The address
 // is redacted: if the original URL of this upstream contains a userinfo with a
 // password, the password is replaced with "xxxxx".
 func (p *dnsOverHTTPS) Address() string { return p.addrRedacted }
 
+// type check
+var _ ProtocolUpstream = (*dnsOverHTTPS)(nil)
+
+// Protocol implements the [ProtocolUpstream] interface for *dnsOverHTTPS.
+func (p *dnsOverHTTPS) Protocol() (proto Protocol) { return ProtocolHTTPS }
+
 // Exchange implements the Upstream interface for *dnsOverHTTPS.
 func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext implements the Upstream interface for *dnsOverHTTPS.
+func (p *dnsOverHTTPS) ExchangeContext(
+	ctx context.Context,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	defer func() { err = classifyError(err) }()
+
+	err = p.active.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer p.active.end()
+
+	restoreRD := forceRecursionDesired(m, p.forceRD)
+	defer func() { restoreRD(resp) }()
+
 	// In order to maximize HTTP cache friendliness, DoH clients using media
 	// formats that include the ID field from the DNS message header, such
 	// as "application/dns-message", SHOULD use a DNS ID of 0 in every DNS
@@ -160,35 +310,59 @@ func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 		return nil, fmt.Errorf("failed to init http client: %w", err)
 	}
 
+	if h := p.prefetchHandler(m); h != nil {
+		// Use the same client, so that the query likely shares the
+		// connection.
+		go p.prefetch(client, m.Copy(), h)
+	}
+
 	// Make the first attempt to send the DNS query.
-	resp, err = p.exchangeHTTPS(client, m)
+	resp, err = p.exchangeHTTPS(ctx, client, m)
+	if isCached && ctx.Err() == nil && isConnReset(err) {
+		// The idle connection has likely been closed by the server, so retry
+		// once, the transport dials a fresh connection then.
+		log.Debug("dnsproxy: %s: retrying on fresh connection: %s", p.addrRedacted, err)
+
+		resp, err = p.exchangeHTTPS(ctx, client, m)
+	}
 
 	// Make up to 2 attempts to re-create the HTTP client and send the request
 	// again.  There are several cases (mostly, with QUIC) where this workaround
 	// is necessary to make HTTP client usable.  We need to make 2 attempts in
 	// the case when the connection was closed (due to inactivity for example)
 	// AND the server refuses to open a 0-RTT connection.
-	for i := 0; isCached && p.shouldRetry(err) && i < 2; i++ {
+	for i := 0; isCached && ctx.Err() == nil && p.shouldRetry(err) && i < 2; i++ {
 		client, err = p.resetClient(err)
 		if err != nil {
 			return nil, fmt.Errorf("failed to reset http client: %w", err)
 		}
 
-		resp, err = p.exchangeHTTPS(client, m)
+		resp, err = p.exchangeHTTPS(ctx, client, m)
 	}
 
 	if err != nil {
+		if ctx.Err() != nil {
+			// The request has been cancelled, so the client is fine.
+			return nil, err
+		}
+
 		// If the request failed anyway, make sure we don't use this client.
 		_, resErr := p.resetClient(err)
 
 		return nil, errors.WithDeferred(err, resErr)
 	}
 
-	return resp, err
+	exchange := func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+		return p.exchangeHTTPS(ctx, client, req)
+	}
+
+	return retryTruncated(ctx, m, resp, p.addrRedacted, p.tcPolicy, exchange)
 }
 
 // Close implements the Upstream interface for *dnsOverHTTPS.
 func (p *dnsOverHTTPS) Close() (err error) {
+	p.active.shutdown()
+
 	p.clientMu.Lock()
 	defer p.clientMu.Unlock()
 
@@ -201,6 +375,36 @@ func (p *dnsOverHTTPS) Close() (err error) {
 	return err
 }
 
+// type check
+var _ RefreshableUpstream = (*dnsOverHTTPS)(nil)
+
+// Refresh implements the [RefreshableUpstream] interface for *dnsOverHTTPS.  It
+// makes the following exchanges use a new HTTP client and closes the idle
+// connections of the current one.  The stored TLS sessions are discarded.
+func (p *dnsOverHTTPS) Refresh() (err error) {
+	p.expireResolved()
+	clearSessions(p.tlsConf)
+
+	p.clientMu.Lock()
+	client := p.client
+	p.client = nil
+	p.clientMu.Unlock()
+
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+// type check
+var _ ProbableUpstream = (*dnsOverHTTPS)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *dnsOverHTTPS.
+func (p *dnsOverHTTPS) Probe(ctx context.Context) (err error) {
+	return probe(ctx, p, p.probeTimeout)
+}
+
 // closeClient cleans up resources used by client if necessary.  Note, that at
 // this point it should only be done for HTTP/3 as it may leak due to keep-alive
 // connections.
@@ -213,93 +417,202 @@ func (p *dnsOverHTTPS) closeClient(client *http.Client) (err error) {
 }
 
 // exchangeHTTPS logs the request and its result and calls exchangeHTTPSClient.
-func (p *dnsOverHTTPS) exchangeHTTPS(client *http.Client, req *dns.Msg) (resp *dns.Msg, err error) {
+func (p *dnsOverHTTPS) exchangeHTTPS(
+	ctx context.Context,
+	client *http.Client,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
 	n := networkTCP
 	if isHTTP3(client) {
 		n = networkUDP
 	}
 
 	logBegin(p.addrRedacted, n, req)
-	defer func() { logFinish(p.addrRedacted, n, err) }()
+	defer func() { logFinish(p.addrRedacted, n, resp, err) }()
 
-	return p.exchangeHTTPSClient(client, req)
+	return p.exchangeHTTPSClient(ctx, client, req)
 }
 
 // exchangeHTTPSClient sends the DNS query to a DoH resolver using the specified
 // http.Client instance.
 func (p *dnsOverHTTPS) exchangeHTTPSClient(
+	ctx context.Context,
 	client *http.Client,
 	req *dns.Msg,
 ) (resp *dns.Msg, err error) {
+	if p.json {
+		return p.exchangeJSON(ctx, client, req)
+	}
+
 	buf, err := req.Pack()
 	if err != nil {
 		return nil, fmt.Errorf("packing message: %w", err)
 	}
 
-	// It appears, that GET requests are more memory-efficient with Golang
-	// implementation of HTTP/2.
-	method := http.MethodGet
-	if isHTTP3(client) {
-		// If we're using HTTP/3, use http3.MethodGet0RTT to force using 0-RTT.
-		method = http3.MethodGet0RTT
-	}
+	start := time.Now()
 
-	q := url.Values{
-		"dns": []string{base64.RawURLEncoding.EncodeToString(buf)},
+	httpResp, err := p.doRequest(ctx, client, p.method, buf)
+	if err != nil {
+		return nil, err
 	}
 
-	u := url.URL{
-		Scheme:   p.addr.Scheme,
-		User:     p.addr.User,
-		Host:     p.addr.Host,
-		Path:     p.addr.Path,
-		RawQuery: q.Encode(),
+	if httpResp.StatusCode == http.StatusRequestURITooLong && p.method == DoHMethodGet {
+		log.OnCloserError(httpResp.Body, log.DEBUG)
+		log.Debug("dnsproxy: %s: uri too long, falling back to post", p.addrRedacted)
+
+		httpResp, err = p.doRequest(ctx, client, DoHMethodPost, buf)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	httpReq, err := http.NewRequest(method, u.String(), nil)
+	body, err := p.readBody(httpResp)
 	if err != nil {
-		return nil, fmt.Errorf("creating http request to %s: %w", p.addrRedacted, err)
+		return nil, err
 	}
 
-	httpReq.Header.Set("Accept", "application/dns-message")
-	httpReq.Header.Set("User-Agent", "")
-
-	httpResp, err := client.Do(httpReq)
+	resp = &dns.Msg{}
+	err = resp.Unpack(body)
 	if err != nil {
-		return nil, fmt.Errorf("requesting %s: %w", p.addrRedacted, err)
+		return nil, fmt.Errorf(
+			"unpacking response from %s: body is %s: %w",
+			p.addrRedacted,
+			body,
+			err,
+		)
 	}
+
+	if resp.Id != req.Id {
+		return resp, dns.ErrId
+	}
+
+	captureWire(ctx, body)
+	p.update(time.Since(start))
+
+	return resp, nil
+}
+
+// readBody reads the body of httpResp, closing it, and checks the status.  It
+// also remembers the protocol of httpResp.
+func (p *dnsOverHTTPS) readBody(httpResp *http.Response) (body []byte, err error) {
 	defer log.OnCloserError(httpResp.Body, log.DEBUG)
 
-	body, err := io.ReadAll(httpResp.Body)
+	p.setProto(httpResp.Proto)
+
+	if httpResp.ContentLength > int64(p.maxRespSize) {
+		return nil, fmt.Errorf(
+			"reading %s: %w: content length %d",
+			p.addrRedacted,
+			ErrResponseTooLarge,
+			httpResp.ContentLength,
+		)
+	}
+
+	// Read one more byte to detect the oversized body.
+	body, err = io.ReadAll(io.LimitReader(httpResp.Body, int64(p.maxRespSize)+1))
 	if err != nil {
 		return nil, fmt.Errorf("reading %s: %w", p.addrRedacted, err)
+	} else if len(body) > p.maxRespSize {
+		return nil, fmt.Errorf("reading %s: %w", p.addrRedacted, ErrResponseTooLarge)
 	}
 
 	if httpResp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(
+		return nil, newKindError(ErrBadResponse, fmt.Errorf(
 			"expected status %d, got %d from %s",
 			http.StatusOK,
 			httpResp.StatusCode,
 			p.addrRedacted,
-		)
+		))
 	}
 
-	resp = &dns.Msg{}
-	err = resp.Unpack(body)
+	return body, nil
+}
+
+// type check
+var _ NegotiatingUpstream = (*dnsOverHTTPS)(nil)
+
+// NegotiatedProtocol implements the [NegotiatingUpstream] interface for
+// *dnsOverHTTPS.
+func (p *dnsOverHTTPS) NegotiatedProtocol() (proto string) {
+	p.protoMu.Lock()
+	defer p.protoMu.Unlock()
+
+	return p.proto
+}
+
+// setProto sets the HTTP protocol of the most recent response.
+func (p *dnsOverHTTPS) setProto(proto string) {
+	p.protoMu.Lock()
+	defer p.protoMu.Unlock()
+
+	p.proto = proto
+}
+
+// doRequest sends the wire-format query buf to the upstream using method.  The
+// request is cancelled as soon as ctx is done.
+func (p *dnsOverHTTPS) doRequest(
+	ctx context.Context,
+	client *http.Client,
+	method DoHMethod,
+	buf []byte,
+) (httpResp *http.Response, err error) {
+	var query string
+	var body io.Reader
+	httpMethod := string(method)
+	if method == DoHMethodGet {
+		query = url.Values{
+			"dns": []string{base64.RawURLEncoding.EncodeToString(buf)},
+		}.Encode()
+
+		if isHTTP3(client) {
+			// If we're using HTTP/3, use http3.MethodGet0RTT to force using
+			// 0-RTT.
+			httpMethod = http3.MethodGet0RTT
+		}
+	} else {
+		body = bytes.NewReader(buf)
+	}
+
+	u := p.requestURL(query)
+	httpReq, err := http.NewRequestWithContext(ctx, httpMethod, u.String(), body)
 	if err != nil {
-		return nil, fmt.Errorf(
-			"unpacking response from %s: body is %s: %w",
-			p.addrRedacted,
-			body,
-			err,
-		)
+		return nil, fmt.Errorf("creating http request to %s: %w", p.addrRedacted, err)
 	}
 
-	if resp.Id != req.Id {
-		err = dns.ErrId
+	httpReq.Header.Set("Accept", "application/dns-message")
+	httpReq.Header.Set("User-Agent", "")
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/dns-message")
 	}
 
-	return resp, err
+	httpResp, err = client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", p.addrRedacted, err)
+	}
+
+	return httpResp, nil
+}
+
+// requestURL returns the URL of the HTTP requests to the server.  It keeps the
+// path and the query parameters of the configured URL, e.g. the authentication
+// tokens, as is, and appends the encoded query parameters, if any.
+func (p *dnsOverHTTPS) requestURL(query string) (u *url.URL) {
+	u = &url.URL{
+		Scheme:   p.addr.Scheme,
+		User:     p.addr.User,
+		Host:     p.addr.Host,
+		Path:     p.addr.Path,
+		RawPath:  p.addr.RawPath,
+		RawQuery: p.addr.RawQuery,
+	}
+
+	if u.RawQuery == "" {
+		u.RawQuery = query
+	} else if query != "" {
+		u.RawQuery += "&" + query
+	}
+
+	return u
 }
 
 // shouldRetry checks what error we have received and returns true if we should
@@ -326,6 +639,13 @@ func (p *dnsOverHTTPS) shouldRetry(err error) (ok bool) {
 	return false
 }
 
+// isConnReset returns true if err means that the connection has been closed by
+// the peer.
+func isConnReset(err error) (ok bool) {
+	return err != nil &&
+		(errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || isConnBroken(err))
+}
+
 // resetClient triggers re-creation of the *http.Client that is used by this
 // upstream.  This method accepts the error that caused resetting client as
 // depending on the error we may also reset the QUIC config.
@@ -448,18 +768,29 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 	}
 
 	transport := &http.Transport{
-		TLSClientConfig:    tlsConf,
-		DisableCompression: true,
-		DialContext:        dialContext,
-		IdleConnTimeout:    transportDefaultIdleConnTimeout,
-		MaxConnsPerHost:    dohMaxConnsPerHost,
-		MaxIdleConns:       dohMaxIdleConns,
+		TLSClientConfig:     tlsConf,
+		DisableCompression:  true,
+		DialContext:         dialContext,
+		IdleConnTimeout:     p.idleConnTimeout,
+		MaxConnsPerHost:     dohMaxConnsPerHost,
+		MaxIdleConns:        p.maxIdleConns,
+		MaxIdleConnsPerHost: p.maxIdleConns,
 		// Since we have a custom DialContext, we need to use this field to make
 		// golang http.Client attempt to use HTTP/2. Otherwise, it would only be
 		// used when negotiated on the TLS level.
 		ForceAttemptHTTP2: true,
 	}
 
+	if !p.supportsH2() {
+		// Some middleboxes break HTTP/2, so don't let the transport negotiate
+		// it when it's not explicitly enabled.  Non-nil empty TLSNextProto
+		// disables HTTP/2 in the transport.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+		return transport, nil
+	}
+
 	// Explicitly configure transport to use HTTP/2.
 	//
 	// See https://github.com/AdguardTeam/dnsproxy/issues/11.
@@ -550,8 +881,23 @@ func (p *dnsOverHTTPS) createTransportH3(
 			tlsCfg *tls.Config,
 			cfg *quic.Config,
 		) (c quic.EarlyConnection, err error) {
-			c, err = quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
-			return c, err
+			if p.binding == nil || p.binding.DSCP == 0 {
+				return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+			}
+
+			pconn, raddr, err := listenMarked(ctx, p.binding, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			c, err = quic.DialEarly(ctx, pconn, raddr, tlsCfg, cfg)
+			if err != nil {
+				return nil, errors.WithDeferred(err, pconn.Close())
+			}
+
+			closeWithConn(c, pconn)
+
+			return c, nil
 		},
 		DisableCompression: true,
 		TLSClientConfig:    tlsConfig,
@@ -661,7 +1007,7 @@ func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan err
 func (p *dnsOverHTTPS) probeTLS(dialContext bootstrap.DialHandler, tlsConfig *tls.Config, ch chan error) {
 	startTime := time.Now()
 
-	conn, err := tlsDial(dialContext, tlsConfig)
+	conn, err := tlsDial(context.Background(), dialContext, tlsConfig)
 	if err != nil {
 		ch <- fmt.Errorf("opening TLS connection: %w", err)
 		return
@@ -687,6 +1033,17 @@ func (p *dnsOverHTTPS) supportsH3() (ok bool) {
 	return false
 }
 
+// supportsH2 returns true if HTTP/2 is supported by this upstream.
+func (p *dnsOverHTTPS) supportsH2() (ok bool) {
+	for _, v := range p.tlsConf.NextProtos {
+		if v == string(HTTPVersion2) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // supportsHTTP returns true if HTTP/1.1 or HTTP2 is supported by this upstream.
 func (p *dnsOverHTTPS) supportsHTTP() (ok bool) {
 	for _, v := range p.tlsConf.NextProtos {
@@ -698,6 +1055,129 @@ func (p *dnsOverHTTPS) supportsHTTP() (ok bool) {
 	return false
 }
 
+// ProbeHTTPVersion establishes a connection to the DNS-over-HTTPS upstream u
+// without sending any DNS queries and returns the HTTP version the server
+// negotiated via ALPN.  If u fails over among several endpoints, see
+// [Options.DoHAlternateURLs], the current one is probed.  HTTP/3 is tried first
+// if it's enabled for u.  ctx limits the whole probe.  Nothing is cached, so
+// each call establishes new connections, which are closed before returning.
+func ProbeHTTPVersion(ctx context.Context, u Upstream) (v HTTPVersion, err error) {
+	var p *dnsOverHTTPS
+	switch unwrapped := unwrapUpstream(u).(type) {
+	case *dnsOverHTTPS:
+		p = unwrapped
+	case *dohFailover:
+		p = unwrapped.endpoint()
+	default:
+		return "", fmt.Errorf("%s is not a dns-over-https upstream", u.Address())
+	}
+
+	dialContext, err := p.getDialer()
+	if err != nil {
+		return "", fmt.Errorf("bootstrapping %s: %w", p.addrRedacted, err)
+	}
+
+	// Don't spoil the session cache and don't expose the probe connections to
+	// the callbacks, see probeH3.
+	tlsConf := p.tlsConf.Clone()
+	tlsConf.ClientSessionCache = nil
+	tlsConf.VerifyPeerCertificate = nil
+	tlsConf.VerifyConnection = nil
+
+	if !p.supportsH3() {
+		return p.probeALPNTLS(ctx, dialContext, tlsConf)
+	} else if !p.supportsHTTP() {
+		return p.probeALPNQUIC(ctx, dialContext, tlsConf)
+	}
+
+	// Probe TLS in parallel so that an unresponsive QUIC doesn't take the
+	// whole time.
+	type result struct {
+		err error
+		v   HTTPVersion
+	}
+
+	tlsCh := make(chan result, 1)
+	go func() {
+		tlsV, tlsErr := p.probeALPNTLS(ctx, dialContext, tlsConf)
+		tlsCh <- result{err: tlsErr, v: tlsV}
+	}()
+
+	v, err = p.probeALPNQUIC(ctx, dialContext, tlsConf)
+	if err == nil {
+		return v, nil
+	}
+
+	log.Debug("dnsproxy: probing http version of %s: %s", p.addrRedacted, err)
+
+	res := <-tlsCh
+
+	return res.v, res.err
+}
+
+// probeALPNQUIC establishes a QUIC connection to the upstream and returns the
+// negotiated HTTP version.
+func (p *dnsOverHTTPS) probeALPNQUIC(
+	ctx context.Context,
+	dialContext bootstrap.DialHandler,
+	tlsConf *tls.Config,
+) (v HTTPVersion, err error) {
+	// Only use the dialed connection to get the resolved address, see probeH3.
+	rawConn, err := dialContext(ctx, "udp", "")
+	if err != nil {
+		return "", fmt.Errorf("dialing: %w", err)
+	}
+	addr := rawConn.RemoteAddr().String()
+	_ = rawConn.Close()
+
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{string(HTTPVersion3)}
+
+	conn, err := quic.DialAddrEarly(ctx, addr, tlsConf, p.getQUICConfig())
+	if err != nil {
+		return "", fmt.Errorf("opening quic connection to %s: %w", p.addrRedacted, err)
+	}
+
+	// Ignore the error since there's no way we can use it for anything useful.
+	defer func() { _ = conn.CloseWithError(QUICCodeNoError, "") }()
+
+	return HTTPVersion(conn.ConnectionState().TLS.NegotiatedProtocol), nil
+}
+
+// probeALPNTLS establishes a TLS connection to the upstream and returns the
+// negotiated HTTP version.  It returns [HTTPVersion11] if the server doesn't
+// support ALPN.
+func (p *dnsOverHTTPS) probeALPNTLS(
+	ctx context.Context,
+	dialContext bootstrap.DialHandler,
+	tlsConf *tls.Config,
+) (v HTTPVersion, err error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = slices.DeleteFunc(tlsConf.NextProtos, func(proto string) (ok bool) {
+		return proto == string(HTTPVersion3)
+	})
+
+	rawConn, err := dialContext(ctx, networkTCP, "")
+	if err != nil {
+		return "", fmt.Errorf("dialing: %w", err)
+	}
+
+	conn := tls.Client(rawConn, tlsConf)
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	err = conn.HandshakeContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("tls handshake with %s: %w", p.addrRedacted, err)
+	}
+
+	v = HTTPVersion(conn.ConnectionState().NegotiatedProtocol)
+	if v == "" {
+		v = HTTPVersion11
+	}
+
+	return v, nil
+}
+
 // isHTTP3 checks if the *http.Client is an HTTP/3 client.
 func isHTTP3(client *http.Client) (ok bool) {
 	_, ok = client.Transport.(*http3Transport)
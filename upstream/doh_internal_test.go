@@ -1,11 +1,13 @@
 package upstream
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/netip"
@@ -18,44 +20,57 @@ import (
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestUpstreamDoH(t *testing.T) {
 	testCases := []struct {
 		name             string
+		wantProto        string
 		expectedProtocol HTTPVersion
 		httpVersions     []HTTPVersion
 		delayHandshakeH3 time.Duration
 		delayHandshakeH2 time.Duration
 		http3Enabled     bool
 	}{{
+		name:             "http1.1",
+		http3Enabled:     false,
+		httpVersions:     []HTTPVersion{HTTPVersion11},
+		expectedProtocol: HTTPVersion11,
+		wantProto:        "HTTP/1.1",
+	}, {
 		name:             "http1.1_h2",
 		http3Enabled:     false,
 		httpVersions:     []HTTPVersion{HTTPVersion11, HTTPVersion2},
 		expectedProtocol: HTTPVersion2,
+		wantProto:        "HTTP/2.0",
 	}, {
 		name:             "fallback_to_http2",
 		http3Enabled:     false,
 		httpVersions:     []HTTPVersion{HTTPVersion3, HTTPVersion2},
 		expectedProtocol: HTTPVersion2,
+		wantProto:        "HTTP/2.0",
 	}, {
 		name:             "http3",
 		http3Enabled:     true,
 		httpVersions:     []HTTPVersion{HTTPVersion3},
 		expectedProtocol: HTTPVersion3,
+		wantProto:        "HTTP/3.0",
 	}, {
 		name:             "race_http3_faster",
 		http3Enabled:     true,
 		httpVersions:     []HTTPVersion{HTTPVersion3, HTTPVersion2},
 		delayHandshakeH2: time.Second,
 		expectedProtocol: HTTPVersion3,
+		wantProto:        "HTTP/3.0",
 	}, {
 		name:             "race_http2_faster",
 		http3Enabled:     true,
 		httpVersions:     []HTTPVersion{HTTPVersion3, HTTPVersion2},
 		delayHandshakeH3: time.Second,
 		expectedProtocol: HTTPVersion2,
+		wantProto:        "HTTP/2.0",
 	}}
 
 	for _, tc := range testCases {
@@ -94,6 +109,11 @@ func TestUpstreamDoH(t *testing.T) {
 				checkUpstream(t, u, address)
 			}
 
+			nu, ok := u.(NegotiatingUpstream)
+			require.True(t, ok)
+
+			assert.Equal(t, tc.wantProto, nu.NegotiatedProtocol())
+
 			doh := u.(*dnsOverHTTPS)
 
 			// Trigger re-connection.
@@ -108,6 +128,517 @@ func TestUpstreamDoH(t *testing.T) {
 	}
 }
 
+func TestNewDoH_h3Scheme(t *testing.T) {
+	const addr = "h3://dns.example/dns-query"
+
+	testCases := []struct {
+		name         string
+		wantErrMsg   string
+		httpVersions []HTTPVersion
+	}{{
+		name:         "default",
+		wantErrMsg:   "",
+		httpVersions: nil,
+	}, {
+		name:         "with_h3",
+		wantErrMsg:   "",
+		httpVersions: []HTTPVersion{HTTPVersion2, HTTPVersion3},
+	}, {
+		name: "without_h3",
+		wantErrMsg: `h3 scheme conflicts with http versions ["http/1.1" "h2"] ` +
+			`that exclude h3`,
+		httpVersions: []HTTPVersion{HTTPVersion11, HTTPVersion2},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{
+				HTTPVersions: tc.httpVersions,
+			})
+			if tc.wantErrMsg != "" {
+				testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			doh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+			assert.Equal(t, []string{string(HTTPVersion3)}, doh.tlsConf.NextProtos)
+			assert.False(t, doh.supportsHTTP())
+		})
+	}
+}
+
+func TestUpstreamDoH_http11Only(t *testing.T) {
+	srv := startDoHServer(t, testDoHServerOptions{})
+
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		InsecureSkipVerify: true,
+		HTTPVersions:       []HTTPVersion{HTTPVersion11},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	doh := u.(*dnsOverHTTPS)
+
+	rt, err := doh.createTransport()
+	require.NoError(t, err)
+
+	transport := testutil.RequireTypeAssert[*http.Transport](t, rt)
+	assert.Equal(t, []string{string(HTTPVersion11)}, transport.TLSClientConfig.NextProtos)
+	assert.False(t, transport.ForceAttemptHTTP2)
+	assert.NotNil(t, transport.TLSNextProto)
+	assert.Empty(t, transport.TLSNextProto)
+
+	checkUpstream(t, u, address)
+}
+
+func TestUpstreamDoH_idleConns(t *testing.T) {
+	srv := startDoHServer(t, testDoHServerOptions{})
+
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+
+	testCases := []struct {
+		name        string
+		opts        *Options
+		wantTimeout time.Duration
+		wantMax     int
+	}{{
+		name:        "default",
+		opts:        &Options{},
+		wantTimeout: DefaultDoHIdleConnTimeout,
+		wantMax:     dohMaxIdleConns,
+	}, {
+		name: "custom",
+		opts: &Options{
+			DoHIdleConnTimeout: 10 * time.Second,
+			DoHMaxIdleConns:    4,
+		},
+		wantTimeout: 10 * time.Second,
+		wantMax:     4,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts.Clone()
+			opts.InsecureSkipVerify = true
+			opts.HTTPVersions = []HTTPVersion{HTTPVersion11}
+
+			u, err := AddressToUpstream(address, opts)
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			doh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+
+			rt, err := doh.createTransport()
+			require.NoError(t, err)
+
+			transport := testutil.RequireTypeAssert[*http.Transport](t, rt)
+			assert.Equal(t, tc.wantTimeout, transport.IdleConnTimeout)
+			assert.Equal(t, tc.wantMax, transport.MaxIdleConns)
+			assert.Equal(t, tc.wantMax, transport.MaxIdleConnsPerHost)
+		})
+	}
+}
+
+func TestUpstreamDoH_maxResponseSize(t *testing.T) {
+	srv := startDoHServer(t, testDoHServerOptions{})
+
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		InsecureSkipVerify: true,
+		Timeout:            timeout,
+		// The test response is definitely larger.
+		MaxResponseSize: 16,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	resp, err := u.Exchange(createTestMessage())
+	assert.ErrorIs(t, err, ErrResponseTooLarge)
+	assert.Nil(t, resp)
+}
+
+func TestUpstreamDoH_prefetchAAAA(t *testing.T) {
+	qtypes := make(chan uint16, 10)
+	handlerFunc := createDoHHandlerFunc()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		buf, err := io.ReadAll(r.Body)
+		require.NoError(testutil.PanicT{}, err)
+
+		m := &dns.Msg{}
+		require.NoError(testutil.PanicT{}, m.Unpack(buf))
+
+		qtypes <- m.Question[0].Qtype
+
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+		handlerFunc(w, r)
+	})
+
+	srv := startDoHServer(t, testDoHServerOptions{handler: mux})
+
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+	doh, err := AddressToUpstream(address, &Options{
+		InsecureSkipVerify: true,
+		Timeout:            timeout,
+		PrefetchAAAA:       true,
+	})
+	require.NoError(t, err)
+
+	u := NewCachingUpstream(doh, CacheOptions{})
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	resp, err := u.Exchange(createHostTestMessage("example.org"))
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	var got []uint16
+	for range 2 {
+		qt, _ := testutil.RequireReceive(t, qtypes, timeout)
+		got = append(got, qt)
+	}
+	assert.ElementsMatch(t, []uint16{dns.TypeA, dns.TypeAAAA}, got)
+
+	req := createHostTestMessage("example.org")
+	req.Question[0].Qtype = dns.TypeAAAA
+
+	// The prefetched response is cached after it's received, so wait for it.
+	cu := testutil.RequireTypeAssert[*cachingUpstream](t, u)
+	require.Eventually(t, func() (ok bool) {
+		return cu.get(newCacheKey(req)) != nil
+	}, timeout, 10*time.Millisecond)
+
+	resp, err = u.Exchange(req)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	assert.Empty(t, qtypes)
+}
+
+func TestUpstreamDoH_truncatedRetry(t *testing.T) {
+	var reqNum atomic.Uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		reqNum.Add(1)
+
+		buf, err := io.ReadAll(r.Body)
+		require.NoError(testutil.PanicT{}, err)
+
+		req := &dns.Msg{}
+		require.NoError(testutil.PanicT{}, req.Unpack(buf))
+
+		resp := respondToTestMessage(req)
+		if opt := req.IsEdns0(); opt == nil || opt.UDPSize() < dns.MaxMsgSize {
+			resp.Answer = nil
+			resp.Truncated = true
+		} else {
+			resp.SetEdns0(opt.UDPSize(), false)
+		}
+
+		buf, err = resp.Pack()
+		require.NoError(testutil.PanicT{}, err)
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(buf)
+	})
+
+	srv := startDoHServer(t, testDoHServerOptions{handler: mux})
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+
+	u, err := AddressToUpstream(address, &Options{
+		InsecureSkipVerify: true,
+		Timeout:            timeout,
+		TruncatedPolicy:    TruncatedPolicyRetry,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	assert.False(t, resp.Truncated)
+	assert.Nil(t, resp.IsEdns0())
+	assert.Nil(t, req.IsEdns0())
+	assert.Equal(t, uint32(2), reqNum.Load())
+}
+
+func TestUpstreamDoH_method(t *testing.T) {
+	testCases := []struct {
+		name        string
+		method      DoHMethod
+		rejectGET   bool
+		wantMethods []string
+	}{{
+		name:        "default",
+		method:      "",
+		rejectGET:   false,
+		wantMethods: []string{http.MethodPost},
+	}, {
+		name:        "post",
+		method:      DoHMethodPost,
+		rejectGET:   false,
+		wantMethods: []string{http.MethodPost},
+	}, {
+		name:        "get",
+		method:      DoHMethodGet,
+		rejectGET:   false,
+		wantMethods: []string{http.MethodGet},
+	}, {
+		name:        "get_uri_too_long",
+		method:      DoHMethodGet,
+		rejectGET:   true,
+		wantMethods: []string{http.MethodGet, http.MethodPost},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var methods []string
+			handlerFunc := createDoHHandlerFunc()
+			mux := http.NewServeMux()
+			mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+				methods = append(methods, r.Method)
+
+				if r.Method == http.MethodGet {
+					// The unpadded encoding rejects the padding.
+					_, decErr := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+					assert.NoError(testutil.PanicT{}, decErr)
+
+					if tc.rejectGET {
+						http.Error(w, "too long", http.StatusRequestURITooLong)
+
+						return
+					}
+				} else {
+					ct := r.Header.Get("Content-Type")
+					assert.Equal(testutil.PanicT{}, "application/dns-message", ct)
+				}
+
+				assert.Equal(testutil.PanicT{}, "application/dns-message", r.Header.Get("Accept"))
+
+				handlerFunc(w, r)
+			})
+
+			srv := startDoHServer(t, testDoHServerOptions{handler: mux})
+
+			address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+			u, err := AddressToUpstream(address, &Options{
+				InsecureSkipVerify: true,
+				Timeout:            timeout,
+				DoHMethod:          tc.method,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, address)
+			assert.Equal(t, tc.wantMethods, methods)
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := AddressToUpstream("https://dns.example/dns-query", &Options{
+			DoHMethod: http.MethodPut,
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestUpstreamDoH_queryParams(t *testing.T) {
+	const path = "/custom/dns-query"
+
+	handlerFunc := createDoHHandlerFunc()
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("token") != "abc" || q.Get("foo") != "a b" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			assert.NotEmpty(testutil.PanicT{}, q.Get("dns"))
+		} else {
+			assert.False(testutil.PanicT{}, q.Has("dns"))
+		}
+
+		handlerFunc(w, r)
+	})
+
+	srv := startDoHServer(t, testDoHServerOptions{handler: mux})
+	address := fmt.Sprintf("https://%s%s?token=abc&foo=a%%20b", srv.addr, path)
+
+	for _, method := range []DoHMethod{DoHMethodGet, DoHMethodPost} {
+		t.Run(string(method), func(t *testing.T) {
+			u, err := AddressToUpstream(address, &Options{
+				InsecureSkipVerify: true,
+				Timeout:            timeout,
+				DoHMethod:          method,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, address)
+		})
+	}
+}
+
+func TestUpstreamDoH_alternateURLs(t *testing.T) {
+	handlerFunc := createDoHHandlerFunc()
+
+	primaryDown := &atomic.Bool{}
+	primaryDown.Store(true)
+
+	primaryReqs, altReqs := &atomic.Int32{}, &atomic.Int32{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/primary", func(w http.ResponseWriter, r *http.Request) {
+		primaryReqs.Add(1)
+		if primaryDown.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		handlerFunc(w, r)
+	})
+	mux.HandleFunc("/alternate", func(w http.ResponseWriter, r *http.Request) {
+		altReqs.Add(1)
+		handlerFunc(w, r)
+	})
+
+	srv := startDoHServer(t, testDoHServerOptions{handler: mux})
+	address := fmt.Sprintf("https://%s/primary", srv.addr)
+
+	u, err := AddressToUpstream(address, &Options{
+		InsecureSkipVerify: true,
+		Timeout:            timeout,
+		DoHAlternateURLs:   []string{fmt.Sprintf("https://%s/alternate", srv.addr)},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	f := testutil.RequireTypeAssert[*dohFailover](t, u)
+
+	now := time.Now()
+	f.now = func() (n time.Time) { return now }
+
+	assert.Equal(t, address, u.Address())
+	assert.Equal(t, ProtocolHTTPS, UpstreamProtocol(u))
+
+	for range dohFailoverThreshold {
+		_, err = u.Exchange(createTestMessage())
+		require.Error(t, err)
+	}
+
+	assert.Equal(t, int32(dohFailoverThreshold), primaryReqs.Load())
+
+	checkUpstream(t, u, address)
+	assert.Equal(t, int32(1), altReqs.Load())
+	assert.Equal(t, int32(dohFailoverThreshold), primaryReqs.Load())
+
+	// The interfaces are delegated to the current endpoint, the alternate one.
+	assert.Positive(t, f.LastRTT())
+	assert.NotEmpty(t, f.ResolvedAddrs())
+	assert.NotEmpty(t, f.NegotiatedProtocol())
+
+	req, err := createTestMessage().Pack()
+	require.NoError(t, err)
+
+	_, err = f.ExchangeWire(req)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), altReqs.Load())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.Cleanup(cancel)
+
+	v, err := ProbeHTTPVersion(ctx, u)
+	require.NoError(t, err)
+	assert.Equal(t, HTTPVersion2, v)
+
+	primaryDown.Store(false)
+	now = now.Add(dohPrimaryRetryDelay)
+
+	checkUpstream(t, u, address)
+	assert.Equal(t, int32(2), altReqs.Load())
+	assert.Equal(t, int32(dohFailoverThreshold+1), primaryReqs.Load())
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err = AddressToUpstream(address, &Options{
+			DoHAlternateURLs: []string{"tls://dns.example"},
+		})
+		assert.ErrorContains(t, err, "must be an https url")
+	})
+}
+
+func TestProbeHTTPVersion(t *testing.T) {
+	testCases := []struct {
+		name         string
+		want         HTTPVersion
+		httpVersions []HTTPVersion
+		http3Enabled bool
+	}{{
+		name:         "default",
+		want:         HTTPVersion2,
+		httpVersions: nil,
+		http3Enabled: true,
+	}, {
+		name:         "http1.1",
+		want:         HTTPVersion11,
+		httpVersions: []HTTPVersion{HTTPVersion11},
+		http3Enabled: false,
+	}, {
+		name:         "http3",
+		want:         HTTPVersion3,
+		httpVersions: []HTTPVersion{HTTPVersion3, HTTPVersion2},
+		http3Enabled: true,
+	}, {
+		name:         "fallback_to_http2",
+		want:         HTTPVersion2,
+		httpVersions: []HTTPVersion{HTTPVersion3, HTTPVersion2},
+		http3Enabled: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := startDoHServer(t, testDoHServerOptions{
+				http3Enabled: tc.http3Enabled,
+			})
+
+			address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+			u, err := AddressToUpstream(address, &Options{
+				InsecureSkipVerify: true,
+				HTTPVersions:       tc.httpVersions,
+				Timeout:            timeout,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			t.Cleanup(cancel)
+
+			v, err := ProbeHTTPVersion(ctx, u)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, v)
+		})
+	}
+
+	t.Run("not_doh", func(t *testing.T) {
+		u, err := AddressToUpstream("tcp://127.0.0.1:53", &Options{})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = ProbeHTTPVersion(context.Background(), u)
+		assert.Error(t, err)
+	})
+}
+
 func TestUpstreamDoH_raceReconnect(t *testing.T) {
 	testCases := []struct {
 		name             string
@@ -272,6 +803,8 @@ func TestUpstreamDoH_0RTT(t *testing.T) {
 	u, err := AddressToUpstream(address, &Options{
 		InsecureSkipVerify: true,
 		QUICTracer:         tracer.TracerForConnection,
+		// Only GET requests are sent within the 0-RTT early data.
+		DoHMethod: DoHMethodGet,
 	})
 	require.NoError(t, err)
 	testutil.CleanupAndRequireSuccess(t, u.Close)
@@ -475,8 +1008,14 @@ func startDoHServer(
 // incoming DNS message and returns the test response.
 func createDoHHandlerFunc() (f http.HandlerFunc) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		dnsParam := r.URL.Query().Get("dns")
-		buf, err := base64.RawURLEncoding.DecodeString(dnsParam)
+		var buf []byte
+		var err error
+		if r.Method == http.MethodPost {
+			buf, err = io.ReadAll(r.Body)
+		} else {
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		}
+
 		if err != nil {
 			http.Error(
 				w,
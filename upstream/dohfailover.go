@@ -0,0 +1,299 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// dohFailoverThreshold is the number of consecutive failures of the
+	// current endpoint making the upstream switch to the next one, see
+	// [Options.DoHAlternateURLs].
+	dohFailoverThreshold = 3
+
+	// dohPrimaryRetryDelay is the time after which the upstream switched away
+	// from the primary endpoint tries it again.
+	dohPrimaryRetryDelay = 30 * time.Second
+)
+
+// dohFailover is a DNS-over-HTTPS [Upstream] failing over among the equivalent
+// endpoints, see [Options.DoHAlternateURLs].
+type dohFailover struct {
+	// now returns the current time.  It's replaced in tests.
+	now func() (now time.Time)
+
+	// mu protects cur, failures, and retryPrimaryAt.
+	mu *sync.Mutex
+
+	// retryPrimaryAt is the time the primary endpoint should be used again at.
+	retryPrimaryAt time.Time
+
+	// endpoints are the upstreams for each endpoint, the primary one first.
+	endpoints []*dnsOverHTTPS
+
+	// cur is the index of the endpoint currently used within endpoints.
+	cur int
+
+	// failures is the number of consecutive failures of the current endpoint.
+	failures int
+}
+
+// newDoHFailover returns the DNS-over-HTTPS upstream for primary failing over
+// to opts.DoHAlternateURLs.
+func newDoHFailover(primary *dnsOverHTTPS, opts *Options) (u *dohFailover, err error) {
+	endpoints := make([]*dnsOverHTTPS, 0, 1+len(opts.DoHAlternateURLs))
+	endpoints = append(endpoints, primary)
+
+	for _, alt := range opts.DoHAlternateURLs {
+		var p *dnsOverHTTPS
+		p, err = newDoHAlternate(alt, opts)
+		if err != nil {
+			return nil, errors.WithDeferred(err, closeDoHEndpoints(endpoints))
+		}
+
+		endpoints = append(endpoints, p)
+	}
+
+	return &dohFailover{
+		now:       time.Now,
+		mu:        &sync.Mutex{},
+		endpoints: endpoints,
+	}, nil
+}
+
+// newDoHAlternate returns the DNS-over-HTTPS upstream for the alternate
+// endpoint addr.
+func newDoHAlternate(addr string, opts *Options) (p *dnsOverHTTPS, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing doh alternate url: %w", err)
+	} else if (u.Scheme != "https" && u.Scheme != "h3") || u.Host == "" {
+		return nil, fmt.Errorf("doh alternate url %q: must be an https url", u.Redacted())
+	}
+
+	p, err = newDNSOverHTTPS(u, opts)
+	if err != nil {
+		return nil, fmt.Errorf("creating doh alternate %s: %w", u.Redacted(), err)
+	}
+
+	return p, nil
+}
+
+// closeDoHEndpoints closes all the endpoints.
+func closeDoHEndpoints(endpoints []*dnsOverHTTPS) (err error) {
+	var errs []error
+	for _, p := range endpoints {
+		closeErr := p.Close()
+		if closeErr != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", p.Address(), closeErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ Upstream = (*dohFailover)(nil)
+
+// Address implements the [Upstream] interface for *dohFailover.  It's the
+// address of the primary endpoint.
+func (u *dohFailover) Address() (addr string) { return u.endpoints[0].Address() }
+
+// type check
+var _ ProtocolUpstream = (*dohFailover)(nil)
+
+// Protocol implements the [ProtocolUpstream] interface for *dohFailover.
+func (u *dohFailover) Protocol() (proto Protocol) { return ProtocolHTTPS }
+
+// Exchange implements the [Upstream] interface for *dohFailover.
+func (u *dohFailover) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *dohFailover.  It
+// exchanges with the current endpoint and switches to the next one after a
+// number of its consecutive failures.  The cancelled exchanges aren't counted.
+func (u *dohFailover) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	idx := u.current()
+
+	resp, err = u.endpoints[idx].ExchangeContext(ctx, req)
+
+	failed := IsFailure(resp, err)
+	if !failed || ctx.Err() == nil {
+		u.report(idx, failed)
+	}
+
+	return resp, err
+}
+
+// current returns the index of the endpoint to exchange with, switching back
+// to the primary one if it's time to retry it.
+func (u *dohFailover) current() (idx int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.cur != 0 && !u.now().Before(u.retryPrimaryAt) {
+		log.Debug("doh %s: retrying primary endpoint", u.Address())
+
+		u.cur, u.failures = 0, 0
+	}
+
+	return u.cur
+}
+
+// endpoint returns the endpoint currently used.
+func (u *dohFailover) endpoint() (p *dnsOverHTTPS) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.endpoints[u.cur]
+}
+
+// report accounts the result of the exchange with the endpoint at idx.
+func (u *dohFailover) report(idx int, failed bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if idx != u.cur {
+		// The endpoint has already been switched.
+		return
+	} else if !failed {
+		u.failures = 0
+
+		return
+	}
+
+	u.failures++
+	if u.failures < dohFailoverThreshold {
+		return
+	}
+
+	if u.cur == 0 {
+		u.retryPrimaryAt = u.now().Add(dohPrimaryRetryDelay)
+	}
+
+	u.cur, u.failures = (u.cur+1)%len(u.endpoints), 0
+
+	log.Debug(
+		"doh %s: switching to endpoint %s",
+		u.Address(),
+		u.endpoints[u.cur].Address(),
+	)
+}
+
+// Close implements the [Upstream] interface for *dohFailover.  It closes all
+// the endpoints.
+func (u *dohFailover) Close() (err error) { return closeDoHEndpoints(u.endpoints) }
+
+// type check
+var _ UpstreamWithStats = (*dohFailover)(nil)
+
+// LastRTT implements the [UpstreamWithStats] interface for *dohFailover.  It
+// returns the one of the current endpoint.
+func (u *dohFailover) LastRTT() (rtt time.Duration) { return u.endpoint().LastRTT() }
+
+// MeanRTT implements the [UpstreamWithStats] interface for *dohFailover.  It
+// returns the one of the current endpoint.
+func (u *dohFailover) MeanRTT() (rtt time.Duration) { return u.endpoint().MeanRTT() }
+
+// type check
+var _ ResolvingUpstream = (*dohFailover)(nil)
+
+// ResolvedAddrs implements the [ResolvingUpstream] interface for *dohFailover.
+// It returns the ones of the current endpoint.
+func (u *dohFailover) ResolvedAddrs() (addrs []netip.Addr) {
+	return u.endpoint().ResolvedAddrs()
+}
+
+// type check
+var _ NegotiatingUpstream = (*dohFailover)(nil)
+
+// NegotiatedProtocol implements the [NegotiatingUpstream] interface for
+// *dohFailover.  It returns the one of the current endpoint.
+func (u *dohFailover) NegotiatedProtocol() (proto string) {
+	return u.endpoint().NegotiatedProtocol()
+}
+
+// type check
+var _ WireUpstream = (*dohFailover)(nil)
+
+// ExchangeWire implements the [WireUpstream] interface for *dohFailover.  The
+// exchange fails over the same way as with ExchangeContext.
+func (u *dohFailover) ExchangeWire(req []byte) (resp []byte, err error) {
+	return exchangeWire(u, req)
+}
+
+// type check
+var _ timeoutUpstream = (*dohFailover)(nil)
+
+// exchangeTimeout implements the [timeoutUpstream] interface for *dohFailover.
+// It returns the one of the primary endpoint.
+func (u *dohFailover) exchangeTimeout() (d time.Duration) {
+	return u.endpoints[0].exchangeTimeout()
+}
+
+// type check
+var _ RefreshableUpstream = (*dohFailover)(nil)
+
+// Refresh implements the [RefreshableUpstream] interface for *dohFailover.  It
+// refreshes all the endpoints.
+func (u *dohFailover) Refresh() (err error) {
+	var errs []error
+	for _, p := range u.endpoints {
+		errs = append(errs, p.Refresh())
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ ProbableUpstream = (*dohFailover)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *dohFailover.  It
+// succeeds if any of the endpoints responds properly.
+func (u *dohFailover) Probe(ctx context.Context) (err error) {
+	var errs []error
+	for _, p := range u.endpoints {
+		err = p.Probe(ctx)
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ BootstrapSetter = (*dohFailover)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for *dohFailover.  The
+// resolvers are used for all the endpoints.
+func (u *dohFailover) SetBootstrap(resolvers []Resolver) {
+	for _, p := range u.endpoints {
+		p.SetBootstrap(resolvers)
+	}
+}
+
+// type check
+var _ PrefetchingUpstream = (*dohFailover)(nil)
+
+// SetPrefetchHandler implements the [PrefetchingUpstream] interface for
+// *dohFailover.  The handler is used for all the endpoints.
+func (u *dohFailover) SetPrefetchHandler(h PrefetchHandler) {
+	for _, p := range u.endpoints {
+		p.SetPrefetchHandler(h)
+	}
+}
@@ -0,0 +1,183 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// jsonMediaType is the media type of the responses of the DNS-over-HTTPS JSON
+// API.
+const jsonMediaType = "application/dns-json"
+
+// jsonResponse is the response of the DNS-over-HTTPS JSON API.
+type jsonResponse struct {
+	Answer     []*jsonRR `json:"Answer"`
+	Authority  []*jsonRR `json:"Authority"`
+	Additional []*jsonRR `json:"Additional"`
+	Status     int       `json:"Status"`
+	TC         bool      `json:"TC"`
+	RA         bool      `json:"RA"`
+	AD         bool      `json:"AD"`
+	CD         bool      `json:"CD"`
+}
+
+// jsonRR is a resource record within the response of the DNS-over-HTTPS JSON
+// API.
+type jsonRR struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+	TTL  uint32 `json:"TTL"`
+	Type uint16 `json:"type"`
+}
+
+// toRR converts r into a resource record.  The data of r must be in the
+// presentation format of its type.
+func (r *jsonRR) toRR() (rr dns.RR, err error) {
+	data := r.Data
+	if r.Type == dns.TypeTXT && !strings.HasPrefix(data, `"`) {
+		// Some providers don't quote the character strings.
+		data = strconv.Quote(data)
+	}
+
+	s := fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(r.Name), r.TTL, dns.Type(r.Type), data)
+	rr, err = dns.NewRR(s)
+	if err != nil {
+		return nil, err
+	} else if rr == nil {
+		return nil, fmt.Errorf("empty record %q", s)
+	}
+
+	return rr, nil
+}
+
+// exchangeJSON sends req to the upstream using the JSON API and converts the
+// response into a DNS message.
+func (p *dnsOverHTTPS) exchangeJSON(
+	ctx context.Context,
+	client *http.Client,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("json api: expected 1 question, got %d", len(req.Question))
+	}
+
+	start := time.Now()
+
+	httpResp, err := p.doJSONRequest(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.readBody(httpResp)
+	if err != nil {
+		return nil, err
+	}
+
+	ct := httpResp.Header.Get("Content-Type")
+	if ct != "" {
+		mediaType, _, ctErr := mime.ParseMediaType(ct)
+		if ctErr != nil || (mediaType != jsonMediaType && mediaType != "application/json") {
+			return nil, fmt.Errorf("unexpected content type %q from %s", ct, p.addrRedacted)
+		}
+	}
+
+	jsonResp := &jsonResponse{}
+	err = json.Unmarshal(body, jsonResp)
+	if err != nil {
+		return nil, fmt.Errorf("decoding response from %s: %w", p.addrRedacted, err)
+	}
+
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Rcode = jsonResp.Status
+	resp.Truncated = jsonResp.TC
+	resp.RecursionAvailable = jsonResp.RA
+	resp.AuthenticatedData = jsonResp.AD
+	resp.CheckingDisabled = jsonResp.CD
+	resp.Answer = p.jsonRRs(jsonResp.Answer)
+	resp.Ns = p.jsonRRs(jsonResp.Authority)
+	resp.Extra = p.jsonRRs(jsonResp.Additional)
+
+	p.update(time.Since(start))
+
+	return resp, nil
+}
+
+// jsonRRs converts records into resource records skipping the malformed ones.
+func (p *dnsOverHTTPS) jsonRRs(records []*jsonRR) (rrs []dns.RR) {
+	for i, r := range records {
+		rr, err := r.toRR()
+		if err != nil {
+			log.Debug("dnsproxy: %s: skipping json record at index %d: %s", p.addrRedacted, i, err)
+
+			continue
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+// doJSONRequest sends the GET request for the question of req to the upstream.
+// The request is cancelled as soon as ctx is done.
+func (p *dnsOverHTTPS) doJSONRequest(
+	ctx context.Context,
+	client *http.Client,
+	req *dns.Msg,
+) (httpResp *http.Response, err error) {
+	q := req.Question[0]
+	params := url.Values{
+		"name": []string{q.Name},
+		"type": []string{strconv.Itoa(int(q.Qtype))},
+	}
+
+	if req.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		if opt.Do() {
+			params.Set("do", "1")
+		}
+
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				params.Set("edns_client_subnet", fmt.Sprintf("%s/%d", e.Address, e.SourceNetmask))
+			}
+		}
+	}
+
+	u := p.requestURL(params.Encode())
+
+	httpMethod := http.MethodGet
+	if isHTTP3(client) {
+		// If we're using HTTP/3, use http3.MethodGet0RTT to force using 0-RTT.
+		httpMethod = http3.MethodGet0RTT
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, httpMethod, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request to %s: %w", p.addrRedacted, err)
+	}
+
+	httpReq.Header.Set("Accept", jsonMediaType)
+	httpReq.Header.Set("User-Agent", "")
+
+	httpResp, err = client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", p.addrRedacted, err)
+	}
+
+	return httpResp, nil
+}
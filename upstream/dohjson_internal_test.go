@@ -0,0 +1,125 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamDoH_json(t *testing.T) {
+	const host = "json.example."
+
+	queries := make(chan url.Values, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resolve", func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+
+		w.Header().Set("Content-Type", jsonMediaType)
+		_, _ = fmt.Fprintf(w, `{
+			"Status": 0,
+			"RA": true,
+			"AD": true,
+			"Answer": [
+				{"name": %[1]q, "type": 1, "TTL": 42, "data": "1.2.3.4"},
+				{"name": %[1]q, "type": 16, "TTL": 42, "data": "some text"},
+				{"name": %[1]q, "type": 1, "TTL": 42, "data": "malformed"}
+			],
+			"Authority": [
+				{"name": "example.", "type": 6, "TTL": 10, "data": "ns. admin. 1 2 3 4 5"}
+			]
+		}`, host)
+	})
+	mux.HandleFunc("/nxdomain", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write([]byte(`{"Status": 3}`))
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html></html>`))
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	})
+
+	srv := startDoHServer(t, testDoHServerOptions{handler: mux})
+
+	newUpstream := func(t *testing.T, path string) (u Upstream) {
+		t.Helper()
+
+		u, err := AddressToUpstream(fmt.Sprintf("https://%s%s", srv.addr, path), &Options{
+			InsecureSkipVerify: true,
+			Timeout:            timeout,
+			DoHJSON:            true,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		return u
+	}
+
+	t.Run("success", func(t *testing.T) {
+		u := newUpstream(t, "/resolve")
+
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, true)
+		req.CheckingDisabled = true
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		params, _ := testutil.RequireReceive(t, queries, timeout)
+		assert.Equal(t, url.Values{
+			"name": []string{host},
+			"type": []string{"1"},
+			"cd":   []string{"1"},
+			"do":   []string{"1"},
+		}, params)
+
+		assert.Equal(t, req.Id, resp.Id)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.True(t, resp.RecursionAvailable)
+		assert.True(t, resp.AuthenticatedData)
+
+		require.Len(t, resp.Answer, 2)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+		assert.Equal(t, "1.2.3.4", a.A.String())
+		assert.Equal(t, uint32(42), a.Hdr.Ttl)
+
+		txt := testutil.RequireTypeAssert[*dns.TXT](t, resp.Answer[1])
+		assert.Equal(t, []string{"some text"}, txt.Txt)
+
+		require.Len(t, resp.Ns, 1)
+		assert.IsType(t, (*dns.SOA)(nil), resp.Ns[0])
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		u := newUpstream(t, "/nxdomain")
+
+		resp, err := u.Exchange(createTestMessage())
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		assert.Empty(t, resp.Answer)
+	})
+
+	t.Run("bad_content_type", func(t *testing.T) {
+		u := newUpstream(t, "/html")
+
+		_, err := u.Exchange(createTestMessage())
+		assert.ErrorContains(t, err, `unexpected content type "text/html"`)
+	})
+
+	t.Run("bad_status", func(t *testing.T) {
+		u := newUpstream(t, "/error")
+
+		_, err := u.Exchange(createTestMessage())
+		assert.ErrorContains(t, err, "expected status 200, got 400")
+	})
+}
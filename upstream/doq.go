@@ -3,17 +3,22 @@ package upstream
 import (
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"runtime"
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
@@ -29,6 +34,14 @@ const (
 	// connection.
 	QUICCodeInternalError = quic.ApplicationErrorCode(1)
 
+	// QUICCodeProtocolError signals that the DoQ implementation encountered
+	// a protocol error and is forcibly aborting the connection or stream.
+	QUICCodeProtocolError = quic.ApplicationErrorCode(2)
+
+	// QUICCodeRequestCancelled signals that the client has cancelled the
+	// request, so the response is no longer needed.
+	QUICCodeRequestCancelled = quic.ApplicationErrorCode(3)
+
 	// QUICKeepAlivePeriod is the value that we pass to *quic.Config and that
 	// controls the period with with keep-alive frames are being sent to the
 	// connection. We set it to 20s as it would be in the quic-go@v0.27.1 with
@@ -54,9 +67,9 @@ var compatProtoDQ = []string{NextProtoDQ, "doq-i00", "dq", "doq-i02"}
 // dnsOverQUIC implements the [Upstream] interface for the DNS-over-QUIC
 // protocol (spec: https://www.rfc-editor.org/rfc/rfc9250.html).
 type dnsOverQUIC struct {
-	// getDialer either returns an initialized dial handler or creates a new
-	// one.
-	getDialer DialerInitializer
+	// bootstrapper resolves the upstream's hostname and creates dial
+	// handlers.
+	*bootstrapper
 
 	// addr is the DNS-over-QUIC server URL.
 	addr *url.URL
@@ -64,6 +77,9 @@ type dnsOverQUIC struct {
 	// tlsConf is the configuration of TLS.
 	tlsConf *tls.Config
 
+	// rttStats measures the round-trip time of the exchanges.
+	*rttStats
+
 	// quicConfig is the QUIC configuration that is used for establishing
 	// connections to the upstream.  This configuration includes the TokenStore
 	// that needs to be stored for the lifetime of dnsOverQUIC since we can
@@ -74,6 +90,21 @@ type dnsOverQUIC struct {
 	// re-opened when needed.
 	conn quic.Connection
 
+	// lastUsed is the time when conn was last used for an exchange.
+	lastUsed time.Time
+
+	// inFlight is the number of exchanges in flight for each connection, both
+	// the current and the draining ones.  It's protected by connMu.
+	inFlight map[quic.Connection]int
+
+	// draining are the connections replaced after reaching maxStreams or
+	// refreshing, which are closed as soon as their exchanges are finished.  It's protected by
+	// connMu.
+	draining map[quic.Connection]struct{}
+
+	// maxRespSize is the maximum size of the response message.
+	maxRespSize int
+
 	// bytesPool is a *sync.Pool we use to store byte buffers in.  These byte
 	// buffers are used to read responses from the upstream.
 	bytesPool *sync.Pool
@@ -89,55 +120,171 @@ type dnsOverQUIC struct {
 
 	// timeout is the timeout for the upstream connection.
 	timeout time.Duration
+
+	// probeTimeout is the timeout of the health-check probes.
+	probeTimeout time.Duration
+
+	// active tracks the exchanges in flight, so that Close waits for them.
+	active *inflight
+
+	// idleTimeout is the time after which an unused connection is closed
+	// instead of being used for the next exchange.  Zero means no limit.
+	idleTimeout time.Duration
+
+	// maxStreams is the maximum number of exchanges over a single connection.
+	// Zero means no limit.
+	maxStreams int
+
+	// streams is the number of exchanges started over conn.  It's protected by
+	// connMu.
+	streams int
+
+	// reconnects is the number of times a broken or idle connection has been
+	// replaced with a new one.  It's protected by connMu.
+	reconnects uint64
+
+	// forceRD is true if the RD bit should be set in the outgoing queries.
+	forceRD bool
+
+	// enable0RTT is true if the idempotent queries may be sent within the 0-RTT
+	// early data of resumed connections.
+	enable0RTT bool
+
+	// tcPolicy defines how the responses with the TC bit set are handled.
+	tcPolicy TruncatedPolicy
+
+	// localIP is the source address of the network path conn has been dialed
+	// over.  It's protected by connMu.
+	localIP netip.Addr
+
+	// fallback is the DNS-over-TLS upstream for the same server used while
+	// the QUIC connections can't be established.  It's nil if the fallback
+	// is disabled, see [Options.DoQFallbackToDoT].
+	fallback Upstream
+
+	// fallbackMu protects fallbackUntil.
+	fallbackMu *sync.Mutex
+
+	// fallbackUntil is the time until which the exchanges are sent to
+	// fallback instead of trying QUIC.  It's zero if QUIC is used.
+	fallbackUntil time.Time
+
+	// migration is true if conn should be replaced once the network path to
+	// the server changes.
+	migration bool
 }
 
 // newDoQ returns the DNS-over-QUIC Upstream.
 func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
+	if opts.ProxyURL != nil {
+		return nil, fmt.Errorf("quic %s: %w", addr.Host, ErrProxyUDP)
+	}
+
 	addPort(addr, defaultPortDoQ)
 
-	u = &dnsOverQUIC{
-		getDialer: newDialerInitializer(addr, opts),
-		addr:      addr,
+	b, err := newBootstrapper(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf, err := newTLSConfig(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf.NextProtos = compatProtoDQ
+
+	ups := &dnsOverQUIC{
+		bootstrapper: b,
+		rttStats:     newRTTStats(opts),
+		addr:         addr,
 		quicConfig: &quic.Config{
 			KeepAlivePeriod: QUICKeepAlivePeriod,
 			TokenStore:      newQUICTokenStore(),
 			Tracer:          opts.QUICTracer,
 		},
-		tlsConf: &tls.Config{
-			ServerName:   addr.Hostname(),
-			RootCAs:      opts.RootCAs,
-			CipherSuites: opts.CipherSuites,
-			// Use the default capacity for the LRU cache.  It may be useful to
-			// store several caches since the user may be routed to different
-			// servers in case there's load balancing on the server-side.
-			ClientSessionCache: tls.NewLRUClientSessionCache(0),
-			MinVersion:         tls.VersionTLS12,
-			// #nosec G402 -- TLS certificate verification could be disabled by
-			// configuration.
-			InsecureSkipVerify:    opts.InsecureSkipVerify,
-			VerifyPeerCertificate: opts.VerifyServerCertificate,
-			VerifyConnection:      opts.VerifyConnection,
-			NextProtos:            compatProtoDQ,
-		},
+		tlsConf:      tlsConf,
 		quicConfigMu: &sync.Mutex{},
 		connMu:       &sync.Mutex{},
 		bytesPoolMu:  &sync.Mutex{},
+		maxRespSize:  maxResponseSize(opts),
 		timeout:      opts.Timeout,
+		forceRD:      !opts.PreserveRecursionDesired,
+		probeTimeout: opts.ProbeTimeout,
+		active:       newInflight(opts),
+		idleTimeout:  opts.DoQIdleTimeout,
+		maxStreams:   opts.DoQMaxStreamsPerConn,
+		inFlight:     map[quic.Connection]int{},
+		draining:     map[quic.Connection]struct{}{},
+		enable0RTT:   opts.EnableQUIC0RTT,
+		tcPolicy:     truncatedPolicy(opts),
+		migration:    opts.EnableQUICMigration,
+		fallbackMu:   &sync.Mutex{},
+	}
+
+	if opts.DoQFallbackToDoT {
+		ups.fallback, err = newDoQFallback(addr, opts)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	runtime.SetFinalizer(u, (*dnsOverQUIC).Close)
+	runtime.SetFinalizer(ups, (*dnsOverQUIC).Close)
 
-	return u, nil
+	return ups, nil
 }
 
 // type check
-var _ Upstream = (*dnsOverQUIC)(nil)
+var _ UpstreamWithStats = (*dnsOverQUIC)(nil)
+
+// type check
+var _ ResolvingUpstream = (*dnsOverQUIC)(nil)
 
 // Address implements the [Upstream] interface for *dnsOverQUIC.
 func (p *dnsOverQUIC) Address() string { return p.addr.String() }
 
+// type check
+var _ ProtocolUpstream = (*dnsOverQUIC)(nil)
+
+// Protocol implements the [ProtocolUpstream] interface for *dnsOverQUIC.
+func (p *dnsOverQUIC) Protocol() (proto Protocol) { return ProtocolQUIC }
+
 // Exchange implements the [Upstream] interface for *dnsOverQUIC.
 func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext implements the [Upstream] interface for *dnsOverQUIC.  The
+// cancelled exchanges don't affect the connection.  If the fallback is enabled
+// and the QUIC connection can't be established, the exchange is sent over
+// DNS-over-TLS instead, see [Options.DoQFallbackToDoT].
+func (p *dnsOverQUIC) ExchangeContext(
+	ctx context.Context,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if p.fallback == nil {
+		return p.exchangeDoQ(ctx, m)
+	}
+
+	return p.exchangeWithFallback(ctx, m)
+}
+
+// exchangeDoQ exchanges m with the upstream over QUIC.  The errors caused by
+// the failure to establish the connection are wrapped with *quicDialError.
+func (p *dnsOverQUIC) exchangeDoQ(
+	ctx context.Context,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	defer func() { err = classifyError(err) }()
+
+	err = p.active.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer p.active.end()
+
+	restoreRD := forceRecursionDesired(m, p.forceRD)
+	defer func() { restoreRD(resp) }()
+
 	// When sending queries over a QUIC connection, the DNS Message ID MUST be
 	// set to zero.
 	id := m.Id
@@ -151,18 +298,28 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 	}()
 
 	// Gets or opens a QUIC connection to use for this query.
-	conn, cached, err := p.getConnection()
+	conn, cached, err := p.getConnection(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("getting conn: %w", err)
+		return nil, &quicDialError{err: fmt.Errorf("getting conn: %w", err)}
 	}
+	defer p.releaseConnection(conn)
 
 	// Make the first attempt to send the DNS query.
-	resp, err = p.exchangeQUIC(m, conn)
+	resp, err = p.exchangeQUIC(ctx, m, conn)
+	if ec, ok := conn.(quic.EarlyConnection); ok && errors.Is(err, quic.Err0RTTRejected) {
+		// The server has rejected the early data, so send the query again
+		// after the handshake.
+		log.Debug("dnsproxy: %s: 0-RTT rejected, retrying with 1-RTT", p.addr)
+
+		conn = ec.NextConnection()
+		resp, err = p.exchangeQUIC(ctx, m, conn)
+	}
 
 	// Failure to use a cached connection should be handled gracefully as this
 	// connection could have been closed by the server or simply be broken due
 	// to how UDP NAT works.  In this case the connection should be re-created.
-	if cached && err != nil {
+	// The same applies to the connection-level errors on a new connection.
+	if err != nil && ctx.Err() == nil && (cached || isQUICRetryError(err)) {
 		log.Debug("dnsproxy: re-creating the QUIC connection and retrying due to %v", err)
 
 		// Close the active connection to make sure the cached connection is
@@ -171,52 +328,129 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
 
 		// Get or re-create the QUIC connection in order to make the second
 		// attempt.
-		conn, _, err = p.getConnection()
+		conn, _, err = p.getConnection(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("getting new conn: %w", err)
+			return nil, &quicDialError{err: fmt.Errorf("getting new conn: %w", err)}
 		}
+		defer p.releaseConnection(conn)
 
 		// Retry sending the request through the new connection.
-		resp, err = p.exchangeQUIC(m, conn)
+		resp, err = p.exchangeQUIC(ctx, m, conn)
 	}
 
 	if err != nil {
 		// If we're unable to exchange messages, make sure the connection is
-		// closed and signal about an internal error.
-		p.closeConnWithError(conn, err)
+		// closed and signal about an internal error.  Don't close it if the
+		// exchange has been cancelled, since it's still usable.
+		if ctx.Err() == nil {
+			p.closeConnWithError(conn, err)
+		}
+
+		return resp, err
 	}
 
-	return resp, err
+	exchange := func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+		return p.exchangeQUIC(ctx, req, conn)
+	}
+
+	return retryTruncated(ctx, m, resp, p.Address(), p.tcPolicy, exchange)
 }
 
 // Close implements the [Upstream] interface for *dnsOverQUIC.
 func (p *dnsOverQUIC) Close() (err error) {
+	p.active.shutdown()
+
 	p.connMu.Lock()
 	defer p.connMu.Unlock()
 
 	runtime.SetFinalizer(p, nil)
 
+	var errs []error
 	if p.conn != nil {
-		err = p.conn.CloseWithError(QUICCodeNoError, "")
+		errs = append(errs, p.conn.CloseWithError(QUICCodeNoError, ""))
+	}
+
+	for conn := range p.draining {
+		errs = append(errs, conn.CloseWithError(QUICCodeNoError, ""))
+		delete(p.draining, conn)
+	}
+
+	if p.fallback != nil {
+		errs = append(errs, p.fallback.Close())
 	}
 
-	return err
+	return errors.Join(errs...)
+}
+
+// type check
+var _ RefreshableUpstream = (*dnsOverQUIC)(nil)
+
+// Refresh implements the [RefreshableUpstream] interface for *dnsOverQUIC.  It
+// makes the following exchanges use a new connection and closes the current
+// one after its exchanges in flight are finished.  The stored TLS sessions are
+// discarded.  The fallback upstream, if any, is refreshed as well.
+func (p *dnsOverQUIC) Refresh() (err error) {
+	p.expireResolved()
+	clearSessions(p.tlsConf)
+
+	p.connMu.Lock()
+	if p.conn != nil {
+		p.drain(p.conn)
+		p.conn = nil
+	}
+	p.connMu.Unlock()
+
+	if r, ok := p.fallback.(RefreshableUpstream); ok {
+		return r.Refresh()
+	}
+
+	return nil
+}
+
+// type check
+var _ BootstrapSetter = (*dnsOverQUIC)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for *dnsOverQUIC.  It
+// also sets the resolvers of the fallback upstream, if any.
+func (p *dnsOverQUIC) SetBootstrap(resolvers []Resolver) {
+	p.bootstrapper.SetBootstrap(resolvers)
+
+	setBootstrap(p.fallback, resolvers)
+}
+
+// type check
+var _ ProbableUpstream = (*dnsOverQUIC)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *dnsOverQUIC.
+func (p *dnsOverQUIC) Probe(ctx context.Context) (err error) {
+	return probe(ctx, p, p.probeTimeout)
 }
 
 // exchangeQUIC attempts to open a new QUIC stream, send the DNS message
 // through it and return the response it got from the server.
-func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn quic.Connection) (resp *dns.Msg, err error) {
+func (p *dnsOverQUIC) exchangeQUIC(
+	ctx context.Context,
+	req *dns.Msg,
+	conn quic.Connection,
+) (resp *dns.Msg, err error) {
 	addr := p.Address()
 
 	logBegin(addr, networkUDP, req)
-	defer func() { logFinish(addr, networkUDP, err) }()
+	defer func() { logFinish(addr, networkUDP, resp, err) }()
 
 	buf, err := req.Pack()
 	if err != nil {
 		return nil, fmt.Errorf("failed to pack DNS message for DoQ: %w", err)
 	}
 
-	stream, err := p.openStream(conn)
+	start := time.Now()
+
+	early, err := p.sendsEarly(ctx, req, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := p.openStream(ctx, conn)
 	if err != nil {
 		return nil, fmt.Errorf("opening stream: %w", err)
 	}
@@ -228,6 +462,18 @@ func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn quic.Connection) (resp *dn
 		}
 	}
 
+	// Cancel the stream in both directions as soon as ctx is done, as RFC 9250
+	// prescribes for the requests the client is no longer interested in.
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(quic.StreamErrorCode(QUICCodeRequestCancelled))
+		stream.CancelWrite(quic.StreamErrorCode(QUICCodeRequestCancelled))
+	})
+	defer func() {
+		if !stop() && err != nil {
+			err = fmt.Errorf("exchange aborted: %w: %w", ctx.Err(), err)
+		}
+	}()
+
 	_, err = stream.Write(proxyutil.AddPrefix(buf))
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to a QUIC stream: %w", err)
@@ -242,7 +488,54 @@ func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn quic.Connection) (resp *dn
 		log.Debug("dnsproxy: closing quic stream: %s", err)
 	}
 
-	return p.readMsg(stream)
+	resp, err = p.readMsg(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	p.update(time.Since(start))
+
+	if p.enable0RTT {
+		used := early && conn.ConnectionState().Used0RTT
+		log.Debug("dnsproxy: %s: exchange used 0-RTT: %t", addr, used)
+	}
+
+	return resp, nil
+}
+
+// sendsEarly returns true if req is going to be sent within the 0-RTT early
+// data of conn.  Since the early data can be replayed, it waits for the
+// handshake to complete if req isn't idempotent.
+func (p *dnsOverQUIC) sendsEarly(
+	ctx context.Context,
+	req *dns.Msg,
+	conn quic.Connection,
+) (early bool, err error) {
+	ec, ok := conn.(quic.EarlyConnection)
+	if !p.enable0RTT || !ok {
+		return false, nil
+	}
+
+	select {
+	case <-ec.HandshakeComplete():
+		return false, nil
+	default:
+		// Go on.
+	}
+
+	if req.Opcode == dns.OpcodeQuery {
+		return true, nil
+	}
+
+	ctx, cancel := p.withDeadline(ctx)
+	defer cancel()
+
+	select {
+	case <-ec.HandshakeComplete():
+		return false, nil
+	case <-ctx.Done():
+		return false, fmt.Errorf("waiting for handshake: %w", ctx.Err())
+	}
 }
 
 // getBytesPool returns (creates if needed) a pool we store byte buffers in.
@@ -264,26 +557,116 @@ func (p *dnsOverQUIC) getBytesPool() (pool *sync.Pool) {
 }
 
 // getConnection opens or returns an existing quic.Connection and indicates
-// whether it opened a new connection or used an existing cached one.
-func (p *dnsOverQUIC) getConnection() (conn quic.Connection, cached bool, err error) {
+// whether it opened a new connection or used an existing cached one.  ctx is
+// only used to dial the new connection.  conn must be passed to
+// releaseConnection after the exchange.
+func (p *dnsOverQUIC) getConnection(
+	ctx context.Context,
+) (conn quic.Connection, cached bool, err error) {
 	p.connMu.Lock()
 	defer p.connMu.Unlock()
 
+	now := time.Now()
+
 	conn = p.conn
 	if conn != nil {
-		return conn, true, nil
+		if p.maxStreams > 0 && p.streams >= p.maxStreams {
+			p.reconnects++
+			log.Debug(
+				"dnsproxy: %s: conn reached %d streams, reconnecting: %d reconnects",
+				p.addr,
+				p.maxStreams,
+				p.reconnects,
+			)
+
+			p.drain(conn)
+		} else if p.migration && p.pathChanged(ctx) {
+			p.reconnects++
+			log.Debug(
+				"dnsproxy: %s: network path changed, reconnecting: %d reconnects",
+				p.addr,
+				p.reconnects,
+			)
+
+			p.drain(conn)
+		} else if p.idleTimeout <= 0 || now.Sub(p.lastUsed) < p.idleTimeout {
+			p.lastUsed = now
+			p.acquire(conn)
+
+			return conn, true, nil
+		} else {
+			// The connection could have been silently dropped by the server or
+			// a NAT, so don't risk using it.
+			p.reconnects++
+			log.Debug(
+				"dnsproxy: %s: conn idle, reconnecting: %d reconnects",
+				p.addr,
+				p.reconnects,
+			)
+
+			err = conn.CloseWithError(QUICCodeNoError, "")
+			if err != nil {
+				log.Debug("dnsproxy: %s: closing idle conn: %s", p.addr, err)
+			}
+		}
+
+		p.conn = nil
 	}
 
-	conn, err = p.openConnection()
+	conn, localIP, err := p.openConnection(ctx)
 	if err != nil {
 		return nil, false, err
 	}
 
 	p.conn = conn
+	p.localIP = localIP
+	p.lastUsed = now
+	p.streams = 0
+	p.acquire(conn)
 
 	return conn, false, nil
 }
 
+// acquire accounts for a new exchange over conn.  p.connMu is expected to be
+// locked.
+func (p *dnsOverQUIC) acquire(conn quic.Connection) {
+	p.streams++
+	p.inFlight[conn]++
+}
+
+// drain closes conn if there are no exchanges in flight over it, or marks it
+// to be closed after them otherwise.  p.connMu is expected to be locked.
+func (p *dnsOverQUIC) drain(conn quic.Connection) {
+	if p.inFlight[conn] > 0 {
+		p.draining[conn] = struct{}{}
+
+		return
+	}
+
+	err := conn.CloseWithError(QUICCodeNoError, "")
+	if err != nil {
+		log.Debug("dnsproxy: %s: closing drained conn: %s", p.addr, err)
+	}
+}
+
+// releaseConnection accounts for the finished exchange over conn returned by
+// getConnection, closing it if it's drained.
+func (p *dnsOverQUIC) releaseConnection(conn quic.Connection) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	p.inFlight[conn]--
+	if p.inFlight[conn] > 0 {
+		return
+	}
+
+	delete(p.inFlight, conn)
+	if _, ok := p.draining[conn]; ok {
+		delete(p.draining, conn)
+		p.drain(conn)
+	}
+}
+
 // getQUICConfig returns the QUIC config in a thread-safe manner.  Note, that
 // this method returns a pointer, it is forbidden to change its properties.
 func (p *dnsOverQUIC) getQUICConfig() (c *quic.Config) {
@@ -304,8 +687,8 @@ func (p *dnsOverQUIC) resetQUICConfig() {
 }
 
 // openStream opens a new QUIC stream for the specified connection.
-func (p *dnsOverQUIC) openStream(conn quic.Connection) (quic.Stream, error) {
-	ctx, cancel := p.withDeadline(context.Background())
+func (p *dnsOverQUIC) openStream(ctx context.Context, conn quic.Connection) (quic.Stream, error) {
+	ctx, cancel := p.withDeadline(ctx)
 	defer cancel()
 
 	stream, err := conn.OpenStreamSync(ctx)
@@ -316,17 +699,106 @@ func (p *dnsOverQUIC) openStream(conn quic.Connection) (quic.Stream, error) {
 	return stream, nil
 }
 
-// openConnection dials a new QUIC connection.
-func (p *dnsOverQUIC) openConnection() (conn quic.Connection, err error) {
+// openConnection dials a new QUIC connection.  localIP is the source address
+// of the network path to the server.
+func (p *dnsOverQUIC) openConnection(
+	ctx context.Context,
+) (conn quic.Connection, localIP netip.Addr, err error) {
+	udpConn, err := p.dialPath(ctx)
+	if err != nil {
+		return nil, netip.Addr{}, err
+	}
+
+	addr := udpConn.RemoteAddr().String()
+	localIP = netutil.NetAddrToAddrPort(udpConn.LocalAddr()).Addr()
+
+	ctx, cancel := p.withDeadline(ctx)
+	defer cancel()
+
+	if p.binding != nil && p.binding.DSCP != 0 {
+		conn, err = p.dialMarked(ctx, addr)
+	} else if p.enable0RTT {
+		conn, err = quic.DialAddrEarly(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	} else {
+		conn, err = quic.DialAddr(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	}
+
+	if err != nil {
+		return nil, netip.Addr{}, fmt.Errorf("dialing quic connection to %s: %w", p.addr, err)
+	}
+
+	return conn, localIP, nil
+}
+
+// dialMarked dials a new QUIC connection to addr over its own UDP socket
+// marking the packets with the DSCP, see [Options.DSCP].
+func (p *dnsOverQUIC) dialMarked(ctx context.Context, addr string) (conn quic.Connection, err error) {
+	pconn, raddr, err := listenMarked(ctx, p.binding, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.enable0RTT {
+		conn, err = quic.DialEarly(ctx, pconn, raddr, p.tlsConf.Clone(), p.getQUICConfig())
+	} else {
+		conn, err = quic.Dial(ctx, pconn, raddr, p.tlsConf.Clone(), p.getQUICConfig())
+	}
+
+	if err != nil {
+		return nil, errors.WithDeferred(err, pconn.Close())
+	}
+
+	closeWithConn(conn, pconn)
+
+	return conn, nil
+}
+
+// packetConn hides the optional interfaces of the wrapped [net.PacketConn].
+type packetConn struct {
+	net.PacketConn
+}
+
+// listenMarked opens the UDP socket to dial the QUIC connection to addr from.
+// The socket marks the packets with the DSCP of b, which must not be nil.  It
+// should be closed along with the connection, see [closeWithConn].
+func listenMarked(
+	ctx context.Context,
+	b *bootstrap.Binding,
+	addr string,
+) (pconn net.PacketConn, raddr *net.UDPAddr, err error) {
+	raddr, err = net.ResolveUDPAddr(networkUDP, addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing address: %w", err)
+	}
+
+	udpConn, err := b.ListenPacket(ctx, addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening socket: %w", err)
+	}
+
+	// Don't let quic-go use the ECN and GSO features of the socket, since it
+	// overrides the traffic class of each packet with the ECN bits then.
+	return packetConn{PacketConn: udpConn}, raddr, nil
+}
+
+// closeWithConn closes pconn as soon as conn is closed.
+func closeWithConn(conn quic.Connection, pconn net.PacketConn) {
+	go func() {
+		<-conn.Context().Done()
+		log.OnCloserError(pconn, log.DEBUG)
+	}()
+}
+
+// dialPath returns the closed UDP connection to the server.  It doesn't send
+// anything, but makes the system choose the reachable address of the server,
+// when there are both IPv4 and IPv6 ones, and the route to it.
+func (p *dnsOverQUIC) dialPath(ctx context.Context) (udpConn *net.UDPConn, err error) {
 	dialContext, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("bootstrapping %s: %w", p.addr, err)
 	}
 
-	// we're using bootstrapped address instead of what's passed to the function
-	// it does not create an actual connection, but it helps us determine
-	// what IP is actually reachable (when there're v4/v6 addresses).
-	rawConn, err := dialContext(context.Background(), "udp", "")
+	rawConn, err := dialContext(ctx, "udp", "")
 	if err != nil {
 		return nil, fmt.Errorf("dialing raw connection to %s: %w", p.addr, err)
 	}
@@ -342,17 +814,24 @@ func (p *dnsOverQUIC) openConnection() (conn quic.Connection, err error) {
 		return nil, fmt.Errorf("unexpected type %T of connection; should be %T", rawConn, udpConn)
 	}
 
-	addr := udpConn.RemoteAddr().String()
-
-	ctx, cancel := p.withDeadline(context.Background())
-	defer cancel()
+	return udpConn, nil
+}
 
-	conn, err = quic.DialAddrEarly(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+// pathChanged returns true if the source address of the network path to the
+// server differs from the one conn has been dialed over, e.g. after switching
+// from Wi-Fi to a cellular network.  quic-go doesn't support the client-side
+// connection migration, so the connection has to be replaced in this case.
+// It also returns true if the server is unreachable, since dialing a new
+// connection reports the error properly.  p.connMu is expected to be locked.
+func (p *dnsOverQUIC) pathChanged(ctx context.Context) (ok bool) {
+	udpConn, err := p.dialPath(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("dialing quic connection to %s: %w", p.addr, err)
+		log.Debug("dnsproxy: %s: checking network path: %s", p.addr, err)
+
+		return true
 	}
 
-	return conn, nil
+	return netutil.NetAddrToAddrPort(udpConn.LocalAddr()).Addr() != p.localIP
 }
 
 // closeConnWithError closes the active connection with error to make sure that
@@ -377,38 +856,63 @@ func (p *dnsOverQUIC) closeConnWithError(conn quic.Connection, err error) {
 		log.Error("dnsproxy: failed to close the conn: %v", err)
 	}
 
-	// If the connection that's being closed is cached, reset the cache.
+	// If the connection that's being closed is cached, reset the cache.  The
+	// concurrent exchanges sharing the connection reset it only once, so that
+	// a single new connection is dialed.
 	if p.conn == conn {
 		p.conn = nil
+		p.reconnects++
+		log.Debug("dnsproxy: %s: conn closed, reconnecting: %d reconnects", p.addr, p.reconnects)
 	}
 }
 
-// readMsg reads the incoming DNS message from the QUIC stream.
-func (p *dnsOverQUIC) readMsg(stream quic.Stream) (m *dns.Msg, err error) {
+// readMsg reads the incoming DNS message from the QUIC stream.  Its bytes are
+// captured, if ctx carries a capture, see [captureWire].
+func (p *dnsOverQUIC) readMsg(ctx context.Context, stream quic.Stream) (m *dns.Msg, err error) {
 	pool := p.getBytesPool()
 	bufPtr := pool.Get().(*[]byte)
 
 	defer pool.Put(bufPtr)
 
+	// All DNS messages (queries and responses) sent over DoQ connections MUST
+	// be encoded as a 2-octet length field followed by the message content as
+	// specified in [RFC1035].
 	respBuf := *bufPtr
-	n, err := stream.Read(respBuf)
-	if err != nil && n == 0 {
+	_, err = io.ReadFull(stream, respBuf[:2])
+	if err != nil {
 		return nil, fmt.Errorf("reading response from %s: %w", p.addr, err)
 	}
 
+	msgLen := int(binary.BigEndian.Uint16(respBuf[:2]))
+	if msgLen > p.maxRespSize {
+		stream.CancelRead(quic.StreamErrorCode(QUICCodeProtocolError))
+
+		return nil, fmt.Errorf(
+			"reading response from %s: %w: %d bytes",
+			p.addr,
+			ErrResponseTooLarge,
+			msgLen,
+		)
+	}
+
+	respBuf = respBuf[:msgLen]
+	_, err = io.ReadFull(stream, respBuf)
+	if err != nil {
+		return nil, fmt.Errorf("reading response from %s: %w", p.addr, err)
+	}
+
+	// IMPORTANT: Note, that this implementation does not support receiving
+	// multiple messages over a single stream.
 	stream.CancelRead(0)
 
-	// All DNS messages (queries and responses) sent over DoQ connections MUST
-	// be encoded as a 2-octet length field followed by the message content as
-	// specified in [RFC1035].
-	// IMPORTANT: Note, that we ignore this prefix here as this implementation
-	// does not support receiving multiple messages over a single connection.
 	m = new(dns.Msg)
-	err = m.Unpack(respBuf[2:])
+	err = m.Unpack(respBuf)
 	if err != nil {
 		return nil, fmt.Errorf("unpacking response from %s: %w", p.addr, err)
 	}
 
+	captureWire(ctx, respBuf)
+
 	return m, nil
 }
 
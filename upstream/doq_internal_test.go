@@ -76,6 +76,25 @@ func TestUpstreamDoQ(t *testing.T) {
 	checkRaceCondition(u)
 }
 
+func TestUpstreamDoQ_maxResponseSize(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+	srv := startDoQServer(t, tlsConf, 0)
+
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		RootCAs: rootCAs,
+		Timeout: timeout,
+		// The test response is definitely larger.
+		MaxResponseSize: 16,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	resp, err := u.Exchange(createTestMessage())
+	assert.ErrorIs(t, err, ErrResponseTooLarge)
+	assert.Nil(t, resp)
+}
+
 func TestUpstream_Exchange_quicServerCloseConn(t *testing.T) {
 	// Use the same tlsConf for all servers to preserve the data necessary for
 	// 0-RTT connections.
@@ -123,6 +142,209 @@ func TestUpstream_Exchange_quicServerCloseConn(t *testing.T) {
 	}
 
 	wg.Wait()
+
+	// Make sure the concurrent exchanges have dialed a single connection.
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+	uq.connMu.Lock()
+	defer uq.connMu.Unlock()
+
+	assert.Equal(t, uint64(1), uq.reconnects)
+}
+
+func TestUpstreamDoQ_idleTimeout(t *testing.T) {
+	const idleTimeout = 100 * time.Millisecond
+
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+	srv := startDoQServer(t, tlsConf, 0)
+
+	tracer := &quicTracer{}
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		RootCAs:        rootCAs,
+		Timeout:        timeout,
+		QUICTracer:     tracer.TracerForConnection,
+		DoQIdleTimeout: idleTimeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	// The connection is reused while it's not idle.
+	checkUpstream(t, u, address)
+	checkUpstream(t, u, address)
+	require.Len(t, tracer.getConnectionsInfo(), 1)
+
+	time.Sleep(2 * idleTimeout)
+
+	// The idle connection is replaced.
+	checkUpstream(t, u, address)
+	require.Len(t, tracer.getConnectionsInfo(), 2)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+	uq.connMu.Lock()
+	defer uq.connMu.Unlock()
+
+	assert.Equal(t, uint64(1), uq.reconnects)
+}
+
+func TestUpstreamDoQ_maxStreamsPerConn(t *testing.T) {
+	const maxStreams = 2
+
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+	srv := startDoQServer(t, tlsConf, 0)
+
+	tracer := &quicTracer{}
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		RootCAs:              rootCAs,
+		Timeout:              timeout,
+		QUICTracer:           tracer.TracerForConnection,
+		DoQMaxStreamsPerConn: maxStreams,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	for range 2*maxStreams + 1 {
+		checkUpstream(t, u, address)
+	}
+
+	require.Len(t, tracer.getConnectionsInfo(), 3)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+	uq.connMu.Lock()
+	defer uq.connMu.Unlock()
+
+	assert.Equal(t, uint64(2), uq.reconnects)
+	assert.Equal(t, 1, uq.streams)
+	assert.Empty(t, uq.inFlight)
+	assert.Empty(t, uq.draining)
+}
+
+func TestUpstreamDoQ_refresh(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+	srv := startDoQServer(t, tlsConf, 0)
+
+	tracer := &quicTracer{}
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		RootCAs:    rootCAs,
+		Timeout:    timeout,
+		QUICTracer: tracer.TracerForConnection,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, address)
+	require.NoError(t, RefreshUpstream(u))
+	checkUpstream(t, u, address)
+
+	require.Len(t, tracer.getConnectionsInfo(), 2)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+	uq.connMu.Lock()
+	defer uq.connMu.Unlock()
+
+	assert.Empty(t, uq.draining)
+	assert.Empty(t, uq.inFlight)
+}
+
+func TestUpstreamDoQ_fallbackToDoT(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	address := fmt.Sprintf("quic://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(address, &Options{
+		RootCAs: srv.rootCAs,
+		// Use a shorter timeout to speed up the test, since nothing listens
+		// for QUIC.
+		Timeout:          500 * time.Millisecond,
+		DoQFallbackToDoT: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+
+	checkUpstream(t, u, address)
+	require.True(t, uq.fallingBack())
+
+	// Exchange over the fallback without trying QUIC.
+	checkUpstream(t, u, address)
+
+	// Make QUIC available and the fallback expired.
+	startDoQServer(t, srv.tlsConfig.Clone(), srv.port)
+
+	uq.fallbackMu.Lock()
+	uq.fallbackUntil = time.Now()
+	uq.fallbackMu.Unlock()
+
+	checkUpstream(t, u, address)
+
+	uq.fallbackMu.Lock()
+	defer uq.fallbackMu.Unlock()
+
+	assert.Zero(t, uq.fallbackUntil)
+
+	uq.connMu.Lock()
+	defer uq.connMu.Unlock()
+
+	assert.NotNil(t, uq.conn)
+}
+
+func TestUpstreamDoQ_migration(t *testing.T) {
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+	srv := startDoQServer(t, tlsConf, 0)
+
+	address := fmt.Sprintf("quic://%s", srv.addr)
+
+	testCases := []struct {
+		name      string
+		wantConns int
+		migration bool
+	}{{
+		name:      "enabled",
+		wantConns: 2,
+		migration: true,
+	}, {
+		name:      "disabled",
+		wantConns: 1,
+		migration: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tracer := &quicTracer{}
+			u, err := AddressToUpstream(address, &Options{
+				RootCAs:             rootCAs,
+				Timeout:             timeout,
+				QUICTracer:          tracer.TracerForConnection,
+				EnableQUICMigration: tc.migration,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+
+			// The connection is reused while the path is the same.
+			checkUpstream(t, u, address)
+			checkUpstream(t, u, address)
+			require.Len(t, tracer.getConnectionsInfo(), 1)
+
+			// Pretend the connection has been dialed over another network.
+			uq.connMu.Lock()
+			uq.localIP = netip.MustParseAddr("192.0.2.1")
+			uq.connMu.Unlock()
+
+			checkUpstream(t, u, address)
+			require.Len(t, tracer.getConnectionsInfo(), tc.wantConns)
+
+			uq.connMu.Lock()
+			defer uq.connMu.Unlock()
+
+			assert.Equal(t, uint64(tc.wantConns-1), uq.reconnects)
+			assert.Empty(t, uq.inFlight)
+		})
+	}
 }
 
 func TestUpstreamDoQ_serverRestart(t *testing.T) {
@@ -173,49 +395,65 @@ func TestUpstreamDoQ_0RTT(t *testing.T) {
 	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
 
 	srv := startDoQServer(t, tlsConf, 0)
-
-	tracer := &quicTracer{}
 	address := fmt.Sprintf("quic://%s", srv.addr)
-	u, err := AddressToUpstream(address, &Options{
-		QUICTracer: tracer.TracerForConnection,
-		RootCAs:    rootCAs,
-	})
-	require.NoError(t, err)
-	testutil.CleanupAndRequireSuccess(t, u.Close)
 
-	uq := u.(*dnsOverQUIC)
-	req := createTestMessage()
+	testCases := []struct {
+		name    string
+		enabled bool
+	}{{
+		name:    "enabled",
+		enabled: true,
+	}, {
+		name:    "disabled",
+		enabled: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tracer := &quicTracer{}
+			u, err := AddressToUpstream(address, &Options{
+				QUICTracer:     tracer.TracerForConnection,
+				RootCAs:        rootCAs,
+				EnableQUIC0RTT: tc.enabled,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			uq := u.(*dnsOverQUIC)
+			req := createTestMessage()
 
-	// Trigger connection to a QUIC server.
-	resp, err := uq.Exchange(req)
-	require.NoError(t, err)
-	requireResponse(t, req, resp)
+			// Trigger connection to a QUIC server.
+			resp, err := uq.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
 
-	// Close the active connection to make sure we'll reconnect.
-	func() {
-		uq.connMu.Lock()
-		defer uq.connMu.Unlock()
+			// Close the active connection to make sure we'll reconnect.
+			func() {
+				uq.connMu.Lock()
+				defer uq.connMu.Unlock()
 
-		err = uq.conn.CloseWithError(QUICCodeNoError, "")
-		require.NoError(t, err)
+				err = uq.conn.CloseWithError(QUICCodeNoError, "")
+				require.NoError(t, err)
 
-		uq.conn = nil
-	}()
+				uq.conn = nil
+			}()
 
-	// Trigger second connection.
-	resp, err = uq.Exchange(req)
-	require.NoError(t, err)
-	requireResponse(t, req, resp)
+			// Trigger second connection.
+			resp, err = uq.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
 
-	// Check traced connections info.
-	conns := tracer.getConnectionsInfo()
-	require.Len(t, conns, 2)
+			// Check traced connections info.
+			conns := tracer.getConnectionsInfo()
+			require.Len(t, conns, 2)
 
-	// Examine the first connection (no 0-RTT there).
-	require.False(t, conns[0].is0RTT())
+			// Examine the first connection (no 0-RTT there).
+			require.False(t, conns[0].is0RTT())
 
-	// Examine the second connection (the one that used 0-RTT).
-	require.True(t, conns[1].is0RTT())
+			// Examine the second connection (the one that may use 0-RTT).
+			require.Equal(t, tc.enabled, conns[1].is0RTT())
+		})
+	}
 }
 
 // testDoHServer is an instance of a test DNS-over-QUIC server.
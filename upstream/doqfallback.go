@@ -0,0 +1,111 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// doqFallbackRetryDelay is the time after which the DNS-over-QUIC upstream
+// fallen back to DNS-over-TLS tries QUIC again, see [Options.DoQFallbackToDoT].
+const doqFallbackRetryDelay = 30 * time.Second
+
+// quicDialError is returned when the QUIC connection to the upstream can't be
+// established.  Its message is the one of the underlying error.
+type quicDialError struct {
+	// err is the underlying error.
+	err error
+}
+
+// type check
+var _ errors.Wrapper = (*quicDialError)(nil)
+
+// Error implements the error interface for *quicDialError.
+func (e *quicDialError) Error() (msg string) { return e.err.Error() }
+
+// Unwrap implements the [errors.Wrapper] interface for *quicDialError.
+func (e *quicDialError) Unwrap() (unwrapped error) { return e.err }
+
+// newDoQFallback returns the DNS-over-TLS upstream for the same host and port
+// as the DNS-over-QUIC upstream with addr.
+func newDoQFallback(addr *url.URL, opts *Options) (u Upstream, err error) {
+	dotAddr := &url.URL{
+		Scheme: "tls",
+		Host:   addr.Host,
+	}
+
+	u, err = newDoT(dotAddr, opts)
+	if err != nil {
+		return nil, fmt.Errorf("creating dot fallback for %s: %w", addr, err)
+	}
+
+	return u, nil
+}
+
+// exchangeWithFallback exchanges m over QUIC, or over p.fallback if the QUIC
+// connection can't be established.  After the failure, QUIC is only tried again
+// once [doqFallbackRetryDelay] passes.
+func (p *dnsOverQUIC) exchangeWithFallback(
+	ctx context.Context,
+	m *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if p.fallingBack() {
+		return p.fallback.ExchangeContext(ctx, m)
+	}
+
+	resp, err = p.exchangeDoQ(ctx, m)
+
+	var dialErr *quicDialError
+	if errors.As(err, &dialErr) && ctx.Err() == nil {
+		p.startFallback(dialErr)
+
+		return p.fallback.ExchangeContext(ctx, m)
+	}
+
+	if err == nil {
+		p.stopFallback()
+	}
+
+	return resp, err
+}
+
+// fallingBack returns true if the exchanges should be sent over the fallback
+// upstream.
+func (p *dnsOverQUIC) fallingBack() (ok bool) {
+	p.fallbackMu.Lock()
+	defer p.fallbackMu.Unlock()
+
+	return time.Now().Before(p.fallbackUntil)
+}
+
+// startFallback makes the exchanges use the fallback upstream for
+// [doqFallbackRetryDelay] due to err.
+func (p *dnsOverQUIC) startFallback(err error) {
+	p.fallbackMu.Lock()
+	defer p.fallbackMu.Unlock()
+
+	if p.fallbackUntil.IsZero() {
+		log.Info("dnsproxy: %s: quic unavailable, falling back to tls: %s", p.addr, err)
+	} else {
+		log.Debug("dnsproxy: %s: quic still unavailable: %s", p.addr, err)
+	}
+
+	p.fallbackUntil = time.Now().Add(doqFallbackRetryDelay)
+}
+
+// stopFallback makes the exchanges use QUIC again after a successful one.
+func (p *dnsOverQUIC) stopFallback() {
+	p.fallbackMu.Lock()
+	defer p.fallbackMu.Unlock()
+
+	if !p.fallbackUntil.IsZero() {
+		log.Info("dnsproxy: %s: quic recovered, stopping fallback to tls", p.addr)
+
+		p.fallbackUntil = time.Time{}
+	}
+}
@@ -27,14 +27,17 @@ type dnsOverTLS struct {
 	// addr is the DNS-over-TLS server URL.
 	addr *url.URL
 
-	// getDialer either returns an initialized dial handler or creates a
-	// new one.
-	getDialer DialerInitializer
+	// bootstrapper resolves the upstream's hostname and creates dial
+	// handlers.
+	*bootstrapper
 
 	// tlsConf is the configuration of TLS.
 	tlsConf *tls.Config
 
-	// connsMu protects conns.
+	// rttStats measures the round-trip time of the exchanges.
+	*rttStats
+
+	// connsMu protects conns, keepaliveTimeout, and keepaliveKnown.
 	connsMu *sync.Mutex
 
 	// conns stores the connections ready for reuse.  Don't use [sync.Pool]
@@ -45,31 +48,84 @@ type dnsOverTLS struct {
 	// This leads to weak performance for all exchanges coming across such
 	// connections.
 	conns []net.Conn
+
+	// probeTimeout is the timeout of the health-check probes.
+	probeTimeout time.Duration
+
+	// maxRespSize is the maximum size of the response message.
+	maxRespSize int
+
+	// keepaliveTimeout is the idle timeout most recently advertised by the
+	// server, see [Options.DoTKeepalive].
+	keepaliveTimeout time.Duration
+
+	// active tracks the exchanges in flight, so that Close waits for them.
+	active *inflight
+
+	// forceRD is true if the RD bit should be set in the outgoing queries.
+	forceRD bool
+
+	// pipeMu protects pipe and pipeDial.
+	pipeMu *sync.Mutex
+
+	// pipe is the connection carrying all the queries if pipelining is
+	// enabled.  It's nil until the first exchange.
+	pipe *pipelinedConn
+
+	// pipeDial is the dialing of the new pipelined connection in progress.
+	// It's nil if there is none.
+	pipeDial *pipelinedDial
+
+	// tcPolicy defines how the responses with the TC bit set are handled.
+	tcPolicy TruncatedPolicy
+
+	// pipelining is true if the queries are pipelined over a single
+	// connection, see [Options.DoTPipelining].
+	pipelining bool
+
+	// keepalive is true if the EDNS TCP keepalive option is used, see
+	// [Options.DoTKeepalive].
+	keepalive bool
+
+	// keepaliveKnown is true if the server has advertised keepaliveTimeout.
+	keepaliveKnown bool
 }
 
 // newDoT returns the DNS-over-TLS Upstream.
 func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 	addPort(addr, defaultPortDoT)
 
+	b, err := newBootstrapper(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf, err := newTLSConfig(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.EnableDANE {
+		err = setDANEVerifier(addr, opts, tlsConf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	tlsUps := &dnsOverTLS{
-		addr:      addr,
-		getDialer: newDialerInitializer(addr, opts),
-		tlsConf: &tls.Config{
-			ServerName:   addr.Hostname(),
-			RootCAs:      opts.RootCAs,
-			CipherSuites: opts.CipherSuites,
-			// Use the default capacity for the LRU cache.  It may be useful to
-			// store several caches since the user may be routed to different
-			// servers in case there's load balancing on the server-side.
-			ClientSessionCache: tls.NewLRUClientSessionCache(0),
-			MinVersion:         tls.VersionTLS12,
-			// #nosec G402 -- TLS certificate verification could be disabled by
-			// configuration.
-			InsecureSkipVerify:    opts.InsecureSkipVerify,
-			VerifyPeerCertificate: opts.VerifyServerCertificate,
-			VerifyConnection:      opts.VerifyConnection,
-		},
-		connsMu: &sync.Mutex{},
+		addr:         addr,
+		bootstrapper: b,
+		rttStats:     newRTTStats(opts),
+		tlsConf:      tlsConf,
+		connsMu:      &sync.Mutex{},
+		forceRD:      !opts.PreserveRecursionDesired,
+		probeTimeout: opts.ProbeTimeout,
+		maxRespSize:  maxResponseSize(opts),
+		active:       newInflight(opts),
+		tcPolicy:     opts.TruncatedPolicy,
+		pipeMu:       &sync.Mutex{},
+		pipelining:   opts.DoTPipelining,
+		keepalive:    opts.DoTKeepalive,
 	}
 
 	runtime.SetFinalizer(tlsUps, (*dnsOverTLS).Close)
@@ -78,56 +134,95 @@ func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 }
 
 // type check
-var _ Upstream = (*dnsOverTLS)(nil)
+var _ UpstreamWithStats = (*dnsOverTLS)(nil)
+
+// type check
+var _ ResolvingUpstream = (*dnsOverTLS)(nil)
 
 // Address implements the [Upstream] interface for *dnsOverTLS.
 func (p *dnsOverTLS) Address() string { return p.addr.String() }
 
+// type check
+var _ ProtocolUpstream = (*dnsOverTLS)(nil)
+
+// Protocol implements the [ProtocolUpstream] interface for *dnsOverTLS.
+func (p *dnsOverTLS) Protocol() (proto Protocol) { return ProtocolTLS }
+
 // Exchange implements the [Upstream] interface for *dnsOverTLS.
 func (p *dnsOverTLS) Exchange(m *dns.Msg) (reply *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext implements the [Upstream] interface for *dnsOverTLS.
+func (p *dnsOverTLS) ExchangeContext(ctx context.Context, m *dns.Msg) (reply *dns.Msg, err error) {
+	defer func() { err = classifyError(err) }()
+
+	err = p.active.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer p.active.end()
+
+	restoreRD := forceRecursionDesired(m, p.forceRD)
+	defer func() { restoreRD(reply) }()
+
 	h, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
 	}
 
-	conn, err := p.conn(h)
+	if p.pipelining {
+		reply, err = p.exchangePipelined(ctx, h, m)
+		if err != nil {
+			return nil, err
+		}
+
+		return reply, handleTruncated(reply, p.Address(), p.tcPolicy)
+	}
+
+	conn, err := p.conn(ctx, h)
 	if err != nil {
 		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
 	}
 
-	reply, err = p.exchangeWithConn(conn, m)
+	reply, err = p.exchangeKeepalive(ctx, conn, m)
 	if err != nil {
+		err = errors.WithDeferred(err, closeConn(conn))
+		if ctx.Err() != nil || errors.Is(err, ErrResponseTooLarge) {
+			return nil, err
+		}
+
 		// The pooled connection might have been closed already, see
 		// https://github.com/AdguardTeam/dnsproxy/issues/3.  The following
 		// connection from pool may also be malformed, so dial a new one.
-
-		err = errors.WithDeferred(err, conn.Close())
 		log.Debug("dot %s: bad conn from pool: %s", p.addr, err)
 
 		// Retry.
-		conn, err = tlsDial(h, p.tlsConf.Clone())
+		conn, err = p.dial(ctx, h)
 		if err != nil {
 			return nil, fmt.Errorf(
 				"dialing %s: connecting to %s: %w",
 				p.addr,
-				p.tlsConf.ServerName,
+				p.addr.Hostname(),
 				err,
 			)
 		}
 
-		reply, err = p.exchangeWithConn(conn, m)
+		reply, err = p.exchangeKeepalive(ctx, conn, m)
 		if err != nil {
-			return reply, errors.WithDeferred(err, conn.Close())
+			return reply, errors.WithDeferred(err, closeConn(conn))
 		}
 	}
 
 	p.putBack(conn)
 
-	return reply, nil
+	return reply, handleTruncated(reply, p.Address(), p.tcPolicy)
 }
 
 // Close implements the [Upstream] interface for *dnsOverTLS.
 func (p *dnsOverTLS) Close() (err error) {
+	p.active.shutdown()
+
 	runtime.SetFinalizer(p, nil)
 
 	p.connsMu.Lock()
@@ -141,29 +236,87 @@ func (p *dnsOverTLS) Close() (err error) {
 		}
 	}
 
+	p.pipeMu.Lock()
+	defer p.pipeMu.Unlock()
+
+	if p.pipe != nil {
+		closeErrs = append(closeErrs, p.pipe.close())
+	}
+
+	return errors.Join(closeErrs...)
+}
+
+// type check
+var _ RefreshableUpstream = (*dnsOverTLS)(nil)
+
+// Refresh implements the [RefreshableUpstream] interface for *dnsOverTLS.  It
+// closes the idle connections.  The pipelined connection is closed as soon as
+// the queries in flight are finished.  The stored TLS sessions are discarded.
+func (p *dnsOverTLS) Refresh() (err error) {
+	p.expireResolved()
+	clearSessions(p.tlsConf)
+
+	p.pipeMu.Lock()
+	if p.pipe != nil {
+		p.pipe.drain()
+		p.pipe = nil
+	}
+	p.pipeMu.Unlock()
+
+	p.connsMu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.connsMu.Unlock()
+
+	var closeErrs []error
+	for _, conn := range conns {
+		closeErr := conn.Close()
+		if closeErr != nil && isCriticalTCP(closeErr) {
+			closeErrs = append(closeErrs, closeErr)
+		}
+	}
+
 	return errors.Join(closeErrs...)
 }
 
+// type check
+var _ ProbableUpstream = (*dnsOverTLS)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *dnsOverTLS.
+func (p *dnsOverTLS) Probe(ctx context.Context) (err error) {
+	return probe(ctx, p, p.probeTimeout)
+}
+
 // conn returns the first available connection from the pool if there is any, or
 // dials a new one otherwise.
-func (p *dnsOverTLS) conn(h bootstrap.DialHandler) (conn net.Conn, err error) {
+func (p *dnsOverTLS) conn(
+	ctx context.Context,
+	h bootstrap.DialHandler,
+) (conn net.Conn, err error) {
 	// Dial a new connection outside the lock, if needed.
 	defer func() {
 		if conn == nil {
-			conn, err = tlsDial(h, p.tlsConf.Clone())
-			err = errors.Annotate(err, "connecting to %s: %w", p.tlsConf.ServerName)
+			conn, err = p.dial(ctx, h)
+			err = errors.Annotate(err, "connecting to %s: %w", p.addr.Hostname())
 		}
 	}()
 
 	p.connsMu.Lock()
 	defer p.connsMu.Unlock()
 
-	l := len(p.conns)
-	if l == 0 {
-		return nil, nil
+	now := time.Now()
+	for l := len(p.conns); l > 0; l = len(p.conns) {
+		p.conns, conn = p.conns[:l-1], p.conns[l-1]
+		if !closeExpired(conn, now) {
+			break
+		}
+
+		conn = nil
 	}
 
-	p.conns, conn = p.conns[:l-1], p.conns[l-1]
+	if conn == nil {
+		return nil, nil
+	}
 
 	err = conn.SetDeadline(time.Now().Add(dialTimeout))
 	if err != nil {
@@ -179,43 +332,84 @@ func (p *dnsOverTLS) conn(h bootstrap.DialHandler) (conn net.Conn, err error) {
 	return conn, nil
 }
 
+// putBack returns conn to the pool.  It closes conn instead if the server has
+// asked to.
 func (p *dnsOverTLS) putBack(conn net.Conn) {
+	if kc, ok := conn.(*keepaliveConn); ok {
+		if kc.closing {
+			err := closeConn(kc)
+			if err != nil {
+				log.Debug("dot %s: closing conn: %s", p.addr, err)
+			}
+
+			return
+		}
+
+		kc.idleSince = time.Now()
+	}
+
 	p.connsMu.Lock()
 	defer p.connsMu.Unlock()
 
 	p.conns = append(p.conns, conn)
 }
 
-// exchangeWithConn tries to exchange the query using conn.
-func (p *dnsOverTLS) exchangeWithConn(conn net.Conn, m *dns.Msg) (reply *dns.Msg, err error) {
+// exchangeWithConn tries to exchange the query using conn.  conn is closed as
+// soon as ctx is done.
+func (p *dnsOverTLS) exchangeWithConn(
+	ctx context.Context,
+	conn net.Conn,
+	m *dns.Msg,
+) (reply *dns.Msg, err error) {
 	addr := p.Address()
 
 	logBegin(addr, networkTCP, m)
-	defer func() { logFinish(addr, networkTCP, err) }()
+	defer func() { logFinish(addr, networkTCP, reply, err) }()
+
+	dnsConn := dns.Conn{Conn: limitMsgSize(conn, p.maxRespSize)}
+	start := time.Now()
 
-	dnsConn := dns.Conn{Conn: conn}
+	stop := abortOnDone(ctx, conn)
+	defer func() {
+		if abortErr := stop(); abortErr != nil {
+			reply, err = nil, fmt.Errorf("exchanging with %s: %w", addr, abortErr)
+		}
+	}()
 
 	err = dnsConn.WriteMsg(m)
 	if err != nil {
 		return nil, fmt.Errorf("sending request to %s: %w", addr, err)
 	}
 
-	reply, err = dnsConn.ReadMsg()
+	raw, err := dnsConn.ReadMsgHeader(nil)
 	if err != nil {
 		return nil, fmt.Errorf("reading response from %s: %w", addr, err)
+	}
+
+	reply = &dns.Msg{}
+	err = reply.Unpack(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response from %s: %w", addr, err)
 	} else if reply.Id != m.Id {
 		return reply, dns.ErrId
 	}
 
-	return reply, err
+	captureWire(ctx, raw)
+	p.update(time.Since(start))
+
+	return reply, nil
 }
 
 // tlsDial is basically the same as tls.DialWithDialer, but we will call our own
 // dialContext function to get connection.
-func tlsDial(dialContext bootstrap.DialHandler, conf *tls.Config) (c *tls.Conn, err error) {
+func tlsDial(
+	ctx context.Context,
+	dialContext bootstrap.DialHandler,
+	conf *tls.Config,
+) (c *tls.Conn, err error) {
 	// We're using bootstrapped address instead of what's passed to the
 	// function.
-	rawConn, err := dialContext(context.Background(), networkTCP, "")
+	rawConn, err := dialContext(ctx, networkTCP, "")
 	if err != nil {
 		return nil, err
 	}
@@ -229,7 +423,7 @@ func tlsDial(dialContext bootstrap.DialHandler, conf *tls.Config) (c *tls.Conn,
 		panic(fmt.Errorf("dnsproxy: tls dial: setting deadline: %w", err))
 	}
 
-	err = conn.Handshake()
+	err = conn.HandshakeContext(ctx)
 	if err != nil {
 		return nil, errors.WithDeferred(err, conn.Close())
 	}
@@ -1,13 +1,16 @@
 package upstream
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -162,11 +165,11 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 	dialHandler, err := p.getDialer()
 	require.NoError(t, err)
 
-	usedConn, err := p.conn(dialHandler)
+	usedConn, err := p.conn(context.Background(), dialHandler)
 	require.NoError(t, err)
 	require.Same(t, usedConn, conn)
 
-	response, err = p.exchangeWithConn(conn, req)
+	response, err = p.exchangeWithConn(context.Background(), conn, req)
 	require.NoError(t, err)
 	requireResponse(t, req, response)
 
@@ -180,11 +183,11 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 	require.Len(t, p.conns, 1)
 	conn = p.conns[0]
 
-	usedConn, err = p.conn(dialHandler)
+	usedConn, err = p.conn(context.Background(), dialHandler)
 	require.NoError(t, err)
 	require.Same(t, usedConn, conn)
 
-	response, err = p.exchangeWithConn(usedConn, req)
+	response, err = p.exchangeWithConn(context.Background(), usedConn, req)
 	require.NoError(t, err)
 	requireResponse(t, req, response)
 
@@ -193,11 +196,388 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 	require.NoError(t, err)
 
 	// Connection with expired deadLine can't be used.
-	response, err = p.exchangeWithConn(usedConn, req)
+	response, err = p.exchangeWithConn(context.Background(), usedConn, req)
 	require.Error(t, err)
 	require.Nil(t, response)
 }
 
+func TestUpstream_dnsOverTLS_refresh(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	// Wrap the upstream to check that the wrapped one is refreshed.
+	u, err := AddressToUpstream(fmt.Sprintf("tls://127.0.0.1:%d", srv.port), &Options{
+		Timeout: timeout,
+		RootCAs: srv.rootCAs,
+		Retries: 1,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	p := testutil.RequireTypeAssert[*dnsOverTLS](t, unwrapUpstream(u))
+
+	p.connsMu.Lock()
+	require.Len(t, p.conns, 1)
+	conn := p.conns[0]
+	p.connsMu.Unlock()
+
+	require.NoError(t, RefreshUpstream(u))
+
+	p.connsMu.Lock()
+	assert.Empty(t, p.conns)
+	p.connsMu.Unlock()
+
+	// The dropped connection is closed.
+	_, err = conn.Write([]byte{0})
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	resp, err = u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+}
+
+func TestUpstream_dnsOverTLS_maxResponseSize(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+
+	for _, pipelining := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pipelining_%t", pipelining), func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:       timeout,
+				RootCAs:       srv.rootCAs,
+				DoTPipelining: pipelining,
+				// The test response is definitely larger.
+				MaxResponseSize: 16,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			resp, err := u.Exchange(createTestMessage())
+			assert.ErrorIs(t, err, ErrResponseTooLarge)
+			assert.Nil(t, resp)
+		})
+	}
+
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:         timeout,
+		RootCAs:         srv.rootCAs,
+		MaxResponseSize: dns.MinMsgSize,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	for range 2 {
+		checkUpstream(t, u, addr)
+	}
+}
+
+func TestUpstream_dnsOverTLS_keepalive(t *testing.T) {
+	testCases := []struct {
+		name      string
+		timeout   uint16
+		wantConns int32
+	}{{
+		name:      "timeout",
+		timeout:   1,
+		wantConns: 2,
+	}, {
+		name:      "close",
+		timeout:   0,
+		wantConns: 3,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var advertised atomic.Int32
+			conns := &sync.Map{}
+			srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				conns.Store(w.RemoteAddr().String(), struct{}{})
+
+				resp := respondToTestMessage(req)
+				if _, ok := responseKeepalive(req, false); ok {
+					advertised.Add(1)
+					resp.SetEdns0(dns.DefaultMsgSize, false)
+					opt := resp.IsEdns0()
+					opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+						Code:    dns.EDNS0TCPKEEPALIVE,
+						Timeout: tc.timeout,
+					})
+				}
+
+				require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+			})
+
+			u, err := AddressToUpstream(fmt.Sprintf("tls://127.0.0.1:%d", srv.port), &Options{
+				Timeout:      timeout,
+				RootCAs:      srv.rootCAs,
+				DoTKeepalive: true,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			ku, ok := u.(KeepaliveUpstream)
+			require.True(t, ok)
+
+			_, ok = ku.Keepalive()
+			require.False(t, ok)
+
+			for range 2 {
+				req := createTestMessage()
+				resp, exErr := u.Exchange(req)
+				require.NoError(t, exErr)
+				requireResponse(t, req, resp)
+
+				// The OPT record added for the option is removed.
+				assert.Nil(t, resp.IsEdns0())
+			}
+
+			ka, ok := ku.Keepalive()
+			require.True(t, ok)
+			assert.Equal(t, time.Duration(tc.timeout)*keepaliveUnit, ka)
+
+			time.Sleep(2 * keepaliveUnit)
+
+			_, err = u.Exchange(createTestMessage())
+			require.NoError(t, err)
+
+			var n int32
+			conns.Range(func(_, _ any) (cont bool) {
+				n++
+
+				return true
+			})
+
+			// The option is only sent within the first query over each
+			// connection.
+			assert.Equal(t, tc.wantConns, n)
+			assert.Equal(t, tc.wantConns, advertised.Load())
+		})
+	}
+}
+
+// startPipeliningServer starts a DNS-over-TLS server reading n queries from
+// each connection before responding to them in reverse order and closing the
+// connection.  It returns the address of the server and the pointer to the
+// number of accepted connections.
+func startPipeliningServer(t *testing.T, n int) (addr string, conns *atomic.Int32) {
+	t.Helper()
+
+	tlsConf, _ := createServerTLSConfig(t, "127.0.0.1")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	conns = &atomic.Int32{}
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			conns.Add(1)
+
+			go func() {
+				pt := testutil.PanicT{}
+				dnsConn := &dns.Conn{Conn: conn}
+				defer func() { _ = conn.Close() }()
+
+				reqs := make([]*dns.Msg, 0, n)
+				for range n {
+					req, readErr := dnsConn.ReadMsg()
+					require.NoError(pt, readErr)
+
+					reqs = append(reqs, req)
+				}
+
+				slices.Reverse(reqs)
+				for _, req := range reqs {
+					require.NoError(pt, dnsConn.WriteMsg(respondToTestMessage(req)))
+				}
+			}()
+		}
+	}()
+
+	return fmt.Sprintf("tls://%s", l.Addr()), conns
+}
+
+func TestUpstream_dnsOverTLS_pipelining(t *testing.T) {
+	const n = 10
+
+	addr, conns := startPipeliningServer(t, n)
+
+	u, err := AddressToUpstream(addr, &Options{
+		InsecureSkipVerify: true,
+		Timeout:            timeout,
+		DoTPipelining:      true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	exchangeAll := func(t *testing.T) {
+		t.Helper()
+
+		wg := &sync.WaitGroup{}
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				pt := testutil.PanicT{}
+
+				// Use the same ID for all the queries to check that the
+				// collisions are handled.
+				req := (&dns.Msg{}).SetQuestion(fmt.Sprintf("host%d.example.", i), dns.TypeA)
+				req.Id = 1
+
+				resp, exchErr := u.Exchange(req)
+				require.NoError(pt, exchErr)
+
+				assert.Equal(pt, req.Id, resp.Id)
+				assert.Equal(pt, req.Question, resp.Question)
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	// All the queries are sent over the same connection, otherwise the server
+	// never responds.
+	exchangeAll(t)
+	assert.Equal(t, int32(1), conns.Load())
+
+	// The server closes the connection after responding, so the upstream
+	// reconnects.
+	exchangeAll(t)
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+func TestUpstream_dnsOverTLS_pipeliningTimeout(t *testing.T) {
+	const exchTimeout = 100 * time.Millisecond
+
+	srv := startDoTServer(t, func(_ dns.ResponseWriter, _ *dns.Msg) {
+		// Never respond.
+	})
+
+	u, err := AddressToUpstream(fmt.Sprintf("tls://127.0.0.1:%d", srv.port), &Options{
+		Timeout:       exchTimeout,
+		RootCAs:       srv.rootCAs,
+		DoTPipelining: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	start := time.Now()
+	resp, err := u.Exchange(createTestMessage())
+	elapsed := time.Since(start)
+
+	assert.True(t, isTimeout(err))
+	assert.Nil(t, resp)
+
+	// The response is awaited for the configured timeout, not the dialing one.
+	assert.Less(t, elapsed, dialTimeout/2)
+}
+
+func TestUpstream_dnsOverTLS_serverName(t *testing.T) {
+	const srvName = "dns.example"
+
+	tlsConf, rootCAs := createServerTLSConfig(t, srvName)
+
+	sniCh := make(chan string, 1)
+	tlsConf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (c *tls.Config, err error) {
+		sniCh <- hello.ServerName
+
+		return nil, nil
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		Listener: tls.NewListener(l, tlsConf),
+		Net:      "tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+		}),
+	}
+
+	go func() {
+		require.NoError(testutil.PanicT{}, srv.ActivateAndServe())
+	}()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	addr := "tls://" + l.Addr().String()
+
+	testCases := []struct {
+		name       string
+		serverName string
+		wantSNI    string
+		disableSNI bool
+		wantErr    bool
+	}{{
+		name:       "override",
+		serverName: srvName,
+		wantSNI:    srvName,
+		disableSNI: false,
+		wantErr:    false,
+	}, {
+		name:       "bad_override",
+		serverName: "other.example",
+		wantSNI:    "other.example",
+		disableSNI: false,
+		wantErr:    true,
+	}, {
+		name:       "disabled",
+		serverName: srvName,
+		wantSNI:    "",
+		disableSNI: true,
+		wantErr:    false,
+	}, {
+		name:       "disabled_bad_hostname",
+		serverName: "",
+		wantSNI:    "",
+		disableSNI: true,
+		wantErr:    true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, uErr := AddressToUpstream(addr, &Options{
+				RootCAs:    rootCAs,
+				ServerName: tc.serverName,
+				DisableSNI: tc.disableSNI,
+				Timeout:    timeout,
+			})
+			require.NoError(t, uErr)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			resp, uErr := u.Exchange(req)
+
+			sni, _ := testutil.RequireReceive(t, sniCh, timeout)
+			assert.Equal(t, tc.wantSNI, sni)
+
+			if tc.wantErr {
+				assert.Error(t, uErr)
+
+				return
+			}
+
+			require.NoError(t, uErr)
+			requireResponse(t, req, resp)
+		})
+	}
+}
+
 // testDoTServer is a test DNS-over-TLS server that can be used in unit-tests.
 type testDoTServer struct {
 	// srv is the *dns.Server instance that listens for DoT requests.
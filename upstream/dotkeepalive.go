@@ -0,0 +1,210 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// KeepaliveUpstream is an [Upstream] reporting the idle timeout of its
+// connections advertised by the server, see [Options.DoTKeepalive].
+//
+// The DNS-over-TLS upstreams created with [AddressToUpstream] implement it,
+// unless they are wrapped, e.g. by configuring [Options.Retries].  Use
+// [UpstreamAs] to get it from the wrapper.
+type KeepaliveUpstream interface {
+	Upstream
+
+	// Keepalive returns the idle timeout most recently advertised by the
+	// server within the EDNS TCP keepalive option.  ok is false if the server
+	// hasn't advertised any yet.  It's safe for concurrent use along with
+	// Exchange.
+	Keepalive() (timeout time.Duration, ok bool)
+}
+
+// keepaliveUnit is the unit of the timeout within the EDNS TCP keepalive
+// option, see RFC 7828.
+const keepaliveUnit = 100 * time.Millisecond
+
+// keepaliveConn is a pooled DNS-over-TLS connection keeping the idle timeout
+// advertised by the server, see [Options.DoTKeepalive].
+type keepaliveConn struct {
+	net.Conn
+
+	// idleSince is the time the connection has been put back to the pool.
+	idleSince time.Time
+
+	// timeout is the idle timeout advertised by the server.  Zero means the
+	// server hasn't advertised any, so the connection is kept until it
+	// breaks.
+	timeout time.Duration
+
+	// advertised is true if the keepalive option has been sent over the
+	// connection already.
+	advertised bool
+
+	// closing is true if the server has asked to close the connection by
+	// advertising the zero timeout.
+	closing bool
+}
+
+// expired returns true if c has been idle for longer than the timeout
+// advertised by the server.
+func (c *keepaliveConn) expired(now time.Time) (ok bool) {
+	return c.timeout > 0 && now.Sub(c.idleSince) >= c.timeout
+}
+
+// type check
+var _ KeepaliveUpstream = (*dnsOverTLS)(nil)
+
+// Keepalive implements the [KeepaliveUpstream] interface for *dnsOverTLS.
+func (p *dnsOverTLS) Keepalive() (timeout time.Duration, ok bool) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	return p.keepaliveTimeout, p.keepaliveKnown
+}
+
+// dial dials a new connection to the server wrapping it into *keepaliveConn if
+// the keepalive option is enabled.
+func (p *dnsOverTLS) dial(ctx context.Context, h bootstrap.DialHandler) (conn net.Conn, err error) {
+	tlsConn, err := tlsDial(ctx, h, p.tlsConf.Clone())
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keepalive {
+		return &keepaliveConn{Conn: tlsConn}, nil
+	}
+
+	return tlsConn, nil
+}
+
+// exchangeKeepalive is like exchangeWithConn, but it also advertises the
+// keepalive option in the first query over conn and remembers the timeout the
+// server responds with.
+func (p *dnsOverTLS) exchangeKeepalive(
+	ctx context.Context,
+	conn net.Conn,
+	m *dns.Msg,
+) (reply *dns.Msg, err error) {
+	kc, ok := conn.(*keepaliveConn)
+	if !ok {
+		return p.exchangeWithConn(ctx, conn, m)
+	}
+
+	req, addedOPT, addedOpt := m, false, false
+	if !kc.advertised {
+		req, addedOPT, addedOpt = withKeepalive(m)
+		kc.advertised = true
+	}
+
+	reply, err = p.exchangeWithConn(ctx, conn, req)
+	if err != nil || reply == nil {
+		return reply, err
+	}
+
+	timeout, advertised := responseKeepalive(reply, addedOpt)
+	if addedOPT {
+		removeOPT(reply)
+	}
+
+	if advertised {
+		p.setKeepalive(kc, timeout)
+	}
+
+	return reply, nil
+}
+
+// setKeepalive sets the idle timeout of conn advertised by the server.
+func (p *dnsOverTLS) setKeepalive(conn *keepaliveConn, timeout time.Duration) {
+	if timeout == 0 {
+		log.Debug("dot %s: server asked to close conn", p.addr)
+
+		conn.closing = true
+	} else if timeout != conn.timeout {
+		log.Debug("dot %s: server keepalive timeout: %s", p.addr, timeout)
+	}
+
+	conn.timeout = timeout
+
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	p.keepaliveTimeout, p.keepaliveKnown = timeout, true
+}
+
+// withKeepalive returns a copy of m with the EDNS TCP keepalive option
+// without the timeout, as a client must send it, see RFC 7828.  addedOPT is
+// true if the OPT record has been added, and addedOpt is true if the option
+// has been added.  m is returned as is if it already has the option.
+func withKeepalive(m *dns.Msg) (req *dns.Msg, addedOPT, addedOpt bool) {
+	opt := m.IsEdns0()
+	if opt != nil && slices.ContainsFunc(opt.Option, isKeepaliveOption) {
+		return m, false, false
+	}
+
+	req = m.Copy()
+	opt = req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+		addedOPT = true
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code: dns.EDNS0TCPKEEPALIVE,
+	})
+
+	return req, addedOPT, true
+}
+
+// responseKeepalive returns the idle timeout advertised within the keepalive
+// option of resp.  If remove is true, the option is also removed from resp.
+func responseKeepalive(resp *dns.Msg, remove bool) (timeout time.Duration, ok bool) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+
+	for _, o := range opt.Option {
+		if ka, isKA := o.(*dns.EDNS0_TCP_KEEPALIVE); isKA {
+			timeout, ok = time.Duration(ka.Timeout)*keepaliveUnit, true
+
+			break
+		}
+	}
+
+	if remove {
+		opt.Option = slices.DeleteFunc(opt.Option, isKeepaliveOption)
+	}
+
+	return timeout, ok
+}
+
+// isKeepaliveOption returns true if o is the EDNS TCP keepalive option.
+func isKeepaliveOption(o dns.EDNS0) (ok bool) {
+	return o.Option() == dns.EDNS0TCPKEEPALIVE
+}
+
+// closeExpired closes conn if it's a *keepaliveConn idle for longer than the
+// timeout advertised by the server.  ok is true if it's been closed.
+func closeExpired(conn net.Conn, now time.Time) (ok bool) {
+	kc, isKA := conn.(*keepaliveConn)
+	if !isKA || !kc.expired(now) {
+		return false
+	}
+
+	err := kc.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Debug("dot upstream: closing expired conn: %s", err)
+	}
+
+	return true
+}
@@ -0,0 +1,384 @@
+package upstream
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// pipelinedConn is a DNS-over-TLS connection carrying multiple queries at once,
+// see [Options.DoTPipelining].
+type pipelinedConn struct {
+	// conn is the underlying connection.
+	conn net.Conn
+
+	// writeMu serializes the writes to conn.
+	writeMu *sync.Mutex
+
+	// mu protects pending, nextID, err, and draining.
+	mu *sync.Mutex
+
+	// pending maps the IDs of the queries sent to the channels awaiting the
+	// responses.
+	pending map[uint16]chan *dns.Msg
+
+	// done is closed when the connection stops reading.
+	done chan struct{}
+
+	// err is the reason the connection stopped reading.
+	err error
+
+	// timeout is the time to wait for the next response while there are
+	// pending queries.
+	timeout time.Duration
+
+	// maxRespSize is the maximum size of the response message.
+	maxRespSize int
+
+	// nextID is the candidate ID of the next query.
+	nextID uint16
+
+	// draining is true if the connection should be closed as soon as there
+	// are no pending queries.
+	draining bool
+}
+
+// newPipelinedConn returns a new pipelined connection over conn and starts
+// reading the responses from it.  The responses larger than maxRespSize break
+// the connection.
+func newPipelinedConn(conn net.Conn, timeout time.Duration, maxRespSize int) (c *pipelinedConn) {
+	c = &pipelinedConn{
+		conn:        conn,
+		writeMu:     &sync.Mutex{},
+		mu:          &sync.Mutex{},
+		pending:     map[uint16]chan *dns.Msg{},
+		done:        make(chan struct{}),
+		timeout:     timeout,
+		maxRespSize: maxRespSize,
+		nextID:      dns.Id(),
+	}
+
+	go c.readLoop()
+
+	return c
+}
+
+// isAlive returns true if c still reads the responses and isn't draining.
+func (c *pipelinedConn) isAlive() (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err == nil && !c.draining
+}
+
+// exchange sends req over c and waits for the response.  req is sent with
+// a unique ID, which is replaced with the original one in the response.
+func (c *pipelinedConn) exchange(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+
+	origID := req.Id
+	req.Id = id
+	buf, err := req.Pack()
+	req.Id = origID
+	if err != nil {
+		c.unregister(id)
+
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	err = c.write(buf)
+	if err != nil {
+		c.unregister(id)
+
+		return nil, err
+	}
+
+	select {
+	case resp = <-ch:
+		resp.Id = origID
+
+		return resp, nil
+	case <-c.done:
+		c.unregister(id)
+
+		return nil, c.err
+	case <-ctx.Done():
+		c.unregister(id)
+
+		return nil, context.Cause(ctx)
+	}
+}
+
+// register allocates the unique ID for the query and the channel to receive
+// the response to.
+func (c *pipelinedConn) register() (id uint16, ch chan *dns.Msg, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, nil, c.err
+	} else if len(c.pending) >= 1<<16 {
+		return 0, nil, errors.Error("no free message ids")
+	}
+
+	for {
+		id = c.nextID
+		c.nextID++
+		if _, ok := c.pending[id]; !ok {
+			break
+		}
+	}
+
+	if len(c.pending) == 0 {
+		// Make sure the connection isn't waiting forever for the responses.
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+
+	ch = make(chan *dns.Msg, 1)
+	c.pending[id] = ch
+
+	return id, ch, nil
+}
+
+// unregister removes the pending query with id.  It closes the draining
+// connection without pending queries.
+func (c *pipelinedConn) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, id)
+	if len(c.pending) == 0 {
+		// Don't let the idle connection time out.
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+
+	c.closeIfDrained()
+}
+
+// closeIfDrained closes the draining connection without pending queries.  c.mu
+// must be locked.
+func (c *pipelinedConn) closeIfDrained() {
+	if c.draining && len(c.pending) == 0 {
+		log.OnCloserError(c.conn, log.DEBUG)
+	}
+}
+
+// write writes the wire-format message buf prefixed with its length.
+func (c *pipelinedConn) write(buf []byte) (err error) {
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(buf)), uint16(len(buf)))
+	msg = append(msg, buf...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	err = c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return fmt.Errorf("setting write deadline: %w", err)
+	}
+
+	_, err = c.conn.Write(msg)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+
+	return nil
+}
+
+// readLoop reads the responses from c and passes them to the pending queries
+// until an error occurs.
+func (c *pipelinedConn) readLoop() {
+	dnsConn := &dns.Conn{Conn: limitMsgSize(c.conn, c.maxRespSize)}
+	for {
+		resp, err := dnsConn.ReadMsg()
+		if err != nil {
+			c.stop(fmt.Errorf("reading response: %w", err))
+
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[resp.Id]
+		delete(c.pending, resp.Id)
+		if len(c.pending) == 0 {
+			// Don't let the idle connection time out.
+			_ = c.conn.SetReadDeadline(time.Time{})
+		} else {
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		c.closeIfDrained()
+		c.mu.Unlock()
+
+		if !ok {
+			log.Debug("dot pipeline: unexpected response id %d from %s", resp.Id, c.conn.RemoteAddr())
+
+			continue
+		}
+
+		ch <- resp
+	}
+}
+
+// stop marks c as stopped due to err and closes it.
+func (c *pipelinedConn) stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+	close(c.done)
+
+	log.OnCloserError(c.conn, log.DEBUG)
+}
+
+// drain makes c close as soon as there are no pending queries.
+func (c *pipelinedConn) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.draining = true
+	c.closeIfDrained()
+}
+
+// close closes c regardless of the pending queries.
+func (c *pipelinedConn) close() (err error) {
+	err = c.conn.Close()
+	if err != nil && isCriticalTCP(err) {
+		return err
+	}
+
+	return nil
+}
+
+// exchangePipelined exchanges m over the pipelined connection, dialing it if
+// necessary.  It retries once over a new connection if the current one turns
+// out to be broken.
+func (p *dnsOverTLS) exchangePipelined(
+	ctx context.Context,
+	h bootstrap.DialHandler,
+	m *dns.Msg,
+) (reply *dns.Msg, err error) {
+	addr := p.Address()
+
+	logBegin(addr, networkTCP, m)
+	defer func() { logFinish(addr, networkTCP, reply, err) }()
+
+	start := time.Now()
+
+	c, isNew, err := p.pipelinedConn(ctx, h)
+	if err != nil {
+		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
+	}
+
+	reply, err = c.exchange(ctx, m)
+	if err != nil && !isNew && ctx.Err() == nil && !c.isAlive() {
+		log.Debug("dot %s: bad pipelined conn: %s", p.addr, err)
+
+		c, _, err = p.pipelinedConn(ctx, h)
+		if err != nil {
+			return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
+		}
+
+		reply, err = c.exchange(ctx, m)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("exchanging with %s: %w", addr, err)
+	}
+
+	p.update(time.Since(start))
+
+	return reply, nil
+}
+
+// pipelinedDial is the dialing of a new pipelined connection shared by all the
+// exchanges awaiting it.
+type pipelinedDial struct {
+	// done is closed when the dialing is finished.
+	done chan struct{}
+
+	// conn is the dialed connection.  It's nil if err isn't nil.  It must
+	// only be accessed after done is closed.
+	conn *pipelinedConn
+
+	// err is the error of dialing.  It must only be accessed after done is
+	// closed.
+	err error
+}
+
+// pipelinedConn returns the current pipelined connection, dialing a new one if
+// there is none or it's broken.  The concurrent calls share the same dialing,
+// which is performed without holding p.pipeMu.  isNew is true if the
+// connection is just dialed.
+func (p *dnsOverTLS) pipelinedConn(
+	ctx context.Context,
+	h bootstrap.DialHandler,
+) (c *pipelinedConn, isNew bool, err error) {
+	p.pipeMu.Lock()
+	if p.pipe != nil && p.pipe.isAlive() {
+		defer p.pipeMu.Unlock()
+
+		return p.pipe, false, nil
+	}
+
+	d := p.pipeDial
+	isDialer := d == nil
+	if isDialer {
+		d = &pipelinedDial{
+			done: make(chan struct{}),
+		}
+		p.pipeDial = d
+	}
+	p.pipeMu.Unlock()
+
+	if isDialer {
+		d.conn, d.err = p.dialPipelined(ctx, h)
+
+		p.pipeMu.Lock()
+		p.pipeDial = nil
+		if d.err == nil {
+			p.pipe = d.conn
+		}
+		p.pipeMu.Unlock()
+
+		close(d.done)
+	}
+
+	select {
+	case <-d.done:
+		return d.conn, true, d.err
+	case <-ctx.Done():
+		return nil, false, context.Cause(ctx)
+	}
+}
+
+// dialPipelined dials a new pipelined connection using h.  The connection waits
+// for the responses for the exchange timeout, see [Options.Timeout].
+func (p *dnsOverTLS) dialPipelined(
+	ctx context.Context,
+	h bootstrap.DialHandler,
+) (c *pipelinedConn, err error) {
+	conn, err := tlsDial(ctx, h, p.tlsConf.Clone())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", p.addr.Hostname(), err)
+	}
+
+	// Reset the deadline set for the handshake, since the connection is
+	// long-lived.
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, errors.WithDeferred(err, conn.Close())
+	}
+
+	return newPipelinedConn(conn, cmp.Or(p.timeout, dialTimeout), p.maxRespSize), nil
+}
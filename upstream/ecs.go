@@ -0,0 +1,126 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// ECS address families as defined by RFC 7871.
+const (
+	ecsFamilyIPv4 uint16 = 1
+	ecsFamilyIPv6 uint16 = 2
+)
+
+// ecsUpstream is an [Upstream] attaching the EDNS Client Subnet option to the
+// outgoing queries.
+type ecsUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// subnet is the option to attach.
+	subnet *dns.EDNS0_SUBNET
+
+	// override is true if the option already present in a query should be
+	// replaced.
+	override bool
+}
+
+// newECSUpstream returns ups wrapped to attach the EDNS Client Subnet option
+// configured in opts.  opts.EDNSClientSubnet must not be nil.
+func newECSUpstream(ups Upstream, opts *Options) (u *ecsUpstream) {
+	return &ecsUpstream{
+		wrapped:  wrapped{ups: ups},
+		subnet:   newECSOption(opts.EDNSClientSubnet, opts.ECSPrefixLen),
+		override: opts.OverrideECS,
+	}
+}
+
+// newECSOption returns the EDNS Client Subnet option for subnet containing at
+// most prefixLen leading bits of its address, if prefixLen is positive.
+func newECSOption(subnet *net.IPNet, prefixLen int) (e *dns.EDNS0_SUBNET) {
+	ones, _ := subnet.Mask.Size()
+	if prefixLen > 0 {
+		ones = min(ones, prefixLen)
+	}
+
+	e = &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+	}
+
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		e.Family = ecsFamilyIPv4
+		e.Address = ip4.Mask(net.CIDRMask(ones, netutil.IPv4BitLen))
+	} else {
+		e.Family = ecsFamilyIPv6
+		e.Address = subnet.IP.Mask(net.CIDRMask(ones, netutil.IPv6BitLen))
+	}
+
+	return e
+}
+
+// type check
+var _ Upstream = (*ecsUpstream)(nil)
+
+// Address implements the [Upstream] interface for *ecsUpstream.
+func (u *ecsUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *ecsUpstream.
+func (u *ecsUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *ecsUpstream.  req
+// itself isn't modified.
+func (u *ecsUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	opt := req.IsEdns0()
+	if opt != nil && !u.override && slices.ContainsFunc(opt.Option, isECSOption) {
+		return u.ups.ExchangeContext(ctx, req)
+	}
+
+	req = req.Copy()
+	opt = req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+
+	opt.Option = slices.DeleteFunc(opt.Option, isECSOption)
+
+	subnet := *u.subnet
+	opt.Option = append(opt.Option, &subnet)
+
+	return u.ups.ExchangeContext(ctx, req)
+}
+
+// isECSOption returns true if o is the EDNS Client Subnet option.
+func isECSOption(o dns.EDNS0) (ok bool) {
+	return o.Option() == dns.EDNS0SUBNET
+}
+
+// Close implements the [Upstream] interface for *ecsUpstream.
+func (u *ecsUpstream) Close() (err error) { return u.ups.Close() }
+
+// ResponseECSScope returns the scope prefix length of the EDNS Client Subnet
+// option in resp.  ok is false if resp has no such option.
+func ResponseECSScope(resp *dns.Msg) (scope uint8, ok bool) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+
+	for _, o := range opt.Option {
+		if e, isECS := o.(*dns.EDNS0_SUBNET); isECS {
+			return e.SourceScope, true
+		}
+	}
+
+	return 0, false
+}
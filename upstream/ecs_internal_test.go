@@ -0,0 +1,112 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestECSUpstream(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.0.2.0/24")
+	require.NoError(t, err)
+
+	existing := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecsFamilyIPv4,
+		SourceNetmask: 16,
+		Address:       net.IP{198, 51, 0, 0},
+	}
+
+	testCases := []struct {
+		reqECS    *dns.EDNS0_SUBNET
+		wantAddr  net.IP
+		name      string
+		prefixLen int
+		wantMask  uint8
+		override  bool
+	}{{
+		reqECS:    nil,
+		wantAddr:  net.IP{192, 0, 2, 0},
+		name:      "no_ecs",
+		prefixLen: 0,
+		wantMask:  24,
+		override:  false,
+	}, {
+		reqECS:    nil,
+		wantAddr:  net.IP{192, 0, 0, 0},
+		name:      "prefix_limit",
+		prefixLen: 16,
+		wantMask:  16,
+		override:  false,
+	}, {
+		reqECS:    existing,
+		wantAddr:  existing.Address,
+		name:      "keep_existing",
+		prefixLen: 0,
+		wantMask:  16,
+		override:  false,
+	}, {
+		reqECS:    existing,
+		wantAddr:  net.IP{192, 0, 2, 0},
+		name:      "override",
+		prefixLen: 0,
+		wantMask:  24,
+		override:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var sent *dns.Msg
+			fake := &dnsproxytest.FakeUpstream{
+				OnAddress: func() (addr string) { return "fake" },
+				OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+					sent = req
+
+					resp = respondToTestMessage(req)
+					resp.SetEdns0(dns.DefaultMsgSize, false)
+					resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_SUBNET{
+						Code:        dns.EDNS0SUBNET,
+						SourceScope: 20,
+					})
+
+					return resp, nil
+				},
+				OnClose: func() (err error) { return nil },
+			}
+
+			u := newECSUpstream(fake, &Options{
+				EDNSClientSubnet: subnet,
+				ECSPrefixLen:     tc.prefixLen,
+				OverrideECS:      tc.override,
+			})
+
+			req := createTestMessage()
+			if tc.reqECS != nil {
+				req.SetEdns0(dns.DefaultMsgSize, false)
+				req.IsEdns0().Option = append(req.IsEdns0().Option, tc.reqECS)
+			}
+
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+
+			scope, ok := ResponseECSScope(resp)
+			require.True(t, ok)
+
+			assert.Equal(t, uint8(20), scope)
+
+			opt := sent.IsEdns0()
+			require.NotNil(t, opt)
+			require.Len(t, opt.Option, 1)
+
+			e, ok := opt.Option[0].(*dns.EDNS0_SUBNET)
+			require.True(t, ok)
+
+			assert.Equal(t, tc.wantMask, e.SourceNetmask)
+			assert.True(t, tc.wantAddr.Equal(e.Address))
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package upstream
+
+import "github.com/miekg/dns"
+
+// ExtendedError returns the info code and the extra text of the first Extended
+// DNS Error option, as defined by RFC 8914, in resp.  ok is false if resp has
+// no such option.  resp may be nil.
+func ExtendedError(resp *dns.Msg) (code uint16, text string, ok bool) {
+	edes := ExtendedErrors(resp)
+	if len(edes) == 0 {
+		return 0, "", false
+	}
+
+	return edes[0].InfoCode, edes[0].ExtraText, true
+}
+
+// ExtendedErrors returns all the Extended DNS Error options, as defined by
+// RFC 8914, in resp in the order of their appearance.  It returns nil if
+// there are none.  resp may be nil.  The options must not be modified.
+func ExtendedErrors(resp *dns.Msg) (edes []*dns.EDNS0_EDE) {
+	if resp == nil {
+		return nil
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok {
+			edes = append(edes, e)
+		}
+	}
+
+	return edes
+}
@@ -0,0 +1,77 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtendedError(t *testing.T) {
+	newResp := func(opts ...dns.EDNS0) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetRcode(createTestMessage(), dns.RcodeServerFailure)
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, opts...)
+
+		return resp
+	}
+
+	bogus := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus, ExtraText: "bad sig"}
+	blocked := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked}
+
+	testCases := []struct {
+		resp     *dns.Msg
+		name     string
+		wantText string
+		wantAll  []*dns.EDNS0_EDE
+		wantCode uint16
+		wantOK   bool
+	}{{
+		resp:     nil,
+		name:     "nil",
+		wantText: "",
+		wantAll:  nil,
+		wantCode: 0,
+		wantOK:   false,
+	}, {
+		resp:     createTestMessage(),
+		name:     "no_opt",
+		wantText: "",
+		wantAll:  nil,
+		wantCode: 0,
+		wantOK:   false,
+	}, {
+		resp:     newResp(&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"}),
+		name:     "no_ede",
+		wantText: "",
+		wantAll:  nil,
+		wantCode: 0,
+		wantOK:   false,
+	}, {
+		resp:     newResp(bogus),
+		name:     "single",
+		wantText: "bad sig",
+		wantAll:  []*dns.EDNS0_EDE{bogus},
+		wantCode: dns.ExtendedErrorCodeDNSBogus,
+		wantOK:   true,
+	}, {
+		resp:     newResp(blocked, bogus),
+		name:     "multiple",
+		wantText: "",
+		wantAll:  []*dns.EDNS0_EDE{blocked, bogus},
+		wantCode: dns.ExtendedErrorCodeBlocked,
+		wantOK:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			code, text, ok := ExtendedError(tc.resp)
+			assert.Equal(t, tc.wantCode, code)
+			assert.Equal(t, tc.wantText, text)
+			assert.Equal(t, tc.wantOK, ok)
+
+			assert.Equal(t, tc.wantAll, ExtendedErrors(tc.resp))
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// The kinds of the errors returned from the exchanges with the upstreams
+// created with [AddressToUpstream].  Use [errors.Is] to check the kind of an
+// error, the underlying error is still available via [errors.Is] and
+// [errors.As] and its message isn't changed.
+const (
+	// ErrTimeout means that the exchange or a part of it has timed out.
+	ErrTimeout errors.Error = "timeout"
+
+	// ErrConnFailed means that the connection to the upstream couldn't be
+	// established or has been broken.
+	ErrConnFailed errors.Error = "connection failed"
+
+	// ErrTLSHandshake means that the TLS handshake with the upstream has
+	// failed, e.g. due to an invalid certificate.
+	ErrTLSHandshake errors.Error = "tls handshake failed"
+
+	// ErrBootstrap means that the hostname of the upstream couldn't be
+	// resolved.
+	ErrBootstrap errors.Error = "bootstrap failed"
+
+	// ErrBadResponse means that the response of the upstream is malformed or
+	// doesn't match the query.
+	ErrBadResponse errors.Error = "bad response"
+)
+
+// kindError is an error of a known kind.
+type kindError struct {
+	// err is the underlying error.
+	err error
+
+	// kind is the kind of err, one of the constants above.
+	kind errors.Error
+}
+
+// newKindError returns err marked with kind.  It returns err as is if it's nil
+// or already has a kind.
+func newKindError(kind errors.Error, err error) (wrapped error) {
+	if err == nil {
+		return nil
+	}
+
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return err
+	}
+
+	return &kindError{
+		err:  err,
+		kind: kind,
+	}
+}
+
+// type check
+var _ errors.Wrapper = (*kindError)(nil)
+
+// Error implements the error interface for *kindError.  It returns the message
+// of the underlying error.
+func (e *kindError) Error() (msg string) { return e.err.Error() }
+
+// Unwrap implements the [errors.Wrapper] interface for *kindError.
+func (e *kindError) Unwrap() (unwrapped error) { return e.err }
+
+// Is returns true if target is the kind of e.
+func (e *kindError) Is(target error) (ok bool) { return target == e.kind }
+
+// classifyError marks err with the kind inferred from its chain.  err is
+// returned as is if it's nil, already has a kind, is caused by the context
+// cancellation, or its kind is unknown.
+func classifyError(err error) (classified error) {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return err
+	}
+
+	switch {
+	case isTLSError(err):
+		return newKindError(ErrTLSHandshake, err)
+	case isTimeout(err):
+		return newKindError(ErrTimeout, err)
+	case isBadResponse(err):
+		return newKindError(ErrBadResponse, err)
+	case isConnError(err):
+		return newKindError(ErrConnFailed, err)
+	default:
+		return err
+	}
+}
+
+// isTLSError returns true if err is caused by a failed TLS handshake.
+func isTLSError(err error) (ok bool) {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		transportErr *quic.TransportError
+	)
+
+	switch {
+	case
+		errors.Is(err, ErrCertPinMismatch),
+		errors.As(err, &verifyErr),
+		errors.As(err, &recordErr),
+		errors.As(err, &alertErr),
+		errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr):
+		return true
+	case errors.As(err, &transportErr):
+		return transportErr.ErrorCode.IsCryptoError()
+	default:
+		return false
+	}
+}
+
+// isBadResponse returns true if err is caused by a malformed or mismatching
+// response.
+func isBadResponse(err error) (ok bool) {
+	var dnsErr *dns.Error
+
+	return errors.Is(err, dns.ErrId) ||
+		errors.Is(err, errQuestion) ||
+		errors.Is(err, ErrResponseTooLarge) ||
+		errors.Is(err, ErrUnexpectedTC) ||
+		errors.As(err, &dnsErr)
+}
+
+// isConnError returns true if err is caused by a failed or broken connection.
+func isConnError(err error) (ok bool) {
+	var (
+		opErr    *net.OpError
+		resetErr *quic.StatelessResetError
+		appErr   *quic.ApplicationError
+	)
+
+	return errors.As(err, &opErr) ||
+		errors.As(err, &resetErr) ||
+		errors.As(err, &appErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		isConnBroken(err)
+}
@@ -0,0 +1,177 @@
+package upstream
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		err      error
+		wantKind error
+		name     string
+	}{{
+		err:      nil,
+		wantKind: nil,
+		name:     "nil",
+	}, {
+		err:      fmt.Errorf("reading: %w", os.ErrDeadlineExceeded),
+		wantKind: ErrTimeout,
+		name:     "deadline",
+	}, {
+		err:      &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED},
+		wantKind: ErrConnFailed,
+		name:     "refused",
+	}, {
+		err:      fmt.Errorf("reading: %w", io.EOF),
+		wantKind: ErrConnFailed,
+		name:     "eof",
+	}, {
+		err:      fmt.Errorf("handshake: %w", x509.UnknownAuthorityError{}),
+		wantKind: ErrTLSHandshake,
+		name:     "unknown_authority",
+	}, {
+		err:      ErrCertPinMismatch,
+		wantKind: ErrTLSHandshake,
+		name:     "pin_mismatch",
+	}, {
+		err:      fmt.Errorf("validating: %w", dns.ErrId),
+		wantKind: ErrBadResponse,
+		name:     "bad_id",
+	}, {
+		err:      fmt.Errorf("%w: mismatched name", errQuestion),
+		wantKind: ErrBadResponse,
+		name:     "bad_question",
+	}, {
+		err:      newKindError(ErrBootstrap, os.ErrDeadlineExceeded),
+		wantKind: ErrBootstrap,
+		name:     "already_kinded",
+	}, {
+		err:      errors.Error("unknown"),
+		wantKind: nil,
+		name:     "unknown",
+	}}
+
+	kinds := []error{ErrTimeout, ErrConnFailed, ErrTLSHandshake, ErrBootstrap, ErrBadResponse}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := classifyError(tc.err)
+			if tc.err == nil {
+				require.NoError(t, err)
+
+				return
+			}
+
+			require.ErrorIs(t, err, tc.err)
+			assert.Equal(t, tc.err.Error(), err.Error())
+
+			for _, kind := range kinds {
+				assert.Equal(t, kind == tc.wantKind, errors.Is(err, kind), kind)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		err := classifyError(context.Canceled)
+		assert.Same(t, context.Canceled, err)
+	})
+}
+
+// errResolver is a [Resolver] always failing with err.
+type errResolver struct {
+	err error
+}
+
+// type check
+var _ Resolver = errResolver{}
+
+// LookupNetIP implements the [Resolver] interface for errResolver.
+func (r errResolver) LookupNetIP(
+	_ context.Context,
+	_ bootstrap.Network,
+	_ string,
+) (addrs []netip.Addr, err error) {
+	return nil, r.err
+}
+
+func TestUpstream_errorKinds(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		srv := startDNSServer(t, func(_ dns.ResponseWriter, _ *dns.Msg) {})
+		testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+		u, err := AddressToUpstream(fmt.Sprintf("127.0.0.1:%d", srv.port), &Options{
+			Timeout: 100 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, ErrTimeout)
+	})
+
+	t.Run("bootstrap", func(t *testing.T) {
+		const testErr errors.Error = "test error"
+
+		u, err := AddressToUpstream("tcp://some.dns.server:53", &Options{
+			Bootstrap: errResolver{err: testErr},
+			Timeout:   timeout,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, ErrBootstrap)
+		assert.ErrorIs(t, err, testErr)
+	})
+
+	t.Run("tls_handshake", func(t *testing.T) {
+		srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+		})
+
+		// Don't trust the self-signed certificate of the server.
+		u, err := AddressToUpstream(fmt.Sprintf("tls://127.0.0.1:%d", srv.port), &Options{
+			Timeout: timeout,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, ErrTLSHandshake)
+	})
+
+	t.Run("bad_response", func(t *testing.T) {
+		srv := startDoHServer(t, testDoHServerOptions{
+			handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			}),
+		})
+
+		u, err := AddressToUpstream(fmt.Sprintf("https://%s/dns-query", srv.addr), &Options{
+			InsecureSkipVerify: true,
+			Timeout:            timeout,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, ErrBadResponse)
+	})
+}
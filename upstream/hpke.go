@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE algorithm identifiers, as defined by RFC 9180.  Only the suite
+// mandatory for Oblivious DoH is supported.
+const (
+	// hpkeKEMX25519 is the identifier of DHKEM(X25519, HKDF-SHA256).
+	hpkeKEMX25519 uint16 = 0x0020
+
+	// hpkeKDFSHA256 is the identifier of HKDF-SHA256.
+	hpkeKDFSHA256 uint16 = 0x0001
+
+	// hpkeAEADAES128GCM is the identifier of AES-128-GCM.
+	hpkeAEADAES128GCM uint16 = 0x0001
+)
+
+// Sizes of the values of the supported HPKE suite.
+const (
+	// hpkeNsecret is the length of the KEM shared secret.
+	hpkeNsecret = 32
+
+	// hpkeNh is the output length of the KDF.
+	hpkeNh = 32
+
+	// hpkeNk is the length of the AEAD key.
+	hpkeNk = 16
+
+	// hpkeNn is the length of the AEAD nonce.
+	hpkeNn = 12
+)
+
+// hpkeKEMSuiteID is the suite identifier used within the KEM.
+var hpkeKEMSuiteID = []byte{'K', 'E', 'M', 0x00, 0x20}
+
+// hpkeSuiteID is the suite identifier used within the key schedule.
+var hpkeSuiteID = []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+
+// hpkeContext is the encryption context of HPKE in the base mode.  Since
+// Oblivious DoH encrypts a single message within each context, the sequence
+// number is always zero.
+type hpkeContext struct {
+	// aead seals and opens the message.
+	aead cipher.AEAD
+
+	// baseNonce is the nonce of the first message.
+	baseNonce []byte
+
+	// exporterSecret is the secret to derive the exported values from.
+	exporterSecret []byte
+}
+
+// hpkeSetupSender encapsulates the shared secret to the public key pkR using
+// the ephemeral private key skE, and returns the encapsulated key and the
+// encryption context.  skE must be generated anew for each message.
+func hpkeSetupSender(
+	skE *ecdh.PrivateKey,
+	pkR *ecdh.PublicKey,
+	info []byte,
+) (enc []byte, c *hpkeContext, err error) {
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("computing shared secret: %w", err)
+	}
+
+	enc = skE.PublicKey().Bytes()
+	secret := hpkeExtractAndExpand(dh, append(enc[:len(enc):len(enc)], pkR.Bytes()...))
+
+	c, err = newHPKEContext(secret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return enc, c, nil
+}
+
+// hpkeExtractAndExpand derives the shared secret of the KEM from the
+// Diffie-Hellman value dh and the KEM context.
+func hpkeExtractAndExpand(dh, kemContext []byte) (secret []byte) {
+	prk := hpkeLabeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh)
+
+	return hpkeLabeledExpand(hpkeKEMSuiteID, prk, "shared_secret", kemContext, hpkeNsecret)
+}
+
+// newHPKEContext runs the key schedule of the base mode for the shared secret.
+func newHPKEContext(sharedSecret, info []byte) (c *hpkeContext, err error) {
+	pskIDHash := hpkeLabeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := hpkeLabeledExtract(hpkeSuiteID, nil, "info_hash", info)
+
+	// The mode identifier of the base mode is zero.
+	keyScheduleContext := append([]byte{0x00}, pskIDHash...)
+	keyScheduleContext = append(keyScheduleContext, infoHash...)
+
+	secret := hpkeLabeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	key := hpkeLabeledExpand(hpkeSuiteID, secret, "key", keyScheduleContext, hpkeNk)
+	nonce := hpkeLabeledExpand(hpkeSuiteID, secret, "base_nonce", keyScheduleContext, hpkeNn)
+	exp := hpkeLabeledExpand(hpkeSuiteID, secret, "exp", keyScheduleContext, hpkeNh)
+
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      nonce,
+		exporterSecret: exp,
+	}, nil
+}
+
+// seal encrypts and authenticates pt with the additional data aad.
+func (c *hpkeContext) seal(aad, pt []byte) (ct []byte) {
+	return c.aead.Seal(nil, c.baseNonce, pt, aad)
+}
+
+// export derives the secret of length l bound to exporterContext.
+func (c *hpkeContext) export(exporterContext []byte, l int) (secret []byte) {
+	return hpkeLabeledExpand(hpkeSuiteID, c.exporterSecret, "sec", exporterContext, l)
+}
+
+// hpkeLabeledExtract is the LabeledExtract function of RFC 9180.
+func hpkeLabeledExtract(suiteID, salt []byte, label string, ikm []byte) (prk []byte) {
+	labeledIKM := append([]byte("HPKE-v1"), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+// hpkeLabeledExpand is the LabeledExpand function of RFC 9180.
+func hpkeLabeledExpand(suiteID, prk []byte, label string, info []byte, l int) (out []byte) {
+	labeledInfo := binary.BigEndian.AppendUint16(nil, uint16(l))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+
+	return hkdfExpand(prk, labeledInfo, l)
+}
+
+// hkdfExpand is the Expand function of HKDF-SHA256.  l must not exceed 8160.
+func hkdfExpand(prk, info []byte, l int) (out []byte) {
+	out = make([]byte, l)
+	_, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), out)
+	if err != nil {
+		// Shouldn't happen, since the lengths used are far below the limit.
+		panic(fmt.Errorf("dnsproxy: hkdf expand: %w", err))
+	}
+
+	return out
+}
+
+// newAESGCM returns the AES-GCM AEAD for key.
+func newAESGCM(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mustDecodeHex returns the bytes encoded in the hexadecimal string s.
+func mustDecodeHex(t require.TestingT, s string) (b []byte) {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+
+	return b
+}
+
+// TestHPKE_rfc9180 checks the implementation against the test vectors of
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM in the base mode, see
+// RFC 9180, Appendix A.1.1.
+func TestHPKE_rfc9180(t *testing.T) {
+	var (
+		info       = mustDecodeHex(t, "4f6465206f6e2061204772656369616e2055726e")
+		skEm       = mustDecodeHex(t, "52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736")
+		pkRm       = mustDecodeHex(t, "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+		skRm       = mustDecodeHex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8")
+		wantEnc    = mustDecodeHex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+		wantShared = mustDecodeHex(t, "fe0e18c9f024ce43799ae393c7e8fe8fce9d218875e8227b0187c04e7d2ea1fc")
+		wantKey    = mustDecodeHex(t, "4531685d41d65f03dc48f6b8302c05b0")
+		wantNonce  = mustDecodeHex(t, "56d890e5accaaf011cff4b7d")
+		plaintext  = mustDecodeHex(t, "4265617574792069732074727574682c20747275746820626561757479")
+		aad        = mustDecodeHex(t, "436f756e742d30")
+		ciphertext = mustDecodeHex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+	)
+
+	skE, err := ecdh.X25519().NewPrivateKey(skEm)
+	require.NoError(t, err)
+
+	skR, err := ecdh.X25519().NewPrivateKey(skRm)
+	require.NoError(t, err)
+	require.Equal(t, pkRm, skR.PublicKey().Bytes())
+
+	enc, sender, err := hpkeSetupSender(skE, skR.PublicKey(), info)
+	require.NoError(t, err)
+	require.Equal(t, wantEnc, enc)
+
+	t.Run("key_schedule", func(t *testing.T) {
+		dh, dhErr := skE.ECDH(skR.PublicKey())
+		require.NoError(t, dhErr)
+
+		shared := hpkeExtractAndExpand(dh, append(enc[:len(enc):len(enc)], pkRm...))
+		assert.Equal(t, wantShared, shared)
+		assert.Equal(t, wantNonce, sender.baseNonce)
+
+		// The AEAD key isn't stored, so compare the results of its use.
+		key, keyErr := newAESGCM(wantKey)
+		require.NoError(t, keyErr)
+
+		assert.Equal(t, key.Seal(nil, wantNonce, plaintext, aad), sender.seal(aad, plaintext))
+	})
+
+	t.Run("seal", func(t *testing.T) {
+		assert.Equal(t, ciphertext, sender.seal(aad, plaintext))
+	})
+
+	t.Run("open", func(t *testing.T) {
+		recipient := hpkeSetupReceiver(t, enc, skR, info)
+
+		pt, openErr := recipient.aead.Open(nil, recipient.baseNonce, ciphertext, aad)
+		require.NoError(t, openErr)
+
+		assert.Equal(t, plaintext, pt)
+	})
+
+	t.Run("export", func(t *testing.T) {
+		testCases := []struct {
+			name    string
+			context string
+			want    string
+		}{{
+			name:    "empty",
+			context: "",
+			want:    "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee",
+		}, {
+			name:    "zero",
+			context: "00",
+			want:    "2e8f0b54673c7029649d4eb9d5e33bf1872cf76d623ff164ac185da9e88c21a5",
+		}, {
+			name:    "test_context",
+			context: "54657374436f6e74657874",
+			want:    "e9e43065102c3836401bed8c3c3c75ae46be1639869391d62c61f1ec7af54931",
+		}}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				got := sender.export(mustDecodeHex(t, tc.context), hpkeNh)
+				assert.Equal(t, mustDecodeHex(t, tc.want), got)
+			})
+		}
+	})
+}
@@ -0,0 +1,250 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultLatencyProbeRatio is the default share of the exchanges of the
+	// upstream returned from [NewLatencyBalancedUpstream] sent to the members
+	// other than the fastest one.
+	DefaultLatencyProbeRatio = 0.05
+
+	// DefaultLatencyPenalty is the default round-trip time accounted for a
+	// failed exchange with a member of the upstream returned from
+	// [NewLatencyBalancedUpstream].
+	DefaultLatencyPenalty = 2 * time.Second
+)
+
+// LatencyOptions are the options for [NewLatencyBalancedUpstream].
+type LatencyOptions struct {
+	// Alpha is the smoothing factor of the exponentially weighted moving
+	// average of the round-trip times of each member, see [Options.RTTAlpha].
+	// If it's not within (0, 1], [DefaultRTTAlpha] is used.
+	Alpha float64
+
+	// ProbeRatio is the share of the exchanges sent to a randomly chosen member
+	// other than the fastest one to keep its estimate fresh.  If zero,
+	// [DefaultLatencyProbeRatio] is used.  If negative, the slower members are
+	// never probed.
+	ProbeRatio float64
+
+	// Penalty is the round-trip time accounted for a failed exchange, as
+	// decided by [IsFailure], unless it actually took longer.  If zero,
+	// [DefaultLatencyPenalty] is used.
+	Penalty time.Duration
+}
+
+// latencyMember is a member of *latencyBalancer.
+type latencyMember struct {
+	// ups is the member upstream.
+	ups Upstream
+
+	// mean is the moving average of the round-trip times of the exchanges with
+	// ups.  It's protected by the mutex of the balancer.
+	mean time.Duration
+
+	// measured is true if there has been at least one exchange with ups.  It's
+	// protected by the mutex of the balancer.
+	measured bool
+}
+
+// latencyBalancer is an [Upstream] exchanging with the member having the
+// lowest average round-trip time.
+type latencyBalancer struct {
+	// mu protects the latency estimates of members.
+	mu *sync.Mutex
+
+	// members are the upstreams to choose from.
+	members []*latencyMember
+
+	// alpha is the smoothing factor of the moving average.
+	alpha float64
+
+	// probeRatio is the share of the exchanges sent to the slower members.
+	probeRatio float64
+
+	// penalty is the round-trip time accounted for a failed exchange.
+	penalty time.Duration
+}
+
+// NewLatencyBalancedUpstream returns an [Upstream] exchanging with the member
+// of ups having the lowest moving average of the round-trip times, so that the
+// members are reordered automatically as their latencies change.  The members
+// which haven't been exchanged with yet are tried first.  A share of the
+// exchanges is sent to the other members to keep their estimates fresh.  ups
+// must not be empty.
+func NewLatencyBalancedUpstream(ups []Upstream, opts LatencyOptions) (u Upstream) {
+	alpha := opts.Alpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = DefaultRTTAlpha
+	}
+
+	probeRatio := opts.ProbeRatio
+	if probeRatio == 0 {
+		probeRatio = DefaultLatencyProbeRatio
+	}
+
+	penalty := opts.Penalty
+	if penalty <= 0 {
+		penalty = DefaultLatencyPenalty
+	}
+
+	members := make([]*latencyMember, 0, len(ups))
+	for _, m := range ups {
+		members = append(members, &latencyMember{ups: m})
+	}
+
+	return &latencyBalancer{
+		mu:         &sync.Mutex{},
+		members:    members,
+		alpha:      alpha,
+		probeRatio: probeRatio,
+		penalty:    penalty,
+	}
+}
+
+// type check
+var _ Upstream = (*latencyBalancer)(nil)
+
+// Address implements the [Upstream] interface for *latencyBalancer.  It lists
+// the addresses of the members, e.g. "latency(tls://dns.example, 1.1.1.1:53)".
+func (u *latencyBalancer) Address() (addr string) {
+	addrs := make([]string, 0, len(u.members))
+	for _, m := range u.members {
+		addrs = append(addrs, m.ups.Address())
+	}
+
+	return fmt.Sprintf("latency(%s)", strings.Join(addrs, ", "))
+}
+
+// Exchange implements the [Upstream] interface for *latencyBalancer.
+func (u *latencyBalancer) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *latencyBalancer.
+// It doesn't retry the exchange with other members.
+func (u *latencyBalancer) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	m := u.choose()
+
+	start := time.Now()
+	resp, err = m.ups.ExchangeContext(ctx, req)
+	rtt := time.Since(start)
+
+	if !IsFailure(resp, err) {
+		u.record(m, rtt)
+	} else if ctx.Err() == nil {
+		u.record(m, max(rtt, u.penalty))
+
+		log.Debug(
+			"dnsproxy: latency: %s failed, penalized: %s",
+			m.ups.Address(),
+			retryReason(resp, err),
+		)
+	}
+
+	if err != nil {
+		return resp, fmt.Errorf("exchanging with %s: %w", m.ups.Address(), err)
+	}
+
+	return resp, nil
+}
+
+// choose returns the member to exchange with.
+func (u *latencyBalancer) choose() (chosen *latencyMember) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	fastest := 0
+	for i, m := range u.members {
+		if !m.measured {
+			return m
+		}
+
+		if m.mean < u.members[fastest].mean {
+			fastest = i
+		}
+	}
+
+	if len(u.members) > 1 && rand.Float64() < u.probeRatio {
+		// Choose any other member.
+		i := rand.IntN(len(u.members) - 1)
+		if i >= fastest {
+			i++
+		}
+
+		return u.members[i]
+	}
+
+	return u.members[fastest]
+}
+
+// record adds the round-trip time of the exchange with m to its estimate.
+func (u *latencyBalancer) record(m *latencyMember, rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !m.measured {
+		m.mean, m.measured = rtt, true
+	} else {
+		m.mean += time.Duration(u.alpha * float64(rtt-m.mean))
+	}
+}
+
+// Close implements the [Upstream] interface for *latencyBalancer.  It closes
+// all the members.
+func (u *latencyBalancer) Close() (err error) {
+	var errs []error
+	for _, m := range u.members {
+		closeErr := m.ups.Close()
+		if closeErr != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", m.ups.Address(), closeErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ ProbableUpstream = (*latencyBalancer)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *latencyBalancer.  It
+// succeeds if any of the members responds properly.
+func (u *latencyBalancer) Probe(ctx context.Context) (err error) {
+	var errs []error
+	for _, m := range u.members {
+		err = probeWrapped(ctx, m.ups)
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ BootstrapSetter = (*latencyBalancer)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for
+// *latencyBalancer.  It sets the resolvers for each member implementing
+// [BootstrapSetter].
+func (u *latencyBalancer) SetBootstrap(resolvers []Resolver) {
+	for _, m := range u.members {
+		setBootstrap(m.ups, resolvers)
+	}
+}
@@ -0,0 +1,106 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyBalancedUpstream(t *testing.T) {
+	const (
+		testErr errors.Error = "test error"
+
+		n = 100
+	)
+
+	t.Run("fastest", func(t *testing.T) {
+		slow, slowN, _ := newChainMember("slow", dns.RcodeSuccess, nil)
+		fast, fastN, _ := newChainMember("fast", dns.RcodeSuccess, nil)
+
+		u := NewLatencyBalancedUpstream([]Upstream{slow, fast}, LatencyOptions{
+			ProbeRatio: -1,
+		})
+		assert.Equal(t, "latency(slow, fast)", u.Address())
+
+		lu := testutil.RequireTypeAssert[*latencyBalancer](t, u)
+
+		// The unmeasured members are tried first.
+		for range 2 {
+			_, err := u.Exchange(createTestMessage())
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 1, *slowN)
+		assert.Equal(t, 1, *fastN)
+
+		lu.record(lu.members[0], time.Hour)
+		lu.record(lu.members[1], 0)
+
+		for range n {
+			req := createTestMessage()
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+		}
+
+		assert.Equal(t, 1, *slowN)
+		assert.Equal(t, n+1, *fastN)
+	})
+
+	t.Run("probe", func(t *testing.T) {
+		slow, slowN, _ := newChainMember("slow", dns.RcodeSuccess, nil)
+		fast, fastN, _ := newChainMember("fast", dns.RcodeSuccess, nil)
+
+		u := NewLatencyBalancedUpstream([]Upstream{slow, fast}, LatencyOptions{
+			ProbeRatio: 0.5,
+			Alpha:      0.01,
+		})
+
+		lu := testutil.RequireTypeAssert[*latencyBalancer](t, u)
+		lu.record(lu.members[0], time.Hour)
+		lu.record(lu.members[1], 0)
+
+		for range n {
+			_, err := u.Exchange(createTestMessage())
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, n, *slowN+*fastN)
+		assert.Positive(t, *slowN)
+		assert.Positive(t, *fastN)
+	})
+
+	t.Run("penalty", func(t *testing.T) {
+		failing, failingN, failingCloses := newChainMember("failing", 0, testErr)
+		working, workingN, workingCloses := newChainMember("working", dns.RcodeSuccess, nil)
+
+		u := NewLatencyBalancedUpstream([]Upstream{failing, working}, LatencyOptions{
+			ProbeRatio: -1,
+			Penalty:    time.Hour,
+		})
+
+		lu := testutil.RequireTypeAssert[*latencyBalancer](t, u)
+		lu.record(lu.members[0], 0)
+		lu.record(lu.members[1], time.Minute)
+
+		_, err := u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, testErr)
+
+		for range n {
+			_, err = u.Exchange(createTestMessage())
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 1, *failingN)
+		assert.Equal(t, n, *workingN)
+
+		require.NoError(t, u.Close())
+		assert.Equal(t, 1, *failingCloses)
+		assert.Equal(t, 1, *workingCloses)
+	})
+}
@@ -0,0 +1,59 @@
+package upstream
+
+// MetadataUpstream is an [Upstream] carrying the user-defined metadata, see
+// [Options.Name] and [Options.Metadata].
+//
+// The upstreams created with [AddressToUpstream] implement it if any of those
+// options is set, as well as the ones returned from [WithName].
+type MetadataUpstream interface {
+	Upstream
+
+	// Name returns the user-defined label of the upstream, or an empty string
+	// if there is none.
+	Name() (name string)
+
+	// Metadata returns the user-defined metadata of the upstream.  It must not
+	// be modified.
+	Metadata() (md map[string]string)
+}
+
+// UpstreamName returns the name of u or the first upstream wrapped by it
+// implementing [MetadataUpstream], if not empty, e.g. for logging.  Otherwise,
+// it returns the address of u.
+func UpstreamName(u Upstream) (name string) {
+	if mu := findMetadataUpstream(u); mu != nil {
+		if name = mu.Name(); name != "" {
+			return name
+		}
+	}
+
+	return u.Address()
+}
+
+// UpstreamMetadata returns the metadata of u or the first upstream wrapped by it
+// implementing [MetadataUpstream].  It returns nil if there is none.  md must
+// not be modified.
+func UpstreamMetadata(u Upstream) (md map[string]string) {
+	if mu := findMetadataUpstream(u); mu != nil {
+		return mu.Metadata()
+	}
+
+	return nil
+}
+
+// findMetadataUpstream returns u or the first upstream wrapped by it
+// implementing [MetadataUpstream], or nil if there is none.
+func findMetadataUpstream(u Upstream) (mu MetadataUpstream) {
+	for {
+		if mu, ok := u.(MetadataUpstream); ok {
+			return mu
+		}
+
+		w, ok := u.(interface{ Unwrap() (ups Upstream) })
+		if !ok {
+			return nil
+		}
+
+		u = w.Unwrap()
+	}
+}
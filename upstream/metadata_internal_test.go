@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptions_Name(t *testing.T) {
+	const name = "primary-us-east"
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+
+	t.Run("unset", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{Timeout: timeout})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		assert.Equal(t, addr, UpstreamName(u))
+		assert.Nil(t, UpstreamMetadata(u))
+	})
+
+	t.Run("set", func(t *testing.T) {
+		md := map[string]string{"region": "us-east"}
+		l := &recordingListener{mu: &sync.Mutex{}}
+		u, err := AddressToUpstream(addr, &Options{
+			Timeout:         timeout,
+			MetricsListener: l,
+			Name:            name,
+			Metadata:        md,
+			Retries:         1,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		assert.Equal(t, name, u.Address())
+		assert.Equal(t, name, UpstreamName(u))
+		assert.Equal(t, md, UpstreamMetadata(u))
+
+		req := createTestMessage()
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+		requireResponse(t, req, resp)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		assert.Equal(t, []string{
+			"start " + name + " A",
+			"dial " + name + " <nil>",
+			"finish " + name + " true 0 <nil>",
+		}, l.events)
+	})
+}
@@ -0,0 +1,165 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/miekg/dns"
+)
+
+// MetricsListener receives the events of the upstreams, e.g. to collect
+// metrics.  Its methods are called concurrently, without holding any locks of
+// the upstreams, so they must be safe for concurrent use and shouldn't block.
+// upstream is the address of the upstream as returned by [Upstream.Address], or
+// [Options.Name] or the name passed to [WithName], if set.
+type MetricsListener interface {
+	// OnExchangeStart is called before exchanging a query of type qtype with
+	// the upstream.
+	OnExchangeStart(upstream string, qtype uint16)
+
+	// OnExchangeFinish is called after the exchange with the upstream started
+	// with OnExchangeStart is finished.  rcode is the response code, or -1 if
+	// there is no response.  err is the error of the exchange, if any.
+	OnExchangeFinish(upstream string, rtt time.Duration, rcode int, err error)
+
+	// OnUpstreamDial is called after each attempt to connect to the upstream.
+	// err is the error of the attempt, if any.
+	OnUpstreamDial(upstream string, err error)
+}
+
+// EmptyMetricsListener is a [MetricsListener] doing nothing.
+type EmptyMetricsListener struct{}
+
+// type check
+var _ MetricsListener = EmptyMetricsListener{}
+
+// OnExchangeStart implements the [MetricsListener] interface for
+// EmptyMetricsListener.
+func (EmptyMetricsListener) OnExchangeStart(_ string, _ uint16) {}
+
+// OnExchangeFinish implements the [MetricsListener] interface for
+// EmptyMetricsListener.
+func (EmptyMetricsListener) OnExchangeFinish(_ string, _ time.Duration, _ int, _ error) {}
+
+// OnUpstreamDial implements the [MetricsListener] interface for
+// EmptyMetricsListener.
+func (EmptyMetricsListener) OnUpstreamDial(_ string, _ error) {}
+
+// dialReporter is implemented by the upstreams dialing the connections, which
+// are able to report the dialing attempts.
+type dialReporter interface {
+	// setOnDial sets the function to call after each dialing attempt.  It must
+	// be called before the upstream is used.
+	setOnDial(onDial func(err error))
+}
+
+// type check
+var _ dialReporter = (*bootstrapper)(nil)
+
+// setOnDial implements the [dialReporter] interface for *bootstrapper.
+func (b *bootstrapper) setOnDial(onDial func(err error)) {
+	b.onDial = onDial
+}
+
+// reportDials returns h reporting the result of each dialing attempt, if b is
+// configured to.
+func (b *bootstrapper) reportDials(h bootstrap.DialHandler) (reporting bootstrap.DialHandler) {
+	onDial := b.onDial
+	if onDial == nil {
+		return h
+	}
+
+	return func(
+		ctx context.Context,
+		network bootstrap.Network,
+		addr string,
+	) (conn net.Conn, err error) {
+		conn, err = h(ctx, network, addr)
+		onDial(err)
+
+		return conn, err
+	}
+}
+
+// metricsUpstream is an [Upstream] reporting the exchanges with the wrapped
+// upstream to a [MetricsListener].
+type metricsUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// listener receives the events.
+	listener MetricsListener
+
+	// addr is the address of ups.
+	addr string
+
+	// label is the name of ups reported to listener, see [labeledUpstream].
+	label string
+}
+
+// newMetricsUpstream returns u reporting its exchanges and, if supported, the
+// dialing attempts to l.  l must not be nil.
+func newMetricsUpstream(u Upstream, l MetricsListener) (m *metricsUpstream) {
+	addr := u.Address()
+
+	m = &metricsUpstream{
+		wrapped:  wrapped{ups: u},
+		listener: l,
+		addr:     addr,
+		label:    addr,
+	}
+
+	if r, ok := u.(dialReporter); ok {
+		r.setOnDial(func(err error) { l.OnUpstreamDial(m.label, err) })
+	}
+
+	return m
+}
+
+// type check
+var _ Upstream = (*metricsUpstream)(nil)
+
+// Address implements the [Upstream] interface for *metricsUpstream.
+func (u *metricsUpstream) Address() (addr string) { return u.addr }
+
+// Exchange implements the [Upstream] interface for *metricsUpstream.
+func (u *metricsUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *metricsUpstream.
+func (u *metricsUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	var qtype uint16
+	if len(req.Question) > 0 {
+		qtype = req.Question[0].Qtype
+	}
+
+	u.listener.OnExchangeStart(u.label, qtype)
+
+	start := time.Now()
+	resp, err = u.ups.ExchangeContext(ctx, req)
+	rtt := time.Since(start)
+
+	rcode := -1
+	if resp != nil {
+		rcode = resp.Rcode
+	}
+
+	u.listener.OnExchangeFinish(u.label, rtt, rcode, err)
+
+	return resp, err
+}
+
+// Close implements the [Upstream] interface for *metricsUpstream.
+func (u *metricsUpstream) Close() (err error) { return u.ups.Close() }
+
+// type check
+var _ labeledUpstream = (*metricsUpstream)(nil)
+
+// setLabel implements the [labeledUpstream] interface for *metricsUpstream.
+func (u *metricsUpstream) setLabel(label string) { u.label = label }
@@ -0,0 +1,82 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingListener is a [MetricsListener] recording the events as strings.
+type recordingListener struct {
+	mu     *sync.Mutex
+	events []string
+}
+
+// type check
+var _ MetricsListener = (*recordingListener)(nil)
+
+// record appends the formatted event to l.
+func (l *recordingListener) record(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, fmt.Sprintf(format, args...))
+}
+
+// OnExchangeStart implements the [MetricsListener] interface for
+// *recordingListener.
+func (l *recordingListener) OnExchangeStart(upstream string, qtype uint16) {
+	l.record("start %s %s", upstream, dns.Type(qtype))
+}
+
+// OnExchangeFinish implements the [MetricsListener] interface for
+// *recordingListener.
+func (l *recordingListener) OnExchangeFinish(
+	upstream string,
+	rtt time.Duration,
+	rcode int,
+	err error,
+) {
+	l.record("finish %s %t %d %v", upstream, rtt > 0, rcode, err)
+}
+
+// OnUpstreamDial implements the [MetricsListener] interface for
+// *recordingListener.
+func (l *recordingListener) OnUpstreamDial(upstream string, err error) {
+	l.record("dial %s %v", upstream, err)
+}
+
+func TestOptions_MetricsListener(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	l := &recordingListener{mu: &sync.Mutex{}}
+	addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:         timeout,
+		MetricsListener: l,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	assert.Equal(t, []string{
+		"start " + addr + " A",
+		"dial " + addr + " <nil>",
+		"finish " + addr + " true 0 <nil>",
+	}, l.events)
+}
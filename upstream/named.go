@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// labeledUpstream is implemented by the wrappers reporting the label of the
+// upstream, e.g. to a [MetricsListener] or a [QueryLogger].
+type labeledUpstream interface {
+	// setLabel sets the label to report.  It must be called before the
+	// upstream is used.
+	setLabel(label string)
+}
+
+// NamedUpstream is an [Upstream] which returns a custom label from its Address
+// method, e.g. for readable logs and metrics.  The methods of [Upstream],
+// [ProbableUpstream], and [BootstrapSetter] are delegated to the wrapped
+// upstream.  Its other optional interfaces, e.g. [UpstreamWithStats], are
+// available through [UpstreamAs].
+type NamedUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// md is the user-defined metadata, if any.
+	md map[string]string
+
+	// name is the label returned from Address.
+	name string
+}
+
+// WithName returns ups wrapped to use name as its address.  name is also
+// reported to the [MetricsListener] and [QueryLogger] configured for ups, if
+// any, so WithName must be called before ups is used.  ups must not be nil.
+func WithName(ups Upstream, name string) (u *NamedUpstream) {
+	return newNamedUpstream(ups, name, nil)
+}
+
+// newNamedUpstream returns ups wrapped to carry name and md, see [Options.Name]
+// and [Options.Metadata].  If name is empty, the address of ups is kept.
+func newNamedUpstream(ups Upstream, name string, md map[string]string) (u *NamedUpstream) {
+	if name != "" {
+		setLabels(ups, name)
+	}
+
+	return &NamedUpstream{
+		wrapped: wrapped{ups: ups},
+		md:      md,
+		name:    name,
+	}
+}
+
+// setLabels sets label to u and all the upstreams wrapped by it implementing
+// [labeledUpstream].
+func setLabels(u Upstream, label string) {
+	for {
+		if l, ok := u.(labeledUpstream); ok {
+			l.setLabel(label)
+		}
+
+		w, ok := u.(interface{ Unwrap() (ups Upstream) })
+		if !ok {
+			return
+		}
+
+		u = w.Unwrap()
+	}
+}
+
+// type check
+var _ MetadataUpstream = (*NamedUpstream)(nil)
+
+// Address implements the [Upstream] interface for *NamedUpstream.  It returns
+// the configured label, if any.
+func (u *NamedUpstream) Address() (addr string) {
+	if u.name == "" {
+		return u.ups.Address()
+	}
+
+	return u.name
+}
+
+// Exchange implements the [Upstream] interface for *NamedUpstream.
+func (u *NamedUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ups.Exchange(req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *NamedUpstream.
+func (u *NamedUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	return u.ups.ExchangeContext(ctx, req)
+}
+
+// Close implements the [Upstream] interface for *NamedUpstream.
+func (u *NamedUpstream) Close() (err error) { return u.ups.Close() }
+
+// Name implements the [MetadataUpstream] interface for *NamedUpstream.
+func (u *NamedUpstream) Name() (name string) { return u.name }
+
+// Metadata implements the [MetadataUpstream] interface for *NamedUpstream.
+func (u *NamedUpstream) Metadata() (md map[string]string) { return u.md }
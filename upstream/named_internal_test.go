@@ -0,0 +1,85 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithName(t *testing.T) {
+	const (
+		name = "primary-doh"
+
+		testErr errors.Error = "test error"
+	)
+
+	inner := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "https://dns.example/dns-query" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return respondToTestMessage(req), nil
+		},
+		OnClose: func() (err error) { return testErr },
+	}
+
+	u := WithName(inner, name)
+	assert.Equal(t, name, u.Address())
+	assert.Same(t, inner, u.Unwrap())
+
+	req := createTestMessage()
+	resp, resolved, err := ExchangeParallel([]Upstream{u}, req)
+	require.NoError(t, err)
+
+	requireResponse(t, req, resp)
+	assert.Equal(t, name, resolved.Address())
+
+	assert.ErrorIs(t, u.Close(), testErr)
+	assert.Equal(t, name, UpstreamName(u))
+}
+
+func TestWithName_label(t *testing.T) {
+	const name = "primary-tcp"
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	l := &recordingListener{mu: &sync.Mutex{}}
+	ql := &recordingQueryLogger{mu: &sync.Mutex{}}
+	inner, err := AddressToUpstream(fmt.Sprintf("tcp://127.0.0.1:%d", srv.port), &Options{
+		Timeout:         timeout,
+		MetricsListener: l,
+		QueryLogger:     ql,
+	})
+	require.NoError(t, err)
+
+	u := WithName(inner, name)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	assert.Equal(t, []string{
+		"start " + name + " A",
+		"dial " + name + " <nil>",
+		"finish " + name + " true 0 <nil>",
+	}, l.events)
+
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	require.Len(t, ql.entries, 1)
+	assert.Equal(t, name, ql.entries[0].Upstream)
+}
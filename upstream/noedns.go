@@ -0,0 +1,56 @@
+package upstream
+
+import (
+	"context"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// noEDNSUpstream is an [Upstream] removing the OPT records from the outgoing
+// queries, see [Options.DisableEDNS0].
+type noEDNSUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+}
+
+// newNoEDNSUpstream returns ups wrapped to remove the OPT records from the
+// outgoing queries.
+func newNoEDNSUpstream(ups Upstream) (u *noEDNSUpstream) {
+	return &noEDNSUpstream{
+		wrapped: wrapped{ups: ups},
+	}
+}
+
+// type check
+var _ Upstream = (*noEDNSUpstream)(nil)
+
+// Address implements the [Upstream] interface for *noEDNSUpstream.
+func (u *noEDNSUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *noEDNSUpstream.
+func (u *noEDNSUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *noEDNSUpstream.  req
+// isn't modified, the OPT records are removed from its copy.
+func (u *noEDNSUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if slices.ContainsFunc(req.Extra, isOPT) {
+		req = req.Copy()
+		req.Extra = slices.DeleteFunc(req.Extra, isOPT)
+	}
+
+	return u.ups.ExchangeContext(ctx, req)
+}
+
+// isOPT returns true if rr is an OPT record.
+func isOPT(rr dns.RR) (ok bool) {
+	return rr.Header().Rrtype == dns.TypeOPT
+}
+
+// Close implements the [Upstream] interface for *noEDNSUpstream.
+func (u *noEDNSUpstream) Close() (err error) { return u.ups.Close() }
@@ -0,0 +1,656 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Constants of Oblivious DoH, as defined by RFC 9230.
+const (
+	// odohMediaType is the media type of the encrypted messages.
+	odohMediaType = "application/oblivious-dns-message"
+
+	// odohConfigsPath is the well-known path of the target configurations.
+	odohConfigsPath = "/.well-known/odohconfigs"
+
+	// odohDefaultTargetPath is the path of the target used when the address
+	// of the upstream has none.
+	odohDefaultTargetPath = "/dns-query"
+
+	// odohVersion is the only supported version of the configuration.
+	odohVersion uint16 = 0x0001
+
+	// odohMessageQuery is the type of the encrypted query message.
+	odohMessageQuery byte = 0x01
+
+	// odohMessageResponse is the type of the encrypted response message.
+	odohMessageResponse byte = 0x02
+
+	// odohDefaultConfigTTL is the time the configurations of the target are
+	// reused for when the response carrying them doesn't specify it.
+	odohDefaultConfigTTL = 1 * time.Hour
+)
+
+// errODoHNoRelay is returned when the upstream with the "odoh" scheme is
+// created without [Options.ODoHRelay].
+const errODoHNoRelay errors.Error = "odoh relay url is required"
+
+// errODoHStaleConfig is returned when the target rejects the query or the
+// response can't be decrypted, which likely means the target has rotated its
+// keys.
+const errODoHStaleConfig errors.Error = "odoh config is stale"
+
+// odohConfig is the supported configuration of an Oblivious DoH target.
+type odohConfig struct {
+	// publicKey is the public key of the target.
+	publicKey *ecdh.PublicKey
+
+	// keyID is the identifier of the key sent along with the queries.
+	keyID []byte
+}
+
+// parseODoHConfigs returns the first supported configuration from the
+// ObliviousDoHConfigs structure b.
+func parseODoHConfigs(b []byte) (c *odohConfig, err error) {
+	configs, rest, err := readVector16(b)
+	if err != nil {
+		return nil, fmt.Errorf("reading configs: %w", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(rest))
+	}
+
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, errors.Error("truncated config version")
+		}
+
+		version := binary.BigEndian.Uint16(configs)
+
+		var contents []byte
+		contents, configs, err = readVector16(configs[2:])
+		if err != nil {
+			return nil, fmt.Errorf("reading config contents: %w", err)
+		}
+
+		if version != odohVersion {
+			continue
+		}
+
+		c, err = parseODoHConfigContents(contents)
+		if err == nil {
+			return c, nil
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, errors.Error("no supported configs")
+}
+
+// parseODoHConfigContents parses the ObliviousDoHConfigContents structure b.
+func parseODoHConfigContents(b []byte) (c *odohConfig, err error) {
+	if len(b) < 6 {
+		return nil, errors.Error("truncated config contents")
+	}
+
+	kem := binary.BigEndian.Uint16(b)
+	kdf := binary.BigEndian.Uint16(b[2:])
+	aead := binary.BigEndian.Uint16(b[4:])
+	if kem != hpkeKEMX25519 || kdf != hpkeKDFSHA256 || aead != hpkeAEADAES128GCM {
+		return nil, fmt.Errorf("unsupported hpke suite %#04x, %#04x, %#04x", kem, kdf, aead)
+	}
+
+	pk, rest, err := readVector16(b[6:])
+	if err != nil {
+		return nil, fmt.Errorf("reading public key: %w", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes in config contents", len(rest))
+	}
+
+	publicKey, err := ecdh.X25519().NewPublicKey(pk)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+
+	return &odohConfig{
+		publicKey: publicKey,
+		keyID:     hkdfExpand(hkdf.Extract(sha256.New, b, nil), []byte("odoh key id"), hpkeNh),
+	}, nil
+}
+
+// odohQuery is the encrypted Oblivious DoH query along with the state required
+// to decrypt the response.
+type odohQuery struct {
+	// hpke is the encryption context of the query.
+	hpke *hpkeContext
+
+	// plain is the encoded ObliviousDoHMessagePlaintext of the query.
+	plain []byte
+
+	// msg is the encoded ObliviousDoHMessage to send.
+	msg []byte
+}
+
+// encryptQuery encrypts the wire-format DNS query for the target configured by
+// c using a new ephemeral key.
+func (c *odohConfig) encryptQuery(query []byte) (q *odohQuery, err error) {
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating ephemeral key: %w", err)
+	}
+
+	return c.encryptQueryWithKey(query, skE)
+}
+
+// encryptQueryWithKey encrypts the wire-format DNS query for the target
+// configured by c using the ephemeral private key skE.
+func (c *odohConfig) encryptQueryWithKey(
+	query []byte,
+	skE *ecdh.PrivateKey,
+) (q *odohQuery, err error) {
+	plain := appendVector16(nil, query)
+	// Don't pad the query.
+	plain = appendVector16(plain, nil)
+
+	enc, hc, err := hpkeSetupSender(skE, c.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, fmt.Errorf("setting up hpke: %w", err)
+	}
+
+	encrypted := append(enc, hc.seal(odohAAD(odohMessageQuery, c.keyID), plain)...)
+
+	return &odohQuery{
+		hpke:  hc,
+		plain: plain,
+		msg:   packODoHMessage(odohMessageQuery, c.keyID, encrypted),
+	}, nil
+}
+
+// decryptResponse decrypts the encoded ObliviousDoHMessage msg and returns the
+// wire-format DNS response.
+func (q *odohQuery) decryptResponse(msg []byte) (resp []byte, err error) {
+	typ, nonce, encrypted, err := unpackODoHMessage(msg)
+	if err != nil {
+		return nil, err
+	} else if typ != odohMessageResponse {
+		return nil, fmt.Errorf("unexpected message type %d", typ)
+	}
+
+	aead, aeadNonce, err := odohResponseKey(q.hpke, q.plain, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := aead.Open(nil, aeadNonce, encrypted, odohAAD(odohMessageResponse, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting response: %w", err)
+	}
+
+	resp, _, err = readVector16(plain)
+	if err != nil {
+		return nil, fmt.Errorf("reading response plaintext: %w", err)
+	}
+
+	return resp, nil
+}
+
+// odohResponseKey derives the AEAD and its nonce protecting the response to
+// the query plain encrypted within hc.
+func odohResponseKey(
+	hc *hpkeContext,
+	plain []byte,
+	respNonce []byte,
+) (aead cipher.AEAD, nonce []byte, err error) {
+	secret := hc.export([]byte("odoh response"), hpkeNk)
+
+	salt := appendVector16(bytes.Clone(plain), respNonce)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+
+	aead, err = newAESGCM(hkdfExpand(prk, []byte("odoh key"), hpkeNk))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aead, hkdfExpand(prk, []byte("odoh nonce"), hpkeNn), nil
+}
+
+// odohAAD returns the additional authenticated data for the message of type
+// typ with the key identifier or the response nonce id.
+func odohAAD(typ byte, id []byte) (aad []byte) {
+	return appendVector16([]byte{typ}, id)
+}
+
+// packODoHMessage encodes the ObliviousDoHMessage structure.
+func packODoHMessage(typ byte, id, encrypted []byte) (msg []byte) {
+	msg = appendVector16([]byte{typ}, id)
+
+	return appendVector16(msg, encrypted)
+}
+
+// unpackODoHMessage decodes the ObliviousDoHMessage structure.
+func unpackODoHMessage(msg []byte) (typ byte, id, encrypted []byte, err error) {
+	if len(msg) == 0 {
+		return 0, nil, nil, errors.Error("empty message")
+	}
+
+	id, rest, err := readVector16(msg[1:])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("reading message id: %w", err)
+	}
+
+	encrypted, rest, err = readVector16(rest)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("reading encrypted message: %w", err)
+	} else if len(rest) > 0 {
+		return 0, nil, nil, fmt.Errorf("%d trailing bytes in message", len(rest))
+	}
+
+	return msg[0], id, encrypted, nil
+}
+
+// appendVector16 appends v prefixed with its 2-byte length to b.
+func appendVector16(b, v []byte) (res []byte) {
+	res = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+
+	return append(res, v...)
+}
+
+// readVector16 reads the value prefixed with its 2-byte length from b.
+func readVector16(b []byte) (v, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errors.Error("truncated length")
+	}
+
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return nil, nil, fmt.Errorf("length %d exceeds %d remaining bytes", l, len(b)-2)
+	}
+
+	return b[2 : 2+l], b[2+l:], nil
+}
+
+// obliviousDoH is an [Upstream] implementing the Oblivious DoH protocol, as
+// defined by RFC 9230.
+type obliviousDoH struct {
+	// relay sends the encrypted queries to the relay.
+	relay *dnsOverHTTPS
+
+	// target fetches the configuration of the target.
+	target *dnsOverHTTPS
+
+	// configMu protects config and configExpire.
+	configMu *sync.Mutex
+
+	// config is the configuration of the target.  It's nil until the first
+	// exchange.
+	config *odohConfig
+
+	// configExpire is the time config should be fetched again at.
+	configExpire time.Time
+
+	// addrRedacted is the redacted address of the target.
+	addrRedacted string
+
+	// targetHost is the host of the target sent to the relay.
+	targetHost string
+
+	// targetPath is the path of the target sent to the relay.
+	targetPath string
+
+	// active tracks the exchanges in flight, so that Close waits for them.
+	active *inflight
+}
+
+// newODoH returns the Oblivious DoH Upstream for the target addr using the
+// relay from opts.
+func newODoH(addr *url.URL, opts *Options) (u Upstream, err error) {
+	if opts.ODoHRelay == "" {
+		return nil, errODoHNoRelay
+	}
+
+	relayURL, err := url.Parse(opts.ODoHRelay)
+	if err != nil {
+		return nil, fmt.Errorf("parsing odoh relay url: %w", err)
+	} else if relayURL.Scheme != "https" || relayURL.Host == "" {
+		return nil, fmt.Errorf("odoh relay url %q: must be an https url", relayURL.Redacted())
+	}
+
+	targetPath := addr.Path
+	if targetPath == "" {
+		targetPath = odohDefaultTargetPath
+	}
+
+	targetHost := addr.Host
+	addPort(addr, defaultPortDoH)
+
+	// The relay and the target only transport the encrypted messages, so the
+	// options affecting the DNS messages don't apply to them.
+	httpOpts := opts.Clone()
+	httpOpts.DoHJSON = false
+	httpOpts.DoHMethod = DoHMethodPost
+	httpOpts.PreserveRecursionDesired = true
+
+	relay, err := newDNSOverHTTPS(relayURL, httpOpts)
+	if err != nil {
+		return nil, fmt.Errorf("creating odoh relay: %w", err)
+	}
+
+	target, err := newDNSOverHTTPS(&url.URL{
+		Scheme: "https",
+		User:   addr.User,
+		Host:   addr.Host,
+		Path:   odohConfigsPath,
+	}, httpOpts)
+	if err != nil {
+		return nil, errors.WithDeferred(
+			fmt.Errorf("creating odoh target: %w", err),
+			relay.Close(),
+		)
+	}
+
+	return &obliviousDoH{
+		relay:        relay,
+		target:       target,
+		configMu:     &sync.Mutex{},
+		addrRedacted: addr.Redacted(),
+		targetHost:   targetHost,
+		targetPath:   targetPath,
+		active:       newInflight(opts),
+	}, nil
+}
+
+// type check
+var _ Upstream = (*obliviousDoH)(nil)
+
+// Address implements the [Upstream] interface for *obliviousDoH.  It's the
+// redacted address of the target.
+func (p *obliviousDoH) Address() (addr string) { return p.addrRedacted }
+
+// type check
+var _ ProtocolUpstream = (*obliviousDoH)(nil)
+
+// Protocol implements the [ProtocolUpstream] interface for *obliviousDoH.
+func (p *obliviousDoH) Protocol() (proto Protocol) { return ProtocolODoH }
+
+// Exchange implements the [Upstream] interface for *obliviousDoH.
+func (p *obliviousDoH) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *obliviousDoH.
+func (p *obliviousDoH) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	defer func() { err = classifyError(err) }()
+
+	err = p.active.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer p.active.end()
+
+	logBegin(p.addrRedacted, networkTCP, req)
+	defer func() { logFinish(p.addrRedacted, networkTCP, resp, err) }()
+
+	buf, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	cfg, err := p.getConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting config of %s: %w", p.addrRedacted, err)
+	}
+
+	resp, err = p.exchangeWithConfig(ctx, cfg, buf)
+	if errors.Is(err, errODoHStaleConfig) {
+		log.Debug("odoh %s: fetching config again: %s", p.addrRedacted, err)
+
+		p.expireConfig(cfg)
+		cfg, err = p.getConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("getting config of %s: %w", p.addrRedacted, err)
+		}
+
+		resp, err = p.exchangeWithConfig(ctx, cfg, buf)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Id != req.Id {
+		return resp, dns.ErrId
+	}
+
+	return resp, handleTruncated(resp, p.addrRedacted, p.relay.tcPolicy)
+}
+
+// exchangeWithConfig encrypts the wire-format DNS query buf for the target
+// configured by cfg, sends it through the relay, and decrypts the response.  It
+// returns an error wrapping errODoHStaleConfig if cfg is likely outdated.
+func (p *obliviousDoH) exchangeWithConfig(
+	ctx context.Context,
+	cfg *odohConfig,
+	buf []byte,
+) (resp *dns.Msg, err error) {
+	q, err := cfg.encryptQuery(buf)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting query to %s: %w", p.addrRedacted, err)
+	}
+
+	body, err := p.doRelayRequest(ctx, q.msg)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err = q.decryptResponse(body)
+	if err != nil {
+		return nil, fmt.Errorf("response from %s: %w: %w", p.addrRedacted, errODoHStaleConfig, err)
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(buf)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response from %s: %w", p.addrRedacted, err)
+	}
+
+	return resp, nil
+}
+
+// getConfig returns the configuration of the target, fetching it if there is
+// none or it has expired.  The configuration is fetched from the well-known
+// URI and reused for the time specified by the max-age directive of the
+// response, see RFC 9230, section 6.2.
+func (p *obliviousDoH) getConfig(ctx context.Context) (c *odohConfig, err error) {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	if p.config != nil && time.Now().Before(p.configExpire) {
+		return p.config, nil
+	}
+
+	client, _, err := p.target.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("init http client: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, p.target.addr.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating http request: %w", err)
+	}
+
+	httpReq.Header.Set("User-Agent", "")
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", p.target.addrRedacted, err)
+	}
+
+	body, err := p.target.readBody(httpResp)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err = parseODoHConfigs(body)
+	if err != nil {
+		return nil, fmt.Errorf("parsing configs: %w", err)
+	}
+
+	ttl, ok := maxAge(httpResp.Header)
+	if !ok {
+		ttl = odohDefaultConfigTTL
+	}
+
+	p.config, p.configExpire = c, time.Now().Add(ttl)
+
+	return c, nil
+}
+
+// expireConfig makes the next call to getConfig fetch the configuration again,
+// unless it's already been fetched after c.
+func (p *obliviousDoH) expireConfig(c *odohConfig) {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	if p.config == c {
+		p.config = nil
+	}
+}
+
+// maxAge returns the value of the max-age directive of the Cache-Control
+// header from h.  ok is false if there is none or it's invalid.
+func maxAge(h http.Header) (d time.Duration, ok bool) {
+	for _, dir := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, val, found := strings.Cut(strings.TrimSpace(dir), "=")
+		if !found || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+
+		secs, err := strconv.ParseUint(strings.Trim(val, `"`), 10, 32)
+		if err != nil {
+			return 0, false
+		}
+
+		return time.Duration(secs) * time.Second, true
+	}
+
+	return 0, false
+}
+
+// doRelayRequest sends the encoded ObliviousDoHMessage msg to the relay and
+// returns the body of the response.
+func (p *obliviousDoH) doRelayRequest(ctx context.Context, msg []byte) (body []byte, err error) {
+	client, _, err := p.relay.getClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to init http client: %w", err)
+	}
+
+	u := *p.relay.addr
+	params := u.Query()
+	params.Set("targethost", p.targetHost)
+	params.Set("targetpath", p.targetPath)
+	u.RawQuery = params.Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(msg))
+	if err != nil {
+		return nil, fmt.Errorf("creating http request to %s: %w", p.relay.addrRedacted, err)
+	}
+
+	httpReq.Header.Set("Accept", odohMediaType)
+	httpReq.Header.Set("Content-Type", odohMediaType)
+	httpReq.Header.Set("User-Agent", "")
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		err = fmt.Errorf("requesting %s: %w", p.relay.addrRedacted, err)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		// Make sure the broken client isn't used anymore.
+		_, resErr := p.relay.resetClient(err)
+
+		return nil, errors.WithDeferred(err, resErr)
+	}
+
+	if httpResp.StatusCode == http.StatusUnauthorized {
+		// The target responds with 401 to the queries encrypted with the
+		// unknown key, see RFC 9230, section 4.3.
+		log.OnCloserError(httpResp.Body, log.DEBUG)
+
+		return nil, fmt.Errorf("response from %s: %w", p.relay.addrRedacted, errODoHStaleConfig)
+	}
+
+	body, err = p.relay.readBody(httpResp)
+	if err != nil {
+		return nil, err
+	}
+
+	ct := httpResp.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil || mediaType != odohMediaType {
+		return nil, fmt.Errorf("unexpected content type %q from %s", ct, p.relay.addrRedacted)
+	}
+
+	return body, nil
+}
+
+// Close implements the [Upstream] interface for *obliviousDoH.
+func (p *obliviousDoH) Close() (err error) {
+	p.active.shutdown()
+
+	return errors.Join(p.relay.Close(), p.target.Close())
+}
+
+// type check
+var _ RefreshableUpstream = (*obliviousDoH)(nil)
+
+// Refresh implements the [RefreshableUpstream] interface for *obliviousDoH.  It
+// also makes the next exchange fetch the configuration of the target again.
+func (p *obliviousDoH) Refresh() (err error) {
+	p.configMu.Lock()
+	p.config = nil
+	p.configMu.Unlock()
+
+	return errors.Join(p.relay.Refresh(), p.target.Refresh())
+}
+
+// type check
+var _ ProbableUpstream = (*obliviousDoH)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *obliviousDoH.
+func (p *obliviousDoH) Probe(ctx context.Context) (err error) {
+	return probe(ctx, p, p.relay.probeTimeout)
+}
+
+// type check
+var _ BootstrapSetter = (*obliviousDoH)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for *obliviousDoH.
+// The resolvers are used for both the relay and the target.
+func (p *obliviousDoH) SetBootstrap(resolvers []Resolver) {
+	p.relay.SetBootstrap(resolvers)
+	p.target.SetBootstrap(resolvers)
+}
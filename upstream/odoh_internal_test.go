@@ -0,0 +1,404 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hpkeSetupReceiver decapsulates the shared secret from enc using skR and
+// returns the encryption context of the receiver.
+func hpkeSetupReceiver(
+	t require.TestingT,
+	enc []byte,
+	skR *ecdh.PrivateKey,
+	info []byte,
+) (c *hpkeContext) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	require.NoError(t, err)
+
+	dh, err := skR.ECDH(pkE)
+	require.NoError(t, err)
+
+	secret := hpkeExtractAndExpand(dh, append(slices.Clone(enc), skR.PublicKey().Bytes()...))
+
+	c, err = newHPKEContext(secret, info)
+	require.NoError(t, err)
+
+	return c
+}
+
+// newODoHConfigs returns the encoded ObliviousDoHConfigs with a single
+// configuration of the specified HPKE suite and public key.
+func newODoHConfigs(kem, kdf, aead uint16, pk *ecdh.PublicKey) (configs []byte) {
+	contents := binary.BigEndian.AppendUint16(nil, kem)
+	contents = binary.BigEndian.AppendUint16(contents, kdf)
+	contents = binary.BigEndian.AppendUint16(contents, aead)
+	contents = appendVector16(contents, pk.Bytes())
+
+	config := binary.BigEndian.AppendUint16(nil, odohVersion)
+	config = appendVector16(config, contents)
+
+	return appendVector16(nil, config)
+}
+
+// newODoHHandler returns the handler serving the configurations at the
+// well-known path and answering the encrypted queries at /proxy, acting as both
+// the relay and the target.  The query parameters of the relay requests are
+// sent to params.
+func newODoHHandler(
+	sk *ecdh.PrivateKey,
+	configs []byte,
+	params chan<- url.Values,
+) (h http.Handler) {
+	// The unsupported configurations are only served, so ignore the error.
+	cfg, _ := parseODoHConfigs(configs)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(odohConfigsPath, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(configs)
+	})
+	mux.HandleFunc("/proxy", func(w http.ResponseWriter, r *http.Request) {
+		pt := testutil.PanicT{}
+
+		params <- r.URL.Query()
+
+		require.Equal(pt, odohMediaType, r.Header.Get("Content-Type"))
+
+		body, readErr := io.ReadAll(r.Body)
+		require.NoError(pt, readErr)
+
+		typ, keyID, encrypted, unpackErr := unpackODoHMessage(body)
+		require.NoError(pt, unpackErr)
+		require.Equal(pt, odohMessageQuery, typ)
+		require.Equal(pt, cfg.keyID, keyID)
+
+		const encLen = 32
+		hc := hpkeSetupReceiver(pt, encrypted[:encLen], sk, []byte("odoh query"))
+
+		aad := odohAAD(odohMessageQuery, keyID)
+		plain, openErr := hc.aead.Open(nil, hc.baseNonce, encrypted[encLen:], aad)
+		require.NoError(pt, openErr)
+
+		query, _, readErr := readVector16(plain)
+		require.NoError(pt, readErr)
+
+		req := &dns.Msg{}
+		require.NoError(pt, req.Unpack(query))
+
+		resp, packErr := respondToTestMessage(req).Pack()
+		require.NoError(pt, packErr)
+
+		nonce := make([]byte, hpkeNk)
+		_, _ = rand.Read(nonce)
+
+		aead, aeadNonce, keyErr := odohResponseKey(hc, plain, nonce)
+		require.NoError(pt, keyErr)
+
+		respPlain := appendVector16(appendVector16(nil, resp), nil)
+		sealed := aead.Seal(nil, aeadNonce, respPlain, odohAAD(odohMessageResponse, nonce))
+
+		w.Header().Set("Content-Type", odohMediaType)
+		_, _ = w.Write(packODoHMessage(odohMessageResponse, nonce, sealed))
+	})
+
+	return mux
+}
+
+func TestUpstreamODoH(t *testing.T) {
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	newUpstream := func(t *testing.T, configs []byte) (u Upstream, params chan url.Values) {
+		t.Helper()
+
+		params = make(chan url.Values, 1)
+		srv := startDoHServer(t, testDoHServerOptions{
+			handler: newODoHHandler(sk, configs, params),
+		})
+
+		u, err = AddressToUpstream(fmt.Sprintf("odoh://%s", srv.addr), &Options{
+			InsecureSkipVerify: true,
+			Timeout:            timeout,
+			ODoHRelay:          fmt.Sprintf("https://%s/proxy", srv.addr),
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		return u, params
+	}
+
+	t.Run("success", func(t *testing.T) {
+		configs := newODoHConfigs(hpkeKEMX25519, hpkeKDFSHA256, hpkeAEADAES128GCM, sk.PublicKey())
+		u, params := newUpstream(t, configs)
+
+		for range 2 {
+			req := createTestMessage()
+			resp, exchErr := u.Exchange(req)
+			require.NoError(t, exchErr)
+			requireResponse(t, req, resp)
+
+			p, _ := testutil.RequireReceive(t, params, timeout)
+			assert.Equal(t, odohDefaultTargetPath, p.Get("targetpath"))
+			assert.NotEmpty(t, p.Get("targethost"))
+		}
+	})
+
+	t.Run("unsupported_config", func(t *testing.T) {
+		const chachaPoly1305 uint16 = 0x0003
+
+		configs := newODoHConfigs(hpkeKEMX25519, hpkeKDFSHA256, chachaPoly1305, sk.PublicKey())
+		u, _ := newUpstream(t, configs)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.ErrorContains(t, err, "unsupported hpke suite")
+	})
+
+	t.Run("no_relay", func(t *testing.T) {
+		_, err = AddressToUpstream("odoh://odoh.example", &Options{})
+		assert.ErrorIs(t, err, errODoHNoRelay)
+	})
+}
+
+func TestUpstreamODoH_configRefresh(t *testing.T) {
+	oldKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	newKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	oldConfigs := newODoHConfigs(hpkeKEMX25519, hpkeKDFSHA256, hpkeAEADAES128GCM, oldKey.PublicKey())
+	newConfigs := newODoHConfigs(hpkeKEMX25519, hpkeKDFSHA256, hpkeAEADAES128GCM, newKey.PublicKey())
+
+	newCfg, err := parseODoHConfigs(newConfigs)
+	require.NoError(t, err)
+
+	newUpstream := func(t *testing.T, cacheControl string) (u Upstream, fetches *atomic.Int32) {
+		t.Helper()
+
+		// Serve the old configurations first, but only accept the queries
+		// encrypted with the new key.
+		fetches = &atomic.Int32{}
+		oldHandler := newODoHHandler(oldKey, oldConfigs, make(chan url.Values, 16))
+		newHandler := newODoHHandler(newKey, newConfigs, make(chan url.Values, 16))
+
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == odohConfigsPath {
+				w.Header().Set("Cache-Control", cacheControl)
+				if fetches.Add(1) == 1 {
+					oldHandler.ServeHTTP(w, r)
+				} else {
+					newHandler.ServeHTTP(w, r)
+				}
+
+				return
+			}
+
+			body, readErr := io.ReadAll(r.Body)
+			require.NoError(testutil.PanicT{}, readErr)
+
+			_, keyID, _, _ := unpackODoHMessage(body)
+			if !bytes.Equal(keyID, newCfg.keyID) {
+				w.WriteHeader(http.StatusUnauthorized)
+
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			newHandler.ServeHTTP(w, r)
+		})
+
+		srv := startDoHServer(t, testDoHServerOptions{handler: h})
+
+		u, err = AddressToUpstream(fmt.Sprintf("odoh://%s", srv.addr), &Options{
+			InsecureSkipVerify: true,
+			Timeout:            timeout,
+			ODoHRelay:          fmt.Sprintf("https://%s/proxy", srv.addr),
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		return u, fetches
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		u, fetches := newUpstream(t, "max-age=3600")
+
+		for range 2 {
+			req := createTestMessage()
+			resp, exchErr := u.Exchange(req)
+			require.NoError(t, exchErr)
+			requireResponse(t, req, resp)
+		}
+
+		assert.Equal(t, int32(2), fetches.Load())
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		const n = 3
+
+		u, fetches := newUpstream(t, "no-store, max-age=0")
+
+		for range n {
+			req := createTestMessage()
+			resp, exchErr := u.Exchange(req)
+			require.NoError(t, exchErr)
+			requireResponse(t, req, resp)
+		}
+
+		// The first fetch returns the old configurations, which are rejected.
+		assert.Equal(t, int32(n+1), fetches.Load())
+	})
+}
+
+func TestMaxAge(t *testing.T) {
+	testCases := []struct {
+		name   string
+		header string
+		want   time.Duration
+		wantOK bool
+	}{{
+		name:   "none",
+		header: "",
+		want:   0,
+		wantOK: false,
+	}, {
+		name:   "simple",
+		header: "max-age=60",
+		want:   time.Minute,
+		wantOK: true,
+	}, {
+		name:   "several",
+		header: "public, Max-Age=\"3600\", must-revalidate",
+		want:   time.Hour,
+		wantOK: true,
+	}, {
+		name:   "invalid",
+		header: "max-age=-1",
+		want:   0,
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Set("Cache-Control", tc.header)
+
+			d, ok := maxAge(h)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.want, d)
+		})
+	}
+}
+
+func TestParseODoHConfigs(t *testing.T) {
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	valid := newODoHConfigs(hpkeKEMX25519, hpkeKDFSHA256, hpkeAEADAES128GCM, sk.PublicKey())
+
+	unknownVersion := bytes.Clone(valid)
+	binary.BigEndian.PutUint16(unknownVersion[2:], 0xff00)
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		configs    []byte
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		configs:    valid,
+	}, {
+		name:       "empty",
+		wantErrMsg: "reading configs: truncated length",
+		configs:    nil,
+	}, {
+		name:       "truncated",
+		wantErrMsg: "reading configs: length 44 exceeds 43 remaining bytes",
+		configs:    valid[:len(valid)-1],
+	}, {
+		name:       "unknown_version",
+		wantErrMsg: "no supported configs",
+		configs:    unknownVersion,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, parseErr := parseODoHConfigs(tc.configs)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, parseErr)
+			if tc.wantErrMsg == "" {
+				require.NotNil(t, c)
+				assert.Len(t, c.keyID, hpkeNh)
+			}
+		})
+	}
+}
+
+// TestODoH_knownAnswer checks the key identifier, the query, and the response
+// against the values produced by an independent implementation of RFC 9230
+// using the keys of RFC 9180, Appendix A.1.1.
+func TestODoH_knownAnswer(t *testing.T) {
+	var (
+		skEm = mustDecodeHex(t, "52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736")
+		skRm = mustDecodeHex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8")
+
+		configs = mustDecodeHex(t, "002c000100280020000100010020"+
+			"3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+		wantKeyID = mustDecodeHex(t, "9e8dcd70b0b660258285b685197740e491cbdd8101b1783affdfeba52e09bc79")
+
+		query     = mustDecodeHex(t, "000001000001000000000000076578616d706c6503636f6d0000010001")
+		wantQuery = mustDecodeHex(t, "0100209e8dcd70b0b660258285b685197740e491cbdd8101b1783affdfeba52e09bc79"+
+			"005137fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"+
+			"ad7537701ae754a322204196c2fbaeff944b3cc630515f8f31435a0d7cb7c82ae4ed"+
+			"413846288fca5dd4695128b780dbed")
+
+		respNonce = mustDecodeHex(t, "000102030405060708090a0b0c0d0e0f")
+		wantNonce = mustDecodeHex(t, "cbed178835cf54fd1593e746")
+		resp      = mustDecodeHex(t, "020010000102030405060708090a0b0c0d0e0f004c0bdee471230beac7777b03dc3e"+
+			"a9e88c2a9ed5789fe675c33d9eef3e5628927675bed04063776125c84f4d2d462472"+
+			"6f86344d03558349bfaac1de19d8e95d7e26410a0c40b80cfdc32071fa")
+		wantResp = mustDecodeHex(t, "000081000001000100000000076578616d706c6503636f6d0000010001"+
+			"076578616d706c6503636f6d00000100010000012c0004c0000201")
+	)
+
+	c, err := parseODoHConfigs(configs)
+	require.NoError(t, err)
+
+	skR, err := ecdh.X25519().NewPrivateKey(skRm)
+	require.NoError(t, err)
+	require.Equal(t, skR.PublicKey().Bytes(), c.publicKey.Bytes())
+
+	assert.Equal(t, wantKeyID, c.keyID)
+
+	skE, err := ecdh.X25519().NewPrivateKey(skEm)
+	require.NoError(t, err)
+
+	q, err := c.encryptQueryWithKey(query, skE)
+	require.NoError(t, err)
+
+	assert.Equal(t, wantQuery, q.msg)
+
+	_, nonce, err := odohResponseKey(q.hpke, q.plain, respNonce)
+	require.NoError(t, err)
+
+	assert.Equal(t, wantNonce, nonce)
+
+	got, err := q.decryptResponse(resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, wantResp, got)
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/miekg/dns"
 )
 
@@ -24,33 +25,121 @@ const (
 // ExchangeParallel returns the dirst successful response from one of u.  It
 // returns an error if all upstreams failed to exchange the request.
 func ExchangeParallel(ups []Upstream, req *dns.Msg) (reply *dns.Msg, resolved Upstream, err error) {
+	return ExchangeParallelLimited(ups, req, 0)
+}
+
+// ParallelExchange sends req to all of ups concurrently and returns the first
+// successful response along with the upstream that produced it.  The exchanges
+// still in flight are canceled once it arrives.  If all upstreams fail, the
+// errors from each of them are joined, including [ErrNoReply] for the ones
+// returned no response.  The overall time is limited by the greatest
+// [Options.Timeout] of ups, if any.
+//
+// It differs from [ExchangeParallel] in the reported errors and the overall
+// timeout only.  ExchangeParallel keeps dropping [ErrNoReply] and reporting
+// a generic error when no upstream responded, since the callers depend on that.
+func ParallelExchange(req *dns.Msg, ups []Upstream) (resp *dns.Msg, u Upstream, err error) {
+	if len(ups) == 0 {
+		return nil, nil, ErrNoUpstreams
+	}
+
+	ctx := context.Background()
+	if d := parallelTimeout(ups); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	resp, u, errs := exchangeParallel(ctx, syncutil.EmptySemaphore{}, ups, req)
+	if resp != nil {
+		return resp, u, nil
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
+
+// exchangeParallel sends req to all of ups concurrently, limited by sema, and
+// returns the first successful response along with the upstream that produced
+// it.  Otherwise, it returns the errors of each exchange.  The exchanges still
+// in flight, as well as the queued ones, are canceled once it returns.
+func exchangeParallel(
+	ctx context.Context,
+	sema syncutil.Semaphore,
+	ups []Upstream,
+	req *dns.Msg,
+) (resp *dns.Msg, u Upstream, errs []error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resCh := make(chan any, len(ups))
+	for _, f := range ups {
+		go exchangeAsync(ctx, sema, f, req, resCh)
+	}
+
+	errs = make([]error, 0, len(ups))
+	for range ups {
+		r, err := receiveAsyncResult(resCh)
+		if err == nil {
+			return r.Resp, r.Upstream, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return nil, nil, errs
+}
+
+// timeoutUpstream is an [Upstream] with the timeout of the exchanges, see
+// [Options.Timeout].
+type timeoutUpstream interface {
+	// exchangeTimeout returns the timeout of the exchanges, or zero if there
+	// is none.
+	exchangeTimeout() (d time.Duration)
+}
+
+// parallelTimeout returns the greatest timeout of the exchanges among ups and
+// the upstreams wrapped by them, or zero if there is none.
+func parallelTimeout(ups []Upstream) (d time.Duration) {
+	for _, u := range ups {
+		if tu, ok := UpstreamAs[timeoutUpstream](u); ok {
+			d = max(d, tu.exchangeTimeout())
+		}
+	}
+
+	return d
+}
+
+// ExchangeParallelLimited is like [ExchangeParallel], but runs at most
+// maxConcurrency exchanges at once, the rest are queued.  The queued exchanges
+// aren't started once the first successful response is received.  Zero
+// maxConcurrency means no limit.
+func ExchangeParallelLimited(
+	ups []Upstream,
+	req *dns.Msg,
+	maxConcurrency uint,
+) (reply *dns.Msg, resolved Upstream, err error) {
 	upsNum := len(ups)
 	switch upsNum {
 	case 0:
 		return nil, nil, ErrNoUpstreams
 	case 1:
-		reply, err = exchangeAndLog(ups[0], req)
+		reply, err = exchangeAndLog(context.Background(), ups[0], req)
 
 		return reply, ups[0], err
 	default:
 		// Go on.
 	}
 
-	resCh := make(chan any, upsNum)
-	for _, f := range ups {
-		go exchangeAsync(f, req, resCh)
+	sema := newExchangeSemaphore(maxConcurrency)
+	reply, resolved, allErrs := exchangeParallel(context.Background(), sema, ups, req)
+	if reply != nil {
+		return reply, resolved, nil
 	}
 
-	errs := []error{}
-	for range ups {
-		var r *ExchangeAllResult
-		r, err = receiveAsyncResult(resCh)
-		if err != nil {
-			if !errors.Is(err, ErrNoReply) {
-				errs = append(errs, err)
-			}
-		} else {
-			return r.Resp, r.Upstream, nil
+	errs := make([]error, 0, len(allErrs))
+	for _, e := range allErrs {
+		if !errors.Is(e, ErrNoReply) {
+			errs = append(errs, e)
 		}
 	}
 
@@ -64,6 +153,37 @@ func ExchangeParallel(ups []Upstream, req *dns.Msg) (reply *dns.Msg, resolved Up
 	return nil, nil, errors.Join(errs...)
 }
 
+// ExchangeBoth sends the A and AAAA queries for name to u concurrently and
+// returns both responses.  If only one of the exchanges fails, the response of
+// the other one is still returned along with the error.  Since the queries are
+// sent concurrently, the overall time is limited by the timeout of u, see
+// [Options.Timeout].
+func ExchangeBoth(u Upstream, name string) (a, aaaa *dns.Msg, err error) {
+	ctx := context.Background()
+	fqdn := dns.Fqdn(name)
+
+	errCh := make(chan error, 1)
+	go func() {
+		var aErr error
+		a, aErr = exchangeAndLog(ctx, u, (&dns.Msg{}).SetQuestion(fqdn, dns.TypeA))
+		if aErr != nil {
+			aErr = fmt.Errorf("exchanging a: %w", aErr)
+		}
+
+		errCh <- aErr
+	}()
+
+	aaaa, err = exchangeAndLog(ctx, u, (&dns.Msg{}).SetQuestion(fqdn, dns.TypeAAAA))
+	if err != nil {
+		err = fmt.Errorf("exchanging aaaa: %w", err)
+	}
+
+	// Receive before returning a, since it's set by the goroutine.
+	aErr := <-errCh
+
+	return a, aaaa, errors.Join(aErr, err)
+}
+
 // ExchangeAllResult is the successful result of [ExchangeAll] for a single
 // upstream.
 type ExchangeAllResult struct {
@@ -77,13 +197,23 @@ type ExchangeAllResult struct {
 // ExchangeAll returns the responses from all of u.  It returns an error only if
 // all upstreams failed to exchange the request.
 func ExchangeAll(ups []Upstream, req *dns.Msg) (res []ExchangeAllResult, err error) {
+	return ExchangeAllLimited(ups, req, 0)
+}
+
+// ExchangeAllLimited is like [ExchangeAll], but runs at most maxConcurrency
+// exchanges at once, the rest are queued.  Zero maxConcurrency means no limit.
+func ExchangeAllLimited(
+	ups []Upstream,
+	req *dns.Msg,
+	maxConcurrency uint,
+) (res []ExchangeAllResult, err error) {
 	upsNum := len(ups)
 	switch upsNum {
 	case 0:
 		return nil, ErrNoUpstreams
 	case 1:
 		var reply *dns.Msg
-		reply, err = exchangeAndLog(ups[0], req)
+		reply, err = exchangeAndLog(context.Background(), ups[0], req)
 		if err != nil {
 			return nil, err
 		} else if reply == nil {
@@ -98,11 +228,12 @@ func ExchangeAll(ups []Upstream, req *dns.Msg) (res []ExchangeAllResult, err err
 	res = make([]ExchangeAllResult, 0, upsNum)
 	var errs []error
 
+	sema := newExchangeSemaphore(maxConcurrency)
 	resCh := make(chan any, upsNum)
 
 	// Start exchanging concurrently.
 	for _, u := range ups {
-		go exchangeAsync(u, req, resCh)
+		go exchangeAsync(context.Background(), sema, u, req, resCh)
 	}
 
 	// Wait for all exchanges to finish.
@@ -140,10 +271,36 @@ func receiveAsyncResult(resCh chan any) (res *ExchangeAllResult, err error) {
 	}
 }
 
+// newExchangeSemaphore returns a semaphore limiting the number of concurrent
+// exchanges to maxConcurrency.  Zero maxConcurrency means no limit.
+func newExchangeSemaphore(maxConcurrency uint) (sema syncutil.Semaphore) {
+	if maxConcurrency == 0 {
+		return syncutil.EmptySemaphore{}
+	}
+
+	return syncutil.NewChanSemaphore(maxConcurrency)
+}
+
 // exchangeAsync tries to resolve DNS request with one upstream and sends the
-// result to respCh.
-func exchangeAsync(u Upstream, req *dns.Msg, resCh chan any) {
-	reply, err := exchangeAndLog(u, req)
+// result to respCh.  It waits for sema before exchanging, and doesn't exchange
+// if ctx is canceled while waiting.  The exchange itself is canceled along with
+// ctx.
+func exchangeAsync(
+	ctx context.Context,
+	sema syncutil.Semaphore,
+	u Upstream,
+	req *dns.Msg,
+	resCh chan any,
+) {
+	err := sema.Acquire(ctx)
+	if err != nil {
+		resCh <- fmt.Errorf("waiting to exchange with %s: %w", u.Address(), err)
+
+		return
+	}
+	defer sema.Release()
+
+	reply, err := exchangeAndLog(ctx, u, req)
 	if err != nil {
 		resCh <- err
 	} else {
@@ -151,13 +308,13 @@ func exchangeAsync(u Upstream, req *dns.Msg, resCh chan any) {
 	}
 }
 
-// exchangeAndLog wraps the [Upstream.Exchange] method with logging.
-func exchangeAndLog(u Upstream, req *dns.Msg) (resp *dns.Msg, err error) {
+// exchangeAndLog wraps the [Upstream.ExchangeContext] method with logging.
+func exchangeAndLog(ctx context.Context, u Upstream, req *dns.Msg) (resp *dns.Msg, err error) {
 	addr := u.Address()
 	req = req.Copy()
 
 	start := time.Now()
-	reply, err := u.Exchange(req)
+	reply, err := u.ExchangeContext(ctx, req)
 	dur := time.Since(start)
 
 	if len(req.Question) > 0 {
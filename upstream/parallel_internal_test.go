@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"net/netip"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -145,6 +149,14 @@ func (u *testUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, nil
 }
 
+// ExchangeContext implements the [Upstream] interface for *testUpstream.
+func (u *testUpstream) ExchangeContext(
+	_ context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	return u.Exchange(req)
+}
+
 // Address implements the [Upstream] interface for *testUpstream.
 func (u *testUpstream) Address() (addr string) {
 	return ""
@@ -189,3 +201,231 @@ func TestExchangeAll(t *testing.T) {
 	ip = resp.Answer[0].(*dns.A).A
 	assert.Equal(t, delayedAnsAddr.AsSlice(), []byte(ip))
 }
+
+// newConcurrencyCountingUpstreams returns n upstreams that track the maximum
+// number of simultaneous exchanges across them in maxCur.
+func newConcurrencyCountingUpstreams(n int, maxCur *atomic.Int64) (ups []Upstream) {
+	cur := &atomic.Int64{}
+
+	for i := range n {
+		ups = append(ups, &dnsproxytest.FakeUpstream{
+			OnAddress: func() (addr string) { return fmt.Sprintf("fake-%d", i) },
+			OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				c := cur.Add(1)
+				defer cur.Add(-1)
+
+				for prev := maxCur.Load(); c > prev; prev = maxCur.Load() {
+					if maxCur.CompareAndSwap(prev, c) {
+						break
+					}
+				}
+
+				time.Sleep(10 * time.Millisecond)
+
+				return respondToTestMessage(req), nil
+			},
+			OnClose: func() (err error) { return nil },
+		})
+	}
+
+	return ups
+}
+
+func TestExchangeAllLimited(t *testing.T) {
+	const upsNum = 10
+
+	for _, limit := range []uint{1, 3} {
+		t.Run(fmt.Sprintf("limit_%d", limit), func(t *testing.T) {
+			maxCur := &atomic.Int64{}
+			ups := newConcurrencyCountingUpstreams(upsNum, maxCur)
+
+			res, err := ExchangeAllLimited(ups, createTestMessage(), limit)
+			require.NoError(t, err)
+
+			assert.Len(t, res, upsNum)
+			assert.LessOrEqual(t, maxCur.Load(), int64(limit))
+		})
+	}
+}
+
+func TestExchangeParallelLimited(t *testing.T) {
+	const upsNum = 10
+
+	for _, limit := range []uint{1, 3} {
+		t.Run(fmt.Sprintf("limit_%d", limit), func(t *testing.T) {
+			maxCur := &atomic.Int64{}
+			ups := newConcurrencyCountingUpstreams(upsNum, maxCur)
+
+			req := createTestMessage()
+			resp, u, err := ExchangeParallelLimited(ups, req, limit)
+			require.NoError(t, err)
+
+			requireResponse(t, req, resp)
+			assert.Contains(t, ups, u)
+			assert.LessOrEqual(t, maxCur.Load(), int64(limit))
+		})
+	}
+}
+
+func TestParallelExchange(t *testing.T) {
+	const (
+		errA errors.Error = "error a"
+		errB errors.Error = "error b"
+	)
+
+	newFailing := func(addr string, err error) (u Upstream) {
+		return &dnsproxytest.FakeUpstream{
+			OnAddress:  func() (a string) { return addr },
+			OnExchange: func(_ *dns.Msg) (resp *dns.Msg, e error) { return nil, err },
+			OnClose:    func() (e error) { return nil },
+		}
+	}
+
+	req := createTestMessage()
+
+	t.Run("success", func(t *testing.T) {
+		good := &dnsproxytest.FakeUpstream{
+			OnAddress: func() (addr string) { return "good" },
+			OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				return respondToTestMessage(req), nil
+			},
+			OnClose: func() (err error) { return nil },
+		}
+
+		ups := []Upstream{newFailing("a", errA), good, newFailing("b", errB)}
+
+		resp, u, err := ParallelExchange(req, ups)
+		require.NoError(t, err)
+
+		requireResponse(t, req, resp)
+		assert.Same(t, good, u)
+	})
+
+	t.Run("all_failed", func(t *testing.T) {
+		ups := []Upstream{
+			newFailing("a", errA),
+			newFailing("b", errB),
+			&testUpstream{empty: true},
+		}
+
+		resp, u, err := ParallelExchange(req, ups)
+		assert.ErrorIs(t, err, errA)
+		assert.ErrorIs(t, err, errB)
+		assert.ErrorIs(t, err, ErrNoReply)
+		assert.Nil(t, resp)
+		assert.Nil(t, u)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		canceled := make(chan error, 1)
+		blocking := &ctxUpstream{
+			onExchange: func(ctx context.Context, _ *dns.Msg) (resp *dns.Msg, err error) {
+				<-ctx.Done()
+				canceled <- ctx.Err()
+
+				return nil, ctx.Err()
+			},
+		}
+
+		good := &dnsproxytest.FakeUpstream{
+			OnAddress: func() (addr string) { return "good" },
+			OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				return respondToTestMessage(req), nil
+			},
+			OnClose: func() (err error) { return nil },
+		}
+
+		resp, u, err := ParallelExchange(req, []Upstream{blocking, good})
+		require.NoError(t, err)
+
+		requireResponse(t, req, resp)
+		assert.Same(t, good, u)
+
+		cancelErr, _ := testutil.RequireReceive(t, canceled, timeout)
+		assert.ErrorIs(t, cancelErr, context.Canceled)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		const testTimeout = 100 * time.Millisecond
+
+		u, err := AddressToUpstream("udp://127.0.0.1:53", &Options{
+			Timeout: testTimeout,
+			Retries: 1,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		ups := []Upstream{u, newFailing("a", errA)}
+		assert.Equal(t, testTimeout, parallelTimeout(ups))
+	})
+}
+
+// ctxUpstream is an [Upstream] exchanging with the context.
+type ctxUpstream struct {
+	// onExchange is called on each exchange.
+	onExchange func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error)
+}
+
+// type check
+var _ Upstream = (*ctxUpstream)(nil)
+
+// Address implements the [Upstream] interface for *ctxUpstream.
+func (u *ctxUpstream) Address() (addr string) { return "ctx" }
+
+// Exchange implements the [Upstream] interface for *ctxUpstream.
+func (u *ctxUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *ctxUpstream.
+func (u *ctxUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	return u.onExchange(ctx, req)
+}
+
+// Close implements the [Upstream] interface for *ctxUpstream.
+func (u *ctxUpstream) Close() (err error) { return nil }
+
+func TestExchangeBoth(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	newUps := func(failType uint16) (u Upstream) {
+		return &dnsproxytest.FakeUpstream{
+			OnAddress: func() (addr string) { return "test" },
+			OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				if req.Question[0].Qtype == failType {
+					return nil, testErr
+				}
+
+				return (&dns.Msg{}).SetReply(req), nil
+			},
+			OnClose: func() (err error) { return nil },
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		a, aaaa, err := ExchangeBoth(newUps(dns.TypeNone), "example.org")
+		require.NoError(t, err)
+
+		require.NotNil(t, a)
+		require.NotNil(t, aaaa)
+		assert.Equal(t, dns.Question{
+			Name:   "example.org.",
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}, a.Question[0])
+		assert.Equal(t, dns.TypeAAAA, aaaa.Question[0].Qtype)
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		a, aaaa, err := ExchangeBoth(newUps(dns.TypeAAAA), "example.org.")
+		assert.ErrorIs(t, err, testErr)
+		assert.ErrorContains(t, err, "exchanging aaaa")
+
+		require.NotNil(t, a)
+		assert.Equal(t, dns.TypeA, a.Question[0].Qtype)
+		assert.Nil(t, aaaa)
+	})
+}
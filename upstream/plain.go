@@ -2,11 +2,15 @@ package upstream
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
@@ -28,27 +32,111 @@ const (
 	networkTCP network = "tcp"
 )
 
+// DefaultUDPBufferSize is the default EDNS0 UDP payload size advertised by
+// plain DNS-over-UDP upstreams, as recommended by the DNS Flag Day 2020.
+const DefaultUDPBufferSize uint16 = 1232
+
+// NetworkUpstream is an [Upstream] able to choose the network of a single
+// exchange.
+//
+// The plain DNS upstreams created with [AddressToUpstream] implement it,
+// unless they are wrapped, e.g. by configuring [Options.Retries].  Use
+// [UpstreamAs] to get it from the wrapper, but note that the exchanges made
+// with it bypass the wrappers.
+type NetworkUpstream interface {
+	Upstream
+
+	// ExchangeNetwork is like ExchangeContext, but if forceTCP is true, req is
+	// sent over TCP right away, without trying UDP first.  It's useful for
+	// the queries known to have large responses, e.g. ANY or DNSKEY.
+	ExchangeNetwork(ctx context.Context, req *dns.Msg, forceTCP bool) (resp *dns.Msg, err error)
+}
+
 // plainDNS implements the [Upstream] interface for the regular DNS protocol.
 type plainDNS struct {
 	// addr is the DNS server URL.  Scheme is always "udp" or "tcp".
 	addr *url.URL
 
-	// getDialer either returns an initialized dial handler or creates a new
-	// one.
-	getDialer DialerInitializer
+	// bootstrapper resolves the upstream's hostname and creates dial
+	// handlers.
+	*bootstrapper
 
 	// net is the network of the connections.
 	net network
 
+	// rttStats measures the round-trip time of the exchanges.
+	*rttStats
+
+	// probeTimeout is the timeout of the health-check probes.
+	probeTimeout time.Duration
+
+	// active tracks the exchanges in flight, so that Close waits for them.
+	active *inflight
+
+	// forceRD is true if the RD bit should be set in the outgoing queries.
+	forceRD bool
+
+	// noTCPFallback is true if the truncated or malformed responses received
+	// over UDP should be returned as is instead of retrying over TCP.
+	noTCPFallback bool
+
+	// preferTCP is true if the queries should be sent over TCP first, even
+	// though the network is UDP.
+	preferTCP bool
+
+	// tcpPool stores the idle TCP connections for reuse.  It's nil if the
+	// connections aren't pooled.
+	tcpPool *tcpConnPool
+
+	// muxMu protects mux.
+	muxMu *sync.Mutex
+
+	// mux is the UDP connection carrying all the queries if multiplexing is
+	// enabled, see [Options.UDPMultiplex].
+	mux *muxUDPConn
+
+	// cookies stores the DNS cookies used over UDP.  It's nil if the cookies
+	// are disabled.
+	cookies *cookieJar
+
+	// tcPolicy defines how the responses with the TC bit set are handled.
+	tcPolicy TruncatedPolicy
+
 	// timeout is the timeout for DNS requests.
 	timeout time.Duration
+
+	// maxRespSize is the maximum size of the responses received over TCP.
+	maxRespSize int
+
+	// udpSize is the EDNS0 UDP payload size advertised in the queries sent
+	// over UDP, it's also the size of the read buffer.
+	udpSize uint16
+
+	// noEDNS is true if the OPT record must not be added to the queries.
+	noEDNS bool
+
+	// dns0x20 is true if the case of the question names sent over UDP should
+	// be randomized, see [Options.EnableDNS0x20].
+	dns0x20 bool
+
+	// strict is true if the packets received over UDP which don't match the
+	// query should be discarded, see [Options.DisableStrictValidation].
+	strict bool
+
+	// multiplex is true if the queries sent over UDP should share a single
+	// connected socket, see [Options.UDPMultiplex].
+	multiplex bool
 }
 
 // newPlain returns the plain DNS Upstream.  addr.Scheme should be either "udp"
 // or "tcp".
 func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 	switch addr.Scheme {
-	case networkUDP, networkTCP:
+	case networkUDP:
+		if opts.ProxyURL != nil {
+			return nil, fmt.Errorf("plain %s: %w", addr.Host, ErrProxyUDP)
+		}
+	case networkTCP:
 		// Go on.
 	default:
 		return nil, fmt.Errorf("unsupported url scheme: %s", addr.Scheme)
@@ -56,16 +144,52 @@ func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 
 	addPort(addr, defaultPortPlain)
 
+	b, err := newBootstrapper(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	udpSize := opts.UDPBufferSize
+	if opts.DisableEDNS0 {
+		udpSize = dns.MinMsgSize
+	} else if udpSize == 0 {
+		udpSize = DefaultUDPBufferSize
+	}
+
+	var cookies *cookieJar
+	if opts.EnableDNSCookies && !opts.DisableEDNS0 && addr.Scheme == networkUDP {
+		cookies = newCookieJar()
+	}
+
 	return &plainDNS{
-		addr:      addr,
-		getDialer: newDialerInitializer(addr, opts),
-		net:       addr.Scheme,
-		timeout:   opts.Timeout,
+		addr:          addr,
+		bootstrapper:  b,
+		rttStats:      newRTTStats(opts),
+		net:           addr.Scheme,
+		timeout:       opts.Timeout,
+		forceRD:       !opts.PreserveRecursionDesired,
+		noTCPFallback: opts.DisableTCPFallback,
+		preferTCP:     opts.PreferTCP && addr.Scheme == networkUDP,
+		probeTimeout:  opts.ProbeTimeout,
+		active:        newInflight(opts),
+		tcPolicy:      opts.TruncatedPolicy,
+		tcpPool:       newTCPConnPool(opts),
+		cookies:       cookies,
+		maxRespSize:   maxResponseSize(opts),
+		udpSize:       max(udpSize, dns.MinMsgSize),
+		noEDNS:        opts.DisableEDNS0,
+		dns0x20:       opts.EnableDNS0x20,
+		strict:        !opts.DisableStrictValidation,
+		muxMu:         &sync.Mutex{},
+		multiplex:     opts.UDPMultiplex && addr.Scheme == networkUDP,
 	}, nil
 }
 
 // type check
-var _ Upstream = &plainDNS{}
+var _ UpstreamWithStats = (*plainDNS)(nil)
+
+// type check
+var _ ResolvingUpstream = (*plainDNS)(nil)
 
 // Address implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Address() string {
@@ -79,47 +203,359 @@ func (p *plainDNS) Address() string {
 	}
 }
 
+// type check
+var _ ProtocolUpstream = (*plainDNS)(nil)
+
+// Protocol implements the [ProtocolUpstream] interface for *plainDNS.  It's
+// either [ProtocolUDP] or [ProtocolTCP], even with [Options.PreferTCP].
+func (p *plainDNS) Protocol() (proto Protocol) { return Protocol(p.net) }
+
 // dialExchange performs a DNS exchange with the specified dial handler.
 // network must be either [networkUDP] or [networkTCP].
 func (p *plainDNS) dialExchange(
+	ctx context.Context,
 	network network,
 	dial bootstrap.DialHandler,
 	req *dns.Msg,
 ) (resp *dns.Msg, err error) {
 	addr := p.Address()
+	start := time.Now()
+
+	logBegin(addr, network, req)
+	defer func() { logFinish(addr, network, resp, err) }()
+
+	if network == networkTCP && p.tcpPool != nil {
+		resp, err = p.pooledExchange(ctx, dial, req)
+	} else if network == networkUDP && p.multiplex {
+		resp, err = p.muxedExchange(ctx, dial, req)
+	} else {
+		resp, err = p.dialedExchange(ctx, network, dial, req)
+	}
+
+	if err != nil {
+		return resp, err
+	}
+
+	if network == networkTCP {
+		err = handleTruncated(resp, addr, p.tcPolicy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = validatePlainResponse(req, resp)
+	if err == nil && network == networkUDP && p.dns0x20 {
+		err = matchCase(req, resp)
+	}
+
+	if err != nil {
+		return resp, err
+	}
+
+	p.update(time.Since(start))
+
+	return resp, nil
+}
+
+// dialedExchange performs a DNS exchange over a newly dialed connection and
+// closes it afterwards.
+func (p *plainDNS) dialedExchange(
+	ctx context.Context,
+	network network,
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
 	client := &dns.Client{Timeout: p.timeout}
 
 	conn := &dns.Conn{}
 	if network == networkUDP {
-		conn.UDPSize = dns.MinMsgSize
+		// The size from the OPT record of req takes precedence, if any.
+		conn.UDPSize = p.udpSize
 	}
 
-	logBegin(addr, network, req)
-	defer func() { logFinish(addr, network, err) }()
-
-	ctx := context.Background()
-	conn.Conn, err = dial(ctx, network, "")
+	conn.Conn, err = p.dial(ctx, network, dial)
 	if err != nil {
 		return nil, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, network, err)
 	}
-	defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
+	defer func(c net.Conn) { err = errors.WithDeferred(err, closeConn(c)) }(conn.Conn)
 
-	resp, _, err = client.ExchangeWithConn(req, conn)
-	if isExpectedConnErr(err) {
-		conn.Conn, err = dial(ctx, network, "")
+	resp, err = p.exchangeConn(ctx, client, network, req, conn)
+	if isExpectedConnErr(err) && ctx.Err() == nil {
+		conn.Conn, err = p.dial(ctx, network, dial)
 		if err != nil {
 			return nil, fmt.Errorf("dialing %s over %s again: %w", p.addr.Host, network, err)
 		}
-		defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
+		defer func(c net.Conn) { err = errors.WithDeferred(err, closeConn(c)) }(conn.Conn)
+
+		resp, err = p.exchangeConn(ctx, client, network, req, conn)
+	}
+
+	if err != nil {
+		return resp, fmt.Errorf("exchanging with %s over %s: %w", p.Address(), network, err)
+	}
+
+	return resp, nil
+}
+
+// dial dials a new connection of network using dial.  The TCP connections
+// reject the responses larger than p.maxRespSize.
+func (p *plainDNS) dial(
+	ctx context.Context,
+	network network,
+	dial bootstrap.DialHandler,
+) (conn net.Conn, err error) {
+	conn, err = dial(ctx, network, "")
+	if err != nil || network != networkTCP {
+		return conn, err
+	}
+
+	return limitMsgSize(conn, p.maxRespSize), nil
+}
+
+// exchangeConn performs a DNS exchange over the newly dialed connection conn of
+// network.  The DNS cookies are used over UDP, if enabled.
+func (p *plainDNS) exchangeConn(
+	ctx context.Context,
+	client *dns.Client,
+	network network,
+	req *dns.Msg,
+	conn *dns.Conn,
+) (resp *dns.Msg, err error) {
+	if network != networkUDP {
+		return exchangeConnContext(ctx, client, req, conn)
+	}
+
+	exchange := func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+		return p.exchangeUDPConn(ctx, client, req, conn)
+	}
+
+	return p.exchangeWithCookies(ctx, exchange, req, conn.RemoteAddr().String())
+}
+
+// udpExchangeFunc performs a single DNS exchange over UDP.
+type udpExchangeFunc func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error)
+
+// exchangeWithCookies performs a DNS exchange with server using exchange.  The
+// DNS cookies are attached to req and learned from the response, if enabled.
+func (p *plainDNS) exchangeWithCookies(
+	ctx context.Context,
+	exchange udpExchangeFunc,
+	req *dns.Msg,
+	server string,
+) (resp *dns.Msg, err error) {
+	if p.cookies == nil {
+		return exchange(ctx, req)
+	}
+
+	creq, ok := p.cookies.attach(req, server)
+	if !ok {
+		// Don't interfere with the cookies of the original query.
+		return exchange(ctx, req)
+	}
+
+	resp, err = p.exchangeCookie(ctx, exchange, creq, server)
+	if err == nil && resp.Rcode == dns.RcodeBadCookie {
+		// The server cookie has been learned from the response, so retry
+		// with it.
+		log.Debug("plain %s: bad cookie from %s, retrying", p.Address(), server)
+
+		creq, _ = p.cookies.attach(req, server)
+		resp, err = p.exchangeCookie(ctx, exchange, creq, server)
+	}
+
+	if resp != nil {
+		removeCookie(resp)
+	}
+
+	return resp, err
+}
+
+// exchangeCookie performs a DNS exchange of req containing the cookie option
+// using exchange and learns the server cookie from the response.
+func (p *plainDNS) exchangeCookie(
+	ctx context.Context,
+	exchange udpExchangeFunc,
+	req *dns.Msg,
+	server string,
+) (resp *dns.Msg, err error) {
+	resp, err = exchange(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	err = p.cookies.learn(server, resp)
+	if err != nil {
+		return nil, fmt.Errorf("checking cookie from %s: %w", server, err)
+	}
+
+	return resp, nil
+}
+
+// exchangeUDPConn performs a DNS exchange over the UDP connection conn.  If
+// the strict validation is enabled, the packets not matching req are discarded
+// until the timeout.
+func (p *plainDNS) exchangeUDPConn(
+	ctx context.Context,
+	client *dns.Client,
+	req *dns.Msg,
+	conn *dns.Conn,
+) (resp *dns.Msg, err error) {
+	if !p.strict {
+		return exchangeConnContext(ctx, client, req, conn)
+	}
+
+	stop := abortOnDone(ctx, conn)
+	resp, err = p.exchangeStrict(req, conn)
+	if abortErr := stop(); abortErr != nil {
+		return nil, abortErr
+	}
+
+	return resp, err
+}
+
+// defaultStrictTimeout is the timeout of the strictly validated exchanges used
+// when [Options.Timeout] is zero, the same as [dns.Client] uses by default.
+const defaultStrictTimeout = 2 * time.Second
+
+// exchangeStrict writes req to conn and reads from it until a response
+// matching req is received or the timeout is reached.  The malformed and
+// mismatched packets are skipped, since those may be spoofed.  If the timeout
+// is reached after receiving a response with the matching ID but a mismatched
+// question, that response is returned along with an error wrapping
+// [errQuestion], so that the exchange could be retried over TCP.
+func (p *plainDNS) exchangeStrict(req *dns.Msg, conn *dns.Conn) (resp *dns.Msg, err error) {
+	timeout := p.timeout
+	if timeout == 0 {
+		timeout = defaultStrictTimeout
+	}
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	err = conn.WriteMsg(req)
+	if err != nil {
+		return nil, fmt.Errorf("writing request: %w", err)
+	}
+
+	size := int(conn.UDPSize)
+	if opt := req.IsEdns0(); opt != nil {
+		size = max(size, int(opt.UDPSize()))
+	}
+
+	buf := make([]byte, max(size, dns.MinMsgSize))
+
+	var mismatched *dns.Msg
+	var mismatchErr error
+	for {
+		var n int
+		n, err = conn.Read(buf)
+		if err != nil {
+			if mismatched != nil && isTimeout(err) {
+				return mismatched, mismatchErr
+			}
+
+			return nil, fmt.Errorf("reading response: %w", err)
+		}
+
+		resp = &dns.Msg{}
+		err = resp.Unpack(buf[:n])
+		if err != nil {
+			log.Debug("plain %s: discarding malformed packet: %s", p.Address(), err)
+
+			continue
+		}
+
+		err = matchResponse(req, resp)
+		if err == nil && p.dns0x20 {
+			err = matchCase(req, resp)
+		}
 
-		resp, _, err = client.ExchangeWithConn(req, conn)
+		if err == nil {
+			return resp, nil
+		}
+
+		log.Debug("plain %s: discarding packet: %s", p.Address(), err)
+
+		if resp.Id == req.Id && resp.Response && errors.Is(err, errQuestion) {
+			mismatched, mismatchErr = resp, err
+		}
 	}
+}
 
+// pooledExchange performs a DNS exchange over TCP using a connection from the
+// pool, if any, and puts it back afterwards.  If the pooled connection turns
+// out to be broken, it's closed and the exchange is retried once over a newly
+// dialed one.
+func (p *plainDNS) pooledExchange(
+	ctx context.Context,
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	conn := p.tcpPool.get()
+	if conn != nil {
+		log.Debug("plain %s: using existing conn %s", p.Address(), conn.RemoteAddr())
+
+		resp, err = p.exchangeWithConn(ctx, conn, req)
+		if err == nil {
+			p.tcpPool.put(conn)
+
+			return resp, nil
+		}
+
+		closeIdle(conn)
+		if ctx.Err() != nil || errors.Is(err, ErrResponseTooLarge) {
+			return nil, fmt.Errorf("exchanging with %s over %s: %w", p.Address(), networkTCP, err)
+		}
+
+		log.Debug("plain %s: pooled conn %s is broken: %s", p.Address(), conn.RemoteAddr(), err)
+	}
+
+	conn, err = p.dial(ctx, networkTCP, dial)
 	if err != nil {
-		return resp, fmt.Errorf("exchanging with %s over %s: %w", addr, network, err)
+		return nil, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, networkTCP, err)
+	}
+
+	resp, err = p.exchangeWithConn(ctx, conn, req)
+	if err != nil {
+		err = fmt.Errorf("exchanging with %s over %s: %w", p.Address(), networkTCP, err)
+
+		return resp, errors.WithDeferred(err, closeConn(conn))
+	}
+
+	p.tcpPool.put(conn)
+
+	return resp, nil
+}
+
+// exchangeWithConn performs a DNS exchange over the TCP connection conn,
+// which is left open unless ctx is done.
+func (p *plainDNS) exchangeWithConn(
+	ctx context.Context,
+	conn net.Conn,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	client := &dns.Client{Net: networkTCP, Timeout: p.timeout}
+
+	return exchangeConnContext(ctx, client, req, &dns.Conn{Conn: conn})
+}
+
+// exchangeConnContext performs a DNS exchange using client over conn.  It
+// closes conn and returns an error as soon as ctx is done.
+func exchangeConnContext(
+	ctx context.Context,
+	client *dns.Client,
+	req *dns.Msg,
+	conn *dns.Conn,
+) (resp *dns.Msg, err error) {
+	stop := abortOnDone(ctx, conn)
+	resp, _, err = client.ExchangeWithConnContext(ctx, req, conn)
+	if abortErr := stop(); abortErr != nil {
+		return nil, abortErr
 	}
 
-	return resp, validatePlainResponse(req, resp)
+	return resp, err
 }
 
 // isExpectedConnErr returns true if the error is expected.  In this case,
@@ -132,35 +568,144 @@ func isExpectedConnErr(err error) (is bool) {
 
 // Exchange implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *plainDNS.
+func (p *plainDNS) ExchangeContext(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	return p.ExchangeNetwork(ctx, req, false)
+}
+
+// type check
+var _ NetworkUpstream = (*plainDNS)(nil)
+
+// ExchangeNetwork implements the [NetworkUpstream] interface for *plainDNS.
+func (p *plainDNS) ExchangeNetwork(
+	ctx context.Context,
+	req *dns.Msg,
+	forceTCP bool,
+) (resp *dns.Msg, err error) {
+	defer func() { err = classifyError(err) }()
+
+	err = p.active.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer p.active.end()
+
+	restoreRD := forceRecursionDesired(req, p.forceRD)
+	defer func() { restoreRD(resp) }()
+
 	dial, err := p.getDialer()
 	if err != nil {
 		// Don't wrap the error since it's informative enough as is.
 		return nil, err
 	}
 
+	if p.net != networkUDP || forceTCP {
+		// The network is already TCP or the caller knows better.
+		return p.dialExchange(ctx, networkTCP, dial, req)
+	}
+
+	if p.preferTCP {
+		resp, err = p.dialExchange(ctx, networkTCP, dial, req)
+		if !isDialError(err) || ctx.Err() != nil {
+			return resp, err
+		}
+
+		log.Debug("plain %s: %s, switching from tcp to udp", p.Address(), err)
+	}
+
+	return p.exchangeUDP(ctx, dial, req)
+}
+
+// isDialError returns true if err is caused by a failure to establish the
+// connection, e.g. a refused one.
+func isDialError(err error) (ok bool) {
+	var opErr *net.OpError
+
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// exchangeUDP performs a DNS exchange over UDP and retries it over TCP if the
+// response is truncated or malformed, unless the fallback is disabled.
+func (p *plainDNS) exchangeUDP(
+	ctx context.Context,
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
 	addr := p.Address()
 
-	resp, err = p.dialExchange(p.net, dial, req)
-	if p.net != networkUDP {
-		// The network is already TCP.
-		return resp, err
+	if req.Id == 0 {
+		// Zero IDs make the off-path response spoofing trivial, so use a
+		// random one and restore the original afterwards.  The responses with
+		// mismatched IDs are skipped while reading, see
+		// [dns.Client.ExchangeWithConnContext].
+		req = req.Copy()
+		req.Id = randomID()
+		defer func() {
+			if resp != nil {
+				resp.Id = 0
+			}
+		}()
+	}
+
+	// Remember the address actually used, so that the fallback to TCP reaches
+	// the same server.
+	var serverAddr string
+	udpDial := func(ctx context.Context, network, a string) (conn net.Conn, dialErr error) {
+		conn, dialErr = dial(ctx, network, a)
+		if dialErr == nil {
+			serverAddr = conn.RemoteAddr().String()
+		}
+
+		return conn, dialErr
+	}
+
+	udpReq, added := p.withUDPSize(req)
+
+	var qname string
+	if p.dns0x20 {
+		udpReq, qname = withRandomCase(udpReq)
+	}
+
+	resp, err = p.dialExchange(ctx, p.net, udpDial, udpReq)
+	if resp != nil {
+		if added {
+			removeOPT(resp)
+		}
+
+		if qname != "" {
+			restoreCase(resp, udpReq.Question[0].Name, qname)
+		}
 	}
 
-	if resp == nil {
-		// There is likely an error with the upstream.
+	if resp == nil || p.noTCPFallback {
+		// There is likely an error with the upstream or the response should
+		// be returned as is.
 		return resp, err
 	}
 
+	tcpDial := dial
+	if serverAddr != "" {
+		tcpDial = p.reportDials(bootstrap.NewDialContext(p.timeout, p.binding, serverAddr))
+	}
+
 	if errors.Is(err, errQuestion) {
 		// The upstream responds with malformed messages, so try TCP.
-		log.Debug("plain %s: %s, using tcp", addr, err)
+		log.Debug("plain %s: %s, switching from udp to tcp at %s", addr, err, serverAddr)
 
-		return p.dialExchange(networkTCP, dial, req)
+		return p.dialExchange(ctx, networkTCP, tcpDial, req)
 	} else if resp.Truncated {
 		// Fallback to TCP on truncated responses.
-		log.Debug("plain %s: resp for %s is truncated, using tcp", &req.Question[0], addr)
-
-		return p.dialExchange(networkTCP, dial, req)
+		log.Debug(
+			"plain %s: resp for %s is truncated, switching from udp to tcp at %s",
+			addr,
+			&req.Question[0],
+			serverAddr,
+		)
+
+		return p.dialExchange(ctx, networkTCP, tcpDial, req)
 	}
 
 	// There is either no error or the error isn't related to the received
@@ -168,9 +713,95 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, err
 }
 
+// randomID returns a cryptographically random non-zero DNS message ID.
+func randomID() (id uint16) {
+	var b [2]byte
+	for id == 0 {
+		_, err := cryptorand.Read(b[:])
+		if err != nil {
+			// Must not happen in normal circumstances.
+			panic(fmt.Errorf("dnsproxy: generating message id: %w", err))
+		}
+
+		id = binary.BigEndian.Uint16(b[:])
+	}
+
+	return id
+}
+
+// withUDPSize returns a copy of req with the OPT record advertising the UDP
+// payload size of p.  If req already has an OPT record or EDNS0 is disabled,
+// it's returned as is and added is false.
+func (p *plainDNS) withUDPSize(req *dns.Msg) (udpReq *dns.Msg, added bool) {
+	if p.noEDNS || req.IsEdns0() != nil {
+		return req, false
+	}
+
+	udpReq = req.Copy()
+	udpReq.SetEdns0(p.udpSize, false)
+
+	return udpReq, true
+}
+
+// removeOPT removes the OPT records from the additional section of resp.
+func removeOPT(resp *dns.Msg) {
+	resp.Extra = slices.DeleteFunc(resp.Extra, isOPT)
+}
+
 // Close implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Close() (err error) {
-	return nil
+	p.active.shutdown()
+
+	err = p.closeMux()
+	if p.tcpPool == nil {
+		return err
+	}
+
+	return errors.Join(err, p.tcpPool.close())
+}
+
+// type check
+var _ ProbableUpstream = (*plainDNS)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *plainDNS.
+func (p *plainDNS) Probe(ctx context.Context) (err error) {
+	return probe(ctx, p, p.probeTimeout)
+}
+
+// type check
+var _ BootstrapSetter = (*plainDNS)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for *plainDNS.  It
+// also closes the pooled connections, since they may lead to the previously
+// resolved addresses, and the multiplexed UDP connection as soon as the queries
+// in flight are finished.
+func (p *plainDNS) SetBootstrap(resolvers []Resolver) {
+	p.bootstrapper.SetBootstrap(resolvers)
+	p.drainMux()
+
+	if p.tcpPool != nil {
+		err := p.tcpPool.drain()
+		if err != nil {
+			log.Debug("plain %s: draining pool: %s", p.Address(), err)
+		}
+	}
+}
+
+// type check
+var _ RefreshableUpstream = (*plainDNS)(nil)
+
+// Refresh implements the [RefreshableUpstream] interface for *plainDNS.  It
+// closes the pooled TCP connections and the multiplexed UDP connection as soon
+// as the queries in flight are finished.
+func (p *plainDNS) Refresh() (err error) {
+	p.expireResolved()
+	p.drainMux()
+
+	if p.tcpPool == nil {
+		return nil
+	}
+
+	return p.tcpPool.drain()
 }
 
 // errQuestion is returned when a message has malformed question section.
@@ -197,3 +828,29 @@ func validatePlainResponse(req, resp *dns.Msg) (err error) {
 
 	return nil
 }
+
+// errNotResponse is returned when a message received from an upstream isn't a
+// response, i.e. its QR bit isn't set.
+const errNotResponse errors.Error = "not a response"
+
+// matchResponse returns an error if resp isn't the response to req, i.e. it
+// has a different ID, its QR bit isn't set, or its question section doesn't
+// match the one of req, including the class.
+func matchResponse(req, resp *dns.Msg) (err error) {
+	if resp.Id != req.Id {
+		return fmt.Errorf("%w: got %d, want %d", dns.ErrId, resp.Id, req.Id)
+	} else if !resp.Response {
+		return errNotResponse
+	}
+
+	err = validatePlainResponse(req, resp)
+	if err != nil {
+		return err
+	}
+
+	if qc := resp.Question[0].Qclass; qc != req.Question[0].Qclass {
+		return fmt.Errorf("%w: mismatched class %s", errQuestion, dns.Class(qc))
+	}
+
+	return nil
+}
@@ -1,14 +1,18 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -63,6 +67,324 @@ func TestUpstream_plainDNS_badID(t *testing.T) {
 	assert.Nil(t, resp)
 }
 
+func TestUpstream_plainDNS_randomID(t *testing.T) {
+	ids := make(chan uint16, 1)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		ids <- req.Id
+
+		// Send a spoofed response first, which should be skipped.
+		spoofed := respondToTestMessage(req)
+		spoofed.Id++
+		require.NoError(testutil.PanicT{}, w.WriteMsg(spoofed))
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{Timeout: timeout})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	req.Id = 0
+
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	id, _ := testutil.RequireReceive(t, ids, timeout)
+	assert.NotZero(t, id)
+	assert.Zero(t, resp.Id)
+	assert.Zero(t, req.Id)
+}
+
+func TestUpstream_plainDNS_strictValidation(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if w.RemoteAddr().Network() != networkUDP {
+			require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+
+			return
+		}
+
+		notResp := respondToTestMessage(req)
+		notResp.Response = false
+		notResp.Answer = nil
+
+		badClass := respondToTestMessage(req)
+		badClass.Question[0].Qclass = dns.ClassCHAOS
+
+		badName := respondToTestMessage(req)
+		badName.Question[0].Name = "bad." + req.Question[0].Name
+
+		// Send the spoofed packets first, which should be skipped.
+		for _, m := range []*dns.Msg{notResp, badClass, badName} {
+			require.NoError(testutil.PanicT{}, w.WriteMsg(m))
+		}
+
+		_, err := w.Write([]byte{0x00})
+		require.NoError(testutil.PanicT{}, err)
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+
+	t.Run("strict", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{
+			Timeout:            timeout,
+			DisableTCPFallback: true,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		req := createTestMessage()
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+		requireResponse(t, req, resp)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{
+			Timeout:                 timeout,
+			DisableTCPFallback:      true,
+			DisableStrictValidation: true,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		resp, err := u.Exchange(createTestMessage())
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.False(t, resp.Response)
+	})
+}
+
+func TestUpstream_plainDNS_strictValidationFallback(t *testing.T) {
+	var tcpReqNum atomic.Uint32
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := respondToTestMessage(req)
+		if w.RemoteAddr().Network() == networkUDP {
+			resp.Question[0].Qclass = dns.ClassCHAOS
+		} else {
+			tcpReqNum.Add(1)
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		// Use a shorter timeout to speed up the test.
+		Timeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	assert.Equal(t, uint32(1), tcpReqNum.Load())
+}
+
+func TestUpstream_plainDNS_dns0x20(t *testing.T) {
+	const qname = "a-long-name-to-randomize.example."
+
+	newUpstream := func(t *testing.T, lowerUDP bool) (u Upstream, names chan string) {
+		t.Helper()
+
+		names = make(chan string, 2)
+		srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			names <- req.Question[0].Name
+
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    100,
+				},
+				A: net.IP{1, 2, 3, 4},
+			}}
+
+			if lowerUDP && w.RemoteAddr().Network() == networkUDP {
+				resp.Question[0].Name = strings.ToLower(resp.Question[0].Name)
+			}
+
+			require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+		})
+		testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+		u, err := AddressToUpstream(fmt.Sprintf("127.0.0.1:%d", srv.port), &Options{
+			// Use a shorter timeout to speed up the test.
+			Timeout:       100 * time.Millisecond,
+			EnableDNS0x20: true,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		return u, names
+	}
+
+	t.Run("echoed", func(t *testing.T) {
+		u, names := newUpstream(t, false)
+
+		resp, err := u.Exchange((&dns.Msg{}).SetQuestion(qname, dns.TypeA))
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		sent, _ := testutil.RequireReceive(t, names, timeout)
+		assert.True(t, strings.EqualFold(qname, sent))
+		assert.NotEqual(t, qname, sent)
+
+		assert.Equal(t, qname, resp.Question[0].Name)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, qname, resp.Answer[0].Header().Name)
+	})
+
+	t.Run("not_preserved", func(t *testing.T) {
+		u, names := newUpstream(t, true)
+
+		resp, err := u.Exchange((&dns.Msg{}).SetQuestion(qname, dns.TypeA))
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		// The query is retried over TCP as is.
+		_, _ = testutil.RequireReceive(t, names, timeout)
+		sent, _ := testutil.RequireReceive(t, names, timeout)
+		assert.Equal(t, qname, sent)
+		assert.Equal(t, qname, resp.Question[0].Name)
+	})
+}
+
+func TestUpstream_plainDNS_forceRecursionDesired(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := respondToTestMessage(req)
+		resp.Rcode = dns.RcodeRefused
+		if req.RecursionDesired {
+			resp.Rcode = dns.RcodeSuccess
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+
+	testCases := []struct {
+		name      string
+		preserve  bool
+		wantRcode int
+	}{{
+		name:      "forced",
+		preserve:  false,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "preserved",
+		preserve:  true,
+		wantRcode: dns.RcodeRefused,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:                  timeout,
+				PreserveRecursionDesired: tc.preserve,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			req.RecursionDesired = false
+
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.False(t, req.RecursionDesired)
+			assert.False(t, resp.RecursionDesired)
+		})
+	}
+}
+
+func TestUpstream_plainDNS_truncatedOverTCP(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := respondToTestMessage(req)
+		resp.Truncated = true
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+
+	testCases := []struct {
+		wantErr error
+		name    string
+		policy  TruncatedPolicy
+		wantTC  bool
+	}{{
+		wantErr: nil,
+		name:    "clear",
+		policy:  TruncatedPolicyClear,
+		wantTC:  false,
+	}, {
+		wantErr: nil,
+		name:    "log",
+		policy:  TruncatedPolicyLog,
+		wantTC:  true,
+	}, {
+		wantErr: ErrUnexpectedTC,
+		name:    "fail",
+		policy:  TruncatedPolicyFail,
+		wantTC:  false,
+	}, {
+		wantErr: nil,
+		name:    "retry_unsupported",
+		policy:  TruncatedPolicyRetry,
+		wantTC:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:         timeout,
+				TruncatedPolicy: tc.policy,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			resp, err := u.Exchange(createTestMessage())
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantTC, resp.Truncated)
+		})
+	}
+
+	t.Run("bad_policy", func(t *testing.T) {
+		_, err := AddressToUpstream(addr, &Options{
+			Timeout:         timeout,
+			TruncatedPolicy: TruncatedPolicyRetry + 1,
+		})
+		assert.ErrorIs(t, err, errBadTruncatedPolicy)
+	})
+}
+
 func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 	req := createTestMessage()
 	goodResp := respondToTestMessage(req)
@@ -138,6 +460,175 @@ func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 	}
 }
 
+func TestUpstream_plainDNS_disableTCPFallback(t *testing.T) {
+	var tcpReqNum atomic.Uint32
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := respondToTestMessage(req)
+		if w.RemoteAddr().Network() == networkUDP {
+			resp.Truncated = true
+		} else {
+			tcpReqNum.Add(1)
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:            timeout,
+		DisableTCPFallback: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	assert.True(t, resp.Truncated)
+	assert.Zero(t, tcpReqNum.Load())
+}
+
+func TestUpstream_plainDNS_exchangeNetwork(t *testing.T) {
+	networks := make(chan string, 1)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		networks <- w.RemoteAddr().Network()
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{Timeout: timeout})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	nu, ok := u.(NetworkUpstream)
+	require.True(t, ok)
+
+	testCases := []struct {
+		name     string
+		want     string
+		forceTCP bool
+	}{{
+		name:     "udp",
+		want:     networkUDP,
+		forceTCP: false,
+	}, {
+		name:     "tcp",
+		want:     networkTCP,
+		forceTCP: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestMessage()
+			resp, exchErr := nu.ExchangeNetwork(context.Background(), req, tc.forceTCP)
+			require.NoError(t, exchErr)
+			requireResponse(t, req, resp)
+
+			got, _ := testutil.RequireReceive(t, networks, timeout)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestOptions_PreferTCP(t *testing.T) {
+	networks := make(chan string, 1)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		networks <- w.RemoteAddr().Network()
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	addr := fmt.Sprintf("udp://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:   timeout,
+		PreferTCP: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", srv.port), u.Address())
+
+	t.Run("tcp", func(t *testing.T) {
+		req := createTestMessage()
+		resp, exchErr := u.Exchange(req)
+		require.NoError(t, exchErr)
+		requireResponse(t, req, resp)
+
+		got, _ := testutil.RequireReceive(t, networks, timeout)
+		assert.Equal(t, networkTCP, got)
+	})
+
+	// Make the TCP connections refused.
+	require.NoError(t, srv.tcpSrv.Shutdown())
+	testutil.CleanupAndRequireSuccess(t, srv.udpSrv.Shutdown)
+
+	// Drop the pooled connection to the stopped server.
+	r, ok := u.(RefreshableUpstream)
+	require.True(t, ok)
+	require.NoError(t, r.Refresh())
+
+	t.Run("udp_fallback", func(t *testing.T) {
+		req := createTestMessage()
+		resp, exchErr := u.Exchange(req)
+		require.NoError(t, exchErr)
+		requireResponse(t, req, resp)
+
+		got, _ := testutil.RequireReceive(t, networks, timeout)
+		assert.Equal(t, networkUDP, got)
+	})
+}
+
+func TestOptions_LocalAddr(t *testing.T) {
+	remotes := make(chan net.Addr, 1)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		remotes <- w.RemoteAddr()
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	for _, network := range []network{networkUDP, networkTCP} {
+		t.Run(network, func(t *testing.T) {
+			addr := fmt.Sprintf("%s://127.0.0.1:%d", network, srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:   timeout,
+				LocalAddr: netutil.IPv4Localhost(),
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+
+			remote, _ := testutil.RequireReceive(t, remotes, timeout)
+			ap, err := netip.ParseAddrPort(remote.String())
+			require.NoError(t, err)
+
+			assert.Equal(t, netutil.IPv4Localhost(), ap.Addr())
+		})
+	}
+
+	t.Run("mismatched_family", func(t *testing.T) {
+		addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+		u, err := AddressToUpstream(addr, &Options{
+			Timeout:   timeout,
+			LocalAddr: netutil.IPv6Localhost(),
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		_, err = u.Exchange(createTestMessage())
+		assert.Error(t, err)
+	})
+}
+
 // testDNSServer is a simple DNS server that can be used in unit-tests.
 type testDNSServer struct {
 	udpListener net.PacketConn
@@ -195,3 +686,410 @@ func (s *testDNSServer) Close() (err error) {
 
 	return errors.WithDeferred(udpErr, tcpErr)
 }
+
+func TestUpstream_plainDNS_tcpPool(t *testing.T) {
+	l, err := net.Listen(networkTCP, "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	srvConns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			srvConns <- conn
+			go func() {
+				dnsConn := &dns.Conn{Conn: conn}
+				for {
+					req, readErr := dnsConn.ReadMsg()
+					if readErr != nil {
+						return
+					}
+
+					_ = dnsConn.WriteMsg(respondToTestMessage(req))
+				}
+			}()
+		}
+	}()
+
+	u, err := AddressToUpstream("tcp://"+l.Addr().String(), &Options{
+		Timeout:      timeout,
+		TCPIdleConns: 1,
+	})
+	require.NoError(t, err)
+
+	for range 3 {
+		checkUpstream(t, u, u.Address())
+	}
+
+	require.Len(t, srvConns, 1)
+	srvConn := <-srvConns
+
+	// Break the pooled connection to make the upstream dial a new one.
+	require.NoError(t, srvConn.Close())
+	checkUpstream(t, u, u.Address())
+
+	require.Len(t, srvConns, 1)
+	srvConn = <-srvConns
+
+	require.NoError(t, u.Close())
+
+	// Make sure the pooled connection is closed.
+	require.NoError(t, srvConn.SetReadDeadline(time.Now().Add(timeout)))
+
+	_, err = srvConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestUpstream_plainDNS_maxResponseSize(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+
+	testCases := []struct {
+		wantErr  error
+		name     string
+		maxSize  int
+		idleConn int
+	}{{
+		wantErr:  ErrResponseTooLarge,
+		name:     "too_large",
+		maxSize:  16,
+		idleConn: 0,
+	}, {
+		wantErr:  ErrResponseTooLarge,
+		name:     "too_large_pooled",
+		maxSize:  16,
+		idleConn: 1,
+	}, {
+		wantErr:  nil,
+		name:     "fits",
+		maxSize:  dns.MinMsgSize,
+		idleConn: 0,
+	}, {
+		wantErr:  nil,
+		name:     "fits_pooled",
+		maxSize:  dns.MinMsgSize,
+		idleConn: 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:         timeout,
+				MaxResponseSize: tc.maxSize,
+				TCPIdleConns:    tc.idleConn,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			for range 2 {
+				req := createTestMessage()
+				resp, exErr := u.Exchange(req)
+				if tc.wantErr != nil {
+					assert.ErrorIs(t, exErr, tc.wantErr)
+					assert.Nil(t, resp)
+
+					continue
+				}
+
+				require.NoError(t, exErr)
+				requireResponse(t, req, resp)
+			}
+		})
+	}
+}
+
+func TestUpstream_plainDNS_udpBufferSize(t *testing.T) {
+	// answersNum is the number of answers making the response larger than
+	// [dns.MinMsgSize] but smaller than [DefaultUDPBufferSize].
+	const answersNum = 50
+
+	sizes := make(chan uint16, 1)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := respondToTestMessage(req)
+		resp.Compress = true
+
+		a := resp.Answer[0]
+		for range answersNum - 1 {
+			resp.Answer = append(resp.Answer, dns.Copy(a))
+		}
+
+		var optNum int
+		for _, rr := range req.Extra {
+			if opt, ok := rr.(*dns.OPT); ok {
+				sizes <- opt.UDPSize()
+				optNum++
+			}
+		}
+
+		require.LessOrEqual(testutil.PanicT{}, optNum, 1)
+		if optNum > 0 {
+			resp.SetEdns0(req.IsEdns0().UDPSize(), false)
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+
+	testCases := []struct {
+		name      string
+		reqSize   uint16
+		optSize   uint16
+		wantSize  uint16
+		wantEDNS0 bool
+	}{{
+		name:      "default",
+		reqSize:   0,
+		optSize:   0,
+		wantSize:  DefaultUDPBufferSize,
+		wantEDNS0: false,
+	}, {
+		name:      "custom",
+		reqSize:   0,
+		optSize:   4096,
+		wantSize:  4096,
+		wantEDNS0: false,
+	}, {
+		name:      "request_opt",
+		reqSize:   2048,
+		optSize:   4096,
+		wantSize:  2048,
+		wantEDNS0: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:       timeout,
+				UDPBufferSize: tc.optSize,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			if tc.reqSize > 0 {
+				req.SetEdns0(tc.reqSize, false)
+			}
+
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.False(t, resp.Truncated)
+			assert.Len(t, resp.Answer, answersNum)
+			assert.Equal(t, tc.wantEDNS0, resp.IsEdns0() != nil)
+
+			size, _ := testutil.RequireReceive(t, sizes, timeout)
+			assert.Equal(t, tc.wantSize, size)
+
+			// The original request must not be modified.
+			assert.Equal(t, tc.reqSize > 0, req.IsEdns0() != nil)
+		})
+	}
+}
+
+func TestUpstream_plainDNS_disableEDNS0(t *testing.T) {
+	// answersNum is the number of answers making the response larger than
+	// [dns.MinMsgSize].
+	const answersNum = 50
+
+	var udpNum, tcpNum atomic.Int32
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		require.Nil(pt, req.IsEdns0())
+
+		resp := respondToTestMessage(req)
+		a := resp.Answer[0]
+		for range answersNum - 1 {
+			resp.Answer = append(resp.Answer, dns.Copy(a))
+		}
+
+		if w.RemoteAddr().Network() == networkUDP {
+			udpNum.Add(1)
+			resp.Truncate(dns.MinMsgSize)
+		} else {
+			tcpNum.Add(1)
+		}
+
+		require.NoError(pt, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:          timeout,
+		DisableEDNS0:     true,
+		EnableDNSCookies: true,
+		EDNSClientSubnet: &net.IPNet{
+			IP:   net.IP{1, 2, 3, 0},
+			Mask: net.CIDRMask(24, 32),
+		},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, answersNum)
+	assert.Equal(t, int32(1), udpNum.Load())
+	assert.Equal(t, int32(1), tcpNum.Load())
+
+	// The original request must not be modified.
+	assert.NotNil(t, req.IsEdns0())
+
+	_, err = AddressToUpstream(addr, &Options{
+		DisableEDNS0:   true,
+		ValidateDNSSEC: true,
+	})
+	assert.ErrorIs(t, err, errDNSSECNoEDNS)
+}
+
+func TestUpstream_plainDNS_cookies(t *testing.T) {
+	const serverCookie = "0102030405060708"
+
+	// clientCookies receives the client cookies of the queries.
+	clientCookies := make(chan string, 2)
+
+	// spoof makes the server respond with a wrong client cookie.
+	spoof := &atomic.Bool{}
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		var cookie string
+		for _, o := range req.IsEdns0().Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				cookie = c.Cookie
+			}
+		}
+
+		require.GreaterOrEqual(pt, len(cookie), clientCookieLen*2)
+
+		client := cookie[:clientCookieLen*2]
+		testutil.RequireSend(pt, clientCookies, client, timeout)
+
+		resp := respondToTestMessage(req)
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		if cookie[clientCookieLen*2:] != serverCookie {
+			resp.Answer = nil
+			resp.Rcode = dns.RcodeBadCookie
+		}
+
+		if spoof.Load() {
+			client = "ffffffffffffffff"
+		}
+
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: client + serverCookie,
+		})
+
+		require.NoError(pt, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:          timeout,
+		EnableDNSCookies: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+
+	// The first query is answered with BADCOOKIE and retried.
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	first, _ := testutil.RequireReceive(t, clientCookies, timeout)
+	retried, _ := testutil.RequireReceive(t, clientCookies, timeout)
+	assert.Equal(t, first, retried)
+	assert.Nil(t, resp.IsEdns0())
+
+	// The server cookie is already known.
+	resp, err = u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	next, _ := testutil.RequireReceive(t, clientCookies, timeout)
+	assert.Equal(t, first, next)
+	assert.Empty(t, clientCookies)
+
+	spoof.Store(true)
+
+	_, err = u.Exchange(req)
+	assert.ErrorIs(t, err, errCookieMismatch)
+}
+
+func TestUpstream_plainDNS_udpMultiplex(t *testing.T) {
+	const queriesNum = 10
+
+	remotes := make(chan string, queriesNum+1)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		remotes <- w.RemoteAddr().String()
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Timeout:      timeout,
+		UDPMultiplex: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	errs := make(chan error, queriesNum)
+	for range queriesNum {
+		go func() {
+			req := createTestMessage()
+			resp, exchErr := u.Exchange(req)
+			if exchErr == nil && resp.Id != req.Id {
+				exchErr = fmt.Errorf("got id %d, want %d", resp.Id, req.Id)
+			}
+
+			errs <- exchErr
+		}()
+	}
+
+	for range queriesNum {
+		exchErr, _ := testutil.RequireReceive(t, errs, timeout)
+		require.NoError(t, exchErr)
+	}
+
+	require.Len(t, remotes, queriesNum)
+
+	first := <-remotes
+	for range queriesNum - 1 {
+		assert.Equal(t, first, <-remotes)
+	}
+
+	// Make sure the socket is dialed again after the refresh.
+	p := testutil.RequireTypeAssert[*plainDNS](t, u)
+	require.NoError(t, p.Refresh())
+
+	checkUpstream(t, u, addr)
+
+	remote, _ := testutil.RequireReceive(t, remotes, timeout)
+	assert.NotEqual(t, first, remote)
+}
@@ -0,0 +1,110 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// PrefetchHandler is called with the speculative query and its response
+// received by a [PrefetchingUpstream].  Both of them must not be modified.
+type PrefetchHandler func(req, resp *dns.Msg)
+
+// PrefetchingUpstream is an [Upstream] sending speculative queries along with
+// the exchanged ones, see [Options.PrefetchAAAA].
+//
+// The DNS-over-HTTPS upstreams created with [AddressToUpstream] implement it,
+// unless they are wrapped with a composite upstream, e.g. [ChainUpstream].
+// The caching upstreams returned from [NewCachingUpstream] set themselves as
+// the handler of the wrapped prefetching upstream, if any.
+type PrefetchingUpstream interface {
+	Upstream
+
+	// SetPrefetchHandler sets the function handling the responses to the
+	// speculative queries.  The speculative queries aren't sent if there is
+	// no handler.  It's safe for concurrent use along with Exchange.
+	SetPrefetchHandler(h PrefetchHandler)
+}
+
+// setPrefetchHandler sets h as the prefetch handler of u or the first upstream
+// wrapped by it implementing [PrefetchingUpstream], if any.
+func setPrefetchHandler(u Upstream, h PrefetchHandler) {
+	for {
+		if pu, ok := u.(PrefetchingUpstream); ok {
+			pu.SetPrefetchHandler(h)
+
+			return
+		}
+
+		w, ok := u.(interface{ Unwrap() (ups Upstream) })
+		if !ok {
+			return
+		}
+
+		u = w.Unwrap()
+	}
+}
+
+// type check
+var _ PrefetchingUpstream = (*dnsOverHTTPS)(nil)
+
+// SetPrefetchHandler implements the [PrefetchingUpstream] interface for
+// *dnsOverHTTPS.
+func (p *dnsOverHTTPS) SetPrefetchHandler(h PrefetchHandler) {
+	p.prefetchMu.Lock()
+	defer p.prefetchMu.Unlock()
+
+	p.onPrefetch = h
+}
+
+// prefetchHandler returns the handler of the prefetched responses for req, or
+// nil if nothing should be prefetched for it.
+func (p *dnsOverHTTPS) prefetchHandler(req *dns.Msg) (h PrefetchHandler) {
+	if !p.prefetchAAAA || len(req.Question) != 1 {
+		return nil
+	}
+
+	q := req.Question[0]
+	if q.Qtype != dns.TypeA || q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	p.prefetchMu.Lock()
+	defer p.prefetchMu.Unlock()
+
+	return p.onPrefetch
+}
+
+// prefetch sends the AAAA query for the name of the A query req using client
+// and passes the response to h.  It's intended to be used as a goroutine, so
+// that the response to req isn't delayed.
+func (p *dnsOverHTTPS) prefetch(client *http.Client, req *dns.Msg, h PrefetchHandler) {
+	defer log.OnPanic("doh: prefetching")
+
+	err := p.active.begin()
+	if err != nil {
+		// The upstream is closed.
+		return
+	}
+	defer p.active.end()
+
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	req.Question[0].Qtype = dns.TypeAAAA
+
+	resp, err := p.exchangeHTTPS(ctx, client, req)
+	if err != nil {
+		log.Debug("dnsproxy: %s: prefetching %s: %s", p.addrRedacted, &req.Question[0], err)
+
+		return
+	}
+
+	h(req, resp)
+}
@@ -0,0 +1,92 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultProbeTimeout is the default timeout of a single health-check probe,
+// see [Options.ProbeTimeout].
+const DefaultProbeTimeout = 2 * time.Second
+
+// ProbableUpstream is an [Upstream] that can be checked for availability
+// without issuing the actual user queries.  All the upstreams created by this
+// package implement it.
+type ProbableUpstream interface {
+	Upstream
+
+	// Probe sends a lightweight query to the upstream and returns nil if it
+	// responds properly.  It returns as soon as ctx is done.  It's safe for
+	// concurrent use along with Exchange.
+	Probe(ctx context.Context) (err error)
+}
+
+// newProbeMsg returns a new message to probe the upstreams with.  It asks for
+// the root name servers, which any recursive resolver is able to answer
+// without relying on any third-party domain.
+func newProbeMsg() (req *dns.Msg) {
+	req = &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+
+	return req
+}
+
+// probe checks if u responds properly to the probe query within timeout or
+// until ctx is done.  If timeout isn't positive, [DefaultProbeTimeout] is
+// used.  The query is sent using the regular exchange path of u, so the
+// connections are reused, but it's never shared with the other exchanges.
+func probe(ctx context.Context, u Upstream, timeout time.Duration) (err error) {
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+
+	req := newProbeMsg()
+	resCh := make(chan result, 1)
+	go func() {
+		resp, exErr := u.ExchangeContext(ctx, req)
+		resCh <- result{
+			resp: resp,
+			err:  exErr,
+		}
+	}()
+
+	var res result
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("probing %s: %w", u.Address(), ctx.Err())
+	case res = <-resCh:
+		// Go on.
+	}
+
+	switch {
+	case res.err != nil:
+		return fmt.Errorf("probing %s: %w", u.Address(), res.err)
+	case res.resp == nil:
+		return fmt.Errorf("probing %s: %w", u.Address(), ErrNoReply)
+	case res.resp.Rcode != dns.RcodeSuccess:
+		return fmt.Errorf("probing %s: got rcode %s", u.Address(), dns.RcodeToString[res.resp.Rcode])
+	default:
+		return validatePlainResponse(req, res.resp)
+	}
+}
+
+// probeWrapped probes the upstream wrapped by another one.  If ups doesn't
+// implement [ProbableUpstream], it's probed with [DefaultProbeTimeout].
+func probeWrapped(ctx context.Context, ups Upstream) (err error) {
+	if p, ok := ups.(ProbableUpstream); ok {
+		return p.Probe(ctx)
+	}
+
+	return probe(ctx, ups, 0)
+}
@@ -0,0 +1,90 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbableUpstream_Probe(t *testing.T) {
+	testCases := []struct {
+		name     string
+		wantErr  string
+		rcode    int
+		noAnswer bool
+	}{{
+		name:     "success",
+		wantErr:  "",
+		rcode:    dns.RcodeSuccess,
+		noAnswer: false,
+	}, {
+		name:     "servfail",
+		wantErr:  "got rcode SERVFAIL",
+		rcode:    dns.RcodeServerFailure,
+		noAnswer: false,
+	}, {
+		name:     "timeout",
+		wantErr:  "context deadline exceeded",
+		rcode:    dns.RcodeSuccess,
+		noAnswer: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				if tc.noAnswer {
+					return
+				}
+
+				resp := (&dns.Msg{}).SetRcode(req, tc.rcode)
+				_ = w.WriteMsg(resp)
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			u, err := AddressToUpstream(fmt.Sprintf("127.0.0.1:%d", srv.port), &Options{
+				// Make sure the probe doesn't wait for the exchange timeout.
+				Timeout:      time.Second,
+				ProbeTimeout: 100 * time.Millisecond,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			pu, ok := u.(ProbableUpstream)
+			require.True(t, ok)
+
+			err = pu.Probe(context.Background())
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestCachingUpstream_Probe(t *testing.T) {
+	fake, exchanges := newCountingUpstream(func(req *dns.Msg) (resp *dns.Msg) {
+		return (&dns.Msg{}).SetReply(req)
+	})
+
+	u := NewCachingUpstream(fake, CacheOptions{})
+
+	pu, ok := u.(ProbableUpstream)
+	require.True(t, ok)
+
+	for range 2 {
+		require.NoError(t, pu.Probe(context.Background()))
+	}
+
+	assert.Equal(t, int32(2), exchanges.Load())
+}
@@ -0,0 +1,147 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/maps"
+)
+
+// qtypeRouterUpstream is an [Upstream] choosing the upstream to exchange with
+// by the type of the question.
+type qtypeRouterUpstream struct {
+	// routes maps the question types to the upstreams.  A nil upstream means
+	// the queries of the type are answered with an empty NOERROR response.
+	routes map[uint16]Upstream
+
+	// def is the upstream for the question types not in routes.
+	def Upstream
+}
+
+// NewQTypeRouterUpstream returns an [Upstream] exchanging with the upstream
+// from routes for the question type of the query, or with def if there is no
+// route for it or the query has no question.  A nil upstream in routes makes
+// the queries of the type answered with an empty NOERROR response without
+// exchanging them, e.g. to disable the IPv6 resolution.  An upstream may be
+// used in several routes.  def must not be nil.
+func NewQTypeRouterUpstream(routes map[uint16]Upstream, def Upstream) (u Upstream) {
+	return &qtypeRouterUpstream{
+		routes: maps.Clone(routes),
+		def:    def,
+	}
+}
+
+// type check
+var _ Upstream = (*qtypeRouterUpstream)(nil)
+
+// Address implements the [Upstream] interface for *qtypeRouterUpstream.  It
+// lists the routes in the order of the question types followed by the default
+// upstream, e.g. "qtype(AAAA: none, HTTPS: tls://dns.example, default:
+// 1.1.1.1:53)".
+func (u *qtypeRouterUpstream) Address() (addr string) {
+	qtypes := maps.Keys(u.routes)
+	slices.Sort(qtypes)
+
+	routes := make([]string, 0, len(qtypes)+1)
+	for _, qt := range qtypes {
+		dst := "none"
+		if ups := u.routes[qt]; ups != nil {
+			dst = ups.Address()
+		}
+
+		routes = append(routes, fmt.Sprintf("%s: %s", dns.Type(qt), dst))
+	}
+
+	routes = append(routes, "default: "+u.def.Address())
+
+	return fmt.Sprintf("qtype(%s)", strings.Join(routes, ", "))
+}
+
+// Exchange implements the [Upstream] interface for *qtypeRouterUpstream.
+func (u *qtypeRouterUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for
+// *qtypeRouterUpstream.
+func (u *qtypeRouterUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if len(req.Question) == 0 {
+		return u.def.ExchangeContext(ctx, req)
+	}
+
+	qt := req.Question[0].Qtype
+	ups, ok := u.routes[qt]
+	if !ok {
+		return u.def.ExchangeContext(ctx, req)
+	} else if ups == nil {
+		log.Debug("dnsproxy: qtype router: suppressing %s query", dns.Type(qt))
+
+		resp = (&dns.Msg{}).SetReply(req)
+		resp.RecursionAvailable = true
+
+		return resp, nil
+	}
+
+	return ups.ExchangeContext(ctx, req)
+}
+
+// members returns the distinct upstreams of u, the default one first.
+func (u *qtypeRouterUpstream) members() (ups []Upstream) {
+	ups = []Upstream{u.def}
+	for _, r := range u.routes {
+		if r != nil && !slices.Contains(ups, r) {
+			ups = append(ups, r)
+		}
+	}
+
+	return ups
+}
+
+// Close implements the [Upstream] interface for *qtypeRouterUpstream.  It
+// closes each of the upstreams once.
+func (u *qtypeRouterUpstream) Close() (err error) {
+	var errs []error
+	for _, ups := range u.members() {
+		closeErr := ups.Close()
+		if closeErr != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", ups.Address(), closeErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ ProbableUpstream = (*qtypeRouterUpstream)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *qtypeRouterUpstream.
+// It succeeds if all of the upstreams respond properly, since each of them
+// serves its own queries.
+func (u *qtypeRouterUpstream) Probe(ctx context.Context) (err error) {
+	var errs []error
+	for _, ups := range u.members() {
+		errs = append(errs, probeWrapped(ctx, ups))
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ BootstrapSetter = (*qtypeRouterUpstream)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for
+// *qtypeRouterUpstream.  It sets the resolvers for each upstream implementing
+// [BootstrapSetter].
+func (u *qtypeRouterUpstream) SetBootstrap(resolvers []Resolver) {
+	for _, ups := range u.members() {
+		setBootstrap(ups, resolvers)
+	}
+}
@@ -0,0 +1,86 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQTypeRouterUpstream(t *testing.T) {
+	def, defN, defCloses := newChainMember("def", dns.RcodeSuccess, nil)
+	v6, v6N, v6Closes := newChainMember("v6", dns.RcodeSuccess, nil)
+
+	u := NewQTypeRouterUpstream(map[uint16]Upstream{
+		dns.TypeAAAA:  nil,
+		dns.TypeHTTPS: v6,
+		dns.TypeSVCB:  v6,
+	}, def)
+	assert.Equal(t, "qtype(AAAA: none, SVCB: v6, HTTPS: v6, default: def)", u.Address())
+
+	testCases := []struct {
+		name    string
+		wantDef int
+		wantV6  int
+		qtype   uint16
+		noQuest bool
+	}{{
+		name:    "default",
+		wantDef: 1,
+		wantV6:  0,
+		qtype:   dns.TypeA,
+		noQuest: false,
+	}, {
+		name:    "routed",
+		wantDef: 0,
+		wantV6:  1,
+		qtype:   dns.TypeHTTPS,
+		noQuest: false,
+	}, {
+		name:    "suppressed",
+		wantDef: 0,
+		wantV6:  0,
+		qtype:   dns.TypeAAAA,
+		noQuest: false,
+	}, {
+		name:    "no_question",
+		wantDef: 1,
+		wantV6:  0,
+		qtype:   dns.TypeAAAA,
+		noQuest: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			*defN, *v6N = 0, 0
+
+			req := (&dns.Msg{}).SetQuestion("example.org.", tc.qtype)
+			if tc.noQuest {
+				req.Question = nil
+			}
+
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+			assert.Equal(t, req.Id, resp.Id)
+			assert.Equal(t, tc.wantDef, *defN)
+			assert.Equal(t, tc.wantV6, *v6N)
+		})
+	}
+
+	t.Run("suppressed_empty", func(t *testing.T) {
+		resp, err := u.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeAAAA))
+		require.NoError(t, err)
+
+		assert.True(t, resp.Response)
+		assert.Empty(t, resp.Answer)
+		assert.Empty(t, resp.Ns)
+	})
+
+	require.NoError(t, u.Close())
+	assert.Equal(t, 1, *defCloses)
+	assert.Equal(t, 1, *v6Closes)
+}
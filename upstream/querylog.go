@@ -0,0 +1,164 @@
+package upstream
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLogger receives the structured entries of the exchanges with the
+// upstreams, e.g. for audit logging.  Its methods are called concurrently,
+// without holding any locks of the upstreams, so they must be safe for
+// concurrent use and shouldn't block.
+type QueryLogger interface {
+	// Log is called after each exchange with the upstream.  entry must not be
+	// retained after it returns.
+	Log(entry *QueryLogEntry)
+}
+
+// QueryLogEntry is the entry of the query log, see [QueryLogger].  It
+// deliberately contains no data identifying the client, except for
+// ClientSubnet, see [Options.LogClientSubnet].
+type QueryLogEntry struct {
+	// Err is the error of the exchange, if any.
+	Err error
+
+	// Upstream is the address of the upstream as returned by
+	// [Upstream.Address], or [Options.Name] or the name passed to [WithName],
+	// if set.
+	Upstream string
+
+	// ClientSubnet is the subnet from the EDNS Client Subnet option of the
+	// query.  It's only set if [Options.LogClientSubnet] is true and the query
+	// carries the option.
+	ClientSubnet netip.Prefix
+
+	// Question is the question of the query.
+	Question dns.Question
+
+	// RTT is the duration of the exchange.
+	RTT time.Duration
+
+	// Rcode is the response code, or -1 if there is no response.
+	Rcode int
+
+	// AnswerCount is the number of records within the answer section of the
+	// response.
+	AnswerCount int
+}
+
+// queryLogUpstream is an [Upstream] logging the exchanges with the wrapped
+// upstream to a [QueryLogger].
+type queryLogUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// logger receives the entries.
+	logger QueryLogger
+
+	// label is the name of ups put into the entries, see [labeledUpstream].
+	label string
+
+	// logSubnet tells to put the client subnet into the entries.
+	logSubnet bool
+}
+
+// newQueryLogUpstream returns u logging its exchanges to the logger from opts.
+// opts.QueryLogger must not be nil.
+func newQueryLogUpstream(u Upstream, opts *Options) (q *queryLogUpstream) {
+	return &queryLogUpstream{
+		wrapped:   wrapped{ups: u},
+		logger:    opts.QueryLogger,
+		label:     u.Address(),
+		logSubnet: opts.LogClientSubnet,
+	}
+}
+
+// type check
+var _ Upstream = (*queryLogUpstream)(nil)
+
+// Address implements the [Upstream] interface for *queryLogUpstream.
+func (u *queryLogUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *queryLogUpstream.
+func (u *queryLogUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *queryLogUpstream.
+func (u *queryLogUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	start := time.Now()
+	resp, err = u.ups.ExchangeContext(ctx, req)
+
+	entry := &QueryLogEntry{
+		Err:      err,
+		Upstream: u.label,
+		RTT:      time.Since(start),
+		Rcode:    -1,
+	}
+
+	if len(req.Question) > 0 {
+		entry.Question = req.Question[0]
+	}
+
+	if resp != nil {
+		entry.Rcode = resp.Rcode
+		entry.AnswerCount = len(resp.Answer)
+	}
+
+	if u.logSubnet {
+		entry.ClientSubnet = requestSubnet(req)
+	}
+
+	u.logger.Log(entry)
+
+	return resp, err
+}
+
+// requestSubnet returns the subnet from the EDNS Client Subnet option of req,
+// or an empty prefix if there is none.
+func requestSubnet(req *dns.Msg) (subnet netip.Prefix) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return netip.Prefix{}
+	}
+
+	for _, o := range opt.Option {
+		ecs, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+
+		addr, ok := netip.AddrFromSlice(ecs.Address)
+		if !ok {
+			return netip.Prefix{}
+		}
+
+		if ecs.Family == 1 {
+			addr = addr.Unmap()
+		}
+
+		subnet, err := addr.Prefix(int(ecs.SourceNetmask))
+		if err != nil {
+			return netip.Prefix{}
+		}
+
+		return subnet
+	}
+
+	return netip.Prefix{}
+}
+
+// Close implements the [Upstream] interface for *queryLogUpstream.
+func (u *queryLogUpstream) Close() (err error) { return u.ups.Close() }
+
+// type check
+var _ labeledUpstream = (*queryLogUpstream)(nil)
+
+// setLabel implements the [labeledUpstream] interface for *queryLogUpstream.
+func (u *queryLogUpstream) setLabel(label string) { u.label = label }
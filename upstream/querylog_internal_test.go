@@ -0,0 +1,88 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingQueryLogger is a [QueryLogger] remembering the entries.
+type recordingQueryLogger struct {
+	mu      *sync.Mutex
+	entries []QueryLogEntry
+}
+
+// type check
+var _ QueryLogger = (*recordingQueryLogger)(nil)
+
+// Log implements the [QueryLogger] interface for *recordingQueryLogger.
+func (l *recordingQueryLogger) Log(entry *QueryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, *entry)
+}
+
+func TestOptions_QueryLogger(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+	subnet := &net.IPNet{IP: net.IP{192, 0, 2, 0}, Mask: net.CIDRMask(24, 32)}
+
+	testCases := []struct {
+		name       string
+		wantSubnet netip.Prefix
+		logSubnet  bool
+	}{{
+		name:       "redacted",
+		wantSubnet: netip.Prefix{},
+		logSubnet:  false,
+	}, {
+		name:       "subnet",
+		wantSubnet: netip.MustParsePrefix("192.0.2.0/24"),
+		logSubnet:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &recordingQueryLogger{mu: &sync.Mutex{}}
+			u, err := AddressToUpstream(addr, &Options{
+				Timeout:          timeout,
+				QueryLogger:      l,
+				LogClientSubnet:  tc.logSubnet,
+				EDNSClientSubnet: subnet,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			require.Len(t, l.entries, 1)
+
+			e := l.entries[0]
+			assert.NoError(t, e.Err)
+			assert.Equal(t, addr, e.Upstream)
+			assert.Equal(t, req.Question[0], e.Question)
+			assert.Equal(t, dns.RcodeSuccess, e.Rcode)
+			assert.Equal(t, 1, e.AnswerCount)
+			assert.Positive(t, e.RTT)
+			assert.Equal(t, tc.wantSubnet, e.ClientSubnet)
+		})
+	}
+}
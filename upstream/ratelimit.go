@@ -0,0 +1,79 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned by the upstreams configured with
+// [Options.RateLimit] when the exchange can't be started within the timeout.
+const ErrRateLimited errors.Error = "rate limit exceeded"
+
+// rateLimitedUpstream is an [Upstream] limiting the rate of the outgoing
+// queries, see [Options.RateLimit].
+type rateLimitedUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// limiter limits the rate of the exchanges with ups.
+	limiter *rate.Limiter
+
+	// timeout is the maximum time to wait for the exchange to start.  Zero
+	// means waiting until the context is done.
+	timeout time.Duration
+}
+
+// newRateLimitedUpstream returns ups wrapped to limit the rate of the outgoing
+// queries according to opts.
+func newRateLimitedUpstream(ups Upstream, opts *Options) (u *rateLimitedUpstream) {
+	burst := opts.RateBurst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return &rateLimitedUpstream{
+		wrapped: wrapped{ups: ups},
+		limiter: rate.NewLimiter(rate.Limit(opts.RateLimit), burst),
+		timeout: opts.Timeout,
+	}
+}
+
+// type check
+var _ Upstream = (*rateLimitedUpstream)(nil)
+
+// Address implements the [Upstream] interface for *rateLimitedUpstream.
+func (u *rateLimitedUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *rateLimitedUpstream.
+func (u *rateLimitedUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *rateLimitedUpstream.
+// It waits for the limiter to allow the exchange first.
+func (u *rateLimitedUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	waitCtx := ctx
+	if u.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, u.timeout)
+		defer cancel()
+	}
+
+	err = u.limiter.Wait(waitCtx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %w", u.ups.Address(), ErrRateLimited, err)
+	}
+
+	return u.ups.ExchangeContext(ctx, req)
+}
+
+// Close implements the [Upstream] interface for *rateLimitedUpstream.
+func (u *rateLimitedUpstream) Close() (err error) { return u.ups.Close() }
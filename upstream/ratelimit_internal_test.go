@@ -0,0 +1,70 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitedUpstream(t *testing.T) {
+	const burst = 2
+
+	t.Run("timeout", func(t *testing.T) {
+		ups, exchanges, _ := newChainMember("limited", dns.RcodeSuccess, nil)
+		u := wrapUpstream(ups, &Options{
+			RateLimit: 0.1,
+			RateBurst: burst,
+			Timeout:   100 * time.Millisecond,
+		})
+
+		for range burst {
+			req := createTestMessage()
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+		}
+
+		_, err := u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, ErrRateLimited)
+		assert.Equal(t, burst, *exchanges)
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		ups, exchanges, _ := newChainMember("limited", dns.RcodeSuccess, nil)
+		u := wrapUpstream(ups, &Options{
+			RateLimit: 20,
+			Timeout:   timeout,
+		})
+
+		start := time.Now()
+		for range burst + 1 {
+			_, err := u.Exchange(createTestMessage())
+			require.NoError(t, err)
+		}
+
+		// The burst is 1 by default, so two of the exchanges wait for 50ms each.
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+		assert.Equal(t, burst+1, *exchanges)
+	})
+
+	t.Run("context", func(t *testing.T) {
+		ups, exchanges, _ := newChainMember("limited", dns.RcodeSuccess, nil)
+		u := wrapUpstream(ups, &Options{
+			RateLimit: 0.1,
+		})
+
+		_, err := u.Exchange(createTestMessage())
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		_, err = u.ExchangeContext(ctx, createTestMessage())
+		assert.ErrorIs(t, err, ErrRateLimited)
+		assert.Equal(t, 1, *exchanges)
+	})
+}
@@ -0,0 +1,206 @@
+package upstream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// DefaultResolvConfPath is the default path of the resolver configuration
+// file.
+const DefaultResolvConfPath = "/etc/resolv.conf"
+
+// The default values and the limits of the resolv.conf options, the same as in
+// glibc, see resolv.conf(5).
+const (
+	defaultResolvConfNdots    = 1
+	defaultResolvConfTimeout  = 5 * time.Second
+	defaultResolvConfAttempts = 2
+
+	maxResolvConfNdots    = 15
+	maxResolvConfTimeout  = 30 * time.Second
+	maxResolvConfAttempts = 5
+)
+
+// ResolvConf is the resolver configuration read from a resolv.conf file.
+type ResolvConf struct {
+	// Nameservers are the addresses of the name servers in the order of
+	// appearance.  The IPv6 ones may have zones.
+	Nameservers []netip.Addr
+
+	// Search is the search list for the host-name lookup.  It's set from
+	// either the last "search" or the last "domain" directive.
+	Search []string
+
+	// Ndots is the number of dots a name must have to be queried as is before
+	// trying the search list.
+	Ndots int
+
+	// Timeout is the time to wait for a response from a name server.
+	Timeout time.Duration
+
+	// Attempts is the number of times the queries are sent to the name
+	// servers.
+	Attempts int
+}
+
+// ReadResolvConf reads the resolver configuration from the file at path.  If
+// path is empty, [DefaultResolvConfPath] is used.  The invalid name server
+// addresses and the unknown directives and options are skipped, just like the
+// system resolver does.
+func ReadResolvConf(path string) (conf *ResolvConf, err error) {
+	if path == "" {
+		path = DefaultResolvConfPath
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading resolv.conf: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	conf, err = parseResolvConf(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return conf, nil
+}
+
+// parseResolvConf parses the resolver configuration from r.
+func parseResolvConf(r io.Reader) (conf *ResolvConf, err error) {
+	conf = &ResolvConf{
+		Ndots:    defaultResolvConfNdots,
+		Timeout:  defaultResolvConfTimeout,
+		Attempts: defaultResolvConfAttempts,
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") ||
+			strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch directive, args := fields[0], fields[1:]; directive {
+		case "nameserver":
+			conf.addNameserver(args)
+		case "domain":
+			if len(args) > 0 {
+				conf.Search = []string{args[0]}
+			}
+		case "search":
+			conf.Search = args
+		case "options":
+			for _, opt := range args {
+				conf.setOption(opt)
+			}
+		default:
+			log.Debug("dnsproxy: resolv.conf: skipping directive %q", directive)
+		}
+	}
+
+	return conf, s.Err()
+}
+
+// addNameserver adds the name server address from the arguments of the
+// nameserver directive.
+func (conf *ResolvConf) addNameserver(args []string) {
+	if len(args) == 0 {
+		return
+	}
+
+	ip, err := netip.ParseAddr(args[0])
+	if err != nil {
+		log.Debug("dnsproxy: resolv.conf: skipping nameserver: %s", err)
+
+		return
+	}
+
+	conf.Nameservers = append(conf.Nameservers, ip)
+}
+
+// setOption sets the value of the option opt in the "name:value" form.  The
+// values are clamped to the limits of the system resolver.
+func (conf *ResolvConf) setOption(opt string) {
+	name, val, ok := strings.Cut(opt, ":")
+	if !ok {
+		return
+	}
+
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		log.Debug("dnsproxy: resolv.conf: bad value of option %q", opt)
+
+		return
+	}
+
+	switch name {
+	case "ndots":
+		conf.Ndots = min(n, maxResolvConfNdots)
+	case "timeout":
+		conf.Timeout = min(time.Duration(n)*time.Second, maxResolvConfTimeout)
+	case "attempts":
+		conf.Attempts = min(max(n, 1), maxResolvConfAttempts)
+	default:
+		// Go on.
+	}
+}
+
+// UpstreamsFromResolvConf returns the plain DNS-over-UDP upstreams for the name
+// servers from the resolver configuration file at path, see [ReadResolvConf].
+// The timeout from the file is used if opts has none.  Use [ReadResolvConf] to
+// get the search list and other options.
+func UpstreamsFromResolvConf(path string, opts *Options) (ups []Upstream, err error) {
+	conf, err := ReadResolvConf(path)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	if len(conf.Nameservers) == 0 {
+		return nil, fmt.Errorf("resolv.conf: %w", ErrNoUpstreams)
+	}
+
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if opts.Timeout == 0 {
+		opts = opts.Clone()
+		opts.Timeout = conf.Timeout
+	}
+
+	for _, ns := range conf.Nameservers {
+		var u Upstream
+		u, err = AddressToUpstream(netip.AddrPortFrom(ns, defaultPortPlain).String(), opts)
+		if err != nil {
+			err = fmt.Errorf("creating upstream for nameserver %s: %w", ns, err)
+
+			return nil, errors.WithDeferred(err, closeAll(ups))
+		}
+
+		ups = append(ups, u)
+	}
+
+	return ups, nil
+}
+
+// closeAll closes all of ups and returns the joined errors.
+func closeAll(ups []Upstream) (err error) {
+	var errs []error
+	for _, u := range ups {
+		errs = append(errs, u.Close())
+	}
+
+	return errors.Join(errs...)
+}
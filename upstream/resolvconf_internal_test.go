@@ -0,0 +1,129 @@
+package upstream
+
+import (
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeResolvConf writes data to a temporary resolv.conf file and returns its
+// path.
+func writeResolvConf(t *testing.T, data string) (path string) {
+	t.Helper()
+
+	path = filepath.Join(t.TempDir(), "resolv.conf")
+	err := os.WriteFile(path, []byte(data), 0o600)
+	require.NoError(t, err)
+
+	return path
+}
+
+func TestReadResolvConf(t *testing.T) {
+	testCases := []struct {
+		want *ResolvConf
+		name string
+		data string
+	}{{
+		want: &ResolvConf{
+			Nameservers: []netip.Addr{
+				netip.MustParseAddr("1.2.3.4"),
+				netip.MustParseAddr("2001:db8::1"),
+				netip.MustParseAddr("fe80::1%eth0"),
+			},
+			Search:   []string{"example.org", "example.net"},
+			Ndots:    2,
+			Timeout:  3 * time.Second,
+			Attempts: 4,
+		},
+		name: "full",
+		data: "# comment\n" +
+			"; another comment\n" +
+			"nameserver 1.2.3.4\n" +
+			"nameserver 2001:db8::1\n" +
+			"nameserver fe80::1%eth0\n" +
+			"nameserver bad.address\n" +
+			"domain example.com\n" +
+			"search example.org example.net\n" +
+			"sortlist 130.155.160.0/255.255.240.0\n" +
+			"options ndots:2 timeout:3 attempts:4 rotate edns0\n",
+	}, {
+		want: &ResolvConf{
+			Ndots:    defaultResolvConfNdots,
+			Timeout:  defaultResolvConfTimeout,
+			Attempts: defaultResolvConfAttempts,
+		},
+		name: "empty",
+		data: "",
+	}, {
+		want: &ResolvConf{
+			Search:   []string{"example.com"},
+			Ndots:    maxResolvConfNdots,
+			Timeout:  maxResolvConfTimeout,
+			Attempts: maxResolvConfAttempts,
+		},
+		name: "clamped",
+		data: "search example.org\ndomain example.com\n" +
+			"options ndots:100 timeout:100 attempts:100 timeout:bad\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf, err := ReadResolvConf(writeResolvConf(t, tc.data))
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, conf)
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := ReadResolvConf(filepath.Join(t.TempDir(), "missing"))
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+func TestUpstreamsFromResolvConf(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		path := writeResolvConf(t, "nameserver 1.2.3.4\nnameserver ::1\noptions timeout:2\n")
+
+		ups, err := UpstreamsFromResolvConf(path, nil)
+		require.NoError(t, err)
+		require.Len(t, ups, 2)
+
+		for _, u := range ups {
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			p := testutil.RequireTypeAssert[*plainDNS](t, u)
+			assert.Equal(t, networkUDP, p.net)
+			assert.Equal(t, 2*time.Second, p.timeout)
+		}
+
+		assert.Equal(t, "1.2.3.4:53", ups[0].Address())
+		assert.Equal(t, "[::1]:53", ups[1].Address())
+	})
+
+	t.Run("options_timeout", func(t *testing.T) {
+		path := writeResolvConf(t, "nameserver 1.2.3.4\noptions timeout:2\n")
+
+		ups, err := UpstreamsFromResolvConf(path, &Options{Timeout: time.Second})
+		require.NoError(t, err)
+		require.Len(t, ups, 1)
+		testutil.CleanupAndRequireSuccess(t, ups[0].Close)
+
+		p := testutil.RequireTypeAssert[*plainDNS](t, ups[0])
+		assert.Equal(t, time.Second, p.timeout)
+	})
+
+	t.Run("no_nameservers", func(t *testing.T) {
+		path := writeResolvConf(t, "search example.org\n")
+
+		_, err := UpstreamsFromResolvConf(path, nil)
+		assert.ErrorIs(t, err, ErrNoUpstreams)
+	})
+}
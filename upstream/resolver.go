@@ -21,6 +21,10 @@ import (
 // from standard library also implements this interface.
 type Resolver = bootstrap.Resolver
 
+// TTLResolver is a [Resolver] also reporting for how long the resolved
+// addresses may be used, see [Options.BootstrapMaxTTL].
+type TTLResolver = bootstrap.TTLResolver
+
 // StaticResolver is a resolver which always responds with an underlying slice
 // of IP addresses.
 type StaticResolver = bootstrap.StaticResolver
@@ -42,19 +46,38 @@ type UpstreamResolver struct {
 	Upstream
 }
 
+// ErrBootstrapHostname is wrapped by [NotBootstrapError] when the address of
+// the bootstrap upstream contains a hostname, which would have to be resolved
+// itself.
+const ErrBootstrapHostname errors.Error = "bootstrap upstream must have an ip address " +
+	"to avoid recursive resolving"
+
 // NewUpstreamResolver creates an upstream that can be used as bootstrap
 // [Resolver].  resolverAddress format is the same as in the
-// [AddressToUpstream].  If the upstream can't be used as a bootstrap, the
-// returned error will have the underlying type of [NotBootstrapError], and r
-// itself will be fully usable.  Closing r.Upstream is caller's responsibility.
+// [AddressToUpstream], and any protocol may be used, including the encrypted
+// ones.  The address of the bootstrap upstream must contain an IP address, not
+// a hostname, since resolving the latter would need a bootstrap itself.  If the
+// upstream can't be used as a bootstrap, the returned error will have the
+// underlying type of [NotBootstrapError], and r itself will be fully usable,
+// resolving its own hostname with the system resolver.  Closing r.Upstream is
+// caller's responsibility.
 func NewUpstreamResolver(resolverAddress string, opts *Options) (r *UpstreamResolver, err error) {
 	upsOpts := &Options{}
 
-	// TODO(ameshkov):  Aren't other options needed here?
+	// Only the options affecting the connection itself are used, since the
+	// rest are intended for the upstreams being bootstrapped.
 	if opts != nil {
 		upsOpts.Timeout = opts.Timeout
+		if opts.BootstrapTimeout != 0 {
+			upsOpts.Timeout = opts.BootstrapTimeout
+		}
+
 		upsOpts.VerifyServerCertificate = opts.VerifyServerCertificate
 		upsOpts.PreferIPv6 = opts.PreferIPv6
+		upsOpts.RootCAs = opts.RootCAs
+		upsOpts.CipherSuites = opts.CipherSuites
+		upsOpts.InsecureSkipVerify = opts.InsecureSkipVerify
+		upsOpts.DSCP = opts.DSCP
 	}
 
 	ups, err := AddressToUpstream(resolverAddress, upsOpts)
@@ -96,6 +119,7 @@ func validateBootstrap(u Upstream) (err error) {
 	var upsURL *url.URL
 	switch u := u.(type) {
 	case *dnsCrypt:
+		// DNSCrypt stamps always contain the IP address of the server.
 		return nil
 	case *plainDNS:
 		upsURL = u.addr
@@ -110,16 +134,17 @@ func validateBootstrap(u Upstream) (err error) {
 	}
 
 	// Make sure the upstream doesn't need a bootstrap.
-	_, err = netip.ParseAddr(upsURL.Hostname())
+	host := upsURL.Hostname()
+	_, err = netip.ParseAddr(host)
 	if err != nil {
-		return NotBootstrapError{err: err}
+		return NotBootstrapError{err: fmt.Errorf("host %q: %w", host, ErrBootstrapHostname)}
 	}
 
 	return nil
 }
 
 // type check
-var _ Resolver = &UpstreamResolver{}
+var _ TTLResolver = &UpstreamResolver{}
 
 // LookupNetIP implements the [Resolver] interface for *UpstreamResolver.  It
 // doesn't consider the TTL of the DNS records.
@@ -144,6 +169,26 @@ func (r *UpstreamResolver) LookupNetIP(
 	return res.addrs, err
 }
 
+// LookupNetIPTTL implements the [TTLResolver] interface for *UpstreamResolver.
+func (r *UpstreamResolver) LookupNetIPTTL(
+	ctx context.Context,
+	network bootstrap.Network,
+	host string,
+) (ips []netip.Addr, ttl time.Duration, err error) {
+	if host == "" {
+		return nil, 0, nil
+	}
+
+	host = dns.Fqdn(strings.ToLower(host))
+
+	res, err := r.lookupNetIP(ctx, network, host)
+	if err != nil {
+		return []netip.Addr{}, 0, err
+	}
+
+	return res.addrs, res.ttl(time.Now()), nil
+}
+
 // ipResult reflects a single A/AAAA record from the DNS response.  It's used
 // to cache the results of lookups.
 type ipResult struct {
@@ -151,19 +196,27 @@ type ipResult struct {
 	addrs  []netip.Addr
 }
 
+// ttl returns the time left until res expires at now.  It's zero if there are
+// no addresses.
+func (res *ipResult) ttl(now time.Time) (ttl time.Duration) {
+	if len(res.addrs) == 0 {
+		return 0
+	}
+
+	return max(res.expire.Sub(now), 0)
+}
+
 // lookupNetIP performs a DNS lookup of host and returns the result.  network
 // must be either [bootstrap.NetworkIP4], [bootstrap.NetworkIP6], or
 // [bootstrap.NetworkIP].  host must be in a lower-case FQDN form.
-//
-// TODO(e.burkov):  Use context.
 func (r *UpstreamResolver) lookupNetIP(
-	_ context.Context,
+	ctx context.Context,
 	network bootstrap.Network,
 	host string,
 ) (result *ipResult, err error) {
 	switch network {
 	case bootstrap.NetworkIP4, bootstrap.NetworkIP6:
-		return r.request(host, network)
+		return r.request(ctx, host, network)
 	case bootstrap.NetworkIP:
 		// Go on.
 	default:
@@ -171,8 +224,8 @@ func (r *UpstreamResolver) lookupNetIP(
 	}
 
 	resCh := make(chan any, 2)
-	go r.resolveAsync(resCh, host, bootstrap.NetworkIP4)
-	go r.resolveAsync(resCh, host, bootstrap.NetworkIP6)
+	go r.resolveAsync(ctx, resCh, host, bootstrap.NetworkIP4)
+	go r.resolveAsync(ctx, resCh, host, bootstrap.NetworkIP6)
 
 	var errs []error
 	result = &ipResult{}
@@ -193,13 +246,18 @@ func (r *UpstreamResolver) lookupNetIP(
 }
 
 // request performs a single DNS lookup of host and returns all the valid
-// addresses from the answer section of the response.  network must be either
-// [bootstrap.NetworkIP4], or [bootstrap.NetworkIP6].  host must be in a
-// lower-case FQDN form.
+// addresses from the answer section of the response.  The SERVFAIL and REFUSED
+// responses are reported as errors, so that the next bootstrap resolver is
+// used.  network must be either [bootstrap.NetworkIP4], or
+// [bootstrap.NetworkIP6].  host must be in a lower-case FQDN form.
 //
 // TODO(e.burkov):  Consider NS and Extra sections when setting TTL.  Check out
 // what RFCs say about it.
-func (r *UpstreamResolver) request(host string, n bootstrap.Network) (res *ipResult, err error) {
+func (r *UpstreamResolver) request(
+	ctx context.Context,
+	host string,
+	n bootstrap.Network,
+) (res *ipResult, err error) {
 	var qtype uint16
 	switch n {
 	case bootstrap.NetworkIP4:
@@ -224,9 +282,11 @@ func (r *UpstreamResolver) request(host string, n bootstrap.Network) (res *ipRes
 
 	// As per [Upstream.Exchange] documentation, the response is always returned
 	// if no error occurred.
-	resp, err := r.Exchange(req)
+	resp, err := r.ExchangeContext(ctx, req)
 	if err != nil {
 		return res, err
+	} else if IsFailure(resp, nil) {
+		return res, fmt.Errorf("%s: response code %s", host, dns.RcodeToString[resp.Rcode])
 	}
 
 	res = &ipResult{
@@ -251,8 +311,13 @@ func (r *UpstreamResolver) request(host string, n bootstrap.Network) (res *ipRes
 
 // resolveAsync performs a single DNS lookup and sends the result to ch.  It's
 // intended to be used as a goroutine.
-func (r *UpstreamResolver) resolveAsync(resCh chan<- any, host, network string) {
-	res, err := r.request(host, network)
+func (r *UpstreamResolver) resolveAsync(
+	ctx context.Context,
+	resCh chan<- any,
+	host string,
+	network string,
+) {
+	res, err := r.request(ctx, host, network)
 	if err != nil {
 		resCh <- err
 	} else {
@@ -285,28 +350,40 @@ func NewCachingResolver(r *UpstreamResolver) (cr *CachingResolver) {
 }
 
 // type check
-var _ Resolver = (*CachingResolver)(nil)
+var _ TTLResolver = (*CachingResolver)(nil)
 
 // LookupNetIP implements the [Resolver] interface for *CachingResolver.
+func (r *CachingResolver) LookupNetIP(
+	ctx context.Context,
+	network bootstrap.Network,
+	host string,
+) (addrs []netip.Addr, err error) {
+	addrs, _, err = r.LookupNetIPTTL(ctx, network, host)
+
+	return addrs, err
+}
+
+// LookupNetIPTTL implements the [TTLResolver] interface for *CachingResolver.
+// The TTL of the cached addresses is the time left until they expire.
 //
 // TODO(e.burkov):  It may appear that several concurrent lookup results rewrite
 // each other in the cache.
-func (r *CachingResolver) LookupNetIP(
+func (r *CachingResolver) LookupNetIPTTL(
 	ctx context.Context,
 	network bootstrap.Network,
 	host string,
-) (addrs []netip.Addr, err error) {
+) (addrs []netip.Addr, ttl time.Duration, err error) {
 	now := time.Now()
 	host = dns.Fqdn(strings.ToLower(host))
 
-	addrs = r.findCached(host, now)
-	if addrs != nil {
-		return addrs, nil
+	res := r.findCached(host, now)
+	if res != nil {
+		return res.addrs, res.ttl(now), nil
 	}
 
 	newRes, err := r.resolver.lookupNetIP(ctx, network, host)
 	if err != nil {
-		return []netip.Addr{}, err
+		return []netip.Addr{}, 0, err
 	}
 
 	r.mu.Lock()
@@ -314,12 +391,12 @@ func (r *CachingResolver) LookupNetIP(
 
 	r.cached[host] = newRes
 
-	return newRes.addrs, nil
+	return newRes.addrs, newRes.ttl(now), nil
 }
 
-// findCached returns the cached addresses for host if it's not expired yet, and
-// the corresponding cached result, if any.
-func (r *CachingResolver) findCached(host string, now time.Time) (addrs []netip.Addr) {
+// findCached returns the cached result for host if it's not expired yet, or nil
+// otherwise.
+func (r *CachingResolver) findCached(host string, now time.Time) (res *ipResult) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -328,5 +405,5 @@ func (r *CachingResolver) findCached(host string, now time.Time) (addrs []netip.
 		return nil
 	}
 
-	return res.addrs
+	return res
 }
@@ -2,6 +2,10 @@ package upstream
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/netip"
 	"testing"
 	"time"
@@ -93,9 +97,143 @@ func TestCachingResolver_staleness(t *testing.T) {
 	t.Run("staleness", func(t *testing.T) {
 		now := time.Now()
 		cached := r.findCached(fqdn, now)
-		require.ElementsMatch(t, []netip.Addr{ip4, ip6}, cached)
+		require.NotNil(t, cached)
+		require.ElementsMatch(t, []netip.Addr{ip4, ip6}, cached.addrs)
 
 		cached = r.findCached(fqdn, now.Add(smallTTL+time.Second))
-		require.Empty(t, cached)
+		require.Nil(t, cached)
 	})
 }
+
+func TestNewUpstreamResolver_encrypted(t *testing.T) {
+	const host = "dot.example"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		buf, err := io.ReadAll(r.Body)
+		require.NoError(testutil.PanicT{}, err)
+
+		req := &dns.Msg{}
+		require.NoError(testutil.PanicT{}, req.Unpack(buf))
+
+		resp := (&dns.Msg{}).SetReply(req)
+		if q := req.Question[0]; q.Qtype == dns.TypeA {
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{127, 0, 0, 1},
+			}}
+		}
+
+		buf, err = resp.Pack()
+		require.NoError(testutil.PanicT{}, err)
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(buf)
+	})
+
+	dohSrv := startDoHServer(t, testDoHServerOptions{handler: mux})
+	r, err := NewUpstreamResolver(fmt.Sprintf("https://%s/dns-query", dohSrv.addr), &Options{
+		Timeout:            timeout,
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, r.Close)
+
+	dotSrv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	u, err := AddressToUpstream(fmt.Sprintf("tls://%s:%d", host, dotSrv.port), &Options{
+		Bootstrap:  r,
+		Timeout:    timeout,
+		RootCAs:    dotSrv.rootCAs,
+		ServerName: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+}
+
+func TestNewUpstreamResolver_customPort(t *testing.T) {
+	const host = "custom-port.example."
+
+	handler := func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := (&dns.Msg{}).SetReply(req)
+		if q := req.Question[0]; q.Qtype == dns.TypeA && q.Name == host {
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{127, 0, 0, 1},
+			}}
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	}
+
+	srv := startDNSServer(t, handler)
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	dotSrv := startDoTServer(t, handler)
+
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+	doqSrv := startDoQServer(t, tlsConf, 0)
+
+	localhost := netip.MustParseAddr("127.0.0.1")
+
+	testCases := []struct {
+		want netip.Addr
+		name string
+		addr string
+	}{{
+		want: localhost,
+		name: "udp",
+		addr: fmt.Sprintf("127.0.0.1:%d", srv.port),
+	}, {
+		want: localhost,
+		name: "udp_scheme",
+		addr: fmt.Sprintf("udp://127.0.0.1:%d", srv.port),
+	}, {
+		want: localhost,
+		name: "tcp",
+		addr: fmt.Sprintf("tcp://127.0.0.1:%d", srv.port),
+	}, {
+		want: localhost,
+		name: "tls",
+		addr: fmt.Sprintf("tls://127.0.0.1:%d", dotSrv.port),
+	}, {
+		// The test DNS-over-QUIC server always responds with the same address.
+		want: netip.MustParseAddr("8.8.8.8"),
+		name: "quic",
+		addr: fmt.Sprintf("quic://%s", doqSrv.addr),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewUpstreamResolver(tc.addr, &Options{
+				Timeout:            timeout,
+				InsecureSkipVerify: true,
+				RootCAs:            rootCAs,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, r.Close)
+
+			ips, err := r.LookupNetIP(context.Background(), "ip4", host)
+			require.NoError(t, err)
+
+			assert.Equal(t, []netip.Addr{tc.want}, ips)
+		})
+	}
+}
@@ -42,6 +42,23 @@ func TestNewUpstreamResolver(t *testing.T) {
 	assert.NotEmpty(t, ipAddrs)
 }
 
+func TestUpstreamResolver_serverFailure(t *testing.T) {
+	ups := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (_ string) { panic("not implemented") },
+		OnClose:   func() (_ error) { panic("not implemented") },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure), nil
+		},
+	}
+
+	r := &upstream.UpstreamResolver{Upstream: ups}
+
+	ipAddrs, err := r.LookupNetIP(context.Background(), "ip", "example.com")
+	require.Error(t, err)
+
+	assert.Empty(t, ipAddrs)
+}
+
 func TestNewUpstreamResolver_validity(t *testing.T) {
 	withTimeoutOpt := &upstream.Options{Timeout: 3 * time.Second}
 
@@ -65,30 +82,39 @@ func TestNewUpstreamResolver_validity(t *testing.T) {
 		name:       "sdns",
 		addr:       "sdns://AQMAAAAAAAAAETk0LjE0MC4xNC4xNDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20",
 		wantErrMsg: "",
+	}, {
+		name:       "doq",
+		addr:       "quic://94.140.14.140",
+		wantErrMsg: "",
 	}, {
 		name:       "tcp",
 		addr:       "tcp://9.9.9.9",
 		wantErrMsg: "",
+	}, {
+		name: "invalid_quic",
+		addr: "quic://dns.adguard.com",
+		wantErrMsg: `not a bootstrap: host "dns.adguard.com": ` +
+			`bootstrap upstream must have an ip address to avoid recursive resolving`,
 	}, {
 		name: "invalid_tls",
 		addr: "tls://dns.adguard.com",
-		wantErrMsg: `not a bootstrap: ParseAddr("dns.adguard.com"): ` +
-			`unexpected character (at "dns.adguard.com")`,
+		wantErrMsg: `not a bootstrap: host "dns.adguard.com": ` +
+			`bootstrap upstream must have an ip address to avoid recursive resolving`,
 	}, {
 		name: "invalid_https",
 		addr: "https://dns.adguard.com/dns-query",
-		wantErrMsg: `not a bootstrap: ParseAddr("dns.adguard.com"): ` +
-			`unexpected character (at "dns.adguard.com")`,
+		wantErrMsg: `not a bootstrap: host "dns.adguard.com": ` +
+			`bootstrap upstream must have an ip address to avoid recursive resolving`,
 	}, {
 		name: "invalid_tcp",
 		addr: "tcp://dns.adguard.com",
-		wantErrMsg: `not a bootstrap: ParseAddr("dns.adguard.com"): ` +
-			`unexpected character (at "dns.adguard.com")`,
+		wantErrMsg: `not a bootstrap: host "dns.adguard.com": ` +
+			`bootstrap upstream must have an ip address to avoid recursive resolving`,
 	}, {
 		name: "invalid_no_scheme",
 		addr: "dns.adguard.com",
-		wantErrMsg: `not a bootstrap: ParseAddr("dns.adguard.com"): ` +
-			`unexpected character (at "dns.adguard.com")`,
+		wantErrMsg: `not a bootstrap: host "dns.adguard.com": ` +
+			`bootstrap upstream must have an ip address to avoid recursive resolving`,
 	}}
 
 	for _, tc := range testCases {
@@ -96,6 +122,7 @@ func TestNewUpstreamResolver_validity(t *testing.T) {
 			r, err := upstream.NewUpstreamResolver(tc.addr, withTimeoutOpt)
 			if tc.wantErrMsg != "" {
 				assert.Equal(t, tc.wantErrMsg, err.Error())
+				assert.ErrorIs(t, err, upstream.ErrBootstrapHostname)
 				if nberr := (&upstream.NotBootstrapError{}); errors.As(err, &nberr) {
 					assert.NotNil(t, r)
 				}
@@ -0,0 +1,78 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// sizeLimitedConn is a stream connection carrying the DNS messages prefixed
+// with their length, which fails the reads of the messages larger than the
+// limit before reading them, see [Options.MaxResponseSize].
+type sizeLimitedConn struct {
+	net.Conn
+
+	// prefix is the length prefix of the current message, which is read
+	// ahead to check it.
+	prefix [2]byte
+
+	// prefixLeft is the number of bytes of prefix not yet returned from Read.
+	prefixLeft int
+
+	// msgLeft is the number of bytes of the current message not yet read.
+	msgLeft int
+
+	// maxSize is the maximum size of a message.
+	maxSize int
+}
+
+// limitMsgSize returns conn wrapped to reject the messages larger than
+// maxSize.  conn is returned as is if maxSize doesn't limit the size of a DNS
+// message.
+func limitMsgSize(conn net.Conn, maxSize int) (c net.Conn) {
+	if maxSize >= dns.MaxMsgSize {
+		return conn
+	}
+
+	return &sizeLimitedConn{
+		Conn:    conn,
+		maxSize: maxSize,
+	}
+}
+
+// type check
+var _ io.Reader = (*sizeLimitedConn)(nil)
+
+// Read implements the [io.Reader] interface for *sizeLimitedConn.  It returns
+// an error wrapping [ErrResponseTooLarge] without returning any of the length
+// prefix if the message is too large.
+func (c *sizeLimitedConn) Read(b []byte) (n int, err error) {
+	if c.prefixLeft == 0 && c.msgLeft == 0 {
+		_, err = io.ReadFull(c.Conn, c.prefix[:])
+		if err != nil {
+			return 0, err
+		}
+
+		msgLen := int(binary.BigEndian.Uint16(c.prefix[:]))
+		if msgLen > c.maxSize {
+			return 0, fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, msgLen)
+		}
+
+		c.prefixLeft, c.msgLeft = len(c.prefix), msgLen
+	}
+
+	if c.prefixLeft > 0 {
+		n = copy(b, c.prefix[len(c.prefix)-c.prefixLeft:])
+		c.prefixLeft -= n
+
+		return n, nil
+	}
+
+	n, err = c.Conn.Read(b[:min(len(b), c.msgLeft)])
+	c.msgLeft -= n
+
+	return n, err
+}
@@ -0,0 +1,313 @@
+package upstream
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// RetryPolicy describes how the failed exchanges are retried.
+type RetryPolicy struct {
+	// Rand is the source of randomness for the backoff jitter.  It must be safe
+	// for concurrent use if the policy is shared between goroutines.  If nil,
+	// a shared [rand.ChaCha8] source securely seeded from crypto/rand is used.
+	// Use a deterministically seeded source, e.g. [rand.PCG], to make the
+	// delays reproducible, e.g. in tests.
+	Rand rand.Source
+
+	// Backoff is the delay before the first retry.  It's doubled for each
+	// subsequent retry.  Zero value means retrying immediately.
+	Backoff time.Duration
+
+	// MaxBackoff is the upper limit for the delay between retries.  Zero value
+	// means no limit.
+	MaxBackoff time.Duration
+
+	// Jitter is the maximum random fraction of the delay that is added to it,
+	// it should be within [0, 1].  For example, 0.5 makes each delay random
+	// within [d, 1.5*d].  Zero value disables the jitter.
+	Jitter float64
+
+	// Retries is the maximum number of retries after the first attempt.
+	Retries int
+}
+
+// lockedSource is a [rand.Source] safe for concurrent use.
+type lockedSource struct {
+	// mu protects src.
+	mu *sync.Mutex
+
+	// src is the actual source of randomness.
+	src rand.Source
+}
+
+// type check
+var _ rand.Source = lockedSource{}
+
+// Uint64 implements the [rand.Source] interface for lockedSource.
+func (s lockedSource) Uint64() (n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Uint64()
+}
+
+// secureRandSource returns the concurrency-safe random source seeded with
+// a cryptographically secure random value.  It's shared by all the retry
+// policies without a custom source.
+var secureRandSource = sync.OnceValue(func() (src rand.Source) {
+	var seed [32]byte
+	_, err := cryptorand.Read(seed[:])
+	if err != nil {
+		// Must not happen in normal circumstances.
+		panic(fmt.Errorf("dnsproxy: seeding random source: %w", err))
+	}
+
+	return lockedSource{
+		mu:  &sync.Mutex{},
+		src: rand.NewChaCha8(seed),
+	}
+})
+
+// delay returns the delay before the retry number n, starting from 1.  src is
+// used to randomize the delay.
+func (p *RetryPolicy) delay(n int, src rand.Source) (d time.Duration) {
+	d = p.Backoff
+	for i := 1; i < n && d > 0; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+
+		d *= 2
+	}
+
+	if p.MaxBackoff > 0 {
+		d = min(d, p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 && d > 0 {
+		// Use the 53 most significant bits to get a uniformly distributed
+		// float64 in [0, 1) without allocating a [rand.Rand].
+		f := float64(src.Uint64()>>11) / (1 << 53)
+		d += time.Duration(f * p.Jitter * float64(d))
+	}
+
+	return d
+}
+
+// ExchangeWithRetry exchanges req with u and retries it according to p if the
+// exchange fails.  It returns the last response and error.  p may be nil, in
+// which case no retries are made.
+func ExchangeWithRetry(u Upstream, req *dns.Msg, p *RetryPolicy) (resp *dns.Msg, err error) {
+	isErr := func(_ *dns.Msg, err error) (ok bool) { return err != nil }
+	resp, _, err = exchangeWithRetry(context.Background(), u, req, p, isErr, nil)
+
+	return resp, err
+}
+
+// exchangeWithRetry exchanges req with u and retries it according to p while
+// shouldRetry returns true for the result.  beforeRetry, if not nil, is called
+// with the result of the failed attempt right before the next one.  It returns
+// the last result and the number of attempts made.  p may be nil, in which
+// case no retries are made.  It stops retrying as soon as ctx is done.
+func exchangeWithRetry(
+	ctx context.Context,
+	u Upstream,
+	req *dns.Msg,
+	p *RetryPolicy,
+	shouldRetry func(resp *dns.Msg, err error) (ok bool),
+	beforeRetry func(resp *dns.Msg, err error),
+) (resp *dns.Msg, attempts int, err error) {
+	resp, err = u.ExchangeContext(ctx, req)
+	attempts = 1
+	if p == nil || p.Retries <= 0 || !shouldRetry(resp, err) {
+		return resp, attempts, err
+	}
+
+	src := p.Rand
+	if src == nil {
+		src = secureRandSource()
+	}
+
+	for n := 1; n <= p.Retries && ctx.Err() == nil && shouldRetry(resp, err); n++ {
+		d := p.delay(n, src)
+		log.Debug(
+			"dnsproxy: retrying exchange with %s in %s (%d/%d): %s",
+			u.Address(),
+			d,
+			n,
+			p.Retries,
+			retryReason(resp, err),
+		)
+
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return resp, attempts, fmt.Errorf("waiting to retry: %w", ctx.Err())
+		case <-timer.C:
+			// Go on.
+		}
+
+		if beforeRetry != nil {
+			beforeRetry(resp, err)
+		}
+
+		resp, err = u.ExchangeContext(ctx, req)
+		attempts++
+	}
+
+	return resp, attempts, err
+}
+
+// retryReason returns the human-readable reason of retrying the exchange
+// resulted in resp and err.
+func retryReason(resp *dns.Msg, err error) (reason any) {
+	if err != nil {
+		return err
+	} else if resp != nil {
+		return dns.RcodeToString[resp.Rcode]
+	}
+
+	return ErrNoReply
+}
+
+// RetryError is returned from the upstreams configured with [Options.Retries]
+// when the exchange failed.
+type RetryError struct {
+	// Err is the error of the last attempt.
+	Err error
+
+	// Attempts is the number of attempts made, including the first one.
+	Attempts int
+}
+
+// type check
+var _ errors.Wrapper = (*RetryError)(nil)
+
+// Error implements the error interface for *RetryError.
+func (e *RetryError) Error() (msg string) {
+	return fmt.Sprintf("after %d attempts: %s", e.Attempts, e.Err)
+}
+
+// Unwrap implements the [errors.Wrapper] interface for *RetryError.
+func (e *RetryError) Unwrap() (unwrapped error) { return e.Err }
+
+// retryUpstream is an [Upstream] retrying the exchanges failed with transient
+// errors.
+type retryUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// policy defines the retries.
+	policy *RetryPolicy
+
+	// retryServFail is true if the SERVFAIL responses should also be retried.
+	retryServFail bool
+}
+
+// newRetryUpstream returns ups wrapped to retry the exchanges according to
+// opts.  opts.Retries must be positive.
+func newRetryUpstream(ups Upstream, opts *Options) (u *retryUpstream) {
+	return &retryUpstream{
+		wrapped: wrapped{ups: ups},
+		policy: &RetryPolicy{
+			Backoff: opts.RetryBackoff,
+			Retries: opts.Retries,
+		},
+		retryServFail: opts.RetryOnServerFailure,
+	}
+}
+
+// type check
+var _ Upstream = (*retryUpstream)(nil)
+
+// Address implements the [Upstream] interface for *retryUpstream.
+func (u *retryUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *retryUpstream.
+func (u *retryUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *retryUpstream.  The
+// attempts following the network errors dial the new connections to the
+// addresses resolved anew, see [RefreshUpstream].
+func (u *retryUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	resp, attempts, err := exchangeWithRetry(
+		ctx,
+		u.ups,
+		req,
+		u.policy,
+		u.shouldRetry,
+		u.beforeRetry,
+	)
+	if err != nil {
+		return resp, &RetryError{
+			Err:      err,
+			Attempts: attempts,
+		}
+	}
+
+	return resp, nil
+}
+
+// shouldRetry returns true if the exchange resulted in resp and err should be
+// retried.
+func (u *retryUpstream) shouldRetry(resp *dns.Msg, err error) (ok bool) {
+	if err != nil {
+		return isRetryable(err)
+	}
+
+	return u.retryServFail && resp != nil && resp.Rcode == dns.RcodeServerFailure
+}
+
+// beforeRetry refreshes the wrapped upstream if the failed attempt resulted in
+// a network error, since the connections and the resolved addresses it reuses
+// may be stale.
+func (u *retryUpstream) beforeRetry(_ *dns.Msg, err error) {
+	if err == nil {
+		return
+	}
+
+	refreshErr := RefreshUpstream(u.ups)
+	if refreshErr != nil {
+		log.Debug("dnsproxy: refreshing %s before retry: %s", u.Address(), refreshErr)
+	}
+}
+
+// Close implements the [Upstream] interface for *retryUpstream.
+func (u *retryUpstream) Close() (err error) { return u.ups.Close() }
+
+// isRetryable returns true if err is likely transient, so that the exchange
+// may succeed when retried.
+func isRetryable(err error) (ok bool) {
+	var transportErr *quic.TransportError
+	switch {
+	case
+		isTimeout(err),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, io.EOF),
+		errors.Is(err, quic.Err0RTTRejected):
+		return true
+	case errors.As(err, &transportErr):
+		// Handshake failures are reported with the crypto error codes.
+		return transportErr.ErrorCode.IsCryptoError()
+	default:
+		return false
+	}
+}
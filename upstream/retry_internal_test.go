@@ -0,0 +1,253 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy_delay(t *testing.T) {
+	newSrc := func() (src rand.Source) { return rand.NewPCG(42, 42) }
+
+	p := &RetryPolicy{
+		Backoff:    10 * time.Millisecond,
+		MaxBackoff: 30 * time.Millisecond,
+	}
+
+	assert.Equal(t, 10*time.Millisecond, p.delay(1, newSrc()))
+	assert.Equal(t, 20*time.Millisecond, p.delay(2, newSrc()))
+	assert.Equal(t, 30*time.Millisecond, p.delay(3, newSrc()))
+	assert.Equal(t, 30*time.Millisecond, p.delay(10, newSrc()))
+
+	p.Jitter = 0.5
+
+	srcA, srcB := newSrc(), newSrc()
+	for n := 1; n <= 5; n++ {
+		da, db := p.delay(n, srcA), p.delay(n, srcB)
+		assert.Equal(t, da, db)
+		assert.GreaterOrEqual(t, da, min(p.Backoff<<(n-1), p.MaxBackoff))
+		assert.LessOrEqual(t, da, p.MaxBackoff*3/2)
+	}
+}
+
+func TestExchangeWithRetry(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	var attempts int
+	u := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "fake" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			attempts++
+			if attempts < 3 {
+				return nil, testErr
+			}
+
+			return respondToTestMessage(req), nil
+		},
+		OnClose: func() (err error) { return nil },
+	}
+
+	req := createTestMessage()
+
+	resp, err := ExchangeWithRetry(u, req, &RetryPolicy{Retries: 1})
+	assert.ErrorIs(t, err, testErr)
+	assert.Nil(t, resp)
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	resp, err = ExchangeWithRetry(u, req, &RetryPolicy{Retries: 2})
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryUpstream(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	req := createTestMessage()
+
+	servFail := &dns.Msg{}
+	servFail.SetRcode(req, dns.RcodeServerFailure)
+
+	testCases := []struct {
+		results       []error
+		wantErr       error
+		name          string
+		wantAttempts  int
+		retryServFail bool
+	}{{
+		results:       []error{os.ErrDeadlineExceeded, syscall.ECONNRESET, nil},
+		wantErr:       nil,
+		name:          "transient",
+		wantAttempts:  3,
+		retryServFail: false,
+	}, {
+		results:       []error{testErr, nil},
+		wantErr:       testErr,
+		name:          "permanent",
+		wantAttempts:  1,
+		retryServFail: false,
+	}, {
+		results:       []error{io.EOF, io.EOF, io.EOF, io.EOF},
+		wantErr:       io.EOF,
+		name:          "exhausted",
+		wantAttempts:  3,
+		retryServFail: false,
+	}, {
+		results:       []error{errServFail, nil},
+		wantErr:       nil,
+		name:          "servfail",
+		wantAttempts:  1,
+		retryServFail: false,
+	}, {
+		results:       []error{errServFail, nil},
+		wantErr:       nil,
+		name:          "servfail_retried",
+		wantAttempts:  2,
+		retryServFail: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			fake := &dnsproxytest.FakeUpstream{
+				OnAddress: func() (addr string) { return "fake" },
+				OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+					err = tc.results[attempts]
+					attempts++
+
+					switch err {
+					case nil:
+						return respondToTestMessage(req), nil
+					case errServFail:
+						return servFail, nil
+					default:
+						return nil, err
+					}
+				},
+				OnClose: func() (err error) { return nil },
+			}
+
+			u := newRetryUpstream(fake, &Options{
+				Retries:              2,
+				RetryOnServerFailure: tc.retryServFail,
+			})
+
+			resp, err := u.Exchange(req)
+			assert.Equal(t, tc.wantAttempts, attempts)
+
+			if tc.wantErr == nil {
+				require.NoError(t, err)
+				require.NotNil(t, resp)
+
+				return
+			}
+
+			assert.ErrorIs(t, err, tc.wantErr)
+
+			retryErr := testutil.RequireTypeAssert[*RetryError](t, err)
+			assert.Equal(t, tc.wantAttempts, retryErr.Attempts)
+		})
+	}
+}
+
+// errServFail is a fake error used in tests to make the fake upstream respond
+// with SERVFAIL.
+const errServFail errors.Error = "servfail"
+
+func TestAddressToUpstream_retries(t *testing.T) {
+	u, err := AddressToUpstream("tcp://127.0.0.1:53", &Options{Retries: 1})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	assert.IsType(t, (*retryUpstream)(nil), u)
+	assert.IsType(t, (*plainDNS)(nil), unwrapUpstream(u))
+}
+
+// sequentResolver is a [Resolver] responding with the next address of addrs
+// for each lookup, and with the last one when they run out.
+type sequentResolver struct {
+	lookups *atomic.Int32
+	addrs   []netip.Addr
+}
+
+// type check
+var _ Resolver = sequentResolver{}
+
+// LookupNetIP implements the [Resolver] interface for sequentResolver.
+func (r sequentResolver) LookupNetIP(
+	_ context.Context,
+	_ bootstrap.Network,
+	_ string,
+) (addrs []netip.Addr, err error) {
+	n := int(r.lookups.Add(1))
+
+	return []netip.Addr{r.addrs[min(n, len(r.addrs))-1]}, nil
+}
+
+func TestRetryUpstream_rebootstrap(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	// The stale address closes the connections at once, so that the exchange
+	// fails with a retryable error.
+	staleAddr := netip.MustParseAddr("127.0.0.2")
+	stale, err := net.Listen("tcp", netip.AddrPortFrom(staleAddr, uint16(srv.port)).String())
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, stale.Close)
+
+	go func() {
+		for {
+			conn, acceptErr := stale.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			_ = conn.Close()
+		}
+	}()
+
+	lookups := &atomic.Int32{}
+	u, err := AddressToUpstream(fmt.Sprintf("tcp://some.dns.server:%d", srv.port), &Options{
+		Bootstrap: sequentResolver{
+			lookups: lookups,
+			addrs:   []netip.Addr{staleAddr, netutil.IPv4Localhost()},
+		},
+		Timeout:         timeout,
+		BootstrapMinTTL: time.Hour,
+		BootstrapMaxTTL: time.Hour,
+		Retries:         1,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	ru, ok := UpstreamAs[ResolvingUpstream](u)
+	require.True(t, ok)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	assert.Equal(t, int32(2), lookups.Load())
+	assert.Equal(t, []netip.Addr{netutil.IPv4Localhost()}, ru.ResolvedAddrs())
+}
@@ -0,0 +1,142 @@
+package upstream
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QueryRewriter rewrites the queries before they are sent to the upstream and
+// the responses received from it, see [Options.QueryRewriter].
+type QueryRewriter interface {
+	// RewriteRequest modifies req before it's sent to the upstream.  req is a
+	// copy of the original query, so it may be modified freely.
+	RewriteRequest(req *dns.Msg)
+
+	// RewriteResponse modifies resp received from the upstream for the query
+	// modified by RewriteRequest, e.g. to restore the owner names.
+	RewriteResponse(resp *dns.Msg)
+}
+
+// SuffixRewriter is a [QueryRewriter] replacing the from suffix of the names
+// within the queries with the to suffix and the other way around within the
+// responses.  The owner names of all the records and the targets of CNAME
+// records are rewritten within the responses.
+type SuffixRewriter struct {
+	// from is the suffix of the original names in a lower-case FQDN form.
+	from string
+
+	// to is the suffix of the names sent to the upstream in a lower-case FQDN
+	// form.
+	to string
+}
+
+// NewSuffixRewriter returns a new rewriter of the from suffix into the to one,
+// e.g. "internal.corp" into "internal.corp.vpn".
+func NewSuffixRewriter(from, to string) (r *SuffixRewriter) {
+	return &SuffixRewriter{
+		from: dns.Fqdn(strings.ToLower(from)),
+		to:   dns.Fqdn(strings.ToLower(to)),
+	}
+}
+
+// type check
+var _ QueryRewriter = (*SuffixRewriter)(nil)
+
+// RewriteRequest implements the [QueryRewriter] interface for *SuffixRewriter.
+func (r *SuffixRewriter) RewriteRequest(req *dns.Msg) {
+	for i := range req.Question {
+		req.Question[i].Name = replaceSuffix(req.Question[i].Name, r.from, r.to)
+	}
+}
+
+// RewriteResponse implements the [QueryRewriter] interface for
+// *SuffixRewriter.
+func (r *SuffixRewriter) RewriteResponse(resp *dns.Msg) {
+	for i := range resp.Question {
+		resp.Question[i].Name = replaceSuffix(resp.Question[i].Name, r.to, r.from)
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			hdr.Name = replaceSuffix(hdr.Name, r.to, r.from)
+			if cname, ok := rr.(*dns.CNAME); ok {
+				cname.Target = replaceSuffix(cname.Target, r.to, r.from)
+			}
+		}
+	}
+}
+
+// replaceSuffix returns name with the from suffix replaced with to, if name is
+// from or its subdomain.  from and to must be in a lower-case FQDN form.
+func replaceSuffix(name, from, to string) (res string) {
+	fqdn := dns.Fqdn(name)
+	lower := strings.ToLower(fqdn)
+	if lower == from {
+		return to
+	} else if !strings.HasSuffix(lower, "."+from) {
+		return name
+	}
+
+	return fqdn[:len(fqdn)-len(from)] + to
+}
+
+// rewriteUpstream is an [Upstream] rewriting the queries and the responses
+// with a [QueryRewriter].
+type rewriteUpstream struct {
+	// wrapped contains the wrapped upstream.
+	wrapped
+
+	// rewriter rewrites the queries and the responses.
+	rewriter QueryRewriter
+}
+
+// newRewriteUpstream returns ups wrapped to rewrite the queries and the
+// responses with r.  r must not be nil.
+func newRewriteUpstream(ups Upstream, r QueryRewriter) (u *rewriteUpstream) {
+	return &rewriteUpstream{
+		wrapped:  wrapped{ups: ups},
+		rewriter: r,
+	}
+}
+
+// type check
+var _ Upstream = (*rewriteUpstream)(nil)
+
+// Address implements the [Upstream] interface for *rewriteUpstream.
+func (u *rewriteUpstream) Address() (addr string) { return u.ups.Address() }
+
+// Exchange implements the [Upstream] interface for *rewriteUpstream.
+func (u *rewriteUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *rewriteUpstream.
+// req isn't modified, it's copy is rewritten instead.  The question section of
+// the response is set to the one of req after rewriting, so that the response
+// matches req.
+func (u *rewriteUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	rreq := req.Copy()
+	u.rewriter.RewriteRequest(rreq)
+
+	resp, err = u.ups.ExchangeContext(ctx, rreq)
+	if resp != nil {
+		u.rewriter.RewriteResponse(resp)
+		resp.Question = slices.Clone(req.Question)
+	}
+
+	return resp, err
+}
+
+// Close implements the [Upstream] interface for *rewriteUpstream.
+func (u *rewriteUpstream) Close() (err error) { return u.ups.Close() }
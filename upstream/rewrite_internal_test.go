@@ -0,0 +1,86 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuffixRewriter(t *testing.T) {
+	var sent []string
+	fake := &dnsproxytest.FakeUpstream{
+		OnAddress: func() (addr string) { return "fake" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			name := req.Question[0].Name
+			sent = append(sent, name)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{&dns.CNAME{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeCNAME,
+					Class:  dns.ClassINET,
+				},
+				Target: "real." + name,
+			}, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   "real." + name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+				},
+				A: net.IP{1, 2, 3, 4},
+			}}
+
+			return resp, nil
+		},
+		OnClose: func() (err error) { return nil },
+	}
+
+	u := newRewriteUpstream(fake, NewSuffixRewriter("internal.corp", "internal.corp.vpn."))
+
+	testCases := []struct {
+		name     string
+		host     string
+		wantSent string
+	}{{
+		name:     "subdomain",
+		host:     "Host.internal.corp.",
+		wantSent: "Host.internal.corp.vpn.",
+	}, {
+		name:     "exact",
+		host:     "internal.corp.",
+		wantSent: "internal.corp.vpn.",
+	}, {
+		name:     "other",
+		host:     "notinternal.corp.",
+		wantSent: "notinternal.corp.",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sent = sent[:0]
+
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, []string{tc.wantSent}, sent)
+			assert.Equal(t, tc.host, req.Question[0].Name)
+
+			assert.Equal(t, req.Id, resp.Id)
+			assert.Equal(t, req.Question, resp.Question)
+
+			require.Len(t, resp.Answer, 2)
+
+			cname := resp.Answer[0].(*dns.CNAME)
+			assert.Equal(t, tc.host, cname.Hdr.Name)
+			assert.Equal(t, "real."+tc.host, cname.Target)
+			assert.Equal(t, "real."+tc.host, resp.Answer[1].Header().Name)
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// FNVHash is the default hash function of [NewShardedUpstream].  It returns
+// the 64-bit FNV-1a hash of name.
+func FNVHash(name string) (h uint64) {
+	hash := fnv.New64a()
+
+	// Never returns an error.
+	_, _ = hash.Write([]byte(name))
+
+	return hash.Sum64()
+}
+
+// shardedUpstream is an [Upstream] exchanging with one of its members chosen by
+// the hash of the question name.
+type shardedUpstream struct {
+	// hashFn returns the hash of the lowercased question name.
+	hashFn func(name string) (h uint64)
+
+	// ups are the members to choose from.
+	ups []Upstream
+}
+
+// NewShardedUpstream returns an [Upstream] exchanging with the member of ups
+// chosen by the hash of the lowercased question name modulo the number of
+// members, so that the same name is always sent to the same member as long as
+// the order of ups is the same.  If the exchange fails, as decided by
+// [IsFailure], the following members are tried in order, wrapping around.  If
+// hashFn is nil, [FNVHash] is used.  ups must not be empty.
+func NewShardedUpstream(ups []Upstream, hashFn func(name string) (h uint64)) (u Upstream) {
+	if hashFn == nil {
+		hashFn = FNVHash
+	}
+
+	return &shardedUpstream{
+		hashFn: hashFn,
+		ups:    ups,
+	}
+}
+
+// type check
+var _ Upstream = (*shardedUpstream)(nil)
+
+// Address implements the [Upstream] interface for *shardedUpstream.  It lists
+// the addresses of the members in order, e.g. "sharded(tls://dns.example,
+// 1.1.1.1:53)".
+func (u *shardedUpstream) Address() (addr string) {
+	addrs := make([]string, 0, len(u.ups))
+	for _, ups := range u.ups {
+		addrs = append(addrs, ups.Address())
+	}
+
+	return fmt.Sprintf("sharded(%s)", strings.Join(addrs, ", "))
+}
+
+// Exchange implements the [Upstream] interface for *shardedUpstream.
+func (u *shardedUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *shardedUpstream.  It
+// returns the first successful response.  If all the members fail, it returns
+// the last response along with the errors of all the members, if any.  It
+// doesn't fall back once ctx is done.
+func (u *shardedUpstream) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	n := len(u.ups)
+	first := u.shard(req)
+
+	var errs []error
+	for i := range n {
+		ups := u.ups[(first+i)%n]
+
+		resp, err = ups.ExchangeContext(ctx, req)
+		if !IsFailure(resp, err) {
+			return resp, err
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("exchanging with %s: %w", ups.Address(), err))
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		if i < n-1 {
+			log.Debug(
+				"dnsproxy: sharded: %s failed, falling back: %s",
+				ups.Address(),
+				retryReason(resp, err),
+			)
+		}
+	}
+
+	return resp, errors.Join(errs...)
+}
+
+// shard returns the index of the member to exchange req with first.  The
+// requests without questions are sent to the first member.
+func (u *shardedUpstream) shard(req *dns.Msg) (idx int) {
+	if len(req.Question) == 0 {
+		return 0
+	}
+
+	h := u.hashFn(strings.ToLower(req.Question[0].Name))
+
+	return int(h % uint64(len(u.ups)))
+}
+
+// Close implements the [Upstream] interface for *shardedUpstream.  It closes
+// all the members.
+func (u *shardedUpstream) Close() (err error) {
+	var errs []error
+	for _, ups := range u.ups {
+		closeErr := ups.Close()
+		if closeErr != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", ups.Address(), closeErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ ProbableUpstream = (*shardedUpstream)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *shardedUpstream.  It
+// succeeds if any of the members responds properly.
+func (u *shardedUpstream) Probe(ctx context.Context) (err error) {
+	var errs []error
+	for _, ups := range u.ups {
+		err = probeWrapped(ctx, ups)
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ BootstrapSetter = (*shardedUpstream)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for
+// *shardedUpstream.  It sets the resolvers for each member implementing
+// [BootstrapSetter].
+func (u *shardedUpstream) SetBootstrap(resolvers []Resolver) {
+	for _, ups := range u.ups {
+		setBootstrap(ups, resolvers)
+	}
+}
@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedUpstream(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	t.Run("stable", func(t *testing.T) {
+		a, aN, _ := newChainMember("a", dns.RcodeSuccess, nil)
+		b, bN, _ := newChainMember("b", dns.RcodeSuccess, nil)
+		c, cN, _ := newChainMember("c", dns.RcodeSuccess, nil)
+
+		var names []string
+		u := NewShardedUpstream([]Upstream{a, b, c}, func(name string) (h uint64) {
+			names = append(names, name)
+
+			return 4
+		})
+		assert.Equal(t, "sharded(a, b, c)", u.Address())
+
+		for _, name := range []string{"example.org.", "EXAMPLE.org."} {
+			req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+		}
+
+		assert.Zero(t, *aN)
+		assert.Equal(t, 2, *bN)
+		assert.Zero(t, *cN)
+		assert.Equal(t, []string{"example.org.", "example.org."}, names)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		a, aN, _ := newChainMember("a", dns.RcodeSuccess, nil)
+		b, bN, _ := newChainMember("b", dns.RcodeSuccess, nil)
+		failing, failingN, _ := newChainMember("failing", 0, testErr)
+
+		u := NewShardedUpstream([]Upstream{a, b, failing}, func(_ string) (h uint64) {
+			return 2
+		})
+
+		req := createTestMessage()
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+		requireResponse(t, req, resp)
+
+		assert.Equal(t, 1, *failingN)
+		assert.Equal(t, 1, *aN)
+		assert.Zero(t, *bN)
+	})
+
+	t.Run("all_failed", func(t *testing.T) {
+		a, _, aCloses := newChainMember("a", 0, testErr)
+		b, _, bCloses := newChainMember("b", dns.RcodeServerFailure, nil)
+
+		u := NewShardedUpstream([]Upstream{a, b}, nil)
+
+		resp, err := u.Exchange(createTestMessage())
+		assert.ErrorIs(t, err, testErr)
+		assert.NotNil(t, resp)
+
+		require.NoError(t, u.Close())
+		assert.Equal(t, 1, *aCloses)
+		assert.Equal(t, 1, *bCloses)
+	})
+
+	t.Run("default_hash", func(t *testing.T) {
+		ups := make([]Upstream, 0, 4)
+		counts := make([]*int, 0, 4)
+		for _, addr := range []string{"a", "b", "c", "d"} {
+			m, n, _ := newChainMember(addr, dns.RcodeSuccess, nil)
+			ups, counts = append(ups, m), append(counts, n)
+		}
+
+		u := NewShardedUpstream(ups, nil)
+		su := testutil.RequireTypeAssert[*shardedUpstream](t, u)
+
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+		want := int(FNVHash("example.org.") % 4)
+		assert.Equal(t, want, su.shard(req))
+
+		for range 10 {
+			_, err := u.Exchange(req)
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 10, *counts[want])
+	})
+}
+
+func TestFNVHash(t *testing.T) {
+	// The FNV-1a offset basis.
+	assert.Equal(t, uint64(0xcbf29ce484222325), FNVHash(""))
+	assert.Equal(t, uint64(0xaf63dc4c8601ec8c), FNVHash("a"))
+}
@@ -0,0 +1,97 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+)
+
+// noSNIServerName is the server name used to omit the Server Name Indication
+// extension.  crypto/tls never sends IP addresses within it, while a non-empty
+// name prevents the HTTP transports from filling it with the request's host.
+const noSNIServerName = "0.0.0.0"
+
+// setServerName sets the server name of conf, which is used to connect to the
+// upstream at addr, according to opts.  conf.RootCAs must already be set.
+func setServerName(conf *tls.Config, addr *url.URL, opts *Options) {
+	name := serverName(addr, opts)
+	if !opts.DisableSNI {
+		conf.ServerName = name
+
+		return
+	}
+
+	conf.ServerName = noSNIServerName
+	if opts.InsecureSkipVerify {
+		return
+	}
+
+	// Verify the certificate manually, since crypto/tls would verify it
+	// against noSNIServerName otherwise.
+	//
+	// #nosec G402 -- The verification is performed by VerifyConnection.
+	conf.InsecureSkipVerify = true
+	conf.VerifyConnection = newNameVerifier(name, conf.RootCAs, opts.VerifyConnection)
+}
+
+// serverName returns the name the certificate of the upstream at addr is
+// verified against according to opts.
+func serverName(addr *url.URL, opts *Options) (name string) {
+	if opts.ServerName != "" {
+		return opts.ServerName
+	}
+
+	return addr.Hostname()
+}
+
+// newNameVerifier returns a function verifying the server's certificate chain
+// against name and roots, the same way crypto/tls does.  next, if not nil, is
+// called after the successful verification.
+func newNameVerifier(
+	name string,
+	roots *x509.CertPool,
+	next func(state tls.ConnectionState) (err error),
+) (verify func(state tls.ConnectionState) (err error)) {
+	return func(state tls.ConnectionState) (err error) {
+		_, err = verifyChain(name, roots, state.PeerCertificates)
+		if err != nil {
+			return err
+		}
+
+		if next != nil {
+			return next(state)
+		}
+
+		return nil
+	}
+}
+
+// verifyChain verifies the certificate chain certs presented by the server
+// against name and roots, the same way crypto/tls does, and returns the
+// verified chains.
+func verifyChain(
+	name string,
+	roots *x509.CertPool,
+	certs []*x509.Certificate,
+) (chains [][]*x509.Certificate, err error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("verifying certificate for %s: no certificates", name)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	chains, err = certs[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("verifying certificate for %s: %w", name, err)
+	}
+
+	return chains, nil
+}
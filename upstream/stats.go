@@ -0,0 +1,91 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultRTTAlpha is the default smoothing factor of the mean round-trip time,
+// see [Options.RTTAlpha].
+const DefaultRTTAlpha = 0.1
+
+// UpstreamWithStats is an [Upstream] measuring the round-trip time of its
+// exchanges.  The measurements only cover the network exchange and don't
+// include the bootstrapping.  Only successful exchanges are measured.
+//
+// The upstreams created with [AddressToUpstream] and [NewUpstreamFromConn]
+// implement it, unless they are wrapped, e.g. by configuring
+// [Options.Retries].  Use [UpstreamAs] to get it from the wrapper.
+type UpstreamWithStats interface {
+	Upstream
+
+	// LastRTT returns the round-trip time of the last successful exchange.
+	// It returns zero if there were no successful exchanges yet.
+	LastRTT() (rtt time.Duration)
+
+	// MeanRTT returns the exponentially weighted moving average of the
+	// round-trip times of the successful exchanges.  It returns zero if there
+	// were no successful exchanges yet.
+	MeanRTT() (rtt time.Duration)
+}
+
+// rttStats stores the round-trip time statistics of an upstream.  It's
+// intended to be embedded into the upstream implementations.
+type rttStats struct {
+	// mu protects last and mean.
+	mu *sync.Mutex
+
+	// last is the last measured round-trip time.
+	last time.Duration
+
+	// mean is the exponentially weighted moving average of the round-trip
+	// times.
+	mean time.Duration
+
+	// alpha is the smoothing factor of mean, it's within (0, 1].
+	alpha float64
+}
+
+// newRTTStats returns new round-trip time statistics with the smoothing factor
+// from opts.
+func newRTTStats(opts *Options) (s *rttStats) {
+	alpha := opts.RTTAlpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = DefaultRTTAlpha
+	}
+
+	return &rttStats{
+		mu:    &sync.Mutex{},
+		alpha: alpha,
+	}
+}
+
+// LastRTT implements the [UpstreamWithStats] interface for *rttStats.
+func (s *rttStats) LastRTT() (rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.last
+}
+
+// MeanRTT implements the [UpstreamWithStats] interface for *rttStats.
+func (s *rttStats) MeanRTT() (rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mean
+}
+
+// update adds the round-trip time of the successful exchange to the
+// statistics.
+func (s *rttStats) update(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last = rtt
+	if s.mean == 0 {
+		s.mean = rtt
+	} else {
+		s.mean += time.Duration(s.alpha * float64(rtt-s.mean))
+	}
+}
@@ -0,0 +1,55 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTTStats_update(t *testing.T) {
+	s := newRTTStats(&Options{RTTAlpha: 0.5})
+
+	assert.Zero(t, s.LastRTT())
+	assert.Zero(t, s.MeanRTT())
+
+	s.update(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, s.LastRTT())
+	assert.Equal(t, 100*time.Millisecond, s.MeanRTT())
+
+	s.update(200 * time.Millisecond)
+	assert.Equal(t, 200*time.Millisecond, s.LastRTT())
+	assert.Equal(t, 150*time.Millisecond, s.MeanRTT())
+
+	s.update(50 * time.Millisecond)
+	assert.Equal(t, 50*time.Millisecond, s.LastRTT())
+	assert.Equal(t, 100*time.Millisecond, s.MeanRTT())
+
+	assert.Equal(t, DefaultRTTAlpha, newRTTStats(&Options{}).alpha)
+}
+
+func TestUpstreamWithStats(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{Timeout: timeout})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	su, ok := u.(UpstreamWithStats)
+	require.True(t, ok)
+
+	assert.Zero(t, su.LastRTT())
+
+	checkUpstream(t, u, addr)
+
+	assert.Positive(t, su.LastRTT())
+	assert.Equal(t, su.LastRTT(), su.MeanRTT())
+}
@@ -0,0 +1,157 @@
+package upstream
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// DefaultTCPIdleTimeout is the default time after which an idle pooled TCP
+// connection is closed, see [Options.TCPIdleTimeout].
+const DefaultTCPIdleTimeout = 10 * time.Second
+
+// idleConn is a pooled connection along with the time it was put back.
+type idleConn struct {
+	// conn is the idle connection.
+	conn net.Conn
+
+	// since is the time the connection became idle.
+	since time.Time
+}
+
+// tcpConnPool is a pool of idle TCP connections to a single upstream.  All
+// methods are safe for concurrent use.
+type tcpConnPool struct {
+	// mu protects conns and closed.
+	mu *sync.Mutex
+
+	// conns are the idle connections, the most recently used ones are at the
+	// end.
+	conns []*idleConn
+
+	// maxIdle is the maximum number of idle connections kept.
+	maxIdle int
+
+	// idleTimeout is the time after which an idle connection is closed.
+	idleTimeout time.Duration
+
+	// closed is true if the pool has been closed.
+	closed bool
+}
+
+// newTCPConnPool returns a new TCP connection pool configured with opts.  It
+// returns nil if opts.TCPIdleConns isn't positive, which means that the
+// connections shouldn't be pooled.
+func newTCPConnPool(opts *Options) (p *tcpConnPool) {
+	if opts.TCPIdleConns <= 0 {
+		return nil
+	}
+
+	idleTimeout := opts.TCPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultTCPIdleTimeout
+	}
+
+	return &tcpConnPool{
+		mu:          &sync.Mutex{},
+		maxIdle:     opts.TCPIdleConns,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// get returns the most recently used idle connection or nil if there is none.
+// Connections idle for longer than the idle timeout are closed.
+func (p *tcpConnPool) get() (conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closeExpired(time.Now())
+
+	l := len(p.conns)
+	if l == 0 {
+		return nil
+	}
+
+	var ic *idleConn
+	p.conns, ic = p.conns[:l-1], p.conns[l-1]
+
+	return ic.conn
+}
+
+// put returns conn to the pool.  conn is closed if the pool is full or closed.
+func (p *tcpConnPool) put(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.closeExpired(now)
+
+	if p.closed || len(p.conns) >= p.maxIdle {
+		closeIdle(conn)
+
+		return
+	}
+
+	p.conns = append(p.conns, &idleConn{
+		conn:  conn,
+		since: now,
+	})
+}
+
+// closeExpired closes and removes the connections idle for longer than the
+// idle timeout at now.  p.mu must be locked.
+func (p *tcpConnPool) closeExpired(now time.Time) {
+	// The connections are sorted by the time they became idle, so find the
+	// first one that hasn't expired yet.
+	i := slices.IndexFunc(p.conns, func(ic *idleConn) (ok bool) {
+		return now.Sub(ic.since) < p.idleTimeout
+	})
+	if i < 0 {
+		i = len(p.conns)
+	}
+
+	for _, ic := range p.conns[:i] {
+		closeIdle(ic.conn)
+	}
+
+	p.conns = slices.Delete(p.conns, 0, i)
+}
+
+// drain closes all the idle connections in the pool.
+func (p *tcpConnPool) drain() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for _, ic := range p.conns {
+		errs = append(errs, ic.conn.Close())
+	}
+	p.conns = nil
+
+	return errors.Join(errs...)
+}
+
+// close drains the pool and makes it close all the connections put back
+// afterwards.
+func (p *tcpConnPool) close() (err error) {
+	err = p.drain()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+
+	return err
+}
+
+// closeIdle closes the idle connection conn and logs the error, if any.
+func closeIdle(conn net.Conn) {
+	err := closeConn(conn)
+	if err != nil {
+		log.Debug("plain: closing idle conn to %s: %s", conn.RemoteAddr(), err)
+	}
+}
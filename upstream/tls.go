@@ -0,0 +1,206 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// ErrCertPinMismatch is returned when the SubjectPublicKeyInfo of the server's
+// certificate doesn't match any of [Options.PinnedKeys].
+const ErrCertPinMismatch errors.Error = "certificate pin mismatch"
+
+// newTLSConfig returns the configuration of TLS for the DNS-over-HTTPS,
+// DNS-over-QUIC, and DNS-over-TLS upstreams at addr according to opts.
+func newTLSConfig(addr *url.URL, opts *Options) (conf *tls.Config, err error) {
+	roots, err := loadRootCAs(opts)
+	if err != nil {
+		return nil, fmt.Errorf("tls %s: %w", addr.Host, err)
+	}
+
+	certs, err := loadClientCerts(opts)
+	if err != nil {
+		return nil, fmt.Errorf("tls %s: %w", addr.Host, err)
+	}
+
+	pins, err := newPinSet(opts.PinnedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("tls %s: %w", addr.Host, err)
+	}
+
+	conf = &tls.Config{
+		RootCAs:            roots,
+		Certificates:       certs,
+		CipherSuites:       opts.CipherSuites,
+		ClientSessionCache: newSessionCache(addr, opts),
+		MinVersion:         tls.VersionTLS12,
+		// #nosec G402 -- TLS certificate verification could be disabled by
+		// configuration.
+		InsecureSkipVerify:    opts.InsecureSkipVerify,
+		VerifyPeerCertificate: opts.VerifyServerCertificate,
+		VerifyConnection:      opts.VerifyConnection,
+	}
+	setServerName(conf, addr, opts)
+
+	if len(pins) > 0 {
+		conf.VerifyConnection = newPinVerifier(pins, conf.VerifyConnection)
+	}
+
+	return conf, nil
+}
+
+// sessionCache is a [tls.ClientSessionCache] storing the sessions of a single
+// upstream within a possibly shared cache.  The keys are prefixed with the
+// scheme and the host of the upstream and the generation, so that clearing the sessions
+// only requires to increment the latter.
+type sessionCache struct {
+	// cache stores the sessions.  It must be safe for concurrent use.
+	cache tls.ClientSessionCache
+
+	// gen is the generation of the sessions, incremented on each clear.
+	gen *atomic.Uint64
+
+	// server is the scheme and the host of the upstream, so that the upstreams
+	// of different protocols on the same host don't share the sessions.
+	server string
+}
+
+// newSessionCache returns the cache of the TLS sessions for the upstream at
+// addr.  It uses opts.TLSSessionCache, if any, or a new LRU cache of the
+// default capacity otherwise.  It returns nil if opts.DisableTLSSessionCache is
+// true.
+func newSessionCache(addr *url.URL, opts *Options) (c tls.ClientSessionCache) {
+	if opts.DisableTLSSessionCache {
+		return nil
+	}
+
+	cache := opts.TLSSessionCache
+	if cache == nil {
+		// Use the default capacity for the LRU cache.  It may be useful to
+		// store several sessions since the user may be routed to different
+		// servers in case there's load balancing on the server-side.
+		cache = tls.NewLRUClientSessionCache(0)
+	}
+
+	return &sessionCache{
+		cache:  cache,
+		gen:    &atomic.Uint64{},
+		server: addr.Scheme + "://" + addr.Host,
+	}
+}
+
+// type check
+var _ tls.ClientSessionCache = (*sessionCache)(nil)
+
+// Get implements the [tls.ClientSessionCache] interface for *sessionCache.
+func (c *sessionCache) Get(sessionKey string) (session *tls.ClientSessionState, ok bool) {
+	return c.cache.Get(c.key(sessionKey))
+}
+
+// Put implements the [tls.ClientSessionCache] interface for *sessionCache.
+func (c *sessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.key(sessionKey), cs)
+}
+
+// key returns the key of the session with sessionKey within c.cache.
+func (c *sessionCache) key(sessionKey string) (key string) {
+	return fmt.Sprintf("%s|%d|%s", c.server, c.gen.Load(), sessionKey)
+}
+
+// clearSessions makes the TLS sessions stored for conf unavailable, so that
+// the following connections perform the full handshake.  The sessions are
+// evicted from the underlying cache eventually.
+func clearSessions(conf *tls.Config) {
+	if c, ok := conf.ClientSessionCache.(*sessionCache); ok {
+		c.gen.Add(1)
+	}
+}
+
+// loadRootCAs returns the root certificates from opts, reading them from
+// opts.RootCAFile if it's set.
+func loadRootCAs(opts *Options) (roots *x509.CertPool, err error) {
+	if opts.RootCAFile == "" {
+		return opts.RootCAs, nil
+	} else if opts.RootCAs != nil {
+		return nil, fmt.Errorf("both root cas and root ca file are set")
+	}
+
+	// #nosec G304 -- The path is trusted since it's set by the configuration.
+	pem, err := os.ReadFile(opts.RootCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading root ca file: %w", err)
+	}
+
+	roots = x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("root ca file %q: no certificates found", opts.RootCAFile)
+	}
+
+	return roots, nil
+}
+
+// loadClientCerts returns the client certificates for the mutual TLS read from
+// the files set in opts, if any.
+func loadClientCerts(opts *Options) (certs []tls.Certificate, err error) {
+	if opts.ClientCertFile == "" && opts.ClientKeyFile == "" {
+		return nil, nil
+	} else if opts.ClientCertFile == "" || opts.ClientKeyFile == "" {
+		return nil, fmt.Errorf("client certificate and key files must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate: %w", err)
+	}
+
+	return []tls.Certificate{cert}, nil
+}
+
+// pinSet is the set of SHA-256 hashes of the pinned SubjectPublicKeyInfo.
+type pinSet map[[sha256.Size]byte]struct{}
+
+// newPinSet returns the set of pins from keys, which must be the SHA-256
+// hashes.
+func newPinSet(keys [][]byte) (pins pinSet, err error) {
+	pins = make(pinSet, len(keys))
+	for i, k := range keys {
+		if len(k) != sha256.Size {
+			return nil, fmt.Errorf("pinned key at index %d: bad length %d", i, len(k))
+		}
+
+		pins[[sha256.Size]byte(k)] = struct{}{}
+	}
+
+	return pins, nil
+}
+
+// newPinVerifier returns a function verifying that the SubjectPublicKeyInfo of
+// the server's leaf certificate is within pins.  next, if not nil, is called
+// after the successful verification.
+func newPinVerifier(
+	pins pinSet,
+	next func(state tls.ConnectionState) (err error),
+) (verify func(state tls.ConnectionState) (err error)) {
+	return func(state tls.ConnectionState) (err error) {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("no certificates: %w", ErrCertPinMismatch)
+		}
+
+		leaf := state.PeerCertificates[0]
+		if _, ok := pins[sha256.Sum256(leaf.RawSubjectPublicKeyInfo)]; !ok {
+			return fmt.Errorf("certificate for %q: %w", leaf.Subject, ErrCertPinMismatch)
+		}
+
+		if next != nil {
+			return next(state)
+		}
+
+		return nil
+	}
+}
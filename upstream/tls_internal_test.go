@@ -0,0 +1,267 @@
+package upstream
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertFiles writes the first certificate of conf and its private key to
+// the PEM files within dir and returns their paths.
+func writeCertFiles(
+	t *testing.T,
+	dir string,
+	name string,
+	conf *tls.Config,
+) (certFile, keyFile string) {
+	t.Helper()
+
+	cert := conf.Certificates[0]
+	key := testutil.RequireTypeAssert[*rsa.PrivateKey](t, cert.PrivateKey)
+
+	certFile = filepath.Join(dir, name+".crt")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+
+	keyFile = filepath.Join(dir, name+".key")
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+
+	return certFile, keyFile
+}
+
+func TestOptions_certFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	srvConf, _ := createServerTLSConfig(t, "127.0.0.1")
+	rootFile, _ := writeCertFiles(t, dir, "root", srvConf)
+
+	cliConf, _ := createServerTLSConfig(t, "client.example")
+	certFile, keyFile := writeCertFiles(t, dir, "client", cliConf)
+
+	clientCerts := make(chan []byte, 1)
+	srvConf.ClientAuth = tls.RequireAnyClientCert
+	srvConf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) (err error) {
+		clientCerts <- rawCerts[0]
+
+		return nil
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", srvConf)
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		Listener: l,
+		Net:      "tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", l.Addr().(*net.TCPAddr).Port)
+
+	t.Run("success", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{
+			Timeout:        timeout,
+			RootCAFile:     rootFile,
+			ClientCertFile: certFile,
+			ClientKeyFile:  keyFile,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		req := createTestMessage()
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+		requireResponse(t, req, resp)
+
+		cert, _ := testutil.RequireReceive(t, clientCerts, timeout)
+		assert.Equal(t, cliConf.Certificates[0].Certificate[0], cert)
+	})
+
+	testCases := []struct {
+		opts       *Options
+		name       string
+		wantErrMsg string
+	}{{
+		opts: &Options{
+			ClientCertFile: certFile,
+		},
+		name: "no_key",
+		wantErrMsg: "tls " + l.Addr().String() +
+			": client certificate and key files must be set together",
+	}, {
+		opts: &Options{
+			RootCAFile: certFile,
+			RootCAs:    x509.NewCertPool(),
+		},
+		name:       "both_roots",
+		wantErrMsg: "tls " + l.Addr().String() + ": both root cas and root ca file are set",
+	}, {
+		opts: &Options{
+			RootCAFile: keyFile,
+		},
+		name: "bad_root",
+		wantErrMsg: "tls " + l.Addr().String() +
+			`: root ca file "` + keyFile + `": no certificates found`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := AddressToUpstream(addr, tc.opts)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestOptions_PinnedKeys(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	leaf, err := x509.ParseCertificate(srv.tlsConfig.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+
+	pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	otherPin := sha256.Sum256([]byte("other"))
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+
+	testCases := []struct {
+		wantErr  error
+		name     string
+		pins     [][]byte
+		insecure bool
+	}{{
+		wantErr:  nil,
+		name:     "match",
+		pins:     [][]byte{otherPin[:], pin[:]},
+		insecure: false,
+	}, {
+		wantErr:  ErrCertPinMismatch,
+		name:     "mismatch",
+		pins:     [][]byte{otherPin[:]},
+		insecure: false,
+	}, {
+		wantErr:  ErrCertPinMismatch,
+		name:     "mismatch_insecure",
+		pins:     [][]byte{otherPin[:]},
+		insecure: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, uErr := AddressToUpstream(addr, &Options{
+				Timeout:            timeout,
+				RootCAs:            srv.rootCAs,
+				InsecureSkipVerify: tc.insecure,
+				PinnedKeys:         tc.pins,
+			})
+			require.NoError(t, uErr)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			resp, uErr := u.Exchange(req)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, uErr, tc.wantErr)
+
+				return
+			}
+
+			require.NoError(t, uErr)
+			requireResponse(t, req, resp)
+		})
+	}
+
+	t.Run("bad_pin", func(t *testing.T) {
+		_, uErr := AddressToUpstream(addr, &Options{
+			PinnedKeys: [][]byte{pin[:1]},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			"tls 127.0.0.1:"+fmt.Sprint(srv.port)+": pinned key at index 0: bad length 1",
+			uErr,
+		)
+	})
+}
+
+func TestOptions_TLSSessionCache(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	resumed := make(chan bool, 1)
+	opts := &Options{
+		RootCAs:         srv.rootCAs,
+		Timeout:         timeout,
+		TLSSessionCache: tls.NewLRUClientSessionCache(0),
+		VerifyConnection: func(state tls.ConnectionState) (err error) {
+			resumed <- state.DidResume
+
+			return nil
+		},
+	}
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+
+	first, err := AddressToUpstream(addr, opts)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, first.Close)
+
+	checkUpstream(t, first, addr)
+
+	didResume, _ := testutil.RequireReceive(t, resumed, timeout)
+	assert.False(t, didResume)
+
+	// The session is shared through the cache.
+	second, err := AddressToUpstream(addr, opts)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, second.Close)
+
+	checkUpstream(t, second, addr)
+
+	didResume, _ = testutil.RequireReceive(t, resumed, timeout)
+	assert.True(t, didResume)
+
+	// The sessions are discarded on refresh.
+	require.NoError(t, RefreshUpstream(second))
+	checkUpstream(t, second, addr)
+
+	didResume, _ = testutil.RequireReceive(t, resumed, timeout)
+	assert.False(t, didResume)
+}
+
+func TestSessionCache_key(t *testing.T) {
+	opts := &Options{
+		TLSSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	dot := newSessionCache(&url.URL{Scheme: "tls", Host: "example.com:853"}, opts)
+	doh := newSessionCache(&url.URL{Scheme: "https", Host: "example.com:853"}, opts)
+
+	dot.Put("example.com", &tls.ClientSessionState{})
+
+	_, ok := dot.Get("example.com")
+	assert.True(t, ok)
+
+	_, ok = doh.Get("example.com")
+	assert.False(t, ok)
+}
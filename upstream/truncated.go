@@ -0,0 +1,120 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// ErrUnexpectedTC is returned when the upstream's response received over
+// a transport without message size limits has the TC bit set and the upstream
+// is configured with [TruncatedPolicyFail].
+const ErrUnexpectedTC errors.Error = "unexpected tc bit in response"
+
+// TruncatedPolicy defines how the responses with the TC bit set are handled when
+// received over a transport without message size limits, i.e. anything except
+// plain DNS over UDP.  A correct server never sets the bit in such responses,
+// so these responses are likely incomplete.
+type TruncatedPolicy uint8
+
+// TruncatedPolicy values.
+const (
+	// TruncatedPolicyClear logs the response and clears its TC bit, so that
+	// the clients don't needlessly retry over TCP.  It's the default.
+	TruncatedPolicyClear TruncatedPolicy = iota
+
+	// TruncatedPolicyLog only logs the response and returns it as is.
+	TruncatedPolicyLog
+
+	// TruncatedPolicyFail makes the exchange fail with [ErrUnexpectedTC], so
+	// that the caller is able to retry or use another upstream.
+	TruncatedPolicyFail
+
+	// TruncatedPolicyRetry makes DNS-over-HTTPS and DNS-over-QUIC upstreams
+	// send the query once again advertising the maximum EDNS0 UDP payload
+	// size, since some servers limit the responses by it regardless of the
+	// transport.  The TC bit of the response to the retried query, if any, is
+	// cleared.  Other upstreams, as well as the upstreams with
+	// [Options.DisableEDNS0], handle it like [TruncatedPolicyClear].
+	TruncatedPolicyRetry
+)
+
+// truncatedPolicy returns the policy of the upstreams able to retry the
+// truncated responses configured with opts.
+func truncatedPolicy(opts *Options) (pol TruncatedPolicy) {
+	if opts.TruncatedPolicy == TruncatedPolicyRetry && opts.DisableEDNS0 {
+		return TruncatedPolicyClear
+	}
+
+	return opts.TruncatedPolicy
+}
+
+// handleTruncated handles resp received from addr over a transport without
+// message size limits according to pol.  resp may be nil.
+func handleTruncated(resp *dns.Msg, addr string, pol TruncatedPolicy) (err error) {
+	if resp == nil || !resp.Truncated {
+		return nil
+	}
+
+	switch pol {
+	case TruncatedPolicyLog:
+		log.Debug("dnsproxy: %s: unexpected tc bit in response", addr)
+	case TruncatedPolicyFail:
+		return fmt.Errorf("%s: %w", addr, ErrUnexpectedTC)
+	default:
+		// TruncatedPolicyClear and TruncatedPolicyRetry.  Other values are
+		// rejected by [AddressToUpstream].
+		log.Debug("dnsproxy: %s: clearing unexpected tc bit in response", addr)
+
+		resp.Truncated = false
+	}
+
+	return nil
+}
+
+// exchangeFunc is a function performing a single DNS exchange.
+type exchangeFunc func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error)
+
+// retryTruncated handles resp to req received from addr over a transport
+// without message size limits according to pol.  If pol is
+// [TruncatedPolicyRetry] and resp is truncated, req is exchanged once again
+// using exchange with the maximum EDNS0 UDP payload size.  The original
+// response is returned if the retry fails.  resp may be nil.
+func retryTruncated(
+	ctx context.Context,
+	req *dns.Msg,
+	resp *dns.Msg,
+	addr string,
+	pol TruncatedPolicy,
+	exchange exchangeFunc,
+) (res *dns.Msg, err error) {
+	if pol != TruncatedPolicyRetry || resp == nil || !resp.Truncated {
+		return resp, handleTruncated(resp, addr, pol)
+	}
+
+	log.Debug("dnsproxy: %s: unexpected tc bit in response, retrying", addr)
+
+	retryReq := req.Copy()
+	opt := retryReq.IsEdns0()
+	if opt != nil {
+		opt.SetUDPSize(dns.MaxMsgSize)
+	} else {
+		retryReq.SetEdns0(dns.MaxMsgSize, false)
+	}
+
+	res, err = exchange(ctx, retryReq)
+	if err != nil {
+		log.Debug("dnsproxy: %s: retrying truncated response: %s", addr, err)
+
+		return resp, handleTruncated(resp, addr, pol)
+	}
+
+	if opt == nil {
+		removeOPT(res)
+	}
+
+	return res, handleTruncated(res, addr, pol)
+}
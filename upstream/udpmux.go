@@ -0,0 +1,419 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// muxQuery is a query sent over a [muxUDPConn] and awaiting the response.
+type muxQuery struct {
+	// req contains the ID the query is sent with and its question section,
+	// it's used to validate the responses.
+	req *dns.Msg
+
+	// resp receives the response.
+	resp chan *dns.Msg
+
+	// mismatched is the response with the matching ID but a mismatched
+	// question, if any.  It's returned on timeout along with mismatchErr, so
+	// that the exchange could be retried over TCP.  Protected by the mutex of
+	// the connection.
+	mismatched *dns.Msg
+
+	// mismatchErr is the reason mismatched is rejected.
+	mismatchErr error
+}
+
+// muxUDPConn is a connected UDP socket carrying multiple queries at once, see
+// [Options.UDPMultiplex].
+type muxUDPConn struct {
+	// conn is the underlying connection.
+	conn net.Conn
+
+	// mu protects pending, nextID, err, and draining.
+	mu *sync.Mutex
+
+	// pending maps the IDs of the queries sent to the queries.
+	pending map[uint16]*muxQuery
+
+	// done is closed when the connection stops reading.
+	done chan struct{}
+
+	// err is the reason the connection stopped reading.
+	err error
+
+	// addr is the address of the upstream used for logging.
+	addr string
+
+	// nextID is the candidate ID of the next query.
+	nextID uint16
+
+	// strict is true if the responses not matching the question of the query
+	// should be discarded, see [Options.DisableStrictValidation].
+	strict bool
+
+	// dns0x20 is true if the case of the question names of the responses
+	// should be validated, see [Options.EnableDNS0x20].
+	dns0x20 bool
+
+	// draining is true if the connection should be closed as soon as there
+	// are no pending queries.
+	draining bool
+}
+
+// newMuxUDPConn returns a new multiplexed connection over conn and starts
+// reading the responses from it.  addr is the address of the upstream.
+func newMuxUDPConn(conn net.Conn, addr string, strict, dns0x20 bool) (c *muxUDPConn) {
+	c = &muxUDPConn{
+		conn:    conn,
+		mu:      &sync.Mutex{},
+		pending: map[uint16]*muxQuery{},
+		done:    make(chan struct{}),
+		addr:    addr,
+		nextID:  randomID(),
+		strict:  strict,
+		dns0x20: dns0x20,
+	}
+
+	go c.readLoop()
+
+	return c
+}
+
+// isAlive returns true if c still reads the responses and isn't draining.
+func (c *muxUDPConn) isAlive() (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err == nil && !c.draining
+}
+
+// exchange sends req over c and waits for the response for timeout.  req is
+// sent with a unique ID, which is replaced with the original one in the
+// response.
+func (c *muxUDPConn) exchange(
+	ctx context.Context,
+	req *dns.Msg,
+	timeout time.Duration,
+) (resp *dns.Msg, err error) {
+	id, q, err := c.register(req)
+	if err != nil {
+		return nil, err
+	}
+
+	origID := req.Id
+	req.Id = id
+	buf, err := req.Pack()
+	req.Id = origID
+	if err != nil {
+		c.unregister(id)
+
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	_, err = c.conn.Write(buf)
+	if err != nil {
+		c.unregister(id)
+
+		return nil, fmt.Errorf("writing request: %w", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case resp = <-q.resp:
+		resp.Id = origID
+
+		return resp, nil
+	case <-c.done:
+		c.unregister(id)
+
+		return nil, c.err
+	case <-ctx.Done():
+		c.unregister(id)
+
+		return nil, context.Cause(ctx)
+	case <-timer.C:
+		return c.expire(q, origID)
+	}
+}
+
+// expire unregisters the timed out query q and returns the mismatched
+// response to it, if any.
+func (c *muxUDPConn) expire(q *muxQuery, origID uint16) (resp *dns.Msg, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(q.req.Id)
+
+	select {
+	case resp = <-q.resp:
+		// The response has arrived right before the timeout.
+		resp.Id = origID
+
+		return resp, nil
+	default:
+		// Go on.
+	}
+
+	if q.mismatched != nil {
+		q.mismatched.Id = origID
+
+		return q.mismatched, q.mismatchErr
+	}
+
+	return nil, fmt.Errorf("reading response: %w", os.ErrDeadlineExceeded)
+}
+
+// register allocates the unique ID for req and the query to receive the
+// response to.
+func (c *muxUDPConn) register(req *dns.Msg) (id uint16, q *muxQuery, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, nil, c.err
+	} else if len(c.pending) >= 1<<16-1 {
+		return 0, nil, errors.Error("no free message ids")
+	}
+
+	for {
+		// Zero IDs are never used, see [randomID].
+		id = c.nextID
+		c.nextID++
+		if _, ok := c.pending[id]; !ok && id != 0 {
+			break
+		}
+	}
+
+	q = &muxQuery{
+		req: &dns.Msg{
+			MsgHdr:   dns.MsgHdr{Id: id},
+			Question: req.Question,
+		},
+		resp: make(chan *dns.Msg, 1),
+	}
+	c.pending[id] = q
+
+	return id, q, nil
+}
+
+// unregister removes the pending query with id.  It closes the draining
+// connection without pending queries.
+func (c *muxUDPConn) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(id)
+}
+
+// remove removes the pending query with id and closes the draining connection
+// without pending queries.  c.mu must be locked.
+func (c *muxUDPConn) remove(id uint16) {
+	delete(c.pending, id)
+	if c.draining && len(c.pending) == 0 {
+		log.OnCloserError(c.conn, log.DEBUG)
+	}
+}
+
+// readLoop reads the responses from c and passes them to the pending queries
+// until an error occurs.  The malformed and unexpected packets are skipped,
+// since those may be spoofed.
+func (c *muxUDPConn) readLoop() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.stop(fmt.Errorf("reading response: %w", err))
+
+			return
+		}
+
+		resp := &dns.Msg{}
+		err = resp.Unpack(buf[:n])
+		if err != nil {
+			log.Debug("plain %s: discarding malformed packet: %s", c.addr, err)
+
+			continue
+		}
+
+		c.dispatch(resp)
+	}
+}
+
+// dispatch passes resp to the pending query it's the response to, if any.
+func (c *muxUDPConn) dispatch(resp *dns.Msg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q, ok := c.pending[resp.Id]
+	if !ok {
+		log.Debug("plain %s: unexpected response id %d", c.addr, resp.Id)
+
+		return
+	}
+
+	if c.strict {
+		err := matchResponse(q.req, resp)
+		if err == nil && c.dns0x20 {
+			err = matchCase(q.req, resp)
+		}
+
+		if err != nil {
+			log.Debug("plain %s: discarding packet: %s", c.addr, err)
+
+			if resp.Response && errors.Is(err, errQuestion) {
+				q.mismatched, q.mismatchErr = resp, err
+			}
+
+			return
+		}
+	}
+
+	c.remove(resp.Id)
+	q.resp <- resp
+}
+
+// stop marks c as stopped due to err and closes it.
+func (c *muxUDPConn) stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+	close(c.done)
+
+	log.OnCloserError(c.conn, log.DEBUG)
+}
+
+// drain makes c close as soon as there are no pending queries.
+func (c *muxUDPConn) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.draining = true
+	if len(c.pending) == 0 {
+		log.OnCloserError(c.conn, log.DEBUG)
+	}
+}
+
+// close closes c regardless of the pending queries.
+func (c *muxUDPConn) close() (err error) {
+	err = c.conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// muxedExchange performs a DNS exchange over the multiplexed UDP connection,
+// dialing it if necessary.  It retries once over a new connection if the
+// current one turns out to be broken, e.g. closed due to an ICMP error.
+func (p *plainDNS) muxedExchange(
+	ctx context.Context,
+	dial bootstrap.DialHandler,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	c, isNew, err := p.muxConn(ctx, dial)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, networkUDP, err)
+	}
+
+	resp, err = p.exchangeMuxConn(ctx, c, req)
+	if err != nil && !isNew && ctx.Err() == nil && !c.isAlive() {
+		log.Debug("plain %s: bad multiplexed conn: %s", p.Address(), err)
+
+		c, _, err = p.muxConn(ctx, dial)
+		if err != nil {
+			return nil, fmt.Errorf("dialing %s over %s again: %w", p.addr.Host, networkUDP, err)
+		}
+
+		resp, err = p.exchangeMuxConn(ctx, c, req)
+	}
+
+	if err != nil {
+		return resp, fmt.Errorf("exchanging with %s over %s: %w", p.Address(), networkUDP, err)
+	}
+
+	return resp, nil
+}
+
+// exchangeMuxConn performs a DNS exchange over the multiplexed connection c.
+// The DNS cookies are used, if enabled.
+func (p *plainDNS) exchangeMuxConn(
+	ctx context.Context,
+	c *muxUDPConn,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	timeout := p.timeout
+	if timeout == 0 {
+		timeout = defaultStrictTimeout
+	}
+
+	exchange := func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+		return c.exchange(ctx, req, timeout)
+	}
+
+	return p.exchangeWithCookies(ctx, exchange, req, c.conn.RemoteAddr().String())
+}
+
+// muxConn returns the current multiplexed connection, dialing a new one if
+// there is none or it's broken.  isNew is true if the connection is just
+// dialed.
+func (p *plainDNS) muxConn(
+	ctx context.Context,
+	dial bootstrap.DialHandler,
+) (c *muxUDPConn, isNew bool, err error) {
+	p.muxMu.Lock()
+	defer p.muxMu.Unlock()
+
+	if p.mux != nil && p.mux.isAlive() {
+		return p.mux, false, nil
+	}
+
+	conn, err := dial(ctx, networkUDP, "")
+	if err != nil {
+		return nil, false, err
+	}
+
+	p.mux = newMuxUDPConn(conn, p.Address(), p.strict, p.dns0x20)
+
+	return p.mux, true, nil
+}
+
+// drainMux makes the multiplexed connection, if any, close as soon as the
+// queries in flight are finished, so that the next exchange dials a new one.
+func (p *plainDNS) drainMux() {
+	p.muxMu.Lock()
+	defer p.muxMu.Unlock()
+
+	if p.mux != nil {
+		p.mux.drain()
+		p.mux = nil
+	}
+}
+
+// closeMux closes the multiplexed connection, if any.
+func (p *plainDNS) closeMux() (err error) {
+	p.muxMu.Lock()
+	defer p.muxMu.Unlock()
+
+	if p.mux == nil {
+		return nil
+	}
+
+	err = p.mux.close()
+	p.mux = nil
+
+	return err
+}
@@ -8,12 +8,16 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
+	"net/http"
 	"net/netip"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
@@ -31,8 +35,15 @@ import (
 type Upstream interface {
 	// Exchange sends the DNS query req to this upstream and returns the
 	// response that has been received or an error if something went wrong.
+	// It's the same as calling ExchangeContext with [context.Background].
 	Exchange(req *dns.Msg) (resp *dns.Msg, err error)
 
+	// ExchangeContext is like Exchange, but it aborts the network operations
+	// in progress as soon as ctx is done, in which case the returned error
+	// wraps the error of ctx.  The timeouts configured within [Options] still
+	// apply.
+	ExchangeContext(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error)
+
 	// Address returns the address of the upstream DNS resolver.
 	Address() (addr string)
 
@@ -74,24 +85,464 @@ type Options struct {
 	// NEPacketTunnelProvider.
 	RootCAs *x509.CertPool
 
+	// PinnedKeys, if not empty, are the SHA-256 hashes of the
+	// SubjectPublicKeyInfo one of which the leaf certificate of the server must
+	// have.  DNS-over-HTTPS, DNS-over-QUIC, and DNS-over-TLS upstreams reject
+	// the connections to the servers with other certificates with an error
+	// wrapping [ErrCertPinMismatch].  The certificate chain is still verified,
+	// unless InsecureSkipVerify is true.
+	PinnedKeys [][]byte
+
+	// RootCAFile, if not empty, is the path to the PEM bundle of the root
+	// certificates used instead of RootCAs, which must be nil then.
+	RootCAFile string
+
+	// ClientCertFile and ClientKeyFile, if not empty, are the paths to the
+	// PEM-encoded certificate and private key presented to the servers by
+	// DNS-over-HTTPS, DNS-over-QUIC, and DNS-over-TLS upstreams for the mutual
+	// TLS authentication.  Both must be set together.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// EDNSClientSubnet, if not nil, is the subnet sent within the EDNS Client
+	// Subnet option of each outgoing query.  The queries already carrying the
+	// option are sent as is, unless OverrideECS is true.
+	EDNSClientSubnet *net.IPNet
+
+	// TrustAnchors are the DS records of the root zone trusted to validate the
+	// DNSSEC signatures, see ValidateDNSSEC.  If empty, [DefaultTrustAnchors]
+	// are used.
+	TrustAnchors []*dns.DS
+
+	// ProxyURL, if not nil, is the URL of the SOCKS5 proxy to dial the
+	// upstreams through.  Its scheme must be either "socks5" or "socks5h".
+	// Upstreams' hostnames are resolved by the proxy, so Bootstrap isn't used.
+	// Only TCP connections are proxied, so that creating the upstreams
+	// requiring UDP, i.e. plain DNS-over-UDP, DNS-over-QUIC, and DNSCrypt,
+	// fails with [ErrProxyUDP].  DNS-over-HTTPS doesn't use HTTP/3 then.
+	ProxyURL *url.URL
+
+	// LocalAddr, if valid, is the local address the outgoing connections are
+	// bound to, including the ones to the proxy.  Dialing fails if it can't be
+	// bound to, e.g. if it doesn't belong to the host or its family differs
+	// from the dialed address.  Note that the certificates of DNSCrypt servers
+	// are fetched without binding, unless DNSCryptRelays are used.
+	LocalAddr netip.Addr
+
+	// Interface, if not empty, is the name of the network interface the
+	// outgoing connections are bound to, just like with LocalAddr.  Its first
+	// non-link-local address of the dialed address's family is used.  It's
+	// ignored if LocalAddr is valid.
+	Interface string
+
+	// DSCP, if not zero, is the Differentiated Services Code Point, see RFC
+	// 2474, the outgoing packets of all the protocols are marked with, so that
+	// the network equipment could prioritize the DNS traffic.  It's set using
+	// the IP_TOS or IPV6_TCLASS socket option and must be less than 64.  Some
+	// systems require privileges to set certain values, so the failures are
+	// only logged.  It's ignored on the platforms other than Unix, e.g. on
+	// Windows, where the marking is controlled by the QoS policies.  It also
+	// applies to the bootstrap resolvers created with [NewUpstreamResolver].
+	// DNS-over-QUIC connections don't use ECN when it's set.
+	DSCP uint8
+
+	// DNSCryptRelays are the anonymized DNSCrypt relays the queries to
+	// DNSCrypt upstreams are sent through, so that the servers don't see the
+	// clients' addresses.  Each one is either a relay stamp, i.e. "sdns://"
+	// with the 0x81 protocol identifier, or an IP address with an optional
+	// port, 443 by default.  A random relay is used for each exchange.  Other
+	// upstreams ignore it.
+	DNSCryptRelays []string
+
 	// CipherSuites is a custom list of TLSv1.2 ciphers.
 	CipherSuites []uint16
 
+	// TLSSessionCache, if not nil, stores the TLS sessions of the
+	// DNS-over-HTTPS, DNS-over-QUIC, and DNS-over-TLS upstreams, so that the
+	// reconnections resume them instead of performing the full handshake.  It
+	// may be shared among the upstreams, since the sessions are stored per
+	// server, and must be safe for concurrent use.  If nil, each upstream
+	// uses its own LRU cache.  The sessions of an upstream are discarded when
+	// it's refreshed, see [RefreshableUpstream].
+	TLSSessionCache tls.ClientSessionCache
+
+	// DoHMethod is the HTTP method DNS-over-HTTPS upstreams use to send the
+	// queries.  If empty, [DoHMethodPost] is used.  GET requests rejected with
+	// the 414 URI Too Long status are retried using POST.
+	DoHMethod DoHMethod
+
+	// ServerName, if not empty, overrides the hostname of DNS-over-HTTPS,
+	// DNS-over-QUIC, and DNS-over-TLS upstreams sent within the Server Name
+	// Indication extension.  The server's certificate is verified against it,
+	// unless InsecureSkipVerify is true.
+	ServerName string
+
 	// Bootstrap is used to resolve upstreams' hostnames.  If nil, the
 	// [net.DefaultResolver] will be used.
 	Bootstrap Resolver
 
+	// QueryRewriter, if not nil, rewrites each query before it's sent to the
+	// upstream and each response received from it, e.g. see [SuffixRewriter].
+	QueryRewriter QueryRewriter
+
+	// MetricsListener, if not nil, receives the events of the upstream, such as
+	// the exchanges with it and the attempts to connect to it.  Use
+	// [EmptyMetricsListener] as a base to only handle some of the events.
+	MetricsListener MetricsListener
+
+	// QueryLogger, if not nil, receives the entry of each exchange with the
+	// upstream, including the retried ones, see Retries.  The entries contain
+	// no client data, unless LogClientSubnet is true.
+	QueryLogger QueryLogger
+
+	// Name, if not empty, is the user-defined label of the upstream, e.g.
+	// "primary-us-east".  It's returned from [Upstream.Address] and
+	// [UpstreamName] and reported to MetricsListener and QueryLogger, the same
+	// way as with [WithName], which is useful to tell apart the upstreams
+	// sharing an address but differing in options.
+	Name string
+
+	// Metadata is the user-defined metadata of the upstream returned from
+	// [UpstreamMetadata].  It must not be modified after the upstream is
+	// created.
+	Metadata map[string]string
+
+	// BootstrapParallel makes the upstreams query all the resolvers set with
+	// [BootstrapSetter.SetBootstrap] concurrently and use the fastest
+	// non-empty response.  Otherwise, the resolvers are queried in order, and
+	// the next one is used when the previous one fails, times out, or responds
+	// with no addresses.
+	BootstrapParallel bool
+
+	// BootstrapTimeout is the timeout for resolving the upstreams' hostnames
+	// with the bootstrap resolvers, so that Timeout only limits the exchanges
+	// themselves.  For the resolvers created with [NewUpstreamResolver], it's
+	// also the timeout of their exchanges.  If zero, Timeout is used.
+	BootstrapTimeout time.Duration
+
+	// BootstrapMinTTL is the minimum time the addresses resolved from the
+	// upstreams' hostnames are reused for, see BootstrapMaxTTL.
+	BootstrapMinTTL time.Duration
+
+	// BootstrapMaxTTL, if positive, makes the upstreams reuse the addresses
+	// resolved from their hostnames until the TTL of the bootstrap responses
+	// expires, but no longer than BootstrapMaxTTL and no shorter than
+	// BootstrapMinTTL.  The TTL is only known for the resolvers implementing
+	// [TTLResolver], for others BootstrapMinTTL is used.  If zero, the
+	// hostnames are resolved for each new connection.
+	BootstrapMaxTTL time.Duration
+
+	// BootstrapJitter, if positive, makes the upstreams reuse the addresses
+	// resolved from their hostnames for a shorter time, reduced by a random
+	// duration of up to BootstrapJitter, see BootstrapMaxTTL.  It spreads the
+	// resolutions of the many upstreams sharing the bootstrap resolvers, which
+	// would otherwise expire at once.  The addresses are never reused for
+	// longer than without it.
+	BootstrapJitter time.Duration
+
 	// HTTPVersions is a list of HTTP versions that should be supported by the
 	// DNS-over-HTTPS client.  If not set, HTTP/1.1 and HTTP/2 will be used.
 	HTTPVersions []HTTPVersion
 
+	// DoHAlternateURLs are the URLs of the DNS-over-HTTPS endpoints
+	// equivalent to the one of the upstream, e.g. the other hostnames of the
+	// same provider.  If not empty, the DNS-over-HTTPS upstream switches to
+	// the next endpoint after several consecutive failures of the current one,
+	// see [IsFailure], and tries the primary endpoint again after a while.  The
+	// address of the upstream is always the primary one.
+	DoHAlternateURLs []string
+
+	// MaxResponseSize is the maximum size of a response message in bytes
+	// accepted from DNS-over-HTTPS, DNS-over-QUIC, DNS-over-TLS, and plain
+	// DNS-over-TCP upstreams.  Larger responses are rejected with
+	// [ErrResponseTooLarge] before reading them, using the Content-Length
+	// header or the length prefix of the message.  If zero or greater than
+	// [dns.MaxMsgSize], [dns.MaxMsgSize] is used, i.e. there is no limit.
+	MaxResponseSize int
+
+	// TCPIdleTimeout is the time after which an idle pooled connection of
+	// a plain DNS-over-TCP upstream is closed, see TCPIdleConns.  If zero,
+	// [DefaultTCPIdleTimeout] is used.
+	TCPIdleTimeout time.Duration
+
+	// DoQIdleTimeout is the time after which an unused DNS-over-QUIC
+	// connection is closed and a new one is dialed for the next exchange,
+	// since the server or a NAT could have silently dropped it.  If zero, the
+	// connections are only re-dialed after failures.
+	DoQIdleTimeout time.Duration
+
+	// DoQMaxStreamsPerConn is the maximum number of queries a DNS-over-QUIC
+	// upstream sends over a single connection, which is useful for the servers
+	// limiting the number of streams per connection.  When it's reached, a new
+	// connection is dialed for the following queries, while the old one is
+	// closed after the queries in flight are finished.  If zero, the number
+	// isn't limited.
+	DoQMaxStreamsPerConn int
+
+	// DoHIdleConnTimeout is the time an idle connection of a DNS-over-HTTPS
+	// upstream is kept open for reuse.  It should be shorter than the one of
+	// the server, so that the connections closed by the server aren't reused.
+	// If zero, [DefaultDoHIdleConnTimeout] is used.
+	DoHIdleConnTimeout time.Duration
+
+	// DoHMaxIdleConns is the maximum number of idle connections a
+	// DNS-over-HTTPS upstream keeps open for reuse.  If zero, 2 is used.
+	DoHMaxIdleConns int
+
+	// ProbeTimeout is the timeout of a single health-check probe, see
+	// [ProbableUpstream].  It's independent of Timeout.  If zero,
+	// [DefaultProbeTimeout] is used.
+	ProbeTimeout time.Duration
+
+	// CloseGracePeriod is the maximum time Close waits for the exchanges in
+	// flight to finish before closing the connections.  The exchanges started
+	// after Close is called fail with [ErrClosed].  If zero,
+	// [DefaultCloseGracePeriod] is used, if negative, Close doesn't wait.
+	CloseGracePeriod time.Duration
+
 	// Timeout is the default upstream timeout.  It's also used as a timeout for
 	// bootstrap DNS requests.  Zero value disables the timeout.
 	Timeout time.Duration
 
+	// RetryBackoff is the delay before the first retry, see Retries.  It's
+	// doubled for each subsequent retry.
+	RetryBackoff time.Duration
+
+	// Retries is the maximum number of retries of an exchange failed with
+	// a transient error, e.g. a timeout, a connection reset, or a QUIC
+	// handshake failure.  Each retry bootstraps the upstream's address anew.
+	// Errors are wrapped into [*RetryError] if it's positive.
+	Retries int
+
+	// RateLimit, if positive, is the maximum average number of queries per
+	// second sent to the upstream.  The exchanges exceeding it wait for their
+	// turn until Timeout or the context expires, in which case
+	// [ErrRateLimited] is returned.  Each upstream has its own limit.
+	RateLimit float64
+
+	// RateBurst is the maximum number of queries sent to the upstream at once
+	// without waiting, see RateLimit.  If zero, 1 is used.
+	RateBurst int
+
+	// MaxConcurrentQueries, if positive, is the maximum number of exchanges in
+	// flight with the upstream.  The exchanges exceeding it wait for one of
+	// those to finish until Timeout or the context expires, in which case
+	// [ErrTooManyQueries] is returned.  It's useful to stay within the stream
+	// limits of the DNS-over-HTTPS and DNS-over-QUIC servers, since each
+	// exchange uses a single stream.  Each upstream has its own limit.
+	MaxConcurrentQueries int
+
+	// ECSPrefixLen, if positive, limits the number of leading bits of
+	// EDNSClientSubnet actually sent, so that the rest of the address isn't
+	// disclosed to the upstream.
+	ECSPrefixLen int
+
+	// TCPIdleConns is the maximum number of idle connections a plain
+	// DNS-over-TCP upstream keeps for reuse.  Zero disables pooling, so that
+	// each exchange uses a new connection.
+	TCPIdleConns int
+
+	// RTTAlpha is the smoothing factor of the mean round-trip time reported by
+	// [UpstreamWithStats], it must be within (0, 1].  Greater values discount
+	// older measurements faster.  If zero, [DefaultRTTAlpha] is used.
+	RTTAlpha float64
+
+	// TruncatedPolicy defines how the responses with the TC bit set are
+	// handled when received over a transport without message size limits.
+	// Plain DNS-over-UDP and DNSCrypt upstreams ignore it.  Only
+	// DNS-over-HTTPS and DNS-over-QUIC upstreams support
+	// [TruncatedPolicyRetry].
+	TruncatedPolicy TruncatedPolicy
+
+	// BalancingStrategy defines the order in which the addresses resolved
+	// from the upstream's hostname are dialed for each new connection.  It
+	// doesn't affect the upstreams with IP addresses and the ones dialed
+	// through a proxy.  The zero value is [BalancingStrategyFirstAvailable].
+	BalancingStrategy BalancingStrategy
+
+	// UDPBufferSize is the EDNS0 UDP payload size advertised by plain
+	// DNS-over-UDP upstreams within the OPT record added to the queries
+	// having none.  It's also the size of the buffer for reading the
+	// responses.  If zero, [DefaultUDPBufferSize] is used.  The OPT record
+	// added is removed from the response.
+	UDPBufferSize uint16
+
+	// EnableQUIC0RTT makes DNS-over-QUIC upstreams send the queries within
+	// the 0-RTT early data when resuming a session with the server.  Since the
+	// early data can be replayed by an attacker, only the idempotent queries,
+	// i.e. the ones with the QUERY opcode, are sent this way.  The queries are
+	// sent again after the handshake if the server rejects the early data.
+	EnableQUIC0RTT bool
+
+	// EnableQUICMigration makes DNS-over-QUIC upstreams check the network path
+	// to the server before reusing a connection and dial a new one once the
+	// path has changed, e.g. when a mobile device switches from Wi-Fi to a
+	// cellular network.  The connections broken by the change are replaced
+	// anyway, but this saves the failed attempt and the timeout.
+	EnableQUICMigration bool
+
+	// PreserveRecursionDesired makes the upstream forward the RD bit of the
+	// original queries as is.  Otherwise, the upstream sets the RD bit in the
+	// outgoing queries, since the recursive resolvers may not recurse for the
+	// queries without it, and restores the original value in both the query
+	// and the response after the exchange.  It's useful for authoritative
+	// upstreams.
+	PreserveRecursionDesired bool
+
+	// OverrideECS makes the upstream replace the EDNS Client Subnet option
+	// already present in the query with EDNSClientSubnet.
+	OverrideECS bool
+
+	// ValidateDNSSEC makes the upstream request the DNSSEC records and validate
+	// the chain of trust of each response starting from TrustAnchors.  The
+	// responses failing the validation are returned along with an error
+	// wrapping [ErrDNSSECValidation].  The additional DNSKEY and DS requests
+	// are sent to the same upstream.
+	ValidateDNSSEC bool
+
+	// EnableDANE makes DNS-over-TLS upstreams look up the TLSA records of their
+	// hostnames, as defined by RFC 6698, and verify the servers' certificates
+	// against those.  The records are requested from the first upstream of
+	// Bootstrap, which must be an upstream resolver then, and validated like
+	// ValidateDNSSEC does, starting from TrustAnchors.  The certificates not
+	// matching the secure records are rejected with an error wrapping
+	// [ErrDANEValidation], as well as the connections for which the lookup
+	// fails.  The certificates matching the DANE-TA and DANE-EE records are
+	// accepted regardless of the WebPKI, while the PKIX-TA and PKIX-EE records
+	// also require the regular verification.  If the records are insecure or
+	// missing, only the regular verification is performed.
+	EnableDANE bool
+
+	// DisableTCPFallback makes plain DNS-over-UDP upstreams return the
+	// truncated and malformed responses as is instead of retrying the queries
+	// over TCP.  Otherwise, the retries are sent to the same address the
+	// original queries have been sent to.
+	DisableTCPFallback bool
+
+	// PreferTCP makes plain DNS-over-UDP upstreams send the queries over TCP
+	// first, keeping the addresses as is.  The queries are only sent over UDP
+	// if the TCP connection can't be established, e.g. when it's refused.
+	PreferTCP bool
+
+	// DisableStrictValidation makes plain DNS-over-UDP upstreams accept the
+	// first response with the matching ID, as [dns.Client] does.  Otherwise,
+	// the packets which aren't responses to the query, i.e. have a different
+	// ID, the QR bit unset, or a different question name, type, or class, are
+	// discarded and the reading continues until Timeout, which mitigates the
+	// off-path cache poisoning.  If only the responses with mismatched
+	// questions are received, the last of those is handled like a malformed
+	// one, see DisableTCPFallback.
+	DisableStrictValidation bool
+
+	// EnableDNS0x20 makes plain DNS-over-UDP upstreams randomize the case of
+	// the letters of the question names, as described by the 0x20 encoding
+	// draft, to further mitigate the off-path spoofing.  The responses must
+	// echo the exact case, otherwise those are handled like the ones with
+	// mismatched questions, see DisableStrictValidation.  The original case is
+	// restored in the responses.  The queries retried over TCP aren't
+	// randomized.  It shouldn't be used with the servers not preserving the
+	// case of the question names.
+	EnableDNS0x20 bool
+
+	// LogClientSubnet makes the upstream put the subnet from the EDNS Client
+	// Subnet option of the queries into the entries passed to QueryLogger.
+	// It's false by default, since the subnet may identify the client.
+	LogClientSubnet bool
+
+	// DisableEDNS0 makes the upstream remove the OPT records from the outgoing
+	// queries and never add them, which is only useful for the legacy servers
+	// responding to the EDNS0 queries improperly.  Note that it reduces the
+	// functionality: UDPBufferSize, EnableDNSCookies, and EDNSClientSubnet are
+	// ignored, and the plain DNS-over-UDP upstreams only accept the responses
+	// of up to 512 bytes, so that the larger ones are retried over TCP.  It
+	// can't be used with ValidateDNSSEC.
+	DisableEDNS0 bool
+
+	// EnableDNSCookies makes plain DNS-over-UDP upstreams use DNS cookies, as
+	// defined by RFC 7873, to mitigate the off-path spoofing.  The client
+	// cookie is the same for all the queries of a single upstream, while the
+	// server cookies are remembered for each server address.  The responses
+	// with the BADCOOKIE rcode are retried once with the new server cookie.
+	EnableDNSCookies bool
+
+	// DoHJSON makes DNS-over-HTTPS upstreams use the JSON API, as provided by
+	// Google and Cloudflare, instead of the RFC 8484 wire format.  The URL of
+	// such an upstream should point to the JSON endpoint, e.g.
+	// "https://dns.google/resolve".  The queries are always sent using GET,
+	// so DoHMethod is ignored, and only the question, the DO and CD bits, and
+	// the ECS option of the query are sent.
+	DoHJSON bool
+
+	// PrefetchAAAA makes DNS-over-HTTPS upstreams send the AAAA query for the
+	// name of each A query speculatively, using the same HTTP client and thus
+	// likely the same connection.  The primary response isn't delayed by it.
+	// The prefetched responses are only requested and passed to the handler
+	// when one is set, see [PrefetchingUpstream], e.g. when the upstream is
+	// wrapped with [NewCachingUpstream].  Note that the HTTP/2 server pushes
+	// are never accepted, since the transport disables them.
+	PrefetchAAAA bool
+
+	// DoTPipelining makes DNS-over-TLS upstreams send all the queries over a
+	// single connection without waiting for the responses to the previous
+	// ones, as described in RFC 7766.  The responses are matched to the
+	// queries by their IDs, which are replaced with unique ones internally.
+	// Otherwise, each connection carries a single query at a time.
+	DoTPipelining bool
+
+	// UDPMultiplex makes plain DNS-over-UDP upstreams send all the queries
+	// over a single connected socket, which is kept open between the
+	// exchanges, instead of dialing a new one for each query.  The responses
+	// are read in the background and matched to the queries by their IDs,
+	// which are replaced with unique ones internally.  The socket is dialed
+	// again after it breaks, e.g. due to an ICMP error, and after the upstream
+	// is refreshed, see [RefreshableUpstream].
+	UDPMultiplex bool
+
+	// DoQFallbackToDoT makes DNS-over-QUIC upstreams send the queries over
+	// DNS-over-TLS to the same host and port when the QUIC connection can't be
+	// established, e.g. in the networks blocking UDP.  QUIC is tried again
+	// after 30 seconds, and the fallback stops after the first successful
+	// exchange over it.  Both the fallback and the recovery are logged.
+	DoQFallbackToDoT bool
+
+	// DoTKeepalive makes DNS-over-TLS upstreams send the EDNS TCP keepalive
+	// option, see RFC 7828, within the first query over each connection and
+	// close the connections idle for longer than the timeout advertised by
+	// the server in response, instead of reusing them.  The option, and the
+	// OPT record if it's been added for it, are removed from the responses.
+	// It doesn't affect the connections used with DoTPipelining.  See
+	// [KeepaliveUpstream] for the timeout advertised.
+	DoTKeepalive bool
+
+	// ODoHRelay is the URL of the Oblivious DoH relay, as defined by RFC 9230,
+	// e.g. "https://relay.example/proxy".  The upstreams with the "odoh"
+	// scheme send the queries encrypted for the target through this relay, so
+	// that neither of them sees both the client address and the query.  It
+	// must be set for such upstreams.  The configuration of the target is
+	// fetched from its well-known URI and reused for the time specified by
+	// the Cache-Control header of the response.  It's fetched again earlier
+	// when the target seems to have rotated its keys, and the query is retried
+	// once then.
+	ODoHRelay string
+
+	// RetryOnServerFailure makes the upstream also retry the exchanges
+	// resulted in SERVFAIL responses, see Retries.
+	RetryOnServerFailure bool
+
 	// InsecureSkipVerify disables verifying the server's certificate.
 	InsecureSkipVerify bool
 
+	// DisableTLSSessionCache disables the TLS session resumption, so that each
+	// connection performs the full handshake.  TLSSessionCache is ignored
+	// then.
+	DisableTLSSessionCache bool
+
+	// DisableSNI makes DNS-over-HTTPS, DNS-over-QUIC, and DNS-over-TLS
+	// upstreams omit the Server Name Indication extension.  The server's
+	// certificate is still verified against ServerName or the upstream's
+	// hostname, but VerifyServerCertificate receives no verified chains then.
+	DisableSNI bool
+
 	// PreferIPv6 tells the bootstrapper to prefer IPv6 addresses for an
 	// upstream.
 	PreferIPv6 bool
@@ -101,17 +552,130 @@ type Options struct {
 func (o *Options) Clone() (clone *Options) {
 	return &Options{
 		Bootstrap:                 o.Bootstrap,
+		BootstrapParallel:         o.BootstrapParallel,
+		BootstrapTimeout:          o.BootstrapTimeout,
+		BootstrapMinTTL:           o.BootstrapMinTTL,
+		BootstrapMaxTTL:           o.BootstrapMaxTTL,
+		BootstrapJitter:           o.BootstrapJitter,
+		MetricsListener:           o.MetricsListener,
+		QueryLogger:               o.QueryLogger,
+		Name:                      o.Name,
+		Metadata:                  o.Metadata,
+		QueryRewriter:             o.QueryRewriter,
 		Timeout:                   o.Timeout,
 		HTTPVersions:              o.HTTPVersions,
+		DoHAlternateURLs:          o.DoHAlternateURLs,
+		DoHMethod:                 o.DoHMethod,
 		VerifyServerCertificate:   o.VerifyServerCertificate,
 		VerifyConnection:          o.VerifyConnection,
 		VerifyDNSCryptCertificate: o.VerifyDNSCryptCertificate,
 		InsecureSkipVerify:        o.InsecureSkipVerify,
+		DisableTLSSessionCache:    o.DisableTLSSessionCache,
+		DisableSNI:                o.DisableSNI,
+		ServerName:                o.ServerName,
 		PreferIPv6:                o.PreferIPv6,
+		BalancingStrategy:         o.BalancingStrategy,
 		QUICTracer:                o.QUICTracer,
 		RootCAs:                   o.RootCAs,
+		RootCAFile:                o.RootCAFile,
+		PinnedKeys:                o.PinnedKeys,
+		ClientCertFile:            o.ClientCertFile,
+		ClientKeyFile:             o.ClientKeyFile,
 		CipherSuites:              o.CipherSuites,
+		TLSSessionCache:           o.TLSSessionCache,
+		DNSCryptRelays:            o.DNSCryptRelays,
+		MaxResponseSize:           o.MaxResponseSize,
+		UDPBufferSize:             o.UDPBufferSize,
+		PreserveRecursionDesired:  o.PreserveRecursionDesired,
+		EnableQUIC0RTT:            o.EnableQUIC0RTT,
+		EnableQUICMigration:       o.EnableQUICMigration,
+		TruncatedPolicy:           o.TruncatedPolicy,
+		Retries:                   o.Retries,
+		RetryBackoff:              o.RetryBackoff,
+		RateLimit:                 o.RateLimit,
+		RateBurst:                 o.RateBurst,
+		MaxConcurrentQueries:      o.MaxConcurrentQueries,
+		RetryOnServerFailure:      o.RetryOnServerFailure,
+		DisableTCPFallback:        o.DisableTCPFallback,
+		PreferTCP:                 o.PreferTCP,
+		DisableStrictValidation:   o.DisableStrictValidation,
+		EnableDNS0x20:             o.EnableDNS0x20,
+		LogClientSubnet:           o.LogClientSubnet,
+		EnableDNSCookies:          o.EnableDNSCookies,
+		DisableEDNS0:              o.DisableEDNS0,
+		RTTAlpha:                  o.RTTAlpha,
+		TCPIdleConns:              o.TCPIdleConns,
+		TCPIdleTimeout:            o.TCPIdleTimeout,
+		EDNSClientSubnet:          o.EDNSClientSubnet,
+		ECSPrefixLen:              o.ECSPrefixLen,
+		OverrideECS:               o.OverrideECS,
+		TrustAnchors:              o.TrustAnchors,
+		ValidateDNSSEC:            o.ValidateDNSSEC,
+		EnableDANE:                o.EnableDANE,
+		ProxyURL:                  o.ProxyURL,
+		LocalAddr:                 o.LocalAddr,
+		Interface:                 o.Interface,
+		DSCP:                      o.DSCP,
+		ProbeTimeout:              o.ProbeTimeout,
+		CloseGracePeriod:          o.CloseGracePeriod,
+		DoQIdleTimeout:            o.DoQIdleTimeout,
+		DoQMaxStreamsPerConn:      o.DoQMaxStreamsPerConn,
+		DoHIdleConnTimeout:        o.DoHIdleConnTimeout,
+		DoHMaxIdleConns:           o.DoHMaxIdleConns,
+		DoHJSON:                   o.DoHJSON,
+		PrefetchAAAA:              o.PrefetchAAAA,
+		DoTPipelining:             o.DoTPipelining,
+		UDPMultiplex:              o.UDPMultiplex,
+		DoTKeepalive:              o.DoTKeepalive,
+		DoQFallbackToDoT:          o.DoQFallbackToDoT,
+		ODoHRelay:                 o.ODoHRelay,
+	}
+}
+
+// ErrProxyUDP is returned when the upstream requiring UDP is configured to be
+// dialed through a proxy, see [Options.ProxyURL].
+const ErrProxyUDP errors.Error = bootstrap.ErrProxyUDP
+
+// errBadDSCP is returned when [Options.DSCP] doesn't fit into six bits.
+const errBadDSCP errors.Error = "dscp must be less than 64"
+
+// errBadTruncatedPolicy is returned when [Options.TruncatedPolicy] isn't one
+// of the defined values.
+const errBadTruncatedPolicy errors.Error = "bad truncated policy"
+
+// errDNSSECNoEDNS is returned when both [Options.DisableEDNS0] and
+// [Options.ValidateDNSSEC] are set, since the validation requires EDNS0.
+const errDNSSECNoEDNS errors.Error = "dnssec validation requires edns0"
+
+// ErrResponseTooLarge is returned when the upstream's response exceeds
+// [Options.MaxResponseSize].
+const ErrResponseTooLarge errors.Error = "response too large"
+
+// forceRecursionDesired sets the RD bit in req if force is true and it isn't set
+// yet.  restore must be called with the response to req after the exchange to
+// clear the bit back in both req and resp, resp may be nil.
+func forceRecursionDesired(req *dns.Msg, force bool) (restore func(resp *dns.Msg)) {
+	if !force || req.RecursionDesired {
+		return func(_ *dns.Msg) {}
+	}
+
+	req.RecursionDesired = true
+
+	return func(resp *dns.Msg) {
+		req.RecursionDesired = false
+		if resp != nil {
+			resp.RecursionDesired = false
+		}
+	}
+}
+
+// maxResponseSize returns the effective maximum response size from opts.
+func maxResponseSize(opts *Options) (n int) {
+	if opts.MaxResponseSize <= 0 || opts.MaxResponseSize > dns.MaxMsgSize {
+		return dns.MaxMsgSize
 	}
+
+	return opts.MaxResponseSize
 }
 
 // HTTPVersion is an enumeration of the HTTP versions that we support.  Values
@@ -131,6 +695,19 @@ const (
 // the DNS-over-HTTPS client.
 var DefaultHTTPVersions = []HTTPVersion{HTTPVersion11, HTTPVersion2}
 
+// DoHMethod is the HTTP method used by the DNS-over-HTTPS client to send the
+// queries.
+type DoHMethod string
+
+const (
+	// DoHMethodPost sends the wire-format query within the request body.
+	DoHMethodPost DoHMethod = http.MethodPost
+
+	// DoHMethodGet sends the base64url-encoded query within the "dns" query
+	// parameter.  It's useful with the caching HTTP proxies and CDNs.
+	DoHMethodGet DoHMethod = http.MethodGet
+)
+
 const (
 	// defaultPortPlain is the default port for plain DNS.
 	defaultPortPlain = 53
@@ -163,6 +740,7 @@ const (
 //   - quic://5.3.5.3:853 for DNS-over-QUIC using IP address;
 //   - quic://name.server:853 for DNS-over-QUIC using domain name;
 //   - h3://dns.google for DNS-over-HTTPS that only works with HTTP/3;
+//   - odoh://odoh.target/dns-query for Oblivious DoH, see [Options.ODoHRelay];
 //   - sdns://... for DNS stamp, see https://dnscrypt.info/stamps-specifications.
 //
 // If addr doesn't have port specified, the default port of the appropriate
@@ -177,7 +755,89 @@ func AddressToUpstream(addr string, opts *Options) (u Upstream, err error) {
 		opts = &Options{}
 	}
 
-	var uu *url.URL
+	uu, err := parseAddress(addr)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
+	}
+
+	if opts.DisableEDNS0 && opts.ValidateDNSSEC {
+		return nil, errDNSSECNoEDNS
+	} else if opts.DSCP >= 64 {
+		return nil, fmt.Errorf("dscp %d: %w", opts.DSCP, errBadDSCP)
+	} else if opts.TruncatedPolicy > TruncatedPolicyRetry {
+		return nil, fmt.Errorf("%w: %d", errBadTruncatedPolicy, opts.TruncatedPolicy)
+	}
+
+	u, err = urlToUpstream(uu, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapUpstream(u, opts), nil
+}
+
+// AddressesToUpstreams converts each of addrs to an Upstream using opts, see
+// [AddressToUpstream].  ups and errs have the same length as addrs, and for
+// each address either the upstream or the error is nil, so that the failed
+// addresses could be reported while the rest of the upstreams are used.  Use
+// [AddressesToUpstreamsStrict] to fail on the first error.
+func AddressesToUpstreams(addrs []string, opts *Options) (ups []Upstream, errs []error) {
+	ups = make([]Upstream, len(addrs))
+	errs = make([]error, len(addrs))
+	for i, addr := range addrs {
+		ups[i], errs[i] = AddressToUpstream(addr, opts)
+	}
+
+	return ups, errs
+}
+
+// AddressesToUpstreamsStrict is like [AddressesToUpstreams] but returns the
+// error for the first address failed to convert.  The upstreams created before
+// are closed in this case.
+func AddressesToUpstreamsStrict(addrs []string, opts *Options) (ups []Upstream, err error) {
+	ups = make([]Upstream, 0, len(addrs))
+	for i, addr := range addrs {
+		var u Upstream
+		u, err = AddressToUpstream(addr, opts)
+		if err != nil {
+			err = fmt.Errorf("upstream at index %d: %w", i, err)
+
+			return nil, errors.WithDeferred(err, closeAll(ups))
+		}
+
+		ups = append(ups, u)
+	}
+
+	return ups, nil
+}
+
+// ValidateAddress returns an error if addr isn't a valid upstream address, see
+// [AddressToUpstream].  It only parses addr, so the hostnames aren't resolved
+// and no connections are made.  The errors are the same [AddressToUpstream]
+// returns for the same addr.
+func ValidateAddress(addr string) (err error) {
+	uu, err := parseAddress(addr)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return err
+	}
+
+	switch sch := uu.Scheme; sch {
+	case "sdns":
+		_, _, err = parseServerStamp(uu)
+
+		return err
+	case "udp", "tcp", "quic", "tls", "h3", "https", "odoh":
+		return nil
+	default:
+		return fmt.Errorf("unsupported url scheme: %s", sch)
+	}
+}
+
+// parseAddress parses and validates the upstream URL from addr.  The address
+// without scheme is considered to be a plain DNS-over-UDP one.
+func parseAddress(addr string) (uu *url.URL, err error) {
 	if strings.Contains(addr, "://") {
 		uu, err = url.Parse(addr)
 		if err != nil {
@@ -196,7 +856,66 @@ func AddressToUpstream(addr string, opts *Options) (u Upstream, err error) {
 		return nil, err
 	}
 
-	return urlToUpstream(uu, opts)
+	return uu, nil
+}
+
+// wrapUpstream wraps u into the upstreams implementing the features configured
+// in opts, which aren't specific to a protocol.
+func wrapUpstream(u Upstream, opts *Options) (wrapped Upstream) {
+	if opts.MaxConcurrentQueries > 0 {
+		u = newConcurrencyLimitedUpstream(u, opts)
+	}
+
+	if opts.RateLimit > 0 {
+		u = newRateLimitedUpstream(u, opts)
+	}
+
+	if opts.DisableEDNS0 {
+		u = newNoEDNSUpstream(u)
+	}
+
+	if opts.MetricsListener != nil {
+		u = newMetricsUpstream(u, opts.MetricsListener)
+	}
+
+	if opts.ValidateDNSSEC {
+		u = newDNSSECUpstream(u, opts)
+	}
+
+	if opts.QueryLogger != nil {
+		u = newQueryLogUpstream(u, opts)
+	}
+
+	if opts.EDNSClientSubnet != nil && !opts.DisableEDNS0 {
+		u = newECSUpstream(u, opts)
+	}
+
+	if opts.Retries > 0 {
+		u = newRetryUpstream(u, opts)
+	}
+
+	if opts.QueryRewriter != nil {
+		u = newRewriteUpstream(u, opts.QueryRewriter)
+	}
+
+	if opts.Name != "" || opts.Metadata != nil {
+		u = newNamedUpstream(u, opts.Name, opts.Metadata)
+	}
+
+	return u
+}
+
+// unwrapUpstream returns the innermost upstream wrapped by u, e.g. with
+// [WithName].
+func unwrapUpstream(u Upstream) (unwrapped Upstream) {
+	for {
+		w, ok := u.(interface{ Unwrap() (ups Upstream) })
+		if !ok {
+			return u
+		}
+
+		u = w.Unwrap()
+	}
 }
 
 // validateUpstreamURL returns an error if the upstream URL is not valid.
@@ -251,16 +970,19 @@ func urlToUpstream(uu *url.URL, opts *Options) (u Upstream, err error) {
 		return newDoT(uu, opts)
 	case "h3", "https":
 		return newDoH(uu, opts)
+	case "odoh":
+		return newODoH(uu, opts)
 	default:
 		return nil, fmt.Errorf("unsupported url scheme: %s", sch)
 	}
 }
 
-// parseStamp converts a DNS stamp to an Upstream.
-func parseStamp(upsURL *url.URL, opts *Options) (u Upstream, err error) {
-	stamp, err := dnsstamps.NewServerStampFromString(upsURL.String())
+// parseServerStamp parses the DNS stamp from upsURL and validates it.  ip is
+// the address of the server from the stamp, if any.
+func parseServerStamp(upsURL *url.URL) (stamp dnsstamps.ServerStamp, ip netip.Addr, err error) {
+	stamp, err = dnsstamps.NewServerStampFromString(upsURL.String())
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse %s: %w", upsURL, err)
+		return stamp, ip, fmt.Errorf("failed to parse %s: %w", upsURL, err)
 	}
 
 	// TODO(e.burkov):  Port?
@@ -270,12 +992,34 @@ func parseStamp(upsURL *url.URL, opts *Options) (u Upstream, err error) {
 			host = stamp.ServerAddrStr
 		}
 
-		var ip netip.Addr
 		ip, err = netip.ParseAddr(host)
 		if err != nil {
-			return nil, fmt.Errorf("invalid server stamp address %s", stamp.ServerAddrStr)
+			return stamp, ip, fmt.Errorf("invalid server stamp address %s", stamp.ServerAddrStr)
 		}
+	}
+
+	switch stamp.Proto {
+	case
+		dnsstamps.StampProtoTypePlain,
+		dnsstamps.StampProtoTypeDNSCrypt,
+		dnsstamps.StampProtoTypeDoH,
+		dnsstamps.StampProtoTypeDoQ,
+		dnsstamps.StampProtoTypeTLS:
+		return stamp, ip, nil
+	default:
+		return stamp, ip, fmt.Errorf("unsupported stamp protocol %s", &stamp.Proto)
+	}
+}
+
+// parseStamp converts a DNS stamp to an Upstream.
+func parseStamp(upsURL *url.URL, opts *Options) (u Upstream, err error) {
+	stamp, ip, err := parseServerStamp(upsURL)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return nil, err
+	}
 
+	if ip.IsValid() {
 		opts.Bootstrap = StaticResolver{ip}
 	}
 
@@ -283,7 +1027,11 @@ func parseStamp(upsURL *url.URL, opts *Options) (u Upstream, err error) {
 	case dnsstamps.StampProtoTypePlain:
 		return newPlain(&url.URL{Scheme: "udp", Host: stamp.ServerAddrStr}, opts)
 	case dnsstamps.StampProtoTypeDNSCrypt:
-		return newDNSCrypt(upsURL, opts), nil
+		if opts.ProxyURL != nil {
+			return nil, fmt.Errorf("dnscrypt: %w", ErrProxyUDP)
+		}
+
+		return newDNSCrypt(upsURL, opts)
 	case dnsstamps.StampProtoTypeDoH:
 		return newDoH(&url.URL{Scheme: "https", Host: stamp.ProviderName, Path: stamp.Path}, opts)
 	case dnsstamps.StampProtoTypeDoQ:
@@ -323,8 +1071,9 @@ func logBegin(addr string, n network, req *dns.Msg) {
 
 // logFinish logs the end of DNS request resolution.  It should be called right
 // after receiving the response from the upstream or the failing action.  n is
-// the [network] that was used to send the request.
-func logFinish(addr string, n network, err error) {
+// the [network] that was used to send the request.  The extended DNS errors of
+// resp, if any, are logged as well.
+func logFinish(addr string, n network, resp *dns.Msg, err error) {
 	logRoutine := log.Debug
 
 	status := "ok"
@@ -337,6 +1086,10 @@ func logFinish(addr string, n network, err error) {
 	}
 
 	logRoutine("dnsproxy: %s: response received over %s: %q", addr, n, status)
+
+	for _, ede := range ExtendedErrors(resp) {
+		log.Debug("dnsproxy: %s: extended dns error: %s", addr, ede)
+	}
 }
 
 // isTimeout returns true if err is a timeout error.
@@ -360,25 +1113,382 @@ func isTimeout(err error) (ok bool) {
 // DialerInitializer returns the handler that it creates.
 type DialerInitializer func() (handler bootstrap.DialHandler, err error)
 
-// newDialerInitializer creates an initializer of the dialer that will dial the
-// addresses resolved from u using opts.
-func newDialerInitializer(u *url.URL, opts *Options) (di DialerInitializer) {
-	if _, err := netip.ParseAddrPort(u.Host); err == nil {
-		// Don't resolve the address of the server since it's already an IP.
-		handler := bootstrap.NewDialContext(opts.Timeout, u.Host)
+// BootstrapSetter is an optional interface for upstreams which resolve their
+// hostnames using bootstrap resolvers.
+type BootstrapSetter interface {
+	// SetBootstrap replaces the resolvers used to resolve the upstream's
+	// hostname.  The next dial handler requested by the upstream is created
+	// using the new resolvers, while the exchanges in flight keep using the
+	// connections they already have.  Empty resolvers mean
+	// [net.DefaultResolver], as well as nil ones within resolvers.  Multiple
+	// resolvers are used in order, unless [Options.BootstrapParallel] is set.
+	// It must be safe for concurrent use.
+	SetBootstrap(resolvers []Resolver)
+}
+
+// bootstrapper resolves the upstream's hostname and creates the dial handlers
+// for the resolved addresses.  It's safe for concurrent use.
+type bootstrapper struct {
+	// mu protects resolver, resolved, cachedHandler, and cachedUntil.
+	mu *sync.RWMutex
+
+	// url is the address of the upstream.  It must not be modified.
+	url *url.URL
+
+	// resolver is used to resolve the hostname of url.  It's nil if the host
+	// of url is an IP address.
+	resolver Resolver
+
+	// staticHandler is the dial handler used when the host of url is an IP
+	// address or when it's dialed through a proxy.  It's nil otherwise.
+	staticHandler bootstrap.DialHandler
+
+	// resolved are the addresses of the most recent successful resolution of
+	// the hostname of url.  It's the address itself if the host of url is an
+	// IP address.  It must not be modified.
+	resolved []netip.Addr
+
+	// cachedHandler is the dial handler for the resolved addresses reused
+	// until cachedUntil.  It's nil if there is none.
+	cachedHandler bootstrap.DialHandler
 
-		return func() (h bootstrap.DialHandler, dialerErr error) {
-			return handler, nil
+	// cachedUntil is the time cachedHandler expires at.
+	cachedUntil time.Time
+
+	// balancer orders the resolved addresses for each new connection.
+	balancer *addrsBalancer
+
+	// timeout is the timeout for dialing.
+	timeout time.Duration
+
+	// bootstrapTimeout is the timeout for resolving the hostname of url.
+	bootstrapTimeout time.Duration
+
+	// minTTL is the minimum time the resolved addresses are reused for.
+	minTTL time.Duration
+
+	// maxTTL is the maximum time the resolved addresses are reused for.  Zero
+	// means that the hostname is resolved for each new connection.
+	maxTTL time.Duration
+
+	// jitter is the maximum random duration the time the resolved addresses
+	// are reused for is reduced by.
+	jitter time.Duration
+
+	// binding is the local endpoint the connections are bound to.  It's nil
+	// if the connections aren't bound.
+	binding *bootstrap.Binding
+
+	// preferV6 tells to prefer IPv6 addresses when dialing.
+	preferV6 bool
+
+	// onDial, if not nil, is called after each dialing attempt.  It's set
+	// before the upstream is used and is never changed afterwards.
+	onDial func(err error)
+
+	// parallel tells to query the multiple bootstrap resolvers concurrently.
+	parallel bool
+}
+
+// newBootstrapper creates a bootstrapper for the addresses resolved from u
+// using opts.  If opts.ProxyURL is set, the host of u is resolved by the proxy.
+func newBootstrapper(u *url.URL, opts *Options) (b *bootstrapper, err error) {
+	balancer, err := newAddrsBalancer(opts.BalancingStrategy)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping %s: %w", u.Host, err)
+	}
+
+	bootstrapTimeout := opts.BootstrapTimeout
+	if bootstrapTimeout == 0 {
+		bootstrapTimeout = opts.Timeout
+	}
+
+	b = &bootstrapper{
+		mu:               &sync.RWMutex{},
+		url:              u,
+		balancer:         balancer,
+		timeout:          opts.Timeout,
+		bootstrapTimeout: bootstrapTimeout,
+		minTTL:           opts.BootstrapMinTTL,
+		maxTTL:           opts.BootstrapMaxTTL,
+		jitter:           opts.BootstrapJitter,
+		binding:          newBinding(opts),
+		preferV6:         opts.PreferIPv6,
+		parallel:         opts.BootstrapParallel,
+	}
+
+	if opts.ProxyURL != nil {
+		// Don't resolve the hostname locally to avoid leaking it.
+		b.staticHandler, err = bootstrap.NewProxyDialContext(
+			opts.Timeout,
+			b.binding,
+			opts.ProxyURL,
+			u.Host,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrapping %s: %w", u.Host, err)
 		}
+
+		return b, nil
 	}
 
-	boot := opts.Bootstrap
-	if boot == nil {
+	if ap, parseErr := netip.ParseAddrPort(u.Host); parseErr == nil {
+		// Don't resolve the address of the server since it's already an IP.
+		b.staticHandler = bootstrap.NewDialContext(opts.Timeout, b.binding, u.Host)
+		b.resolved = []netip.Addr{ap.Addr()}
+
+		return b, nil
+	}
+
+	b.resolver = opts.Bootstrap
+	if b.resolver == nil {
 		// Use the default resolver for bootstrapping.
-		boot = net.DefaultResolver
+		b.resolver = net.DefaultResolver
+	}
+
+	return b, nil
+}
+
+// newBinding returns the local endpoint to bind the connections to according
+// to opts.  It returns nil if the connections shouldn't be bound.
+func newBinding(opts *Options) (b *bootstrap.Binding) {
+	if !opts.LocalAddr.IsValid() && opts.Interface == "" && opts.DSCP == 0 {
+		return nil
+	}
+
+	return &bootstrap.Binding{
+		Addr:      opts.LocalAddr,
+		Interface: opts.Interface,
+		DSCP:      opts.DSCP,
+	}
+}
+
+// type check
+var _ timeoutUpstream = (*bootstrapper)(nil)
+
+// exchangeTimeout implements the [timeoutUpstream] interface for *bootstrapper.
+func (b *bootstrapper) exchangeTimeout() (d time.Duration) { return b.timeout }
+
+// type check
+var _ DialerInitializer = (*bootstrapper)(nil).getDialer
+
+// getDialer returns the dial handler for the upstream's address resolved with
+// the current bootstrap resolver.  The handler is reused while the TTL of the
+// resolved addresses, bounded by minTTL and maxTTL, isn't expired.
+func (b *bootstrapper) getDialer() (h bootstrap.DialHandler, err error) {
+	if b.staticHandler != nil {
+		return b.reportDials(b.staticHandler), nil
+	}
+
+	b.mu.RLock()
+	r := b.resolver
+	h, until := b.cachedHandler, b.cachedUntil
+	b.mu.RUnlock()
+
+	if h != nil && time.Now().Before(until) {
+		return b.reportDials(h), nil
+	}
+
+	addrs, ttl, err := bootstrap.ResolveAddrs(b.url, b.bootstrapTimeout, r, b.preferV6)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, newKindError(ErrBootstrap, err)
+	}
+
+	strs := make([]string, 0, len(addrs))
+	resolved := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+		resolved = append(resolved, addr.Addr())
+	}
+
+	h = bootstrap.NewOrderedDialContext(b.timeout, b.binding, b.balancer.order, strs...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.resolved = resolved
+	if b.maxTTL > 0 && len(addrs) > 0 {
+		b.cachedHandler = h
+		b.cachedUntil = time.Now().Add(b.reuseTime(ttl))
+	}
+
+	return b.reportDials(h), nil
+}
+
+// reuseTime returns the time the addresses resolved with ttl are reused for,
+// bounded by minTTL and maxTTL and randomly reduced by up to jitter.
+func (b *bootstrapper) reuseTime(ttl time.Duration) (d time.Duration) {
+	d = max(min(ttl, b.maxTTL), b.minTTL)
+	if b.jitter > 0 && d > 0 {
+		d -= rand.N(min(b.jitter, d))
+	}
+
+	return d
+}
+
+// expireResolved makes the next call to getDialer resolve the hostname again.
+func (b *bootstrapper) expireResolved() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cachedHandler = nil
+}
+
+// ResolvingUpstream is an [Upstream] reporting the addresses its hostname has
+// been resolved to by the bootstrap resolvers.
+//
+// The upstreams created with [AddressToUpstream] implement it, except for the
+// DNSCrypt ones, unless they are wrapped, e.g. by configuring
+// [Options.Retries].  Use [UpstreamAs] to get it from the wrapper.
+type ResolvingUpstream interface {
+	Upstream
+
+	// ResolvedAddrs returns the addresses of the most recent successful
+	// resolution of the upstream's hostname in the order they are dialed.  It
+	// returns nil before the first successful resolution and if the hostname
+	// is resolved by a proxy.  If the upstream's address is an IP address, it
+	// returns that address.  It's safe for concurrent use.
+	ResolvedAddrs() (addrs []netip.Addr)
+}
+
+// RefreshableUpstream is an [Upstream] able to drop the connections it keeps
+// for reuse and the addresses it has resolved, see [Options.BootstrapMaxTTL],
+// so that the following exchanges dial the new connections to the addresses
+// resolved anew by the bootstrap resolvers.  Note that the bootstrap resolvers
+// may cache the addresses themselves, e.g. [CachingResolver].
+//
+// The upstreams created with [AddressToUpstream] implement it, except for the
+// DNSCrypt ones, see also [RefreshUpstream].
+type RefreshableUpstream interface {
+	Upstream
+
+	// Refresh drops the connections kept for reuse.  The exchanges in flight
+	// aren't interrupted, their connections are closed after they finish.
+	// It's safe for concurrent use along with Exchange.
+	Refresh() (err error)
+}
+
+// RefreshUpstream refreshes the upstream wrapped by u, e.g. by configuring
+// [Options.Retries], if it implements [RefreshableUpstream].  Otherwise, it
+// does nothing.
+func RefreshUpstream(u Upstream) (err error) {
+	r, ok := unwrapUpstream(u).(RefreshableUpstream)
+	if !ok {
+		return nil
+	}
+
+	return r.Refresh()
+}
+
+// Protocol is the protocol of an upstream.
+type Protocol string
+
+// Protocol values.
+const (
+	ProtocolUDP      Protocol = "udp"
+	ProtocolTCP      Protocol = "tcp"
+	ProtocolTLS      Protocol = "tls"
+	ProtocolHTTPS    Protocol = "https"
+	ProtocolQUIC     Protocol = "quic"
+	ProtocolDNSCrypt Protocol = "dnscrypt"
+	ProtocolODoH     Protocol = "odoh"
+)
+
+// ProtocolUpstream is an [Upstream] able to report its protocol.
+//
+// The upstreams created with [AddressToUpstream] implement it, see also
+// [UpstreamProtocol].
+type ProtocolUpstream interface {
+	Upstream
+
+	// Protocol returns the protocol of the upstream.  DNS-over-HTTPS upstreams
+	// return [ProtocolHTTPS] regardless of the HTTP version, and the DNS
+	// stamps are reported as the protocol they describe.
+	Protocol() (proto Protocol)
+}
+
+// UpstreamProtocol returns the protocol of u or the first upstream wrapped by
+// it, e.g. by configuring [Options.Retries], implementing [ProtocolUpstream].
+// It returns an empty string if there is none, e.g. for [ChainUpstream].
+func UpstreamProtocol(u Upstream) (proto Protocol) {
+	pu, ok := UpstreamAs[ProtocolUpstream](u)
+	if !ok {
+		return ""
+	}
+
+	return pu.Protocol()
+}
+
+// ResolvedAddrs implements the [ResolvingUpstream] interface for
+// *bootstrapper.
+func (b *bootstrapper) ResolvedAddrs() (addrs []netip.Addr) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return slices.Clone(b.resolved)
+}
+
+// type check
+var _ BootstrapSetter = (*bootstrapper)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for *bootstrapper.
+// It does nothing if the upstream's address is an IP address or if it's dialed
+// through a proxy.
+func (b *bootstrapper) SetBootstrap(resolvers []Resolver) {
+	if b.staticHandler != nil {
+		return
 	}
 
-	return func() (h bootstrap.DialHandler, err error) {
-		return bootstrap.ResolveDialContext(u, opts.Timeout, boot, opts.PreferIPv6)
+	resolvers = slices.Clone(resolvers)
+	for i, r := range resolvers {
+		if r == nil {
+			resolvers[i] = net.DefaultResolver
+		}
+	}
+
+	var r Resolver
+	switch {
+	case len(resolvers) == 0:
+		r = net.DefaultResolver
+	case len(resolvers) == 1:
+		r = resolvers[0]
+	case b.parallel:
+		r = ParallelResolver(resolvers)
+	default:
+		r = ConsequentResolver(resolvers)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.resolver = r
+	b.cachedHandler = nil
+}
+
+// abortOnDone arranges for conn to be closed as soon as ctx is done, so that
+// the I/O operations in progress on it return immediately.  stop must be called
+// once the operations are finished.  It returns a non-nil error wrapping the
+// error of ctx if conn has been closed, so conn must not be used anymore.
+func abortOnDone(ctx context.Context, conn io.Closer) (stop func() (err error)) {
+	stopFunc := context.AfterFunc(ctx, func() { _ = conn.Close() })
+
+	return func() (err error) {
+		if stopFunc() {
+			return nil
+		}
+
+		return fmt.Errorf("exchange aborted: %w", ctx.Err())
 	}
 }
+
+// closeConn closes conn unless it's been closed already, e.g. by the function
+// returned from [abortOnDone].
+func closeConn(conn io.Closer) (err error) {
+	err = conn.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
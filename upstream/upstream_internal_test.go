@@ -1,22 +1,28 @@
 package upstream
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
+	"net/http"
 	"net/netip"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/ameshkov/dnsstamps"
@@ -330,12 +336,73 @@ func TestAddressToUpstream_bads(t *testing.T) {
 		addr: "tcp://123",
 		wantErrMsg: `invalid address 123: bad hostname "123": bad top-level domain name ` +
 			`label "123": all octets are numeric`,
+	}, {
+		addr:       "sdns://AQ",
+		wantErrMsg: "failed to parse sdns://AQ: stamp is too short",
 	}}
 
 	for _, tc := range testCases {
 		t.Run(tc.addr, func(t *testing.T) {
 			_, err := AddressToUpstream(tc.addr, nil)
 			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			err = ValidateAddress(tc.addr)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestAddressesToUpstreams(t *testing.T) {
+	addrs := []string{"1.1.1.1", "asdf://1.1.1.1", "tcp://8.8.8.8"}
+
+	t.Run("partial", func(t *testing.T) {
+		ups, errs := AddressesToUpstreams(addrs, nil)
+		require.Len(t, ups, len(addrs))
+		require.Len(t, errs, len(addrs))
+
+		assert.NoError(t, errs[0])
+		testutil.AssertErrorMsg(t, "unsupported url scheme: asdf", errs[1])
+		assert.NoError(t, errs[2])
+
+		assert.Equal(t, "1.1.1.1:53", ups[0].Address())
+		assert.Nil(t, ups[1])
+		assert.Equal(t, "tcp://8.8.8.8:53", ups[2].Address())
+
+		for _, u := range []Upstream{ups[0], ups[2]} {
+			require.NoError(t, u.Close())
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		ups, err := AddressesToUpstreamsStrict(addrs, nil)
+		testutil.AssertErrorMsg(t, "upstream at index 1: unsupported url scheme: asdf", err)
+		assert.Nil(t, ups)
+
+		ups, err = AddressesToUpstreamsStrict([]string{addrs[0], addrs[2]}, nil)
+		require.NoError(t, err)
+		require.Len(t, ups, 2)
+
+		require.NoError(t, closeAll(ups))
+	})
+}
+
+func TestValidateAddress(t *testing.T) {
+	testCases := []string{
+		"1.1.1.1",
+		"one.one.one.one:5353",
+		"tcp://one.one.one.one",
+		"tls://one.one.one.one",
+		"https://[2606:4700:4700::1111]/dns-query",
+		"h3://one.one.one.one",
+		"quic://dns.adguard-dns.com",
+		"odoh://odoh.example/dns-query",
+		"sdns://AQMAAAAAAAAAETk0LjE0MC4xNC4xNDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIj" +
+			"IuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20",
+	}
+
+	for _, addr := range testCases {
+		t.Run(addr, func(t *testing.T) {
+			assert.NoError(t, ValidateAddress(addr))
 		})
 	}
 }
@@ -494,6 +561,521 @@ func TestAddressToUpstream_StaticResolver(t *testing.T) {
 	}
 }
 
+// delayedResolver is a [Resolver] responding with the localhost address after
+// the delay.
+type delayedResolver struct {
+	delay time.Duration
+}
+
+// type check
+var _ Resolver = delayedResolver{}
+
+// LookupNetIP implements the [Resolver] interface for delayedResolver.
+func (r delayedResolver) LookupNetIP(
+	ctx context.Context,
+	_ bootstrap.Network,
+	_ string,
+) (addrs []netip.Addr, err error) {
+	select {
+	case <-time.After(r.delay):
+		return []netip.Addr{netutil.IPv4Localhost()}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestOptions_BootstrapTimeout(t *testing.T) {
+	const (
+		exchangeTimeout = 200 * time.Millisecond
+		delay           = 2 * exchangeTimeout
+	)
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://some.dns.server:%d", srv.port)
+
+	testCases := []struct {
+		wantErr          error
+		name             string
+		bootstrapTimeout time.Duration
+	}{{
+		wantErr:          context.DeadlineExceeded,
+		name:             "exchange_timeout",
+		bootstrapTimeout: 0,
+	}, {
+		wantErr:          nil,
+		name:             "bootstrap_timeout",
+		bootstrapTimeout: timeout,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := AddressToUpstream(addr, &Options{
+				Bootstrap:        delayedResolver{delay: delay},
+				Timeout:          exchangeTimeout,
+				BootstrapTimeout: tc.bootstrapTimeout,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			resp, err := u.Exchange(req)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+		})
+	}
+}
+
+// countingTTLResolver is a [TTLResolver] responding with the localhost address
+// and the configured TTL, counting the lookups.
+type countingTTLResolver struct {
+	lookups *atomic.Int32
+	ttl     time.Duration
+}
+
+// type check
+var _ TTLResolver = countingTTLResolver{}
+
+// LookupNetIP implements the [Resolver] interface for countingTTLResolver.
+func (r countingTTLResolver) LookupNetIP(
+	ctx context.Context,
+	network bootstrap.Network,
+	host string,
+) (addrs []netip.Addr, err error) {
+	addrs, _, err = r.LookupNetIPTTL(ctx, network, host)
+
+	return addrs, err
+}
+
+// LookupNetIPTTL implements the [TTLResolver] interface for
+// countingTTLResolver.
+func (r countingTTLResolver) LookupNetIPTTL(
+	_ context.Context,
+	_ bootstrap.Network,
+	_ string,
+) (addrs []netip.Addr, ttl time.Duration, err error) {
+	r.lookups.Add(1)
+
+	return []netip.Addr{netutil.IPv4Localhost()}, r.ttl, nil
+}
+
+func TestOptions_BootstrapTTL(t *testing.T) {
+	const n = 3
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://some.dns.server:%d", srv.port)
+
+	newUpstream := func(t *testing.T, r TTLResolver, minTTL, maxTTL time.Duration) (u Upstream) {
+		t.Helper()
+
+		u, err := AddressToUpstream(addr, &Options{
+			Bootstrap:       r,
+			Timeout:         timeout,
+			BootstrapMinTTL: minTTL,
+			BootstrapMaxTTL: maxTTL,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		return u
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		lookups := &atomic.Int32{}
+		u := newUpstream(t, countingTTLResolver{lookups: lookups, ttl: time.Hour}, 0, time.Hour)
+
+		for range n {
+			checkUpstream(t, u, addr)
+		}
+
+		assert.Equal(t, int32(1), lookups.Load())
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		lookups := &atomic.Int32{}
+		u := newUpstream(t, countingTTLResolver{lookups: lookups, ttl: time.Hour}, 0, time.Hour)
+
+		for range n {
+			checkUpstream(t, u, addr)
+			require.NoError(t, RefreshUpstream(u))
+		}
+
+		assert.Equal(t, int32(n), lookups.Load())
+	})
+
+	t.Run("max_ttl", func(t *testing.T) {
+		lookups := &atomic.Int32{}
+		u := newUpstream(t, countingTTLResolver{lookups: lookups, ttl: time.Hour}, 0, time.Nanosecond)
+
+		for range n {
+			time.Sleep(time.Millisecond)
+			checkUpstream(t, u, addr)
+		}
+
+		assert.Equal(t, int32(n), lookups.Load())
+	})
+
+	t.Run("min_ttl", func(t *testing.T) {
+		lookups := &atomic.Int32{}
+		u := newUpstream(t, countingTTLResolver{lookups: lookups, ttl: 0}, time.Hour, time.Hour)
+
+		for range n {
+			checkUpstream(t, u, addr)
+		}
+
+		assert.Equal(t, int32(1), lookups.Load())
+	})
+}
+
+func TestBootstrapper_reuseTime(t *testing.T) {
+	const n = 100
+
+	t.Run("no_jitter", func(t *testing.T) {
+		b := &bootstrapper{minTTL: time.Minute, maxTTL: time.Hour}
+
+		assert.Equal(t, time.Minute, b.reuseTime(0))
+		assert.Equal(t, 10*time.Minute, b.reuseTime(10*time.Minute))
+		assert.Equal(t, time.Hour, b.reuseTime(24*time.Hour))
+	})
+
+	t.Run("jitter", func(t *testing.T) {
+		b := &bootstrapper{maxTTL: time.Hour, jitter: time.Minute}
+
+		seen := map[time.Duration]struct{}{}
+		for range n {
+			d := b.reuseTime(time.Hour)
+			require.LessOrEqual(t, d, time.Hour)
+			require.Greater(t, d, time.Hour-time.Minute)
+
+			seen[d] = struct{}{}
+		}
+
+		assert.Greater(t, len(seen), 1)
+	})
+
+	t.Run("jitter_exceeds_ttl", func(t *testing.T) {
+		b := &bootstrapper{maxTTL: time.Hour, jitter: time.Hour}
+
+		for range n {
+			d := b.reuseTime(time.Second)
+			require.LessOrEqual(t, d, time.Second)
+			require.Positive(t, d)
+		}
+	})
+}
+
+func TestBootstrapper_SetBootstrap(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("tcp://some.dns.server:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Bootstrap: StaticResolver{},
+		Timeout:   timeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	_, err = u.Exchange(createTestMessage())
+	require.Error(t, err)
+
+	bs, ok := u.(BootstrapSetter)
+	require.True(t, ok)
+
+	bs.SetBootstrap([]Resolver{StaticResolver{netutil.IPv4Localhost()}})
+	checkUpstream(t, u, addr)
+}
+
+func TestBootstrapper_ResolvedAddrs(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	t.Run("hostname", func(t *testing.T) {
+		addr := fmt.Sprintf("tcp://some.dns.server:%d", srv.port)
+		u, err := AddressToUpstream(addr, &Options{
+			Bootstrap: StaticResolver{netutil.IPv4Localhost()},
+			Timeout:   timeout,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		ru, ok := u.(ResolvingUpstream)
+		require.True(t, ok)
+
+		assert.Nil(t, ru.ResolvedAddrs())
+
+		checkUpstream(t, u, addr)
+		assert.Equal(t, []netip.Addr{netutil.IPv4Localhost()}, ru.ResolvedAddrs())
+	})
+
+	t.Run("ip", func(t *testing.T) {
+		addr := fmt.Sprintf("tcp://127.0.0.1:%d", srv.port)
+		u, err := AddressToUpstream(addr, &Options{Timeout: timeout})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		ru, ok := u.(ResolvingUpstream)
+		require.True(t, ok)
+
+		assert.Equal(t, []netip.Addr{netutil.IPv4Localhost()}, ru.ResolvedAddrs())
+	})
+}
+
+func TestAddressToUpstream_proxy(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	proxyAddr, dests := startSOCKS5Server(t)
+	proxyURL := &url.URL{Scheme: "socks5", Host: proxyAddr}
+
+	t.Run("tcp", func(t *testing.T) {
+		// The hostname isn't resolvable locally, so it must be resolved by the
+		// proxy.
+		addr := fmt.Sprintf("tcp://dns.server.invalid:%d", srv.port)
+		u, err := AddressToUpstream(addr, &Options{
+			Bootstrap: StaticResolver{},
+			Timeout:   timeout,
+			ProxyURL:  proxyURL,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		checkUpstream(t, u, addr)
+
+		assert.Equal(t, fmt.Sprintf("dns.server.invalid:%d", srv.port), <-dests)
+	})
+
+	for _, addr := range []string{
+		"udp://127.0.0.1:53",
+		"quic://127.0.0.1:853",
+		"sdns://AQcAAAAAAAAAEzE0OS4xMTIuMTEyLjEwOjg0NDMgZ8hHuMh1jNEgJFVDvnVnRt803x2EwAuMRwNo34Idhj4ZMi5kbnNjcnlwdC1jZXJ0LnF1YWQ5Lm5ldA",
+	} {
+		t.Run(addr, func(t *testing.T) {
+			_, err := AddressToUpstream(addr, &Options{ProxyURL: proxyURL})
+			assert.ErrorIs(t, err, ErrProxyUDP)
+		})
+	}
+
+	t.Run("bad_scheme", func(t *testing.T) {
+		_, err := AddressToUpstream("tcp://127.0.0.1:53", &Options{
+			ProxyURL: &url.URL{Scheme: "http", Host: proxyAddr},
+		})
+		assert.Error(t, err)
+	})
+}
+
+// startSOCKS5Server starts a minimal SOCKS5 server supporting the CONNECT
+// command with domain names and no authentication.  It connects to the port
+// of the requested destination on localhost and sends the requested
+// destinations to dests.
+func startSOCKS5Server(t *testing.T) (addr string, dests chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	dests = make(chan string, 10)
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			go serveSOCKS5(conn, dests)
+		}
+	}()
+
+	return l.Addr().String(), dests
+}
+
+// serveSOCKS5 serves a single SOCKS5 connection.
+func serveSOCKS5(conn net.Conn, dests chan<- string) {
+	defer func() { _ = conn.Close() }()
+
+	// Read the greeting and choose no authentication.
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	} else if _, err = io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	} else if _, err = conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// Read the CONNECT request with the domain name address type.
+	if _, err := io.ReadFull(conn, buf[:5]); err != nil || buf[3] != 3 {
+		return
+	}
+
+	host := make([]byte, buf[4])
+	if _, err := io.ReadFull(conn, host); err != nil {
+		return
+	} else if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+
+	port := binary.BigEndian.Uint16(buf[:2])
+	dests <- netutil.JoinHostPort(string(host), port)
+
+	upConn, err := net.Dial("tcp", netutil.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return
+	}
+	defer func() { _ = upConn.Close() }()
+
+	if _, err = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	go func() { _, _ = io.Copy(upConn, conn) }()
+	_, _ = io.Copy(conn, upConn)
+}
+
+func TestUpstream_ExchangeContext(t *testing.T) {
+	// release unblocks the handlers, so that the servers are able to shut
+	// down.
+	release := make(chan struct{})
+	dnsHandler := func(_ dns.ResponseWriter, _ *dns.Msg) { <-release }
+
+	plainSrv := startDNSServer(t, dnsHandler)
+	dotSrv := startDoTServer(t, dnsHandler)
+	dohSrv := startDoHServer(t, testDoHServerOptions{
+		handler: http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}),
+	})
+
+	// Register it after starting the servers, since the cleanups are called
+	// in the reverse order.
+	t.Cleanup(func() { close(release) })
+
+	testCases := []struct {
+		opts *Options
+		name string
+		addr string
+	}{{
+		opts: &Options{},
+		name: "udp",
+		addr: fmt.Sprintf("127.0.0.1:%d", plainSrv.port),
+	}, {
+		opts: &Options{},
+		name: "tcp",
+		addr: fmt.Sprintf("tcp://127.0.0.1:%d", plainSrv.port),
+	}, {
+		opts: &Options{RootCAs: dotSrv.rootCAs},
+		name: "dot",
+		addr: fmt.Sprintf("tls://127.0.0.1:%d", dotSrv.port),
+	}, {
+		opts: &Options{RootCAs: dohSrv.rootCAs},
+		name: "doh",
+		addr: fmt.Sprintf("https://%s/dns-query", dohSrv.addr),
+	}}
+
+	const cancelAfter = 100 * time.Millisecond
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Make sure the timeout isn't what interrupts the exchange.
+			tc.opts.Timeout = 10 * timeout
+
+			u, err := AddressToUpstream(tc.addr, tc.opts)
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+
+			time.AfterFunc(cancelAfter, cancel)
+
+			start := time.Now()
+			resp, err := u.ExchangeContext(ctx, createTestMessage())
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Nil(t, resp)
+			assert.Less(t, time.Since(start), timeout)
+		})
+	}
+}
+
+func TestUpstreamProtocol(t *testing.T) {
+	const dnscryptStamp = "sdns://AQMAAAAAAAAAETk0LjE0MC4xNC4xNDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV" +
+		"2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20"
+
+	testCases := []struct {
+		addr string
+		want Protocol
+	}{{
+		addr: "1.1.1.1",
+		want: ProtocolUDP,
+	}, {
+		addr: "tcp://1.1.1.1",
+		want: ProtocolTCP,
+	}, {
+		addr: "tls://1.1.1.1",
+		want: ProtocolTLS,
+	}, {
+		addr: "https://1.1.1.1/dns-query",
+		want: ProtocolHTTPS,
+	}, {
+		addr: "h3://1.1.1.1/dns-query",
+		want: ProtocolHTTPS,
+	}, {
+		addr: "quic://1.1.1.1",
+		want: ProtocolQUIC,
+	}, {
+		addr: "odoh://1.1.1.1/dns-query",
+		want: ProtocolODoH,
+	}, {
+		addr: dnscryptStamp,
+		want: ProtocolDNSCrypt,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.addr, func(t *testing.T) {
+			u, err := AddressToUpstream(tc.addr, &Options{
+				Timeout:   timeout,
+				Retries:   1,
+				ODoHRelay: "https://1.1.1.1/proxy",
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			assert.Equal(t, tc.want, UpstreamProtocol(u))
+		})
+	}
+
+	t.Run("chain", func(t *testing.T) {
+		u, err := AddressToUpstream("1.1.1.1", nil)
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		assert.Empty(t, UpstreamProtocol(NewChainUpstream(u)))
+	})
+}
+
 func TestAddPort(t *testing.T) {
 	testCases := []struct {
 		name string
@@ -0,0 +1,216 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// weightedCooldown is the time a failed member of a weighted upstream stays
+	// demoted.
+	weightedCooldown = 30 * time.Second
+
+	// weightedDemotionDivisor is the divisor of the weight of a demoted member
+	// of a weighted upstream.
+	weightedDemotionDivisor = 4
+)
+
+// WeightedUpstream is a member of the upstream created with
+// [NewWeightedUpstream].
+type WeightedUpstream struct {
+	// Upstream is the member upstream.  It must not be nil.
+	Upstream Upstream
+
+	// Weight is the relative frequency of selecting Upstream.  The members
+	// with non-positive weights are only selected when all the other members
+	// are demoted down to zero.
+	Weight int
+}
+
+// weightedMember is a member of *weightedBalancer.
+type weightedMember struct {
+	// ups is the member upstream.
+	ups Upstream
+
+	// demotedUntil is the time the demotion of the member ends at.  It's
+	// protected by the mutex of the balancer.
+	demotedUntil time.Time
+
+	// weight is the configured weight of the member.
+	weight int
+}
+
+// weightedBalancer is an [Upstream] exchanging with one of its members chosen
+// randomly according to their weights.
+type weightedBalancer struct {
+	// mu protects the demotion state of members.
+	mu *sync.Mutex
+
+	// members are the upstreams to choose from.
+	members []*weightedMember
+
+	// cooldown is the time a failed member stays demoted.
+	cooldown time.Duration
+}
+
+// NewWeightedUpstream returns an [Upstream] exchanging with one of the members
+// of pairs chosen randomly according to their weights.  The members failed to
+// exchange, as decided by [IsFailure], get their weight reduced four times for
+// 30 seconds.  pairs must not be empty.
+func NewWeightedUpstream(pairs []WeightedUpstream) (u Upstream) {
+	members := make([]*weightedMember, 0, len(pairs))
+	for _, p := range pairs {
+		members = append(members, &weightedMember{
+			ups:    p.Upstream,
+			weight: max(p.Weight, 0),
+		})
+	}
+
+	return &weightedBalancer{
+		mu:       &sync.Mutex{},
+		members:  members,
+		cooldown: weightedCooldown,
+	}
+}
+
+// type check
+var _ Upstream = (*weightedBalancer)(nil)
+
+// Address implements the [Upstream] interface for *weightedBalancer.  It lists
+// the addresses of the members along with their configured weights, e.g.
+// "weighted(tls://dns.example=3, 1.1.1.1:53=1)".
+func (u *weightedBalancer) Address() (addr string) {
+	addrs := make([]string, 0, len(u.members))
+	for _, m := range u.members {
+		addrs = append(addrs, fmt.Sprintf("%s=%d", m.ups.Address(), m.weight))
+	}
+
+	return fmt.Sprintf("weighted(%s)", strings.Join(addrs, ", "))
+}
+
+// Exchange implements the [Upstream] interface for *weightedBalancer.
+func (u *weightedBalancer) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext implements the [Upstream] interface for *weightedBalancer.
+// It doesn't retry the exchange with other members.
+func (u *weightedBalancer) ExchangeContext(
+	ctx context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	m := u.choose()
+
+	resp, err = m.ups.ExchangeContext(ctx, req)
+	if IsFailure(resp, err) && ctx.Err() == nil {
+		u.demote(m)
+
+		log.Debug(
+			"dnsproxy: weighted: %s failed, demoted: %s",
+			m.ups.Address(),
+			retryReason(resp, err),
+		)
+	}
+
+	if err != nil {
+		return resp, fmt.Errorf("exchanging with %s: %w", m.ups.Address(), err)
+	}
+
+	return resp, nil
+}
+
+// choose returns the member to exchange with.
+func (u *weightedBalancer) choose() (chosen *weightedMember) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+
+	weights := make([]int, len(u.members))
+	total := 0
+	for i, m := range u.members {
+		weights[i] = m.weight
+		if now.Before(m.demotedUntil) {
+			weights[i] /= weightedDemotionDivisor
+		}
+
+		total += weights[i]
+	}
+
+	if total == 0 {
+		return u.members[rand.IntN(len(u.members))]
+	}
+
+	n := rand.IntN(total)
+	for i, w := range weights {
+		if n < w {
+			return u.members[i]
+		}
+
+		n -= w
+	}
+
+	// Shouldn't happen, since n is less than total.
+	return u.members[len(u.members)-1]
+}
+
+// demote reduces the weight of m for the cooldown period.
+func (u *weightedBalancer) demote(m *weightedMember) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	m.demotedUntil = time.Now().Add(u.cooldown)
+}
+
+// Close implements the [Upstream] interface for *weightedBalancer.  It closes
+// all the members.
+func (u *weightedBalancer) Close() (err error) {
+	var errs []error
+	for _, m := range u.members {
+		closeErr := m.ups.Close()
+		if closeErr != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", m.ups.Address(), closeErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ ProbableUpstream = (*weightedBalancer)(nil)
+
+// Probe implements the [ProbableUpstream] interface for *weightedBalancer.  It
+// succeeds if any of the members responds properly.
+func (u *weightedBalancer) Probe(ctx context.Context) (err error) {
+	var errs []error
+	for _, m := range u.members {
+		err = probeWrapped(ctx, m.ups)
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// type check
+var _ BootstrapSetter = (*weightedBalancer)(nil)
+
+// SetBootstrap implements the [BootstrapSetter] interface for
+// *weightedBalancer.  It sets the resolvers for each member implementing
+// [BootstrapSetter].
+func (u *weightedBalancer) SetBootstrap(resolvers []Resolver) {
+	for _, m := range u.members {
+		setBootstrap(m.ups, resolvers)
+	}
+}
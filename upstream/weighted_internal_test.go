@@ -0,0 +1,99 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeightedUpstream(t *testing.T) {
+	const (
+		testErr errors.Error = "test error"
+
+		n = 1000
+	)
+
+	t.Run("distribution", func(t *testing.T) {
+		heavy, heavyN, _ := newChainMember("heavy", dns.RcodeSuccess, nil)
+		light, lightN, _ := newChainMember("light", dns.RcodeSuccess, nil)
+		unused, unusedN, _ := newChainMember("unused", dns.RcodeSuccess, nil)
+
+		u := NewWeightedUpstream([]WeightedUpstream{{
+			Upstream: heavy,
+			Weight:   3,
+		}, {
+			Upstream: light,
+			Weight:   1,
+		}, {
+			Upstream: unused,
+			Weight:   0,
+		}})
+		assert.Equal(t, "weighted(heavy=3, light=1, unused=0)", u.Address())
+
+		for range n {
+			req := createTestMessage()
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+		}
+
+		assert.Equal(t, n, *heavyN+*lightN)
+		assert.Greater(t, *heavyN, *lightN)
+		assert.Zero(t, *unusedN)
+	})
+
+	t.Run("demotion", func(t *testing.T) {
+		failing, failingN, failingCloses := newChainMember("failing", 0, testErr)
+		working, workingN, workingCloses := newChainMember("working", dns.RcodeSuccess, nil)
+
+		u := NewWeightedUpstream([]WeightedUpstream{{
+			Upstream: failing,
+			Weight:   1,
+		}, {
+			Upstream: working,
+			Weight:   100,
+		}})
+
+		wu := testutil.RequireTypeAssert[*weightedBalancer](t, u)
+		wu.demote(wu.members[0])
+
+		// The demoted weight is zero, so the failing member is never chosen.
+		for range n {
+			_, err := u.Exchange(createTestMessage())
+			require.NoError(t, err)
+		}
+
+		assert.Zero(t, *failingN)
+		assert.Equal(t, n, *workingN)
+
+		// Restore the failing member.
+		wu.mu.Lock()
+		wu.members[0].demotedUntil = time.Time{}
+		wu.members[0].weight = 100
+		wu.members[1].weight = 1
+		wu.mu.Unlock()
+
+		var err error
+		for *failingN == 0 {
+			_, err = u.Exchange(createTestMessage())
+		}
+
+		assert.ErrorIs(t, err, testErr)
+
+		wu.mu.Lock()
+		demotedUntil := wu.members[0].demotedUntil
+		wu.mu.Unlock()
+
+		assert.True(t, demotedUntil.After(time.Now()))
+
+		require.NoError(t, u.Close())
+
+		assert.Equal(t, 1, *failingCloses)
+		assert.Equal(t, 1, *workingCloses)
+	})
+}
@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// WireUpstream is an [Upstream] able to return the responses in the wire
+// format exactly as received from the server, which is useful for caching the
+// serialized responses without repacking them, which may reorder the records.
+//
+// Only the DNS-over-HTTPS, DNS-over-TLS, and DNS-over-QUIC upstreams implement
+// it, and the wrappers don't forward it, since they may modify the responses.
+// So the upstream returned from [AddressToUpstream] doesn't implement it if
+// any of the following options is set:
+//   - [Options.DisableEDNS0]
+//   - [Options.EDNSClientSubnet]
+//   - [Options.MaxConcurrentQueries]
+//   - [Options.Metadata]
+//   - [Options.MetricsListener]
+//   - [Options.Name]
+//   - [Options.QueryLogger]
+//   - [Options.QueryRewriter]
+//   - [Options.RateLimit]
+//   - [Options.Retries]
+//   - [Options.ValidateDNSSEC]
+//
+// Neither do the upstreams returned from [WithName] and other wrapping
+// constructors.  Use [UpstreamExchangeWire] to exchange the wire-format
+// messages with any upstream.  The exchanges with it still go through the same
+// path as with ExchangeContext, which remains the primary one.
+type WireUpstream interface {
+	Upstream
+
+	// ExchangeWire exchanges req, which is a DNS message in the wire format,
+	// and returns the bytes of the response received from the server.  The ID
+	// of resp is replaced with the one of req.  Other modifications made to
+	// the parsed responses, e.g. due to [Options.PreserveRecursionDesired], aren't
+	// applied to resp.  If the bytes received aren't available, e.g. with the
+	// JSON API or [Options.DoTPipelining], the parsed response is packed.
+	ExchangeWire(req []byte) (resp []byte, err error)
+}
+
+// wireCapture receives the bytes of the last response received within an
+// exchange.
+type wireCapture struct {
+	// raw is the copy of the bytes of the last response, if any.
+	raw []byte
+}
+
+// wireCaptureKey is the context key for *wireCapture.
+type wireCaptureKey struct{}
+
+// withWireCapture returns a copy of parent carrying a new capture of the bytes
+// of the responses.
+func withWireCapture(parent context.Context) (ctx context.Context, c *wireCapture) {
+	c = &wireCapture{}
+
+	return context.WithValue(parent, wireCaptureKey{}, c), c
+}
+
+// captureWire remembers the copy of raw, the bytes of the response, if ctx
+// carries a capture.  The bytes are copied, since they may be reused.
+func captureWire(ctx context.Context, raw []byte) {
+	c, ok := ctx.Value(wireCaptureKey{}).(*wireCapture)
+	if ok {
+		c.raw = slices.Clone(raw)
+	}
+}
+
+// UpstreamExchangeWire exchanges req, which is a DNS message in the wire
+// format, with u and returns the response in the wire format.  It uses
+// [WireUpstream.ExchangeWire] of u or of the upstream wrapped by u with
+// [WithName], [Options.Name], or [Options.Metadata], since those don't modify
+// the messages.  Otherwise, e.g. if u validates DNSSEC or rewrites the queries,
+// it unpacks req, exchanges it with u, and packs the response, so that the
+// wrappers aren't bypassed.
+func UpstreamExchangeWire(u Upstream, req []byte) (resp []byte, err error) {
+	for w := u; ; {
+		if wu, ok := w.(WireUpstream); ok {
+			return wu.ExchangeWire(req)
+		}
+
+		n, ok := w.(*NamedUpstream)
+		if !ok {
+			break
+		}
+
+		w = n.ups
+	}
+
+	m := &dns.Msg{}
+	err = m.Unpack(req)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking request: %w", err)
+	}
+
+	r, err := u.ExchangeContext(context.Background(), m)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err = r.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing response: %w", err)
+	}
+
+	return resp, nil
+}
+
+// exchangeWire implements [WireUpstream.ExchangeWire] for the upstreams
+// capturing the bytes of the responses.
+func exchangeWire(u Upstream, req []byte) (resp []byte, err error) {
+	m := &dns.Msg{}
+	err = m.Unpack(req)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking request: %w", err)
+	}
+
+	ctx, c := withWireCapture(context.Background())
+
+	r, err := u.ExchangeContext(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.raw == nil {
+		resp, err = r.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("packing response: %w", err)
+		}
+
+		return resp, nil
+	}
+
+	binary.BigEndian.PutUint16(c.raw, r.Id)
+
+	return c.raw, nil
+}
+
+// type check
+var _ WireUpstream = (*dnsOverHTTPS)(nil)
+
+// ExchangeWire implements the [WireUpstream] interface for *dnsOverHTTPS.
+func (p *dnsOverHTTPS) ExchangeWire(req []byte) (resp []byte, err error) {
+	return exchangeWire(p, req)
+}
+
+// type check
+var _ WireUpstream = (*dnsOverTLS)(nil)
+
+// ExchangeWire implements the [WireUpstream] interface for *dnsOverTLS.
+func (p *dnsOverTLS) ExchangeWire(req []byte) (resp []byte, err error) {
+	return exchangeWire(p, req)
+}
+
+// type check
+var _ WireUpstream = (*dnsOverQUIC)(nil)
+
+// ExchangeWire implements the [WireUpstream] interface for *dnsOverQUIC.
+func (p *dnsOverQUIC) ExchangeWire(req []byte) (resp []byte, err error) {
+	return exchangeWire(p, req)
+}
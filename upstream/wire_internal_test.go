@@ -0,0 +1,120 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startWireServer starts the DNS-over-TLS server sending the compressed
+// responses, so that repacking them would change the bytes.  The bytes of the
+// responses are sent to sent.
+func startWireServer(t *testing.T) (srv *testDoTServer, sent chan []byte) {
+	t.Helper()
+
+	sent = make(chan []byte, 1)
+	srv = startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		resp := respondToTestMessage(req)
+		resp.Compress = true
+
+		raw, err := resp.Pack()
+		require.NoError(pt, err)
+
+		sent <- raw
+
+		_, err = w.Write(raw)
+		require.NoError(pt, err)
+	})
+
+	return srv, sent
+}
+
+func TestWireUpstream_ExchangeWire(t *testing.T) {
+	srv, sent := startWireServer(t)
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		RootCAs: srv.rootCAs,
+		Timeout: timeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	wu, ok := u.(WireUpstream)
+	require.True(t, ok)
+
+	req, err := createTestMessage().Pack()
+	require.NoError(t, err)
+
+	resp, err := wu.ExchangeWire(req)
+	require.NoError(t, err)
+
+	want, _ := testutil.RequireReceive(t, sent, timeout)
+	assert.Equal(t, want, resp)
+
+	repacked := &dns.Msg{}
+	require.NoError(t, repacked.Unpack(resp))
+
+	packed, err := repacked.Pack()
+	require.NoError(t, err)
+
+	assert.NotEqual(t, packed, resp)
+}
+
+func TestUpstreamExchangeWire(t *testing.T) {
+	srv, sent := startWireServer(t)
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+	reqMsg := createTestMessage()
+	req, err := reqMsg.Pack()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		opts     *Options
+		name     string
+		wantSame bool
+	}{{
+		opts:     &Options{Name: "named"},
+		name:     "named",
+		wantSame: true,
+	}, {
+		opts:     &Options{Retries: 1},
+		name:     "wrapped",
+		wantSame: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.RootCAs = srv.rootCAs
+			tc.opts.Timeout = timeout
+
+			u, uErr := AddressToUpstream(addr, tc.opts)
+			require.NoError(t, uErr)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			_, ok := u.(WireUpstream)
+			require.False(t, ok)
+
+			resp, exchErr := UpstreamExchangeWire(u, req)
+			require.NoError(t, exchErr)
+
+			raw, _ := testutil.RequireReceive(t, sent, timeout)
+			if tc.wantSame {
+				assert.Equal(t, raw, resp)
+			} else {
+				assert.NotEqual(t, raw, resp)
+			}
+
+			m := &dns.Msg{}
+			require.NoError(t, m.Unpack(resp))
+
+			requireResponse(t, reqMsg, m)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package upstream
+
+import "context"
+
+// wrapped is intended to be embedded into the upstreams wrapping a single one.
+// It implements [ProbableUpstream], [BootstrapSetter], and the Unwrap method by
+// delegating to the wrapped upstream, so that the probes and the bootstrap
+// resolvers bypass the wrapper.
+type wrapped struct {
+	// ups is the wrapped upstream.  It must not be nil.
+	ups Upstream
+}
+
+// Probe implements the [ProbableUpstream] interface for wrapped.
+func (w wrapped) Probe(ctx context.Context) (err error) { return probeWrapped(ctx, w.ups) }
+
+// SetBootstrap implements the [BootstrapSetter] interface for wrapped.
+func (w wrapped) SetBootstrap(resolvers []Resolver) { setBootstrap(w.ups, resolvers) }
+
+// Unwrap returns the wrapped upstream.
+func (w wrapped) Unwrap() (ups Upstream) { return w.ups }
+
+// setBootstrap sets resolvers as the bootstrap resolvers of u.  It does nothing
+// if u doesn't implement [BootstrapSetter].
+func setBootstrap(u Upstream, resolvers []Resolver) {
+	if bs, ok := u.(BootstrapSetter); ok {
+		bs.SetBootstrap(resolvers)
+	}
+}
+
+// UpstreamAs returns the first of u and the upstreams wrapped by it, e.g. due to
+// [Options.Retries] or [WithName], implementing T.  ok is false if there is no
+// such upstream.  It's useful to get the optional interfaces hidden by the
+// wrappers, e.g. [UpstreamWithStats].  Note that the exchanges made with the
+// result bypass the wrappers above it.
+func UpstreamAs[T any](u Upstream) (t T, ok bool) {
+	for {
+		if t, ok = u.(T); ok {
+			return t, true
+		}
+
+		w, isWrapper := u.(interface{ Unwrap() (ups Upstream) })
+		if !isWrapper {
+			return t, false
+		}
+
+		u = w.Unwrap()
+	}
+}
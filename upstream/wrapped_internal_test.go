@@ -0,0 +1,47 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamAs(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	u, err := AddressToUpstream(fmt.Sprintf("tcp://127.0.0.1:%d", srv.port), &Options{
+		Timeout: timeout,
+		Name:    "named",
+		Retries: 1,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	_, ok := u.(UpstreamWithStats)
+	require.False(t, ok)
+
+	checkUpstream(t, u, u.Address())
+
+	stats, ok := UpstreamAs[UpstreamWithStats](u)
+	require.True(t, ok)
+
+	assert.Positive(t, stats.LastRTT())
+
+	_, ok = UpstreamAs[NetworkUpstream](u)
+	assert.True(t, ok)
+
+	named, ok := UpstreamAs[*NamedUpstream](u)
+	require.True(t, ok)
+
+	assert.Same(t, u, named)
+
+	_, ok = UpstreamAs[KeepaliveUpstream](u)
+	assert.False(t, ok)
+}